@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// MissingBaseline remembers which crate versions were missing from the
+// mirror in the last complete run, so a run can report only what changed:
+// versions newly missing, and versions no longer missing. The set is stored
+// as a sorted array of 64-bit hashes of "{name}-{version}". A nil
+// MissingBaseline tracks nothing.
+type MissingBaseline struct {
+	path     string
+	previous []uint64
+	existed  bool
+
+	mu      sync.Mutex
+	current []uint64
+	found   []string
+}
+
+// missingBaselineMagic starts every missing baseline file
+const missingBaselineMagic = "OMMB0001"
+
+// missingHash hashes a crate version ID for the baseline
+func missingHash(id string) uint64 {
+	sum := sha256.Sum256([]byte(id))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// LoadMissingBaseline reads the baseline at path. A missing file, or reset,
+// yields an empty baseline that reports nothing as newly missing.
+func LoadMissingBaseline(path string, reset bool) (*MissingBaseline, error) {
+	b := &MissingBaseline{path: path}
+	if reset {
+		return b, nil
+	}
+
+	previous, existed, err := readHashSet(path, missingBaselineMagic, "missing baseline")
+	if err != nil {
+		return nil, err
+	}
+	b.previous, b.existed = previous, existed
+	return b, nil
+}
+
+// readHashSet reads a sorted hash set written by writeHashSet. A missing
+// file yields an empty set and existed false; kind names the file in errors.
+func readHashSet(path, magic, kind string) (hashes []uint64, existed bool, err error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s: %v", kind, err)
+	}
+	if len(content) < len(magic)+8 || string(content[:len(magic)]) != magic {
+		return nil, false, fmt.Errorf("%s is not a %s file", path, kind)
+	}
+	content = content[len(magic):]
+	count := binary.BigEndian.Uint64(content)
+	content = content[8:]
+	if uint64(len(content)) != count*8 {
+		return nil, false, fmt.Errorf("%s %s is truncated", kind, path)
+	}
+	hashes = make([]uint64, count)
+	for i := range hashes {
+		hashes[i] = binary.BigEndian.Uint64(content[i*8:])
+	}
+	return hashes, true, nil
+}
+
+// writeHashSet replaces the file at path with magic, the count, and the
+// sorted, deduplicated hashes as big-endian words. hashes is sorted in place.
+func writeHashSet(path, magic, kind string, hashes []uint64) error {
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	var word [8]byte
+	unique := 0
+	for i, hash := range hashes {
+		if i == 0 || hash != hashes[i-1] {
+			unique++
+		}
+	}
+	binary.BigEndian.PutUint64(word[:], uint64(unique))
+	buf.Write(word[:])
+	for i, hash := range hashes {
+		if i > 0 && hash == hashes[i-1] {
+			continue
+		}
+		binary.BigEndian.PutUint64(word[:], hash)
+		buf.Write(word[:])
+	}
+
+	temp := path + ".tmp"
+	if err := fsWriteFile(temp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", kind, err)
+	}
+	if err := fsRename(temp, path); err != nil {
+		fsRemove(temp)
+		return fmt.Errorf("failed to write %s: %v", kind, err)
+	}
+	return nil
+}
+
+// hashSetContains reports whether the sorted set holds hash
+func hashSetContains(hashes []uint64, hash uint64) bool {
+	i := sort.Search(len(hashes), func(i int) bool { return hashes[i] >= hash })
+	return i < len(hashes) && hashes[i] == hash
+}
+
+// contains reports whether the previous run had hash missing
+func (b *MissingBaseline) contains(hash uint64) bool {
+	return hashSetContains(b.previous, hash)
+}
+
+// Existed reports whether there was a baseline to compare against
+func (b *MissingBaseline) Existed() bool {
+	return b != nil && b.existed
+}
+
+// Missing records a missing version and reports whether it is newly missing
+func (b *MissingBaseline) Missing(id string) bool {
+	if b == nil {
+		return true
+	}
+
+	hash := missingHash(id)
+	b.mu.Lock()
+	b.current = append(b.current, hash)
+	b.mu.Unlock()
+	return b.existed && !b.contains(hash)
+}
+
+// Found records an organized version, remembering it if it was missing before
+func (b *MissingBaseline) Found(id string) {
+	if b == nil || !b.contains(missingHash(id)) {
+		return
+	}
+
+	b.mu.Lock()
+	b.found = append(b.found, id)
+	b.mu.Unlock()
+}
+
+// Reset clears what the current run recorded
+func (b *MissingBaseline) Reset() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current = nil
+	b.found = nil
+}
+
+// Delta returns how many versions are no longer missing, and the ones
+// among them that were organized in this run, sorted
+func (b *MissingBaseline) Delta() (int, []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sort.Slice(b.current, func(i, j int) bool { return b.current[i] < b.current[j] })
+
+	gone := 0
+	for _, hash := range b.previous {
+		i := sort.Search(len(b.current), func(i int) bool { return b.current[i] >= hash })
+		if i == len(b.current) || b.current[i] != hash {
+			gone++
+		}
+	}
+	found := append([]string(nil), b.found...)
+	sort.Strings(found)
+	return gone, found
+}
+
+// Save replaces the baseline with this run's missing set
+func (b *MissingBaseline) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return writeHashSet(b.path, missingBaselineMagic, "missing baseline", b.current)
+}
+
+// CrateNameBaseline remembers the crate names in the index at the last
+// complete run, stored like MissingBaseline as a sorted set of hashes of the
+// lowercased names, so a run can tell which crates were removed upstream.
+// A nil CrateNameBaseline tracks nothing.
+type CrateNameBaseline struct {
+	path     string
+	previous []uint64
+	existed  bool
+	current  []uint64
+}
+
+// crateNameBaselineMagic starts every crate name baseline file
+const crateNameBaselineMagic = "OMCN0001"
+
+// LoadCrateNameBaseline reads the baseline at path. A missing file, or
+// reset, yields an empty baseline that reports no crate as removed.
+func LoadCrateNameBaseline(path string, reset bool) (*CrateNameBaseline, error) {
+	b := &CrateNameBaseline{path: path}
+	if reset {
+		return b, nil
+	}
+	previous, existed, err := readHashSet(path, crateNameBaselineMagic, "crate name baseline")
+	if err != nil {
+		return nil, err
+	}
+	b.previous, b.existed = previous, existed
+	return b, nil
+}
+
+// Existed reports whether there was a baseline to compare against
+func (b *CrateNameBaseline) Existed() bool {
+	return b != nil && b.existed
+}
+
+// Record sets the crate names in this run's index from its index files
+func (b *CrateNameBaseline) Record(files []IndexFile) {
+	if b == nil {
+		return
+	}
+	b.current = make([]uint64, len(files))
+	for i, file := range files {
+		b.current[i] = missingHash(strings.ToLower(filepath.Base(file.Path)))
+	}
+	sort.Slice(b.current, func(i, j int) bool { return b.current[i] < b.current[j] })
+}
+
+// Present reports whether a crate is in this run's index
+func (b *CrateNameBaseline) Present(name string) bool {
+	return hashSetContains(b.current, missingHash(strings.ToLower(name)))
+}
+
+// Removed reports whether a crate was in the last run's index but is not
+// in this one
+func (b *CrateNameBaseline) Removed(name string) bool {
+	hash := missingHash(strings.ToLower(name))
+	return hashSetContains(b.previous, hash) && !hashSetContains(b.current, hash)
+}
+
+// RemovedCount returns how many crates of the last run's index are gone
+func (b *CrateNameBaseline) RemovedCount() int {
+	removed := 0
+	for _, hash := range b.previous {
+		if !hashSetContains(b.current, hash) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Save replaces the baseline with this run's crate names
+func (b *CrateNameBaseline) Save() error {
+	return writeHashSet(b.path, crateNameBaselineMagic, "crate name baseline", b.current)
+}
+
+// splitCrateFileName splits "{name}-{version}.crate" at the first hyphen
+// followed by a valid version
+func splitCrateFileName(fileName string) (name, version string, ok bool) {
+	stem := strings.TrimSuffix(fileName, ".crate")
+	if stem == fileName {
+		return "", "", false
+	}
+	for i := 1; i < len(stem)-1; i++ {
+		if stem[i] != '-' {
+			continue
+		}
+		if _, err := indexentry.ParseVersion(stem[i+1:]); err == nil {
+			return stem[:i], stem[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// RemovedFile is a mirrored crate file of a crate removed from the index
+type RemovedFile struct {
+	Crate       string `json:"crate"`
+	Version     string `json:"version"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+// RemovedReport lists the crates removed upstream but still mirrored
+type RemovedReport struct {
+	RunID          string        `json:"run_id,omitempty"`
+	RemovedCrates  int           `json:"removed_crates"`
+	MirroredCrates int           `json:"mirrored_crates"`
+	Bytes          int64         `json:"bytes"`
+	Files          []RemovedFile `json:"files"`
+}
+
+// summarizeRemoved compares the index's crate names with the baseline,
+// reports (and optionally quarantines) the mirrored files of crates that
+// disappeared upstream, and, when the whole index was seen, saves the names
+// as the new baseline. Files of a renamed crate whose new name is still in
+// the index are not reported.
+func summarizeRemoved(report *Report, crateIndex FileIndex, opts *Options, logger *Logger) {
+	if opts.Shards != nil {
+		logger.Warning("Not comparing or updating the crate name baseline: the run did not cover the whole index")
+		return
+	}
+	if !opts.CrateNames.Existed() {
+		logger.Info("Crate names: %d in the index; no baseline to compare against yet", len(opts.CrateNames.current))
+	} else {
+		removed := &RemovedReport{RunID: opts.RunID, RemovedCrates: opts.CrateNames.RemovedCount()}
+		crates := make(map[string]bool)
+		for fileName, path := range crateIndex {
+			name, version, ok := splitCrateFileName(fileName)
+			if !ok || !opts.CrateNames.Removed(name) || opts.CrateNames.Present(opts.RenameMap.Canonical(strings.ToLower(name))) {
+				continue
+			}
+			file := RemovedFile{Crate: name, Version: version, Path: path}
+			if info, err := os.Stat(path); err == nil {
+				file.Size = info.Size()
+			}
+			removed.Files = append(removed.Files, file)
+			removed.Bytes += file.Size
+			crates[name] = true
+		}
+		sort.Slice(removed.Files, func(i, j int) bool { return removed.Files[i].Path < removed.Files[j].Path })
+		removed.MirroredCrates = len(crates)
+		report.RemovedCrates = removed.RemovedCrates
+		report.RemovedMirrored = len(removed.Files)
+
+		logger.Info("Crate names: %d removed from the index since the last run, %d of them still mirrored (%d files, %d bytes)",
+			removed.RemovedCrates, removed.MirroredCrates, len(removed.Files), removed.Bytes)
+		for i := range removed.Files {
+			file := &removed.Files[i]
+			logger.Warning("Removed upstream but still mirrored: %s (%d bytes)", file.Path, file.Size)
+			if opts.QuarantineDir == "" {
+				continue
+			}
+			rel, err := filepath.Rel(opts.MirrorDir, file.Path)
+			if err != nil {
+				rel = filepath.Base(file.Path)
+			}
+			target := filepath.Join(opts.QuarantineDir, rel)
+			if opts.DryRun {
+				logger.Info("DRY RUN: Would quarantine %s to %s", file.Path, target)
+				continue
+			}
+			if err := fsMkdirAll(filepath.Dir(target), opts.DirMode); err != nil {
+				logger.Error("Failed to quarantine %s: %v", file.Path, err)
+				continue
+			}
+			if _, err := TransferFile(file.Path, target, true, false, opts.FileMode); err != nil {
+				logger.Error("Failed to quarantine %s: %v", file.Path, err)
+				continue
+			}
+			file.Quarantined = target
+			report.Quarantined++
+		}
+		if opts.QuarantineDir != "" {
+			logger.Info("Quarantined %d files of removed crates to %s", report.Quarantined, opts.QuarantineDir)
+		}
+
+		if opts.RemovedReport != "" {
+			if data, err := json.MarshalIndent(removed, "", "  "); err != nil {
+				logger.Error("Failed to encode removed crates report: %v", err)
+			} else if err := fsWriteFile(opts.RemovedReport, append(data, '\n'), 0644); err != nil {
+				logger.Error("Failed to write removed crates report: %v", err)
+			} else {
+				logger.Info("Wrote removed crates report to %s", opts.RemovedReport)
+			}
+		}
+	}
+
+	if opts.DryRun {
+		logger.Info("DRY RUN: Not updating the crate name baseline")
+	} else if err := opts.CrateNames.Save(); err != nil {
+		logger.Error("%v", err)
+	} else {
+		logger.Info("Updated crate name baseline %s", opts.CrateNames.path)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// DefaultBootstrapWorkers is how many crate files -bootstrap downloads at once
+const DefaultBootstrapWorkers = 4
+
+// BootstrapFetchTimeout bounds the download of a single crate file
+const BootstrapFetchTimeout = 5 * time.Minute
+
+// BootstrapReport summarizes a -bootstrap run: the versions requested, what
+// was fetched for them, and how many the run went on to organize
+type BootstrapReport struct {
+	Requested  int           `json:"requested"`
+	Unresolved int           `json:"unresolved"`
+	Rejected   int           `json:"rejected"`
+	Present    int           `json:"present"`
+	Fetched    int           `json:"fetched"`
+	Failed     int           `json:"failed"`
+	Bytes      int64         `json:"bytes"`
+	Organized  int           `json:"organized"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+// Coverage returns the percentage of the requested versions organized
+func (r *BootstrapReport) Coverage() float64 {
+	if r.Requested == 0 {
+		return 100
+	}
+	return float64(r.Organized) * 100 / float64(r.Requested)
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the bootstrap
+func (r *BootstrapReport) SummaryLine() string {
+	return fmt.Sprintf("bootstrap: requested=%d unresolved=%d rejected=%d present=%d fetched=%d failed=%d bytes=%d organized=%d coverage=%.1f%% dur=%s",
+		r.Requested, r.Unresolved, r.Rejected, r.Present, r.Fetched, r.Failed, r.Bytes, r.Organized, r.Coverage(), r.Duration.Round(time.Millisecond))
+}
+
+// bootstrapRequest is a crate named by a -bootstrap list, with the version
+// to fetch, or "" for its latest
+type bootstrapRequest struct {
+	name, version string
+}
+
+// loadBootstrapList reads a -bootstrap source. A Cargo.lock, told apart by
+// its .lock extension, requests its pinned registry versions; any other
+// file lists one "name" or "name version" per line, with # comments.
+func loadBootstrapList(path string) ([]bootstrapRequest, error) {
+	if strings.HasSuffix(path, ".lock") {
+		lock, err := LoadLockfile(path)
+		if err != nil {
+			return nil, err
+		}
+		var requests []bootstrapRequest
+		for _, locked := range lock.pinned {
+			requests = append(requests, bootstrapRequest{name: locked.name, version: locked.version})
+		}
+		return requests, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read crate list: %v", err)
+	}
+	var requests []bootstrapRequest
+	for i, line := range strings.Split(string(content), "\n") {
+		if hash := strings.IndexByte(line, '#'); hash >= 0 {
+			line = line[:hash]
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+		case 1:
+			requests = append(requests, bootstrapRequest{name: fields[0]})
+		case 2:
+			requests = append(requests, bootstrapRequest{name: fields[0], version: fields[1]})
+		default:
+			return nil, fmt.Errorf("%s:%d: want a crate name and optional version, got %q", path, i+1, strings.TrimSpace(line))
+		}
+	}
+	return requests, nil
+}
+
+// latestVersion returns the highest version among entries that is not
+// yanked, preferring stable versions, or nil if every version is yanked
+func latestVersion(entries []MetadataEntry) MetadataEntry {
+	indexentry.SortEntries(entries)
+	var latest MetadataEntry
+	for _, entry := range entries {
+		if yanked, _ := entry["yanked"].(bool); yanked {
+			continue
+		}
+		if v, err := indexentry.ParseVersion(entry.Version()); err == nil && v.IsPrerelease() && latest != nil {
+			continue
+		}
+		latest = entry
+	}
+	return latest
+}
+
+// rateLimiter spreads reads shared by several goroutines so that together
+// they take no more than rate bytes per second
+type rateLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// Wait blocks until n more bytes fit within the rate. A nil limiter never waits.
+func (l *rateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedReader reads through a rateLimiter
+type limitedReader struct {
+	r     io.Reader
+	limit *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.limit.Wait(n)
+	return n, err
+}
+
+// fetchCrate downloads url to path through a partial file, keeping it only
+// if its SHA-256 is cksum, and returns the number of bytes fetched. Without
+// a cksum nothing is downloaded, since the file could not be verified.
+func fetchCrate(client *http.Client, url, path, cksum string, limit *rateLimiter, mode, dirMode os.FileMode) (int64, error) {
+	if cksum == "" {
+		return 0, fmt.Errorf("the index entry has no cksum to verify the download against")
+	}
+	if err := fsMkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return 0, err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	partial := path + PartialTransferSuffix
+	file, err := fsOpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), &limitedReader{r: resp.Body, limit: limit})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsRemove(partial)
+		return n, err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(got, cksum) {
+		fsRemove(partial)
+		return n, fmt.Errorf("SHA-256 %s does not match the index's %s", got, cksum)
+	}
+	if err := fsRename(partial, path); err != nil {
+		fsRemove(partial)
+		return n, err
+	}
+	return n, nil
+}
+
+// Bootstrap fills a new or partial mirror with the crate versions named by
+// sources: crate lists, which request each crate's latest version unless
+// they name one, or Cargo.lock files. It resolves the versions from the
+// index, downloads those not already in the mirror from the registry's
+// "dl" URL, verified against the index's cksum, to MirrorCratePath, and
+// returns the resolved versions as a Lockfile so the run that follows
+// organizes exactly those. Versions already in the mirror are not fetched
+// again, so an interrupted bootstrap picks up where it left off. Names and
+// versions from the lists and the index are validated before they become
+// paths, and entries without a cksum are not fetched. A positive rate
+// limits the downloads together to that many bytes per second.
+func Bootstrap(opts *Options, sources []string, workers int, rate int64, logger *Logger) (*Lockfile, *BootstrapReport, error) {
+	if workers < 1 {
+		return nil, nil, fmt.Errorf("-bootstrap-workers must be at least 1")
+	}
+	var limit *rateLimiter
+	if rate > 0 {
+		limit = &rateLimiter{rate: rate}
+	}
+	startTime := time.Now()
+	report := &BootstrapReport{}
+	pins := &Lockfile{Path: strings.Join(sources, ","), pinned: make(map[string]*lockedVersion), names: make(map[string]bool)}
+
+	template := RegistryDownloadTemplate(opts.IndexDir)
+	if template == "" {
+		return nil, nil, fmt.Errorf("no config.json with a \"dl\" URL in %s to download from", opts.IndexDir)
+	}
+	crateIndex, err := BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, nil, logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+
+	// Resolve every request against the index
+	var fetches []MissingCrate
+	for _, source := range sources {
+		requests, err := loadBootstrapList(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Info("Resolving %d crates requested by %s...", len(requests), source)
+		for _, request := range requests {
+			if err := validateBootstrapRequest(request); err != nil {
+				logger.Warning("Cannot bootstrap %s %s from %s: %v", request.name, request.version, source, err)
+				report.Requested++
+				report.Rejected++
+				continue
+			}
+			entries, err := readIndexEntries(filepath.Join(opts.IndexDir, filepath.FromSlash(indexentry.IndexPath(request.name))))
+			var entry MetadataEntry
+			if err == nil && request.version == "" {
+				entry = latestVersion(entries)
+			}
+			for _, candidate := range entries {
+				if request.version != "" && candidate.Version() == request.version {
+					entry = candidate
+				}
+			}
+			if entry == nil {
+				logger.Warning("Cannot bootstrap %s %s: it is not in the index", request.name, request.version)
+				report.Requested++
+				report.Unresolved++
+				continue
+			}
+			name, version := entry.Name(), entry.Version()
+			path := MirrorCratePath(opts.MirrorDir, name, version)
+			cksum, _ := entry["cksum"].(string)
+			if err := validateBootstrapEntry(request, entry, opts.MirrorDir, path); err != nil {
+				logger.Warning("Cannot bootstrap %s %s: index entry rejected: %v", request.name, request.version, err)
+				report.Requested++
+				report.Rejected++
+				continue
+			}
+			if pins.Pinned(name, version) {
+				continue
+			}
+			pins.pin(name, version)
+			report.Requested++
+			if _, ok := crateIndex[name+"-"+version+".crate"]; ok {
+				report.Present++
+				continue
+			}
+			fetches = append(fetches, MissingCrate{
+				Crate:   name,
+				Version: version,
+				URL:     DownloadURL(template, name, version, cksum),
+				SHA256:  cksum,
+				Path:    path,
+			})
+		}
+	}
+	pins.Reset()
+	logger.Info("Bootstrapping %d versions: %d already in the mirror, %d to fetch, %d not in the index, %d rejected",
+		report.Requested, report.Present, len(fetches), report.Unresolved, report.Rejected)
+
+	// Download with a pool of workers, logging progress as they finish
+	type fetchResult struct {
+		crate MissingCrate
+		bytes int64
+		err   error
+	}
+	client := &http.Client{Timeout: BootstrapFetchTimeout}
+	jobs := make(chan MissingCrate)
+	results := make(chan fetchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for crate := range jobs {
+				n, err := fetchCrate(client, crate.URL, crate.Path, crate.SHA256, limit, opts.FileMode, opts.DirMode)
+				results <- fetchResult{crate: crate, bytes: n, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, crate := range fetches {
+			jobs <- crate
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	lastProgress := time.Now()
+	done := 0
+	for result := range results {
+		done++
+		report.Bytes += result.bytes
+		if result.err != nil {
+			logger.Error("Failed to fetch %s-%s: %v", result.crate.Crate, result.crate.Version, result.err)
+			report.Failed++
+		} else {
+			logger.Debug("Fetched %s (%d bytes)", result.crate.Path, result.bytes)
+			report.Fetched++
+		}
+		if time.Since(lastProgress) >= 10*time.Second {
+			logger.Info("Fetched %d of %d versions (%d bytes, %d failed)", done, len(fetches), report.Bytes, report.Failed)
+			lastProgress = time.Now()
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Fetched %d versions (%d bytes) in %v; %d failed", report.Fetched, report.Bytes, report.Duration, report.Failed)
+	return pins, report, nil
+}
+
+// validateBootstrapRequest checks a crate list's name and version before
+// they are used to find the crate's index file
+func validateBootstrapRequest(request bootstrapRequest) error {
+	if err := indexentry.ValidateName(request.name); err != nil {
+		return err
+	}
+	if request.version != "" {
+		if _, err := indexentry.ParseVersion(request.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBootstrapEntry checks the index entry resolved for a request
+// before its name and version become a download path: both must be valid,
+// the name must be the one requested, the path must stay in the mirror, and
+// there must be a cksum to verify the download against
+func validateBootstrapEntry(request bootstrapRequest, entry MetadataEntry, mirrorDir, path string) error {
+	name, version := entry.Name(), entry.Version()
+	if err := indexentry.ValidateName(name); err != nil {
+		return err
+	}
+	if _, err := indexentry.ParseVersion(version); err != nil {
+		return err
+	}
+	if err := checkPathComponents(name, version); err != nil {
+		return err
+	}
+	if !strings.EqualFold(name, request.name) {
+		return fmt.Errorf("entry is for crate %q", name)
+	}
+	mirror, err := filepath.Abs(mirrorDir)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if !isWithin(mirror, abs) {
+		return fmt.Errorf("%s is outside the mirror", path)
+	}
+	if cksum, _ := entry["cksum"].(string); cksum == "" {
+		return fmt.Errorf("entry has no cksum")
+	}
+	return nil
+}
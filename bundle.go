@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// BundleSuffix is the suffix of the per-crate aggregate bundle files
+const BundleSuffix = ".versions.json"
+
+// BundleWriter merges organized versions into one bundle file per crate,
+// "{root}/{index path}.versions.json", holding the entries of every
+// organized version sorted by semver. A crate whose versions were all
+// organized cleanly gets its bundle rebuilt from them, dropping versions no
+// longer in the index or the mirror; otherwise the versions processed are
+// merged into the bundle in place, so none is lost. Writes
+// to the same bundle are serialized through a fixed set of locks selected by
+// hashing the bundle path, so they are safe even if two workers ever handle
+// the same crate.
+type BundleWriter struct {
+	locks [64]sync.Mutex
+}
+
+// lock returns the lock guarding path
+func (b *BundleWriter) lock(path string) *sync.Mutex {
+	hash := uint32(2166136261)
+	for i := 0; i < len(path); i++ {
+		hash ^= uint32(path[i])
+		hash *= 16777619
+	}
+	return &b.locks[hash%uint32(len(b.locks))]
+}
+
+// BundlePath returns the path of a crate's bundle under the guard's root
+func (g *PathGuard) BundlePath(crateName string) (string, error) {
+	if crateName == "" || crateName == "." || crateName == ".." || strings.ContainsAny(crateName, `/\`) ||
+		strings.ContainsRune(crateName, 0) {
+		return "", fmt.Errorf("unsafe path component %q", crateName)
+	}
+	bundlePath := filepath.Join(g.root, filepath.FromSlash(indexentry.IndexPath(crateName))+BundleSuffix)
+	bundlePath = filepath.Join(filepath.Dir(bundlePath), g.safeName(filepath.Dir(bundlePath), filepath.Base(bundlePath)))
+	if !isWithin(g.root, bundlePath) {
+		return "", fmt.Errorf("%s is outside %s", bundlePath, g.root)
+	}
+	if !g.allowSymlinks {
+		if err := g.checkResolved(filepath.Dir(bundlePath)); err != nil {
+			return "", err
+		}
+	}
+	return bundlePath, nil
+}
+
+// readBundle reads a bundle file, returning no entries if it does not exist
+func readBundle(path string) ([]MetadataEntry, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []MetadataEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Merge adds entries to the crate's bundle in dest, replacing any existing
+// entry with the same version, or with rebuild replaces the bundle with just
+// entries, removing it if there are none. It reports whether the bundle
+// changed.
+func (b *BundleWriter) Merge(dest *Destination, crateName string, entries []MetadataEntry, rebuild bool, opts *Options, logger *Logger) (bool, error) {
+	path, err := dest.Guard.BundlePath(crateName)
+	if err != nil {
+		return false, err
+	}
+	if usual := strings.ToLower(crateName) + BundleSuffix; filepath.Base(path) != usual {
+		logger.Warning("Writing bundle %s as %s, since %s is not a valid file name here", usual, filepath.Base(path), usual)
+	}
+
+	mu := b.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if rebuild && len(entries) == 0 {
+		if err := fsRemove(path); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	var existing []MetadataEntry
+	if !rebuild {
+		existing, err = readBundle(path)
+		if err != nil {
+			logger.Warning("Replacing unreadable bundle %s: %v", path, err)
+			existing = nil
+		}
+	}
+
+	byVersion := make(map[string]MetadataEntry, len(existing)+len(entries))
+	for _, entry := range append(existing, entries...) {
+		version, _ := entry["vers"].(string)
+		byVersion[version] = entry
+	}
+	merged := make([]MetadataEntry, 0, len(byVersion))
+	for _, entry := range byVersion {
+		merged = append(merged, entry)
+	}
+	indexentry.SortEntries(merged)
+
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+
+	if err := fsMkdirAll(filepath.Dir(path), opts.DirMode); err != nil {
+		return false, err
+	}
+	temp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := fsWriteFile(temp, data, opts.FileMode); err != nil {
+		fsRemove(temp)
+		return false, err
+	}
+	if err := fsRename(temp, path); err != nil {
+		fsRemove(temp)
+		return false, err
+	}
+	return true, nil
+}
+
+// BundleReport summarizes an aggregate bundle verification pass
+type BundleReport struct {
+	Checked    int           `json:"checked"`
+	OK         int           `json:"ok"`
+	Mismatched int           `json:"mismatched"`
+	Missing    int           `json:"missing"`
+	Errors     int           `json:"errors"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *BundleReport) SummaryLine() string {
+	return fmt.Sprintf("verify-aggregate: checked=%d ok=%d mismatched=%d missing=%d errors=%d dur=%s",
+		r.Checked, r.OK, r.Mismatched, r.Missing, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// VerifyBundles checks that each crate's bundle in every destination holds
+// exactly the current index entries of the versions present in the mirror,
+// in semver order. Local index entries take precedence over main ones.
+func VerifyBundles(opts *Options, logger *Logger) (*BundleReport, error) {
+	logger.Info("Verifying aggregate bundles...")
+	startTime := time.Now()
+
+	crateIndex, err := BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, nil, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+	metadataFiles, err := FindMetadataFiles(opts.IndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find metadata files: %v", err)
+	}
+	if opts.LocalIndexDir != "" {
+		localFiles, err := FindMetadataFiles(opts.LocalIndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find local metadata files: %v", err)
+		}
+		metadataFiles = append(metadataFiles, localFiles...)
+	}
+
+	report := &BundleReport{}
+
+	// Collect the expected entries per crate; local files come last and win
+	expected := make(map[string]map[string]MetadataEntry)
+	for _, file := range metadataFiles {
+		entries, err := readIndexEntries(file.Path)
+		if err != nil {
+			logger.Error("Failed to read metadata file %s: %v", file.Path, err)
+			report.Errors++
+			continue
+		}
+		crateName := filepath.Base(file.Path)
+		for _, entry := range entries {
+			name := crateName
+			if opts.CrateIDMode {
+				name, _ = entry["name"].(string)
+			}
+			version, _ := entry["vers"].(string)
+			if name == "" || version == "" {
+				continue
+			}
+			if opts.Prereleases == PrereleasesSkip {
+				if parsed, err := indexentry.ParseVersion(version); err == nil && parsed.IsPrerelease() {
+					continue
+				}
+			}
+			if opts.MinVersions.Below(name, version) {
+				continue
+			}
+			_, present := crateIndex[name+"-"+version+".crate"]
+			for _, alias := range opts.RenameMap.Aliases(name) {
+				if present {
+					break
+				}
+				_, present = crateIndex[alias+"-"+version+".crate"]
+			}
+			if !present {
+				continue
+			}
+			if expected[crateName] == nil {
+				expected[crateName] = make(map[string]MetadataEntry)
+			}
+			expected[crateName][version] = entry
+		}
+	}
+
+	crateNames := make([]string, 0, len(expected))
+	for crateName := range expected {
+		crateNames = append(crateNames, crateName)
+	}
+	sort.Strings(crateNames)
+
+	for _, dest := range opts.Destinations {
+		for _, crateName := range crateNames {
+			report.Checked++
+			path, err := dest.Guard.BundlePath(crateName)
+			if err != nil {
+				logger.Error("Rejected unsafe bundle path for %s under %s: %v", crateName, dest.Root, err)
+				report.Errors++
+				continue
+			}
+			bundle, err := readBundle(path)
+			if err != nil {
+				logger.Error("Failed to read bundle %s: %v", path, err)
+				report.Errors++
+				continue
+			}
+			if bundle == nil {
+				logger.Error("Missing bundle %s", path)
+				report.Missing++
+				continue
+			}
+
+			want := make([]MetadataEntry, 0, len(expected[crateName]))
+			for _, entry := range expected[crateName] {
+				want = append(want, entry)
+			}
+			indexentry.SortEntries(want)
+
+			ok := len(bundle) == len(want)
+			for i := 0; ok && i < len(want); i++ {
+				replayTransforms(bundle[i], want[i])
+				got, err1 := canonicalEntry(bundle[i])
+				exp, err2 := canonicalEntry(want[i])
+				ok = err1 == nil && err2 == nil && bytes.Equal(got, exp)
+			}
+			if !ok {
+				logger.Error("Bundle %s does not match the index: has %d versions, expected %d", path, len(bundle), len(want))
+				report.Mismatched++
+				continue
+			}
+			report.OK++
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Bundle verification complete: %d of %d bundles match the index, %d mismatched, %d missing in %v",
+		report.OK, report.Checked, report.Mismatched, report.Missing, report.Duration)
+	return report, nil
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Schedule determines when the daemon runs next
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// intervalSchedule runs at a fixed interval
+type intervalSchedule time.Duration
+
+// Next returns the time one interval after the given time
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cronSchedule runs at the times matched by a 5-field cron expression
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	anyDay   bool
+	anyWeek  bool
+}
+
+// ParseSchedule parses an interval such as "30m" or a 5-field cron
+// expression ("minute hour day-of-month month day-of-week") such as
+// "0 3 * * *". The shorthands @hourly, @daily, and @weekly are accepted.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	}
+
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval < time.Minute {
+			return nil, fmt.Errorf("interval %s is shorter than one minute", interval)
+		}
+		return intervalSchedule(interval), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q is neither a duration nor a 5-field cron expression", spec)
+	}
+
+	var schedule cronSchedule
+	var err error
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	targets := []*uint64{&schedule.minutes, &schedule.hours, &schedule.days, &schedule.months, &schedule.weekdays}
+	for i, field := range fields {
+		if *targets[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, fmt.Errorf("cron field %q: %v", field, err)
+		}
+	}
+	// Sunday may be written as 0 or 7
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	schedule.anyDay = fields[2] == "*"
+	schedule.anyWeek = fields[4] == "*"
+
+	return &schedule, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges, and steps
+// ("*", "5", "1-5", "*/15", "0-30/10") into a bitset
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches applies cron's rule that when both day-of-month and
+// day-of-week are restricted, a day matching either one qualifies
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dayOK := s.days&(1<<uint(t.Day())) != 0
+	weekOK := s.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeek:
+		return true
+	case s.anyDay:
+		return weekOK
+	case s.anyWeek:
+		return dayOK
+	default:
+		return dayOK || weekOK
+	}
+}
+
+// Next returns the first matching minute strictly after the given time
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Five years is enough to find any satisfiable expression (e.g. Feb 29)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit
+}
+
+// Daemon runs the organizer repeatedly on a schedule
+type Daemon struct {
+	opts     *Options
+	schedule Schedule
+	logger   *Logger
+	trigger  chan string
+
+	// BackfillInterval is how often to look for the crate files of
+	// Options.RecentlyMissing between runs; 0 disables backfilling
+	BackfillInterval time.Duration
+
+	mu         sync.Mutex
+	running    bool
+	runs       int
+	lastStart  time.Time
+	lastEnd    time.Time
+	lastReport *Report
+	lastError  string
+	nextRun    time.Time
+}
+
+// NewDaemon creates a daemon for the given options and schedule
+func NewDaemon(opts *Options, schedule Schedule, logger *Logger) *Daemon {
+	return &Daemon{
+		opts:     opts,
+		schedule: schedule,
+		logger:   logger,
+		trigger:  make(chan string, 1),
+	}
+}
+
+// Trigger requests a run. Requests made while a run is in progress or
+// already pending are coalesced into it rather than queued.
+func (d *Daemon) Trigger(reason string) {
+	d.mu.Lock()
+	running := d.running
+	d.mu.Unlock()
+	if running {
+		d.logger.Info("Run requested (%s) while a run is in progress; coalesced", reason)
+		return
+	}
+
+	select {
+	case d.trigger <- reason:
+	default:
+		d.logger.Info("Run requested (%s) while a run is pending; coalesced", reason)
+	}
+}
+
+// Run starts the schedule and status server and performs runs until SIGTERM
+// or an interrupt. SIGHUP triggers an immediate run. A shutdown request
+// received during a run takes effect once that run completes.
+func (d *Daemon) Run(statusAddr string) error {
+	if statusAddr != "" {
+		listener, err := net.Listen("tcp", statusAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", statusAddr, err)
+		}
+		server := &http.Server{Handler: d.statusHandler()}
+		go server.Serve(listener)
+		defer server.Close()
+		d.logger.Info("Serving status on http://%s/status and /metrics", listener.Addr())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	stop := make(chan struct{})
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				d.logger.Info("Received SIGHUP")
+				d.Trigger("SIGHUP")
+				continue
+			}
+			d.mu.Lock()
+			running := d.running
+			d.mu.Unlock()
+			if running {
+				d.logger.Info("Received %v; shutting down after the in-flight run completes", sig)
+			} else {
+				d.logger.Info("Received %v; shutting down", sig)
+			}
+			close(stop)
+			return
+		}
+	}()
+
+	// Run once at startup, then on schedule
+	d.Trigger("startup")
+	timer := time.NewTimer(d.scheduleNext())
+	defer timer.Stop()
+
+	var backfill <-chan time.Time
+	if d.opts.RecentlyMissing != nil && d.BackfillInterval > 0 {
+		ticker := time.NewTicker(d.BackfillInterval)
+		defer ticker.Stop()
+		backfill = ticker.C
+	}
+
+	d.logger.Info("Daemon started (pid %d)", os.Getpid())
+	for {
+		select {
+		case <-stop:
+			d.logger.Info("Daemon stopped after %d runs", d.runs)
+			return nil
+		default:
+		}
+
+		select {
+		case <-stop:
+			d.logger.Info("Daemon stopped after %d runs", d.runs)
+			return nil
+		case <-timer.C:
+			d.Trigger("schedule")
+			timer.Reset(d.scheduleNext())
+		case reason := <-d.trigger:
+			d.runOnce(reason)
+		case <-backfill:
+			d.backfill()
+		}
+	}
+}
+
+// scheduleNext records the next scheduled run and returns the wait until it
+func (d *Daemon) scheduleNext() time.Duration {
+	now := time.Now()
+	next := d.schedule.Next(now)
+
+	d.mu.Lock()
+	d.nextRun = next
+	d.mu.Unlock()
+
+	return next.Sub(now)
+}
+
+// runOnce performs a single run and records its outcome
+func (d *Daemon) runOnce(reason string) {
+	d.mu.Lock()
+	d.running = true
+	d.lastStart = time.Now()
+	d.mu.Unlock()
+
+	d.logger.Info("Starting scheduled run (%s)", reason)
+	report, err := RunOrganize(d.opts, d.logger)
+	if err != nil {
+		d.logger.Error("Run failed: %v", err)
+	} else {
+		d.logger.Info("%s", report.SummaryLine())
+	}
+
+	d.mu.Lock()
+	d.running = false
+	d.runs++
+	d.lastEnd = time.Now()
+	if err != nil {
+		d.lastError = err.Error()
+	} else {
+		d.lastError = ""
+		d.lastReport = report
+	}
+	d.mu.Unlock()
+
+	if err := d.opts.RecentlyMissing.Save(); err != nil {
+		d.logger.Warning("Failed to save recently missing set: %v", err)
+	}
+}
+
+// backfill organizes the recently missing versions whose crate files have
+// arrived since the last run, one read of each index file, and adds them
+// to the last run's counts
+func (d *Daemon) backfill() {
+	recent := d.opts.RecentlyMissing
+	if recent.Len() == 0 {
+		return
+	}
+	crateIndex, err := d.opts.CrateIndexCache.Refresh(d.logger)
+	if err != nil {
+		d.logger.Error("Backfill failed: %v", err)
+		return
+	}
+	arrived := recent.Arrived(crateIndex)
+	if len(arrived) == 0 {
+		return
+	}
+
+	// Only the arrived versions are written, so leave out everything that
+	// needs the crate's other versions or must reflect a whole run
+	opts := *d.opts
+	opts.Snapshot = nil
+	opts.Latest = nil
+	opts.Bundles = nil
+	opts.Categories = nil
+	opts.CompactIndexDir = ""
+	opts.Checkpoint = nil
+
+	organized := 0
+	for start := 0; start < len(arrived); {
+		file := arrived[start].Index
+		wanted := make(map[string]bool)
+		end := start
+		for ; end < len(arrived) && arrived[end].Index.Path == file.Path; end++ {
+			wanted[arrived[end].Version] = true
+		}
+		start = end
+
+		fileOpts := opts
+		fileOpts.EntryFilter = func(entry MetadataEntry) bool {
+			version, _ := entry["vers"].(string)
+			return wanted[version] && (opts.EntryFilter == nil || opts.EntryFilter(entry))
+		}
+		result := ProcessMetadataFile(file, crateIndex, &fileOpts, d.logger)
+		organized += result.Success
+		if result.Success > 0 {
+			d.logger.Info("Backfilled %d versions of %s", result.Success, result.Crate)
+		}
+	}
+	d.logger.Info("Backfilled metadata for %d of %d recently missing versions whose crate files arrived", organized, len(arrived))
+
+	d.mu.Lock()
+	if d.lastReport != nil && organized > 0 {
+		report := *d.lastReport
+		report.Backfilled += organized
+		report.Success += organized
+		report.Missing -= organized
+		if report.Missing < 0 {
+			// Some were missing in an earlier run than this report's
+			report.Missing = 0
+		}
+		d.lastReport = &report
+	}
+	d.mu.Unlock()
+
+	if err := recent.Save(); err != nil {
+		d.logger.Warning("Failed to save recently missing set: %v", err)
+	}
+}
+
+// DaemonStatus is the JSON document served at /status
+type DaemonStatus struct {
+	Running    bool      `json:"running"`
+	Runs       int       `json:"runs"`
+	LastStart  time.Time `json:"last_start,omitempty"`
+	LastEnd    time.Time `json:"last_end,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastReport *Report   `json:"last_report,omitempty"`
+	NextRun    time.Time `json:"next_run"`
+}
+
+// Status returns a snapshot of the daemon's state
+func (d *Daemon) Status() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DaemonStatus{
+		Running:    d.running,
+		Runs:       d.runs,
+		LastStart:  d.lastStart,
+		LastEnd:    d.lastEnd,
+		LastError:  d.lastError,
+		LastReport: d.lastReport,
+		NextRun:    d.nextRun,
+	}
+}
+
+// statusHandler serves /status as JSON and /metrics in Prometheus text format
+func (d *Daemon) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(d.Status())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		status := d.Status()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		running := 0
+		if status.Running {
+			running = 1
+		}
+		fmt.Fprintf(w, "organize_runs_total %d\n", status.Runs)
+		fmt.Fprintf(w, "organize_run_in_progress %d\n", running)
+		fmt.Fprintf(w, "organize_next_run_timestamp_seconds %d\n", status.NextRun.Unix())
+		if report := status.LastReport; report != nil {
+			fmt.Fprintf(w, "organize_last_run_end_timestamp_seconds %d\n", status.LastEnd.Unix())
+			fmt.Fprintf(w, "organize_last_run_duration_seconds %f\n", report.Duration.Seconds())
+			fmt.Fprintf(w, "organize_last_run_versions %d\n", report.Versions)
+			fmt.Fprintf(w, "organize_last_run_linked %d\n", report.Success)
+			fmt.Fprintf(w, "organize_last_run_missing %d\n", report.Missing)
+			fmt.Fprintf(w, "organize_last_run_backfilled %d\n", report.Backfilled)
+			fmt.Fprintf(w, "organize_last_run_errors %d\n", report.Errors)
+		}
+	})
+	return mux
+}
+
+// RecentlyMissing remembers the versions whose crate files were recently
+// missing from the mirror, so a daemon can organize each as soon as its
+// crate file appears instead of at the next run, which may skip the crate
+// entirely if its index file is unchanged. It keeps the Max versions most
+// recently reported missing and forgets any not reported within Window.
+type RecentlyMissing struct {
+	Path   string
+	Max    int
+	Window time.Duration
+
+	// versions is keyed by the name of the expected crate file
+	versions map[string]*MissingVersion
+	mu       sync.Mutex
+}
+
+// MissingVersion is a version in the recently missing set, with the index
+// file its entry is read from again once its crate file arrives
+type MissingVersion struct {
+	Crate   string    `json:"crate"`
+	Version string    `json:"version"`
+	Index   IndexFile `json:"index"`
+	Seen    time.Time `json:"seen"`
+}
+
+// LoadRecentlyMissing reads the set saved by a previous daemon, or starts
+// an empty one if there is none
+func LoadRecentlyMissing(path string, max int, window time.Duration) (*RecentlyMissing, error) {
+	recent := &RecentlyMissing{Path: path, Max: max, Window: window, versions: make(map[string]*MissingVersion)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return recent, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recently missing set: %v", err)
+	}
+	if err := json.Unmarshal(data, &recent.versions); err != nil {
+		return nil, fmt.Errorf("failed to parse recently missing set %s: %v", path, err)
+	}
+	recent.prune(time.Now())
+	return recent, nil
+}
+
+// Len returns the number of versions in the set
+func (r *RecentlyMissing) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.versions)
+}
+
+// Missed records that a version's crate file is missing
+func (r *RecentlyMissing) Missed(crateFile, crate, version string, file IndexFile) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.versions[crateFile] = &MissingVersion{Crate: crate, Version: version, Index: file, Seen: time.Now()}
+	r.mu.Unlock()
+}
+
+// Found removes a version whose crate file is no longer missing
+func (r *RecentlyMissing) Found(crateFile string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.versions, crateFile)
+	r.mu.Unlock()
+}
+
+// Arrived removes and returns the versions whose crate files are now in
+// the crate index
+func (r *RecentlyMissing) Arrived(crateIndex FileIndex) []MissingVersion {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(time.Now())
+
+	var arrived []MissingVersion
+	for crateFile, missing := range r.versions {
+		if _, ok := crateIndex[crateFile]; ok {
+			arrived = append(arrived, *missing)
+			delete(r.versions, crateFile)
+		}
+	}
+	sort.Slice(arrived, func(i, j int) bool {
+		return arrived[i].Index.Path < arrived[j].Index.Path
+	})
+	return arrived
+}
+
+// prune forgets the versions not reported missing within the window, then
+// the least recently reported beyond Max. The caller holds r.mu, if needed.
+func (r *RecentlyMissing) prune(now time.Time) {
+	for crateFile, missing := range r.versions {
+		if r.Window > 0 && now.Sub(missing.Seen) > r.Window {
+			delete(r.versions, crateFile)
+		}
+	}
+	if r.Max <= 0 || len(r.versions) <= r.Max {
+		return
+	}
+	crateFiles := make([]string, 0, len(r.versions))
+	for crateFile := range r.versions {
+		crateFiles = append(crateFiles, crateFile)
+	}
+	sort.Slice(crateFiles, func(i, j int) bool {
+		return r.versions[crateFiles[i]].Seen.Before(r.versions[crateFiles[j]].Seen)
+	})
+	for _, crateFile := range crateFiles[:len(crateFiles)-r.Max] {
+		delete(r.versions, crateFile)
+	}
+}
+
+// Save prunes the set and writes it for the next daemon
+func (r *RecentlyMissing) Save() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	r.prune(time.Now())
+	data, err := json.Marshal(r.versions)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := r.Path + ".tmp"
+	if err := fsWriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return fsRename(tmpPath, r.Path)
+}
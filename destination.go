@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Destination is one root that metadata documents are written to, with its
+// own layout, path guard, and counts
+type Destination struct {
+	Root     string
+	InMirror bool
+	Dest     DestStrategy
+	Guard    *PathGuard
+
+	// Store, if set, receives the documents as objects instead of files;
+	// such a destination has no Guard, and Root is the store's URL
+	Store ObjectStore
+
+	// Spill, if set, caps the metadata files per directory
+	Spill *DirSpill
+
+	written   int64
+	unchanged int64
+	failed    int64
+
+	// symlinksReplaced and symlinksFollowed count the symlinks found at
+	// output paths and replaced or written through
+	symlinksReplaced int64
+	symlinksFollowed int64
+
+	// dirs holds the *dirWrites of every directory a metadata file was
+	// written or found unchanged in during the run, for the directory
+	// manifests and write latency
+	dirs sync.Map
+
+	// slots holds a semaphore per directory when Options.WritersPerDir
+	// limits the writers in each; waitNanos is the time spent waiting
+	slots     sync.Map
+	waitNanos int64
+}
+
+// dirWrites are the writes into one directory and the time they took,
+// including any wait for a slot
+type dirWrites struct {
+	writes int64
+	nanos  int64
+}
+
+// DestinationCounts are the per-destination results of a run
+type DestinationCounts struct {
+	Written   int           `json:"written"`
+	Unchanged int           `json:"unchanged"`
+	Failed    int           `json:"failed"`
+	WriteTime time.Duration `json:"write_time_ns"`
+	DirWait   time.Duration `json:"dir_wait_ns"`
+
+	SymlinksReplaced       int `json:"symlinks_replaced,omitempty"`
+	SymlinksWrittenThrough int `json:"symlinks_written_through,omitempty"`
+}
+
+// NewDestination creates a destination rooted at root. If inMirror is true,
+// root is the mirror itself and metadata is written beside the crate files.
+func NewDestination(root, layout, mirrorDir string, inMirror, allowSymlinks bool) (*Destination, error) {
+	outputDir := root
+	if inMirror {
+		outputDir = ""
+	}
+	dest, err := NewDestStrategy(layout, mirrorDir, outputDir)
+	if err != nil {
+		return nil, err
+	}
+	guard, err := NewPathGuard(root, allowSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	return &Destination{Root: root, InMirror: inMirror, Dest: dest, Guard: guard}, nil
+}
+
+// NewObjectDestination creates a destination that puts documents into an
+// object store, keyed by the paths the layout gives them under an output
+// directory
+func NewObjectDestination(store ObjectStore, layout, mirrorDir string) (*Destination, error) {
+	dest, err := NewDestStrategy(layout, mirrorDir, string(filepath.Separator))
+	if err != nil {
+		return nil, err
+	}
+	return &Destination{Root: store.String(), Dest: dest, Store: store}, nil
+}
+
+// Values of -prereleases
+const (
+	PrereleasesInclude  = "include"
+	PrereleasesSkip     = "skip"
+	PrereleasesSeparate = "separate"
+)
+
+// PrereleaseDir is the subdirectory prerelease metadata is written to with
+// -prereleases separate
+const PrereleaseDir = "prerelease"
+
+// OutputPath returns the guarded path of the metadata file for a version,
+// in the PrereleaseDir subdirectory if separate is set
+func (d *Destination) OutputPath(crateFilePath, name, version string, metadata MetadataEntry, separate bool) (string, error) {
+	dir := d.Dest.Dir(crateFilePath, metadata)
+	if separate {
+		dir = filepath.Join(dir, PrereleaseDir)
+	}
+	if d.Store != nil {
+		// Object keys have no symlinks or reserved file names to guard against
+		if err := checkPathComponents(name, version); err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, fmt.Sprintf("%s-%s%s", name, version, MetadataFileSuffix)), nil
+	}
+	outputPath, err := d.Guard.OutputPath(dir, name, version)
+	if err != nil || d.Spill == nil {
+		return outputPath, err
+	}
+	return d.Spill.Place(outputPath)
+}
+
+// ExistingPath returns the path a version's metadata file was written to,
+// like OutputPath but without placing a new file in a part directory
+func (d *Destination) ExistingPath(crateFilePath, name, version string, metadata MetadataEntry, separate bool) (string, error) {
+	dir := d.Dest.Dir(crateFilePath, metadata)
+	if separate {
+		dir = filepath.Join(dir, PrereleaseDir)
+	}
+	outputPath, err := d.Guard.OutputPath(dir, name, version)
+	if err != nil || d.Spill == nil {
+		return outputPath, err
+	}
+	return d.Spill.Placed(outputPath), nil
+}
+
+// PartDirPrefix starts the names of the subdirectories metadata files spill
+// into once their directory holds -max-files-per-dir of them
+const PartDirPrefix = "part-"
+
+// PartsFileName records, in each output root, the metadata files that were
+// placed in a part subdirectory instead of their usual directory
+const PartsFileName = ".organize-parts.json"
+
+// DirSpill keeps directories below a number of metadata files by placing
+// the extra files in numbered part-NNN subdirectories. Once written, a file
+// keeps its place on later runs, recorded in PartsFileName.
+type DirSpill struct {
+	root string
+	max  int
+
+	mu      sync.Mutex
+	parts   map[string]string    // usual path, relative to the root -> part subdirectory
+	pending map[string]partPlace // absolute path placed in a part -> placement, until written
+	counts  map[string][]int     // absolute directory -> metadata files in it and in each part
+	added   int
+}
+
+// partPlace is a file's placement in a part subdirectory
+type partPlace struct {
+	rel  string
+	part string
+}
+
+// LoadDirSpill creates a spill for the output root, reading the placements
+// of earlier runs from its PartsFileName
+func LoadDirSpill(root string, max int) (*DirSpill, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	spill := &DirSpill{root: absRoot, max: max, parts: make(map[string]string), pending: make(map[string]partPlace), counts: make(map[string][]int)}
+	content, err := ioutil.ReadFile(filepath.Join(absRoot, PartsFileName))
+	if err == nil {
+		if err := json.Unmarshal(content, &spill.parts); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", filepath.Join(absRoot, PartsFileName), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return spill, nil
+}
+
+// Placed returns the path Place put a file at in an earlier call or run, or
+// outputPath if it was not placed in a part directory
+func (s *DirSpill) Placed(outputPath string) string {
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		return outputPath
+	}
+	rel, err := filepath.Rel(s.root, absPath)
+	if err != nil {
+		return outputPath
+	}
+	dir, base := filepath.Split(outputPath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if part, ok := s.parts[filepath.ToSlash(rel)]; ok {
+		return filepath.Join(dir, part, base)
+	}
+	return outputPath
+}
+
+// Place returns where the metadata file usually at outputPath goes: its
+// recorded place, its usual directory if it is there already or while that
+// has room, or else the first part subdirectory with room. A placement in a
+// part subdirectory is only recorded once Written reports the file written.
+func (s *DirSpill) Place(outputPath string) (string, error) {
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.root, absPath)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	dir, base := filepath.Split(outputPath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if part, ok := s.parts[rel]; ok {
+		return filepath.Join(dir, part, base), nil
+	}
+
+	// A file already in its usual directory stays there, and was counted
+	// when the directory was
+	absDir := filepath.Dir(absPath)
+	counts, ok := s.counts[absDir]
+	if !ok {
+		counts = countPartFiles(absDir)
+		s.counts[absDir] = counts
+	}
+	if _, err := os.Stat(outputPath); err == nil {
+		return outputPath, nil
+	}
+	if counts[0] < s.max {
+		counts[0]++
+		return outputPath, nil
+	}
+
+	n := 1
+	for ; n < len(counts) && counts[n] >= s.max; n++ {
+	}
+	if n == len(counts) {
+		counts = append(counts, 0)
+		s.counts[absDir] = counts
+	}
+	counts[n]++
+	part := fmt.Sprintf("%s%03d", PartDirPrefix, n)
+	s.pending[filepath.Join(absDir, part, base)] = partPlace{rel: rel, part: part}
+	return filepath.Join(dir, part, base), nil
+}
+
+// Written records the placement of a file Place put in a part
+// subdirectory, now that it has been written to placedPath
+func (s *DirSpill) Written(placedPath string) {
+	if s == nil {
+		return
+	}
+	absPath, err := filepath.Abs(placedPath)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if place, ok := s.pending[absPath]; ok {
+		delete(s.pending, absPath)
+		s.parts[place.rel] = place.part
+		s.added++
+	}
+}
+
+// countPartFiles counts the metadata files in dir and in each of its part
+// subdirectories
+func countPartFiles(dir string) []int {
+	counts := []int{0}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			if strings.HasSuffix(name, MetadataFileSuffix) {
+				counts[0]++
+			}
+			continue
+		}
+		if !isPartDir(name) {
+			continue
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(name, PartDirPrefix))
+		for len(counts) <= n {
+			counts = append(counts, 0)
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(dir, name))
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), MetadataFileSuffix) {
+				counts[n]++
+			}
+		}
+	}
+	return counts
+}
+
+// isPartDir reports whether a directory name is a part subdirectory
+func isPartDir(name string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, PartDirPrefix))
+	return strings.HasPrefix(name, PartDirPrefix) && err == nil && n >= 1
+}
+
+// Save writes the placements to PartsFileName in the root if any were
+// added. It returns how many files are in part subdirectories.
+func (s *DirSpill) Save() (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.added == 0 {
+		return len(s.parts), nil
+	}
+
+	path := filepath.Join(s.root, PartsFileName)
+	data, err := json.MarshalIndent(s.parts, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := fsWriteFile(path, data, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	s.added = 0
+	return len(s.parts), nil
+}
+
+// Write writes a metadata document to outputPath, creating its directory
+// if needed. With skipUnchanged, an existing file with identical content is
+// left alone and reported as unchanged.
+func (d *Destination) Write(outputPath string, data []byte, opts *Options) (bool, error) {
+	if d.Store != nil {
+		return d.writeObject(outputPath, data, opts)
+	}
+	written, err := d.writeFile(outputPath, data, opts)
+	if err == nil {
+		d.Spill.Written(outputPath)
+	}
+	return written, err
+}
+
+// writeFile writes a metadata document to a file, as Write
+func (d *Destination) writeFile(outputPath string, data []byte, opts *Options) (bool, error) {
+	// A symlink at the output path, such as one into a store that may be
+	// gone, would make the write depend on its target; replace it with a
+	// real file unless a valid one may be written through
+	throughLink := false
+	if info, err := os.Lstat(outputPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if _, err := os.Stat(outputPath); err == nil && opts.PreserveSymlinks {
+			throughLink = true
+		} else if err := fsRemove(outputPath); err != nil {
+			atomic.AddInt64(&d.failed, 1)
+			return false, fmt.Errorf("failed to remove symlink at %s: %v", outputPath, err)
+		} else {
+			atomic.AddInt64(&d.symlinksReplaced, 1)
+		}
+	}
+
+	if opts.SkipUnchanged {
+		if existing, err := ioutil.ReadFile(outputPath); err == nil && bytes.Equal(existing, data) {
+			atomic.AddInt64(&d.unchanged, 1)
+			d.dirWrites(filepath.Dir(outputPath))
+			return false, nil
+		}
+	}
+
+	dir := filepath.Dir(outputPath)
+	start := time.Now()
+	release := d.acquireDir(dir, opts.WritersPerDir)
+	defer release()
+	if opts.WritersPerDir > 0 {
+		atomic.AddInt64(&d.waitNanos, int64(time.Since(start)))
+	}
+
+	// Directories beside crate files exist already, except for prereleases and parts
+	if base := filepath.Base(dir); !d.InMirror || base == PrereleaseDir || isPartDir(base) {
+		if err := fsMkdirAll(dir, opts.DirMode); err != nil {
+			atomic.AddInt64(&d.failed, 1)
+			return false, err
+		}
+	}
+
+	// Write a temp file beside the output and rename it into place, so a
+	// killed run never leaves a truncated metadata file. A symlink written
+	// through is kept by renaming over its target instead. The temp file
+	// is a partial file, so index discovery skips it and the next run
+	// cleans it up.
+	target := outputPath
+	if throughLink {
+		if resolved, err := filepath.EvalSymlinks(outputPath); err == nil {
+			target = resolved
+		}
+	}
+	temp := target + "." + strconv.Itoa(os.Getpid()) + PartialTransferSuffix
+	if err := fsWriteFile(temp, data, opts.FileMode); err != nil {
+		fsRemove(temp)
+		atomic.AddInt64(&d.failed, 1)
+		return false, err
+	}
+	if err := fsRename(temp, target); err != nil {
+		fsRemove(temp)
+		atomic.AddInt64(&d.failed, 1)
+		return false, err
+	}
+
+	atomic.AddInt64(&d.written, 1)
+	if throughLink {
+		atomic.AddInt64(&d.symlinksFollowed, 1)
+	}
+	stats := d.dirWrites(dir)
+	atomic.AddInt64(&stats.writes, 1)
+	atomic.AddInt64(&stats.nanos, int64(time.Since(start)))
+	return true, nil
+}
+
+// dirWrites returns the write stats of dir, recording it as an output directory
+func (d *Destination) dirWrites(dir string) *dirWrites {
+	if stats, ok := d.dirs.Load(dir); ok {
+		return stats.(*dirWrites)
+	}
+	stats, _ := d.dirs.LoadOrStore(dir, &dirWrites{})
+	return stats.(*dirWrites)
+}
+
+// acquireDir waits until fewer than limit writers are writing into dir and
+// returns the function that releases the slot. With no limit it does not wait.
+func (d *Destination) acquireDir(dir string, limit int) func() {
+	if limit <= 0 {
+		return func() {}
+	}
+	slot, ok := d.slots.Load(dir)
+	if !ok {
+		slot, _ = d.slots.LoadOrStore(dir, make(chan struct{}, limit))
+	}
+	ch := slot.(chan struct{})
+	ch <- struct{}{}
+	return func() { <-ch }
+}
+
+// LogWriteLatency logs the mean time per metadata file write, the time
+// spent waiting for directory slots, and the directories that took longest
+func (d *Destination) LogWriteLatency(logger *Logger, top int) {
+	type dirTotal struct {
+		dir           string
+		writes, nanos int64
+	}
+	var dirs []dirTotal
+	var writes, nanos int64
+	d.dirs.Range(func(key, value interface{}) bool {
+		stats := value.(*dirWrites)
+		if n := atomic.LoadInt64(&stats.writes); n > 0 {
+			total := atomic.LoadInt64(&stats.nanos)
+			dirs = append(dirs, dirTotal{key.(string), n, total})
+			writes += n
+			nanos += total
+		}
+		return true
+	})
+	if writes == 0 {
+		return
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].nanos != dirs[j].nanos {
+			return dirs[i].nanos > dirs[j].nanos
+		}
+		return dirs[i].dir < dirs[j].dir
+	})
+	if len(dirs) > top {
+		dirs = dirs[:top]
+	}
+	busiest := make([]string, len(dirs))
+	for i, dir := range dirs {
+		busiest[i] = fmt.Sprintf("%s (%d writes, %v total)", dir.dir, dir.writes, time.Duration(dir.nanos).Round(time.Microsecond))
+	}
+	logger.Info("Writes under %s: %d files, mean %v per write, %v waiting for directory slots; slowest directories: %s",
+		d.Root, writes, (time.Duration(nanos) / time.Duration(writes)).Round(time.Microsecond),
+		time.Duration(atomic.LoadInt64(&d.waitNanos)).Round(time.Millisecond), strings.Join(busiest, ", "))
+}
+
+// writeObject puts a document into the destination's object store. With
+// skipUnchanged, an object whose stored checksum matches is left alone.
+func (d *Destination) writeObject(outputPath string, data []byte, opts *Options) (bool, error) {
+	key := d.Store.Key(outputPath)
+	if opts.SkipUnchanged {
+		if unchanged, err := d.Store.Unchanged(key, data); err == nil && unchanged {
+			atomic.AddInt64(&d.unchanged, 1)
+			return false, nil
+		}
+	}
+	if err := d.Store.Put(key, data); err != nil {
+		atomic.AddInt64(&d.failed, 1)
+		return false, err
+	}
+	atomic.AddInt64(&d.written, 1)
+	return true, nil
+}
+
+// WriteDirManifests writes the manifest of every directory the destination
+// wrote to during the run, returning how many were written
+func (d *Destination) WriteDirManifests(logger *Logger) (int, error) {
+	var dirs []string
+	d.dirs.Range(func(key, _ interface{}) bool {
+		dirs = append(dirs, key.(string))
+		return true
+	})
+	sort.Strings(dirs)
+
+	for i, dir := range dirs {
+		if _, err := WriteDirManifest(dir, logger); err != nil {
+			return i, fmt.Errorf("failed to write manifest for %s: %v", dir, err)
+		}
+	}
+	return len(dirs), nil
+}
+
+// Counts returns the destination's counts for the current run
+func (d *Destination) Counts() DestinationCounts {
+	return DestinationCounts{
+		Written:   int(atomic.LoadInt64(&d.written)),
+		Unchanged: int(atomic.LoadInt64(&d.unchanged)),
+		Failed:    int(atomic.LoadInt64(&d.failed)),
+		WriteTime: d.writeTime(),
+		DirWait:   time.Duration(atomic.LoadInt64(&d.waitNanos)),
+
+		SymlinksReplaced:       int(atomic.LoadInt64(&d.symlinksReplaced)),
+		SymlinksWrittenThrough: int(atomic.LoadInt64(&d.symlinksFollowed)),
+	}
+}
+
+// writeTime is the total time spent writing metadata files in the run
+func (d *Destination) writeTime() time.Duration {
+	var nanos int64
+	d.dirs.Range(func(_, value interface{}) bool {
+		nanos += atomic.LoadInt64(&value.(*dirWrites).nanos)
+		return true
+	})
+	return time.Duration(nanos)
+}
+
+// ResetCounts clears the destination's counts before a new run
+func (d *Destination) ResetCounts() {
+	atomic.StoreInt64(&d.written, 0)
+	atomic.StoreInt64(&d.unchanged, 0)
+	atomic.StoreInt64(&d.failed, 0)
+	atomic.StoreInt64(&d.waitNanos, 0)
+	d.dirs.Range(func(key, _ interface{}) bool {
+		d.dirs.Delete(key)
+		return true
+	})
+	d.slots.Range(func(key, _ interface{}) bool {
+		d.slots.Delete(key)
+		return true
+	})
+}
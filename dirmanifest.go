@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DirManifestName is the name of the manifest written in each directory of
+// metadata files with -dir-manifests
+const DirManifestName = "index.json"
+
+// DirManifest lists the metadata files in one directory with their content
+// hashes, so downstream sync can skip unchanged files without reading them
+type DirManifest struct {
+	Canonicalization int                         `json:"canonicalization"`
+	Generated        time.Time                   `json:"generated"`
+	Files            map[string]DirManifestEntry `json:"files"`
+}
+
+// DirManifestEntry is one file of a directory manifest
+type DirManifestEntry struct {
+	ContentHash string `json:"content_hash"`
+	Size        int64  `json:"size"`
+}
+
+// WriteDirManifest writes the manifest for dir, hashing every metadata file
+// in it, and returns how many files it lists
+func WriteDirManifest(dir string, logger *Logger) (int, error) {
+	manifest, err := buildDirManifest(dir, nil, time.Time{}, logger)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeDirManifest(dir, manifest); err != nil {
+		return 0, err
+	}
+	return len(manifest.Files), nil
+}
+
+// buildDirManifest lists the metadata files in dir with their content
+// hashes. A file of the same size as in the cached manifest and not modified
+// since cachedAt keeps its cached hash instead of being read again.
+func buildDirManifest(dir string, cached *DirManifest, cachedAt time.Time, logger *Logger) (*DirManifest, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &DirManifest{Canonicalization: CanonicalizationVersion, Generated: time.Now().UTC(), Files: make(map[string]DirManifestEntry)}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), MetadataFileSuffix) {
+			continue
+		}
+		if cached != nil && cached.Canonicalization == CanonicalizationVersion {
+			if old, ok := cached.Files[entry.Name()]; ok {
+				if info, err := entry.Info(); err == nil && info.Size() == old.Size && !info.ModTime().After(cachedAt) {
+					manifest.Files[entry.Name()] = old
+					continue
+				}
+			}
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		hash, err := ContentHash(data)
+		if err != nil {
+			logger.Warning("Leaving %s out of the directory manifest: %v", filepath.Join(dir, entry.Name()), err)
+			continue
+		}
+		manifest.Files[entry.Name()] = DirManifestEntry{ContentHash: hash, Size: int64(len(data))}
+	}
+	return manifest, nil
+}
+
+// writeDirManifest atomically writes the manifest into dir. Its mtime is set
+// after the rename, so that it is no older than the directory's mtime until
+// the directory changes again.
+func writeDirManifest(dir string, manifest *DirManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, DirManifestName)
+	temp := filepath.Join(dir, "."+DirManifestName+".tmp")
+	if err := fsWriteFile(temp, data, 0644); err != nil {
+		fsRemove(temp)
+		return err
+	}
+	if err := fsRename(temp, path); err != nil {
+		fsRemove(temp)
+		return err
+	}
+	now := time.Now()
+	return fsChtimes(path, now, now)
+}
+
+// DirManifestReport summarizes a directory manifest verification pass
+type DirManifestReport struct {
+	Checked   int           `json:"checked"`
+	Unchanged int           `json:"unchanged"`
+	OK        int           `json:"ok"`
+	Stale     int           `json:"stale"`
+	Fixed     int           `json:"fixed"`
+	Errors    int           `json:"errors"`
+	Duration  time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *DirManifestReport) SummaryLine() string {
+	return fmt.Sprintf("verify-dir-manifests: checked=%d unchanged=%d ok=%d stale=%d fixed=%d errors=%d dur=%s",
+		r.Checked, r.Unchanged, r.OK, r.Stale, r.Fixed, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// VerifyDirManifests walks each root for directories holding a manifest and
+// compares the manifest with the metadata files actually there, rewriting
+// stale manifests if fix is set. Directories not modified since their
+// manifest was written are skipped, as are files whose size and mtime show
+// they have not changed since; only new or modified files are hashed.
+func VerifyDirManifests(roots []string, fix bool, logger *Logger) (*DirManifestReport, error) {
+	logger.Info("Verifying directory manifests...")
+	startTime := time.Now()
+	report := &DirManifestReport{}
+
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if isTrashDir(info) {
+				return filepath.SkipDir
+			}
+			if info.IsDir() || info.Name() != DirManifestName {
+				return nil
+			}
+			dir := filepath.Dir(path)
+			report.Checked++
+
+			dirInfo, err := os.Stat(dir)
+			if err != nil {
+				logger.Error("Failed to stat %s: %v", dir, err)
+				report.Errors++
+				return nil
+			}
+			if !dirInfo.ModTime().After(info.ModTime()) {
+				report.Unchanged++
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(path)
+			var cached DirManifest
+			if err == nil {
+				err = json.Unmarshal(data, &cached)
+			}
+			if err != nil {
+				logger.Error("Failed to read manifest %s: %v", path, err)
+				report.Errors++
+				return nil
+			}
+
+			actual, err := buildDirManifest(dir, &cached, info.ModTime(), logger)
+			if err != nil {
+				logger.Error("Failed to list %s: %v", dir, err)
+				report.Errors++
+				return nil
+			}
+			drift := dirManifestDrift(&cached, actual)
+			if len(drift) == 0 {
+				report.OK++
+				// Refresh the mtime so the directory is skipped next time
+				if fix {
+					now := time.Now()
+					fsChtimes(path, now, now)
+				}
+				return nil
+			}
+
+			report.Stale++
+			logger.Warning("Stale manifest %s: %s", path, strings.Join(drift, "; "))
+			if fix {
+				if err := writeDirManifest(dir, actual); err != nil {
+					logger.Error("Failed to rewrite manifest %s: %v", path, err)
+					report.Errors++
+				} else {
+					report.Fixed++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error walking %s: %v", root, err)
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Checked %d directory manifests in %v: %d unchanged directories skipped, %d ok, %d stale, %d fixed",
+		report.Checked, report.Duration, report.Unchanged, report.OK, report.Stale, report.Fixed)
+	return report, nil
+}
+
+// dirManifestDrift describes how a manifest differs from the actual files
+func dirManifestDrift(manifest, actual *DirManifest) []string {
+	var drift []string
+	if manifest.Canonicalization != actual.Canonicalization {
+		drift = append(drift, fmt.Sprintf("canonicalization version %d, current %d", manifest.Canonicalization, actual.Canonicalization))
+	}
+	var added, removed, changed []string
+	for name, entry := range actual.Files {
+		old, ok := manifest.Files[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case old != entry:
+			changed = append(changed, name)
+		}
+	}
+	for name := range manifest.Files {
+		if _, ok := actual.Files[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for _, group := range []struct {
+		label string
+		names []string
+	}{{"unlisted", added}, {"deleted", removed}, {"changed", changed}} {
+		if len(group.names) > 0 {
+			sort.Strings(group.names)
+			drift = append(drift, group.label+" "+strings.Join(group.names, ", "))
+		}
+	}
+	return drift
+}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// archiveModTime is the timestamp of every file in an archive
+var archiveModTime = time.Unix(0, 0).UTC()
+
+// WriteArchive writes every metadata file under root to a gzipped tar at
+// path, reproducibly: files sorted by their slash-separated relative path,
+// contents in canonical JSON form (see CanonicalJSON), mode 0644, owner
+// 0:0 with no names, timestamps archiveModTime, and a gzip header with no
+// name, no mtime, and OS byte 255. The archive depends only on the relative
+// paths and canonical contents of the metadata files, and on the Go
+// version's compress/flate output. It returns the number of files archived
+// and the archive's SHA-256.
+func WriteArchive(path, root string) (int, string, error) {
+	var files []string
+	err := filepath.Walk(root, func(file string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isTrashDir(info) {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), MetadataFileSuffix) {
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("error walking %s: %v", root, err)
+	}
+	sort.Strings(files)
+
+	temp := path + ".tmp"
+	out, err := fsCreate(temp)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create archive: %v", err)
+	}
+	hash := sha256.New()
+	gz, _ := gzip.NewWriterLevel(io.MultiWriter(out, hash), gzip.BestCompression)
+	gz.OS = 255
+	tw := tar.NewWriter(gz)
+
+	fail := func(err error) (int, string, error) {
+		out.Close()
+		fsRemove(temp)
+		return 0, "", fmt.Errorf("failed to write archive: %v", err)
+	}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return fail(err)
+		}
+		canonical, err := CanonicalJSON(data)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v", name, err))
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(canonical)),
+			ModTime:  archiveModTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fail(err)
+		}
+		if _, err := tw.Write(canonical); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := gz.Close(); err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		fsRemove(temp)
+		return 0, "", fmt.Errorf("failed to write archive: %v", err)
+	}
+	if err := fsRename(temp, path); err != nil {
+		fsRemove(temp)
+		return 0, "", fmt.Errorf("failed to write archive: %v", err)
+	}
+	return len(files), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// PartialTransferSuffix marks a transfer destination that is still being
+// written. Files with this suffix are left behind only by interrupted
+// transfers and are removed by CleanupPartialTransfers.
+const PartialTransferSuffix = ".organize-partial"
+
+// TransferFile copies src to dst, or moves it if move is true, and returns
+// the SHA-256 of the transferred bytes. The source is hashed as it is copied
+// into a partial file beside dst, which is renamed into place only when
+// complete; with verify, the partial file is re-read and its hash compared
+// before that. A move tries a rename first and falls back to copy and delete
+// (for example across devices). The source is only removed once the
+// destination is in place, so an interrupted transfer leaves it intact.
+func TransferFile(src, dst string, move, verify bool, mode os.FileMode) (string, error) {
+	if move {
+		if err := fsRename(src, dst); err == nil {
+			if !verify {
+				return "", nil
+			}
+			return hashFile(dst)
+		}
+	}
+
+	partial := dst + PartialTransferSuffix
+	srcHash, err := copyHashed(src, partial, mode)
+	if err != nil {
+		fsRemove(partial)
+		return "", err
+	}
+
+	if verify {
+		dstHash, err := hashFile(partial)
+		if err != nil {
+			fsRemove(partial)
+			return "", fmt.Errorf("failed to verify %s: %v", partial, err)
+		}
+		if dstHash != srcHash {
+			fsRemove(partial)
+			return "", fmt.Errorf("verification failed for %s: source sha256 %s, destination sha256 %s", dst, srcHash, dstHash)
+		}
+	}
+
+	if err := fsRename(partial, dst); err != nil {
+		fsRemove(partial)
+		return "", err
+	}
+
+	if move {
+		if err := fsRemove(src); err != nil {
+			return srcHash, fmt.Errorf("copied %s but failed to remove source: %v", dst, err)
+		}
+	}
+	return srcHash, nil
+}
+
+// copyHashed copies src to dst, hashing the bytes as they are written, and
+// syncs dst before returning the hash
+func copyHashed(src, dst string, mode os.FileMode) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := fsOpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFile returns the hex SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// PublishReceiptName is the receipt Publish writes in the destination root
+const PublishReceiptName = ".organize-publish.json"
+
+// PublishProblem is a file Publish could not place in the destination
+type PublishProblem struct {
+	Path   string `json:"path"`
+	Want   string `json:"want_sha256,omitempty"`
+	Got    string `json:"got_sha256,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// PublishReceipt summarizes a publish
+type PublishReceipt struct {
+	Source      string           `json:"source"`
+	Destination string           `json:"destination"`
+	Manifest    string           `json:"manifest"`
+	Labels      Labels           `json:"labels,omitempty"`
+	Finished    time.Time        `json:"finished"`
+	Listed      int              `json:"listed"`
+	Copied      int              `json:"copied"`
+	Linked      int              `json:"linked"`
+	Unchanged   int              `json:"unchanged"`
+	Mismatched  int              `json:"mismatched"`
+	Deleted     int              `json:"deleted"`
+	Unmatched   int              `json:"unmatched,omitempty"`
+	Trash       string           `json:"trash,omitempty"`
+	Errors      int              `json:"errors"`
+	Problems    []PublishProblem `json:"problems,omitempty"`
+	Duration    time.Duration    `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the publish
+func (r *PublishReceipt) SummaryLine() string {
+	return fmt.Sprintf("publish: listed=%d copied=%d linked=%d unchanged=%d mismatched=%d deleted=%d unmatched=%d errors=%d dur=%s",
+		r.Listed, r.Copied, r.Linked, r.Unchanged, r.Mismatched, r.Deleted, r.Unmatched, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// Publish places the metadata files listed in a -manifest-out manifest,
+// found under source, at the same relative paths under dest. Each file is
+// hardlinked when source and dest share a filesystem and copied otherwise,
+// into a partial file that is renamed into place only if its SHA-256 is the
+// one the manifest recorded, so a failed or mismatched file leaves the
+// destination's previous version in place. Files listed as unchanged that
+// already exist in dest with the recorded size are left alone. If deletions
+// is set, the files of the crates in that -removed-report are removed from
+// dest, found through the layout of the source destination. A receipt is
+// written to PublishReceiptName in dest.
+func Publish(sourceDest *Destination, dest, manifestPath, deletions string, labels Labels, trash *Trash, mode, dirMode os.FileMode, logger *Logger) (*PublishReceipt, error) {
+	source := sourceDest.Root
+	logger.Info("Publishing %s to %s using the manifest %s...", source, dest, manifestPath)
+	startTime := time.Now()
+	receipt := &PublishReceipt{Source: source, Destination: dest, Manifest: manifestPath, Labels: labels}
+	problem := func(path, want, got, reason string) {
+		logger.Error("Failed to publish %s: %s", path, reason)
+		receipt.Problems = append(receipt.Problems, PublishProblem{Path: path, Want: want, Got: got, Reason: reason})
+	}
+
+	in, err := openArtifact(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer in.Close()
+	decoder := json.NewDecoder(bufio.NewReader(in))
+	for {
+		var entry ManifestEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %s: %v", manifestPath, err)
+		}
+		receipt.Listed++
+
+		rel, err := filepath.Rel(source, entry.Path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			receipt.Errors++
+			problem(entry.Path, "", "", fmt.Sprintf("not under %s", source))
+			continue
+		}
+		target := filepath.Join(dest, rel)
+		if info, err := os.Stat(target); err == nil {
+			// A target hardlinked to the source by an earlier publish is
+			// the same file, and renaming over it would be a no-op
+			sourceInfo, sourceErr := os.Stat(entry.Path)
+			if sourceErr == nil && os.SameFile(info, sourceInfo) || !entry.Changed && info.Size() == int64(entry.Size) {
+				receipt.Unchanged++
+				continue
+			}
+		}
+
+		if err := fsMkdirAll(filepath.Dir(target), dirMode); err != nil {
+			receipt.Errors++
+			problem(entry.Path, "", "", err.Error())
+			continue
+		}
+		partial := target + PartialTransferSuffix
+		fsRemove(partial)
+		linked := fsLink(entry.Path, partial) == nil
+		var got string
+		if linked {
+			got, err = hashFile(partial)
+		} else {
+			got, err = copyHashed(entry.Path, partial, mode)
+		}
+		if err != nil {
+			fsRemove(partial)
+			receipt.Errors++
+			problem(entry.Path, "", "", err.Error())
+			continue
+		}
+		if got != entry.SHA256 {
+			fsRemove(partial)
+			receipt.Mismatched++
+			problem(entry.Path, entry.SHA256, got, "content differs from the manifest")
+			continue
+		}
+		if err := fsRename(partial, target); err != nil {
+			fsRemove(partial)
+			receipt.Errors++
+			problem(entry.Path, "", "", err.Error())
+			continue
+		}
+		if linked {
+			receipt.Linked++
+		} else {
+			receipt.Copied++
+		}
+	}
+
+	if deletions != "" {
+		receipt.Trash = filepath.Join(trash.Root, TrashDirName, trash.RunID)
+		data, err := ioutil.ReadFile(deletions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deletions: %v", err)
+		}
+		var removed RemovedReport
+		if err := json.Unmarshal(data, &removed); err != nil {
+			return nil, fmt.Errorf("failed to parse deletions %s: %v", deletions, err)
+		}
+		var byName map[string][]string
+		for _, file := range removed.Files {
+			if err := checkPathComponents(file.Crate, file.Version); err != nil {
+				receipt.Errors++
+				problem(file.Path, "", "", fmt.Sprintf("invalid deletion: %v", err))
+				continue
+			}
+
+			// The crate file is only in dest when the source is the mirror
+			var targets []string
+			if isWithin(source, file.Path) {
+				rel, _ := filepath.Rel(source, file.Path)
+				targets = append(targets, filepath.Join(dest, rel))
+			}
+
+			// The metadata file is where the source layout put it; the date
+			// layout may need a publish date the report does not record, so
+			// failing that it is looked up by name anywhere in dest
+			name := file.Crate + "-" + file.Version + MetadataFileSuffix
+			metadataFile := filepath.Join(sourceDest.Dest.Dir(file.Path, MetadataEntry{"name": file.Crate, "vers": file.Version}), name)
+			found := false
+			if isWithin(source, metadataFile) {
+				rel, _ := filepath.Rel(source, metadataFile)
+				if _, err := os.Lstat(filepath.Join(dest, rel)); err == nil {
+					targets = append(targets, filepath.Join(dest, rel))
+					found = true
+				}
+			}
+			if !found {
+				if byName == nil {
+					if byName, err = publishedByName(dest); err != nil {
+						return nil, err
+					}
+				}
+				targets = append(targets, byName[name]...)
+			}
+
+			deleted := 0
+			for _, path := range targets {
+				if err := trash.Remove(path); err == nil {
+					logger.Info("Moved %s to the trash, removed upstream", path)
+					receipt.Deleted++
+					deleted++
+				} else if !os.IsNotExist(err) {
+					receipt.Errors++
+					problem(path, "", "", fmt.Sprintf("failed to delete: %v", err))
+				}
+			}
+			if deleted == 0 {
+				logger.Warning("No published file found for %s %s, removed upstream", file.Crate, file.Version)
+				receipt.Unmatched++
+				receipt.Problems = append(receipt.Problems, PublishProblem{Path: file.Path, Reason: "removed upstream, but no published file was found for it"})
+			}
+		}
+	}
+
+	receipt.Finished = time.Now().UTC()
+	receipt.Duration = time.Since(startTime)
+	data, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return receipt, err
+	}
+	receiptPath := filepath.Join(dest, PublishReceiptName)
+	if err := fsWriteFile(receiptPath, append(data, '\n'), 0644); err != nil {
+		return receipt, fmt.Errorf("failed to write publish receipt: %v", err)
+	}
+	logger.Info("Published %d of %d files (%d linked, %d unchanged, %d mismatched, %d errors); receipt in %s",
+		receipt.Copied+receipt.Linked, receipt.Listed, receipt.Linked, receipt.Unchanged, receipt.Mismatched, receipt.Errors, receiptPath)
+	return receipt, nil
+}
+
+// publishedByName maps the names of the metadata files under a publish root
+// to their paths, leaving out the trash
+func publishedByName(root string) (map[string][]string, error) {
+	byName := make(map[string][]string)
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isTrashDir(info) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), MetadataFileSuffix) {
+			byName[info.Name()] = append(byName[info.Name()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %v", root, err)
+	}
+	return byName, nil
+}
+
+// CleanupPartialTransfers removes partial files left under root by
+// interrupted transfers and returns how many were (or in dry-run mode
+// would be) removed. Partial files are incomplete copies, so they are
+// deleted rather than staged in the trash.
+func CleanupPartialTransfers(root string, dryRun bool, logger *Logger) (int, error) {
+	removed := 0
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isTrashDir(info) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), PartialTransferSuffix) {
+			return nil
+		}
+
+		if dryRun {
+			logger.Info("DRY RUN: Would remove partial transfer %s", path)
+		} else if err := fsRemove(path); err != nil {
+			logger.Error("Failed to remove partial transfer %s: %v", path, err)
+			return nil
+		} else {
+			logger.Info("Removed partial transfer %s", path)
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("error walking %s: %v", root, err)
+	}
+	return removed, nil
+}
+
+// LocalRegistryIndexDir is the index directory inside a cargo local registry
+const LocalRegistryIndexDir = "index"
+
+// ExportReport summarizes a -export-local-registry pass
+type ExportReport struct {
+	Crates   int           `json:"crates"`
+	Versions int           `json:"versions"`
+	Linked   int           `json:"linked"`
+	Copied   int           `json:"copied"`
+	Skipped  int           `json:"skipped"`
+	Invalid  int           `json:"invalid"`
+	Errors   int           `json:"errors"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *ExportReport) SummaryLine() string {
+	return fmt.Sprintf("export-local-registry: crates=%d versions=%d linked=%d copied=%d skipped=%d invalid=%d errors=%d dur=%s",
+		r.Crates, r.Versions, r.Linked, r.Copied, r.Skipped, r.Invalid, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// ExportLocalRegistry writes a cargo local registry to outDir: the .crate
+// files of the requested crates (all crates if names is empty) flat in
+// outDir, hardlinked where possible and copied otherwise, and an index/
+// directory holding only the entries whose crate file is present and
+// matches its cksum. Entries get the transforms a run applies (the entry
+// filter, -normalize-schema and -strip-fields), and names and versions that
+// are not plain path components are skipped as invalid. The result is then
+// checked the way cargo reads it.
+func ExportLocalRegistry(opts *Options, outDir string, names []string, logger *Logger) (*ExportReport, error) {
+	logger.Info("Exporting local registry to %s...", outDir)
+	startTime := time.Now()
+
+	// cargo cannot use entries without these
+	for _, field := range opts.StripFields {
+		if field == "name" || field == "vers" || field == "cksum" {
+			return nil, fmt.Errorf("cannot strip %q from a local registry's index, which cargo reads it from", field)
+		}
+	}
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output directory %s: %v", outDir, err)
+	}
+
+	crateIndex, err := BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, nil, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+	metadataFiles, err := FindMetadataFiles(opts.IndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find metadata files: %v", err)
+	}
+	if opts.LocalIndexDir != "" {
+		localFiles, err := FindMetadataFiles(opts.LocalIndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find local metadata files: %v", err)
+		}
+		metadataFiles = append(metadataFiles, localFiles...)
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(name)] = true
+	}
+
+	// Collect each crate's entries in index order; local files come last
+	// and replace the upstream entry for the same version
+	type exportEntry struct {
+		version string
+		entry   MetadataEntry
+	}
+	crates := make(map[string][]exportEntry)
+	var order []string
+	report := &ExportReport{}
+	for _, file := range metadataFiles {
+		fileName := strings.ToLower(filepath.Base(file.Path))
+		if len(wanted) > 0 && !wanted[fileName] && !opts.CrateIDMode {
+			continue
+		}
+		entries, err := readIndexEntries(file.Path)
+		if err != nil {
+			logger.Error("Failed to read metadata file %s: %v", file.Path, err)
+			report.Errors++
+			continue
+		}
+	entries:
+		for _, entry := range entries {
+			version, _ := entry["vers"].(string)
+			if version == "" {
+				continue
+			}
+			// Index files named by ID hold the crate's name in each entry
+			crateName := fileName
+			if opts.CrateIDMode {
+				crateName = strings.ToLower(entry.Name())
+				if len(wanted) > 0 && !wanted[crateName] {
+					continue
+				}
+			}
+			if opts.EntryFilter != nil && !opts.EntryFilter(entry) {
+				continue
+			}
+			if _, ok := crates[crateName]; !ok {
+				order = append(order, crateName)
+				crates[crateName] = nil
+			}
+			for i, existing := range crates[crateName] {
+				if existing.version == version {
+					crates[crateName][i].entry = entry
+					continue entries
+				}
+			}
+			crates[crateName] = append(crates[crateName], exportEntry{version, entry})
+		}
+	}
+	for name := range wanted {
+		if _, ok := crates[name]; !ok {
+			logger.Warning("Crate %s is not in the index", name)
+			report.Errors++
+		}
+	}
+	sort.Strings(order)
+
+	if err := fsMkdirAll(filepath.Join(outDir, LocalRegistryIndexDir), opts.DirMode); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", outDir, err)
+	}
+
+	for _, crateName := range order {
+		var lines []string
+		for _, candidate := range crates[crateName] {
+			entry, version := candidate.entry, candidate.version
+			name, _ := entry["name"].(string)
+			if name == "" {
+				name = crateName
+			}
+			if err := exportablePath(absOut, name, version); err != nil {
+				logger.Warning("Skipping %s %s: %v", name, version, err)
+				report.Invalid++
+				continue
+			}
+			if opts.Prereleases == PrereleasesSkip {
+				if parsed, err := indexentry.ParseVersion(version); err == nil && parsed.IsPrerelease() {
+					continue
+				}
+			}
+			if opts.MinVersions.Below(name, version) {
+				continue
+			}
+
+			src, present := crateIndex[name+"-"+version+".crate"]
+			for _, alias := range opts.RenameMap.Aliases(name) {
+				if present {
+					break
+				}
+				src, present = crateIndex[alias+"-"+version+".crate"]
+			}
+			if !present {
+				report.Skipped++
+				logger.Debug("Skipping %s %s: no crate file", name, version)
+				continue
+			}
+
+			// cargo rejects a crate file whose checksum differs from the index
+			cksum, _ := entry["cksum"].(string)
+			actual, err := hashFile(src)
+			if err != nil {
+				logger.Error("Failed to hash %s: %v", src, err)
+				report.Errors++
+				continue
+			}
+			if !strings.EqualFold(actual, cksum) {
+				logger.Warning("Skipping %s %s: index cksum %s, file has %s", name, version, cksum, actual)
+				report.Invalid++
+				continue
+			}
+
+			linked, err := placeRegistryCrate(src, filepath.Join(outDir, name+"-"+version+".crate"), opts.FileMode)
+			if err != nil {
+				logger.Error("Failed to export %s: %v", src, err)
+				report.Errors++
+				continue
+			}
+			if linked {
+				report.Linked++
+			} else {
+				report.Copied++
+			}
+
+			// Export what a run would write, without its _local block
+			if opts.NormalizeSchema {
+				normalizeSchema(entry)
+			}
+			for _, path := range opts.StripFields {
+				stripField(entry, strings.Split(path, "."))
+			}
+			line, err := json.Marshal(entry)
+			if err != nil {
+				logger.Error("Failed to encode %s %s: %v", name, version, err)
+				report.Errors++
+				continue
+			}
+			lines = append(lines, string(line))
+			report.Versions++
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		indexPath := filepath.Join(outDir, LocalRegistryIndexDir, filepath.FromSlash(indexentry.IndexPath(crateName)))
+		if err := fsMkdirAll(filepath.Dir(indexPath), opts.DirMode); err != nil {
+			logger.Error("Failed to create %s: %v", filepath.Dir(indexPath), err)
+			report.Errors++
+			continue
+		}
+		if err := fsWriteFile(indexPath, []byte(strings.Join(lines, "\n")+"\n"), opts.FileMode); err != nil {
+			logger.Error("Failed to write %s: %v", indexPath, err)
+			report.Errors++
+			continue
+		}
+		report.Crates++
+	}
+
+	problems, err := VerifyLocalRegistry(outDir, logger)
+	if err != nil {
+		return nil, err
+	}
+	report.Errors += problems
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Exported %d versions of %d crates in %v", report.Versions, report.Crates, report.Duration)
+	return report, nil
+}
+
+// exportablePath checks that a crate name and version make a crate file
+// name that stays directly in a local registry at absOut
+func exportablePath(absOut, name, version string) error {
+	if err := indexentry.ValidateName(name); err != nil {
+		return err
+	}
+	if err := checkPathComponents(name, version); err != nil {
+		return err
+	}
+	if dst := filepath.Join(absOut, name+"-"+version+".crate"); filepath.Dir(dst) != absOut {
+		return fmt.Errorf("%s is outside %s", dst, absOut)
+	}
+	return nil
+}
+
+// placeRegistryCrate hardlinks src to dst, falling back to a copy when
+// they are on different filesystems. A dst that is already src is left
+// alone. It reports whether dst is a hardlink.
+func placeRegistryCrate(src, dst string, mode os.FileMode) (bool, error) {
+	if dstInfo, err := os.Stat(dst); err == nil {
+		if srcInfo, err := os.Stat(src); err == nil && os.SameFile(srcInfo, dstInfo) {
+			return true, nil
+		}
+		if err := fsRemove(dst); err != nil {
+			return false, err
+		}
+	}
+	if err := fsLink(src, dst); err == nil {
+		return true, nil
+	}
+	temp := dst + PartialTransferSuffix
+	if _, err := copyHashed(src, temp, mode); err != nil {
+		fsRemove(temp)
+		return false, err
+	}
+	if err := fsRename(temp, dst); err != nil {
+		fsRemove(temp)
+		return false, err
+	}
+	return false, nil
+}
+
+// VerifyLocalRegistry checks a local registry the way cargo reads it:
+// every index entry must have its {name}-{version}.crate file beside the
+// index directory. It logs and returns the number of entries without one.
+func VerifyLocalRegistry(dir string, logger *Logger) (int, error) {
+	indexDir := filepath.Join(dir, LocalRegistryIndexDir)
+	problems := 0
+	err := filepath.Walk(indexDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == "config.json" || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		entries, err := readIndexEntries(path)
+		if err != nil {
+			logger.Error("Failed to read %s: %v", path, err)
+			problems++
+			return nil
+		}
+		for _, entry := range entries {
+			name, _ := entry["name"].(string)
+			version, _ := entry["vers"].(string)
+			if _, err := os.Stat(filepath.Join(dir, name+"-"+version+".crate")); err != nil {
+				logger.Error("Local registry entry %s %s has no crate file", name, version)
+				problems++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return problems, fmt.Errorf("failed to verify local registry %s: %v", dir, err)
+	}
+	return problems, nil
+}
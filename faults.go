@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultsEnvVar names the environment variable that configures fault
+// injection. It is deliberately not a flag, so it never appears in -help,
+// and only builds with the faults tag and the tests read it; see faultSpec.
+const FaultsEnvVar = "ORGANIZE_FAULTS"
+
+// faultSpec returns the fault injection spec for a run. Release builds
+// inject no faults whatever the environment says; building with -tags
+// faults makes it read FaultsEnvVar, as the test binary always does.
+var faultSpec = func() string { return "" }
+
+// FaultInjector makes file writes and index reads misbehave on purpose,
+// so that retries, atomicity, and recovery can be exercised before they are
+// trusted. It is configured from a comma-separated spec such as
+//
+//	seed=42,write-fail=0.05,read-delay=10ms,enospc-after=1048576,kill-after-writes=100
+//
+// write-fail fails that fraction of writes, read-delay sleeps before each
+// index file read, enospc-after fails writes with ENOSPC once that many bytes
+// have been written (writing the part that fits first, as a full disk
+// would), and kill-after-writes kills the process immediately after that
+// many writes and renames. Writes are faulted in the fs* wrappers, so every
+// file the organizer writes with fsWriteFile is affected. Random choices come from a seeded generator, so a run with the
+// same spec and input fails the same way. A nil FaultInjector injects nothing.
+type FaultInjector struct {
+	Spec            string
+	WriteFailRate   float64
+	ReadDelay       time.Duration
+	ENOSPCAfter     int64
+	KillAfterWrites int64
+
+	mu      sync.Mutex
+	rng     *mathrand.Rand
+	bytes   int64
+	writes  int64
+	crashed bool
+}
+
+// ParseFaults parses a fault injection spec
+func ParseFaults(spec string) (*FaultInjector, error) {
+	f := &FaultInjector{Spec: spec}
+	seed := int64(1)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid fault %q (expected key=value)", part)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		case "write-fail":
+			f.WriteFailRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (f.WriteFailRate < 0 || f.WriteFailRate > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "read-delay":
+			f.ReadDelay, err = time.ParseDuration(value)
+		case "enospc-after":
+			f.ENOSPCAfter, err = strconv.ParseInt(value, 10, 64)
+		case "kill-after-writes":
+			f.KillAfterWrites, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %s: %v", part, err)
+		}
+	}
+	f.rng = mathrand.New(mathrand.NewSource(seed))
+	return f, nil
+}
+
+// BeforeRead delays an index file read, returning early if ctx is done
+func (f *FaultInjector) BeforeRead(ctx context.Context) {
+	if f == nil || f.ReadDelay <= 0 {
+		return
+	}
+	timer := time.NewTimer(f.ReadDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// beforeWrite decides the fault for a write of n bytes: an injected
+// failure, or how many of the bytes fit before the disk is full
+func (f *FaultInjector) beforeWrite(n int) (int, error) {
+	if f == nil {
+		return n, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.WriteFailRate > 0 && f.rng.Float64() < f.WriteFailRate {
+		return 0, fmt.Errorf("injected write failure")
+	}
+	allowed := int64(n)
+	if f.ENOSPCAfter > 0 && f.bytes+allowed > f.ENOSPCAfter {
+		allowed = f.ENOSPCAfter - f.bytes
+		if allowed < 0 {
+			allowed = 0
+		}
+	}
+	f.bytes += allowed
+	return int(allowed), nil
+}
+
+// afterWrite counts a completed write, killing the process once
+// kill-after-writes is reached
+func (f *FaultInjector) afterWrite() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.writes++
+	kill := f.KillAfterWrites > 0 && f.writes >= f.KillAfterWrites && !f.crashed
+	f.crashed = f.crashed || kill
+	f.mu.Unlock()
+	if kill {
+		fmt.Fprintf(os.Stderr, "fault injection: killing process after %d writes\n", f.KillAfterWrites)
+		if process, err := os.FindProcess(os.Getpid()); err == nil {
+			process.Kill()
+		}
+		os.Exit(137)
+	}
+}
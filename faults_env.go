@@ -0,0 +1,12 @@
+//go:build faults
+// +build faults
+
+package main
+
+import "os"
+
+// Builds with the faults tag take their fault injection spec from the
+// environment, for testing recovery outside the tests
+func init() {
+	faultSpec = func() string { return os.Getenv(FaultsEnvVar) }
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runFlags holds the command line flags of one run
+type runFlags struct {
+	*flag.FlagSet
+	indexDir            *string
+	sourceFormat        *string
+	mirrorDir           *string
+	logPath             *string
+	registriesPath      *string
+	registrySelection   *string
+	threads             *int
+	dryRun              *bool
+	noIgnoreFile        *bool
+	outputDirs          stringList
+	s3Bucket            *string
+	s3Prefix            *string
+	s3Endpoint          *string
+	layout              *string
+	dateLayout          *bool
+	fileMode            *string
+	dirMode             *string
+	renameMapPath       *string
+	diff                *bool
+	planFile            *string
+	missingBaseline     *string
+	resetBaseline       *bool
+	crateNamesBaseline  *string
+	removedReport       *string
+	quarantineRemoved   *string
+	parseCacheDir       *string
+	compactBudget       *time.Duration
+	compactCache        *string
+	checkpointPath      *string
+	snapshotPath        *string
+	trackCrateFiles     *bool
+	allowSymlinkEscape  *bool
+	minVersion          *string
+	globalMinVersion    *string
+	latestN             *int
+	prereleases         *string
+	stripFields         *string
+	normalizeSchema     *bool
+	checkNames          *bool
+	validateDeps        *bool
+	daemon              *bool
+	scheduleSpec        *string
+	statusAddr          *string
+	backfillState       *string
+	backfillInterval    *time.Duration
+	backfillMax         *int
+	backfillWindow      *time.Duration
+	order               *string
+	timeout             *time.Duration
+	etaSmoothing        *float64
+	perFileTimeout      *time.Duration
+	sanityThreshold     *float64
+	abortOnSanity       *bool
+	thenVerify          *bool
+	resultsSocket       *string
+	cpuProfile          *string
+	memProfile          *string
+	verifyOnly          *bool
+	verifyChecksum      *bool
+	verifyWorkers       *int
+	otelEndpoint        *string
+	otelSample          *float64
+	otelSlow            *time.Duration
+	labels              Labels
+	runIDFlag           *string
+	envOut              *string
+	githubOutput        *bool
+	dirManifests        *bool
+	manifestOut         *string
+	compressManifest    *bool
+	compressReport      *bool
+	categoriesLog       *bool
+	categoriesOut       *string
+	categoriesTop       *int
+	aggregate           *bool
+	verifyDirManifests  *bool
+	fix                 *bool
+	publish             *string
+	publishManifest     *string
+	publishDeletions    *string
+	deleteRemoved       *bool
+	verifyAggregate     *bool
+	listMissing         *bool
+	listMissingOut      *string
+	listMissingFormat   *string
+	listMissingYanked   *bool
+	chunkSize           *int
+	dumpEntry           *string
+	exportLocalRegistry *string
+	exportCrates        *string
+	skipIfSynced        *bool
+	rawLine             *string
+	verifyRawLines      *bool
+	mergeReport         *bool
+	mergeOut            *string
+	latestLinks         *bool
+	latestFallback      *string
+	strictJSON          *bool
+	crateIDMode         *bool
+	retryPasses         *int
+	retryDelay          *time.Duration
+	checkCollisions     *bool
+	checkCaseCollisions *bool
+	disambiguateCase    *bool
+	checkConfig         *bool
+	failOnBadConfig     *bool
+	verifyIndexManifest *string
+	failOnCollision     *bool
+	bootstrapSources    stringList
+	bootstrapWorkers    *int
+	bootstrapRate       *int64
+	lockfilePath        *string
+	indexMaxDepth       *int
+	indexMaxFiles       *int
+	followIndexSymlinks *bool
+	shardExpr           *string
+	reportPaths         stringList
+	archiveOut          *string
+	summaryJSON         *string
+	summarySchema       *string
+	htmlReport          *string
+	outputsZero         *string
+	treeOut             *string
+	localIndexDir       *string
+	debug               *bool
+	asyncLog            *string
+	compactIndexOut     *string
+	mtimeSkew           *time.Duration
+	fixMtimes           *bool
+	skipUnchanged       *bool
+	preserveSymlinks    *bool
+	writersPerDir       *int
+	maxFilesPerDir      *int
+	lockPath            *string
+	emptyTrash          *string
+	trashRetention      *time.Duration
+	restore             *string
+	repairPermissions   *bool
+	reconcile           *bool
+	reconcileRewrite    *bool
+	reconcileKeep       *string
+	reconcileOut        *string
+	readOnly            *bool
+	reportDir           *string
+}
+
+// newRunFlags declares the flags of a run, with their defaults and usage
+func newRunFlags() *runFlags {
+	flags := &runFlags{FlagSet: flag.NewFlagSet(os.Args[0], flag.ExitOnError)}
+	flags.indexDir = flags.String("index-dir", "E:\\crates.io-index", "Directory containing the crates.io index")
+	flags.sourceFormat = flags.String("source-format", SourceFormatAuto, "Index format: auto, git (checkout), sparse (plain JSON-lines snapshot), or sparse-cache (cargo's .cache files)")
+	flags.mirrorDir = flags.String("mirror-dir", "E:\\crates-mirror", "Directory containing the mirrored crates")
+	flags.logPath = flags.String("log-path", "E:\\metadata-organize-log.txt", "Path to log file")
+	flags.registriesPath = flags.String("registries", "", "JSON file of registries (name, index_dir, mirror_dir, output_dirs, args) to organize one after another, each kept separate")
+	flags.registrySelection = flags.String("registry", "", "Comma-separated names of the -registries to organize; all if empty")
+	flags.threads = flags.Int("threads", runtime.NumCPU(), "Number of worker threads")
+	flags.dryRun = flags.Bool("dry-run", false, "Dry run mode (no files will be created)")
+	flags.noIgnoreFile = flags.Bool("no-ignore-file", false, "Ignore the mirror's "+IgnoreFileName+" file and scan everything")
+	flags.Var(&flags.outputDirs, "output-dir", "Directory to write metadata files under instead of next to the crate files (repeatable)")
+	flags.s3Bucket = flags.String("s3-bucket", "", "Put metadata documents into this S3-compatible bucket, as another destination beside any -output-dir (instead of the mirror)")
+	flags.s3Prefix = flags.String("s3-prefix", "", "Key prefix for -s3-bucket objects")
+	flags.s3Endpoint = flags.String("s3-endpoint", "", "S3 endpoint URL for -s3-bucket (default $AWS_ENDPOINT_URL_S3, $AWS_ENDPOINT_URL, or AWS)")
+	flags.layout = flags.String("layout", LayoutBeside, "Output layout: beside (mirror the crate directories), flat, or date (YYYY/MM/ by publish date)")
+	flags.dateLayout = flags.Bool("date-layout", false, "Shorthand for -layout date")
+	flags.fileMode = flags.String("file-mode", "0644", "Permission bits (octal) for written metadata files")
+	flags.dirMode = flags.String("dir-mode", "0755", "Permission bits (octal) for directories created for metadata files")
+	flags.renameMapPath = flags.String("rename-map", "", "JSON or CSV file of old-name,new-name crate renames to retry lookups under")
+	flags.diff = flags.Bool("diff", false, "In dry-run mode, show field-level changes against existing metadata files")
+	flags.planFile = flags.String("plan-file", "", "Path to write the dry-run diff plan to")
+	flags.missingBaseline = flags.String("missing-baseline", "", "File of the versions missing in the last complete run; only changes from it are warned about")
+	flags.resetBaseline = flags.Bool("reset-baseline", false, "Start the -missing-baseline and -crate-names-baseline afresh instead of comparing against them")
+	flags.crateNamesBaseline = flags.String("crate-names-baseline", "", "File of the crate names in the index at the last run; the mirrored files of crates removed since are reported")
+	flags.removedReport = flags.String("removed-report", "", "Write the crates removed upstream but still mirrored, with their files and sizes, as JSON to this file (requires -crate-names-baseline)")
+	flags.quarantineRemoved = flags.String("quarantine-removed", "", "Move the mirrored files of crates removed upstream to this directory, keeping their mirror paths (requires -crate-names-baseline)")
+	flags.parseCacheDir = flags.String("parse-cache", "", "Directory caching parsed index files by content hash, so unchanged files are not parsed again")
+	flags.compactBudget = flags.Duration("compact-cache-budget", DefaultCompactBudget, "Time a run that read every index file may spend removing dead -parse-cache entries afterwards (0 disables); with -compact-cache, the time limit (default none)")
+	flags.compactCache = flags.String("compact-cache", "", "Only remove the entries of this parse cache that no current index file uses, and exit")
+	flags.checkpointPath = flags.String("checkpoint", "", "Checkpoint file of progress and counts; an interrupted run resumes from it and reports on the whole job")
+	flags.snapshotPath = flags.String("snapshot", "", "Snapshot file of index file hashes; crates unchanged since the last run are skipped")
+	flags.trackCrateFiles = flags.Bool("track-crate-files", false, "Record each crate file's size and mtime in the metadata; with -snapshot, crates whose files changed in the mirror are processed again")
+	flags.allowSymlinkEscape = flags.Bool("allow-symlink-escape", false, "Allow writing through symlinked crate directories that point outside the mirror")
+	flags.minVersion = flags.String("min-version", "", "Comma-separated crate=version floors; versions of those crates below the floor are skipped (e.g. serde=1.0.0,rand=0.8.0)")
+	flags.globalMinVersion = flags.String("global-min-version", "", "Skip versions below this semver version for every crate without a -min-version floor of its own")
+	flags.latestN = flags.Int("latest-n", 0, "Organize only the N highest semver versions of each crate, skipping older ones; prereleases don't take a place when -prereleases is skip (0 = all)")
+	flags.prereleases = flags.String("prereleases", PrereleasesInclude, "Prerelease versions: include them, skip them, or write them to a separate prerelease/ subdirectory")
+	flags.stripFields = flags.String("strip-fields", "", "Comma-separated fields to remove from every entry before writing; dotted paths reach nested fields (e.g. deps.registry)")
+	flags.normalizeSchema = flags.Bool("normalize-schema", false, "Rewrite v1 and v2 index entries into one form: features2 merged into features and \"v\" set to 2")
+	flags.checkNames = flags.Bool("check-names", false, "Flag versions whose metadata \"name\" disagrees with the name in their crate file's name (ignored with -crate-id-mode)")
+	flags.validateDeps = flags.Bool("validate-deps", false, "Flag versions whose dependency requirements are not valid semver requirements")
+	flags.daemon = flags.Bool("daemon", false, "Run continuously, organizing on the -schedule until SIGTERM")
+	flags.scheduleSpec = flags.String("schedule", "1h", "Daemon schedule: an interval such as 30m, or a 5-field cron expression")
+	flags.statusAddr = flags.String("status-addr", "", "Address (e.g. :9090) to serve /status and /metrics on in daemon mode")
+	flags.backfillState = flags.String("backfill-state", "", "File persisting the versions recently found missing; in daemon mode, each is organized as soon as its crate file appears")
+	flags.backfillInterval = flags.Duration("backfill-interval", time.Minute, "How often the daemon looks for the crate files of recently missing versions between runs")
+	flags.backfillMax = flags.Int("backfill-max", 10000, "Most versions to remember as recently missing; the least recently reported are forgotten first")
+	flags.backfillWindow = flags.Duration("backfill-window", 24*time.Hour, "Forget versions that have not been reported missing for this long")
+	flags.order = flags.String("order", OrderWalk, "Order to process index files in: walk, size-desc (largest first), name, or mtime-desc (newest first)")
+	flags.timeout = flags.Duration("timeout", 0, "Stop dispatching new index files after this long (e.g. 2h); 0 means no limit")
+	flags.etaSmoothing = flags.Float64("eta-smoothing", DefaultETASmoothing, "Weight (0-1] of the latest second's rate in the moving average of versions per second behind the progress ETA; higher reacts faster")
+	flags.perFileTimeout = flags.Duration("per-file-timeout", 0, "Abandon an index file that takes longer than this to process (e.g. 30s), counting it as an error; 0 means no limit")
+	flags.sanityThreshold = flags.Float64("sanity-threshold", 95, "Warn that the index and mirror look mismatched if more than this percentage of the first versions are missing; 0 disables the check")
+	flags.abortOnSanity = flags.Bool("abort-on-sanity", false, "Stop the run, exiting with status 3, if the -sanity-threshold check fails")
+	flags.thenVerify = flags.Bool("then-verify", false, "After a complete run, verify checksums and whatever else the run wrote (raw lines, bundles, directory manifests), exiting with status 4 if verification fails")
+	flags.resultsSocket = flags.String("results-socket", "", "Unix socket to stream per-file results and progress to as JSON lines")
+	flags.cpuProfile = flags.String("cpuprofile", "", "Write a CPU profile to this file")
+	flags.memProfile = flags.String("memprofile", "", "Write a heap profile to this file at the end of the run")
+	flags.verifyOnly = flags.Bool("verify-only", false, "Only verify crate files against the index checksums, without organizing")
+	flags.verifyChecksum = flags.Bool("verify-checksum", false, "Hash each matched crate file while organizing; versions whose SHA-256 differs from the entry's cksum are logged, not written, and counted as failed")
+	flags.verifyWorkers = flags.Int("verify-workers", runtime.NumCPU(), "Number of checksum verification workers, independent of -threads")
+	flags.otelEndpoint = flags.String("otel-endpoint", "", "OpenTelemetry collector to export traces to over OTLP/HTTP, e.g. http://localhost:4318")
+	flags.otelSample = flags.Float64("otel-sample", 0.01, "Fraction of index files to export spans for")
+	flags.otelSlow = flags.Duration("otel-slow", time.Second, "Always export spans for index files that take at least this long")
+	flags.labels = make(Labels)
+	flags.Var(flags.labels, "label", "Annotate the run with a key=value label, recorded in the log, summary JSON, reports, publish receipt, and checkpoint (repeatable)")
+	flags.runIDFlag = flags.String("run-id", "", "ID for this run in logs, reports, and the lock file (default: a generated ULID)")
+	flags.envOut = flags.String("env-out", "", "Append processed, linked, missing, errors, and duration_seconds as key=value lines to this file")
+	flags.githubOutput = flags.Bool("github-output", false, "Append the -env-out lines to the file named by $GITHUB_OUTPUT")
+	flags.dirManifests = flags.Bool("dir-manifests", false, "Write an "+DirManifestName+" manifest of content hashes in every directory metadata files are written to")
+	flags.manifestOut = flags.String("manifest-out", "", "Write an NDJSON manifest of the path, SHA-256, and size of every metadata file written or unchanged (gzipped if the name ends in .gz)")
+	flags.compressManifest = flags.Bool("compress-manifest", false, "Gzip the manifest even if its name does not end in .gz")
+	flags.compressReport = flags.Bool("compress-report", false, "Gzip the -report-out reports even if their names do not end in .gz")
+	flags.categoriesLog = flags.Bool("categories", false, "Tally crates per category and keyword and log the top ones")
+	flags.categoriesOut = flags.String("categories-out", "", "Write the category and keyword tally to this JSON file (implies -categories)")
+	flags.categoriesTop = flags.Int("categories-top", 50, "Number of categories and keywords to list in -categories-out; 0 lists all")
+	flags.aggregate = flags.Bool("aggregate", false, "Merge each crate's organized versions into a per-crate "+BundleSuffix+" bundle, sorted by semver")
+	flags.verifyDirManifests = flags.Bool("verify-dir-manifests", false, "Only check the "+DirManifestName+" directory manifests against the metadata files beside them")
+	flags.fix = flags.Bool("fix", false, "With -verify-dir-manifests, rewrite the stale manifests")
+	flags.publish = flags.String("publish", "", "Only publish the organized metadata files listed in -publish-manifest to this destination root, hash-verified, writing a receipt there")
+	flags.publishManifest = flags.String("publish-manifest", "", "The -manifest-out manifest of the run whose files -publish copies")
+	flags.publishDeletions = flags.String("publish-deletions", "", "The -removed-report of removed crates whose files -delete removes from the -publish destination")
+	flags.deleteRemoved = flags.Bool("delete", false, "With -publish, delete the files of the crates in -publish-deletions from the destination")
+	flags.verifyAggregate = flags.Bool("verify-aggregate", false, "Only check that each crate's bundle matches its current index entries for present versions")
+	flags.listMissing = flags.Bool("list-missing", false, "Only list the index versions missing from the mirror as tab-separated name, version, and download URL")
+	flags.listMissingOut = flags.String("list-missing-out", "-", "Where to write the -list-missing list (- for stdout)")
+	flags.listMissingFormat = flags.String("list-missing-format", MissingFormatTSV, "Format of the -list-missing list: tsv, aria2 (an aria2c -i input file), or curl (a curl --config file)")
+	flags.listMissingYanked = flags.Bool("list-missing-yanked", false, "Include yanked versions in the -list-missing list")
+	flags.chunkSize = flags.Int("chunk-size", 0, "Split the -list-missing list into files of this many versions, numbered before the extension of -list-missing-out")
+	flags.dumpEntry = flags.String("dump-entry", "", "Only print the parsed entry, expected crate file, and destination paths of this crate at the version given as the first argument, as JSON")
+	flags.exportLocalRegistry = flags.String("export-local-registry", "", "Only export the present crate versions as a cargo local registry (flat .crate files plus index/) in this directory")
+	flags.exportCrates = flags.String("export-crates", "", "Comma-separated crates to export with -export-local-registry; all crates if empty")
+	flags.skipIfSynced = flags.Bool("skip-if-synced", false, "Exit without scanning if the index is unchanged since the last fully successful run, recorded in "+StateFileName)
+	flags.rawLine = flags.String("record-raw-line", "", "Record each entry's source index line in the _local block: hash (its SHA-256) or full (the line and its hash)")
+	flags.verifyRawLines = flags.Bool("verify-raw-lines", false, "Only check that written metadata documents trace back to their recorded index lines")
+	flags.mergeReport = flags.Bool("merge-report", false, "Merge the NDJSON reports (or directories of reports) given as arguments into one")
+	flags.mergeOut = flags.String("merge-out", "-", "Where to write the merged report (- for stdout)")
+	flags.latestLinks = flags.Bool("latest-links", false, "Maintain {name}-latest pointers to each crate's newest stable version")
+	flags.latestFallback = flags.String("latest-fallback", LatestPointer, "Pointer kind when symlinks are unsupported: pointer or copy")
+	flags.strictJSON = flags.Bool("strict-json", false, "Reject index entries with duplicate keys in a JSON object")
+	flags.crateIDMode = flags.Bool("crate-id-mode", false, "Index files are named by crate ID; take crate names from each entry's name field")
+	flags.retryPasses = flags.Int("retry-passes", 0, "Extra passes over versions whose metadata writes failed, after the main pass")
+	flags.retryDelay = flags.Duration("retry-delay", time.Minute, "Delay before each retry pass")
+	flags.checkCollisions = flags.Bool("check-collisions", false, "Report output paths claimed by more than one crate version")
+	flags.checkCaseCollisions = flags.Bool("check-case-collisions", false, "Report mirror crate files and output paths that differ only by case (implies -check-collisions)")
+	flags.disambiguateCase = flags.Bool("disambiguate-case", false, "Give metadata files of crate files differing only by case a hash suffix, recorded in "+RenamedNamesFile+" (implies -check-case-collisions)")
+	flags.checkConfig = flags.Bool("check-config", false, "Check that the index's config.json is well-formed, with \"dl\" and \"api\" URLs, and warn if not")
+	flags.failOnBadConfig = flags.Bool("fail-on-bad-config", false, "Exit with an error before processing if the index's config.json is malformed (implies -check-config)")
+	flags.verifyIndexManifest = flags.String("verify-index-manifest", "", "Before processing, check index files against a manifest of their entry counts and/or SHA-256s (JSON lines or sha256sum output), warning about truncated or altered files")
+	flags.failOnCollision = flags.Bool("fail-on-collision", false, "Skip colliding writes and exit with an error if any output path is claimed twice (implies -check-collisions)")
+	flags.Var(&flags.bootstrapSources, "bootstrap", "Fetch the crate versions in this crate list (name or name version per line) or Cargo.lock into the mirror, then organize only those (repeatable)")
+	flags.bootstrapWorkers = flags.Int("bootstrap-workers", DefaultBootstrapWorkers, "Number of crate files -bootstrap downloads at once")
+	flags.bootstrapRate = flags.Int64("bootstrap-rate", 0, "Limit -bootstrap downloads to this many bytes per second in total (0 = no limit)")
+	flags.lockfilePath = flags.String("organize-from-lockfile", "", "Only organize the registry crate versions pinned by this Cargo.lock, and report those not in the index or mirror")
+	flags.indexMaxDepth = flags.Int("index-max-depth", DefaultIndexMaxDepth, "Fail if the index walk goes more than this many directories deep (0 for no limit)")
+	flags.indexMaxFiles = flags.Int("index-max-files", DefaultIndexMaxFiles, "Fail if the index walk finds more than this many files (0 for no limit)")
+	flags.followIndexSymlinks = flags.Bool("follow-index-symlinks", false, "Walk into symlinked directories in the index, skipping any that lead to a directory already walked")
+	flags.shardExpr = flags.String("shards", "", "Only process crates whose names start with a character in these ranges, e.g. \"a-f\" or \"q-z,0-9\"")
+	flags.archiveOut = flags.String("archive-out", "", "After the run, write every metadata file under the (first) output root to this reproducible .tar.gz. "+
+		"Its bytes depend only on the files' relative paths and canonical JSON contents (and the Go version's gzip compressor): "+
+		"files are sorted by path, with mode 0644, owner 0:0, and mtime 1970-01-01, and the gzip header has no name or mtime")
+	flags.summaryJSON = flags.String("summary-json", "", "Write the run's summary report, including the per-outcome categories, as JSON to this file")
+	flags.summarySchema = flags.String("summary-schema", "", "Only write the JSON Schema of the -summary-json report to this file (- for stdout)")
+	flags.htmlReport = flags.String("html-report", "", "Write a self-contained HTML summary of the run (counts, top missing crates, categories) to this file")
+	flags.Var(&flags.reportPaths, "report-out", "Write a streaming per-file report here, as CSV if the name ends in .csv and NDJSON otherwise (repeatable)")
+	flags.outputsZero = flags.String("outputs-zero", "", "Write the paths of written metadata files, NUL-terminated, to this file (- for stdout)")
+	flags.treeOut = flags.String("tree-out", "", "Write a sorted tree of the metadata files produced (or planned in a dry run) to this file (- for stdout)")
+	flags.localIndexDir = flags.String("local-index-dir", "", "Secondary index directory of local or private crates; its versions take precedence")
+	flags.debug = flags.Bool("debug", false, "Log debug messages")
+	flags.asyncLog = flags.String("async-log", AsyncLogAuto, "Write the log file from a background goroutine: auto (when a startup check finds log writes slow), on, or off")
+	flags.compactIndexOut = flags.String("compact-index-out", "", "Directory to write compacted index files to, holding only the entries that were organized")
+	flags.mtimeSkew = flags.Duration("mtime-skew", DefaultMtimeSkew, "How far in the future a file's mtime may be before it is reported as clock skew")
+	flags.fixMtimes = flags.Bool("fix-mtimes", false, "Clamp future file mtimes to now")
+	flags.skipUnchanged = flags.Bool("skip-unchanged", false, "Don't rewrite metadata files whose content would not change (checked per destination)")
+	flags.preserveSymlinks = flags.Bool("preserve-symlinks", false, "Write through valid symlinks at metadata output paths instead of replacing them with real files")
+	flags.writersPerDir = flags.Int("writers-per-dir", 0, "Let at most this many workers write into one directory at once, for filesystems where concurrent creates in one directory contend; 0 means no limit")
+	flags.maxFilesPerDir = flags.Int("max-files-per-dir", 0, "Put metadata files beyond this many per directory into part-001/, part-002/, ... subdirectories; 0 means no limit")
+	flags.lockPath = flags.String("lock-file", "", "Lock file preventing concurrent runs (default: "+LockFileName+" in the mirror root)")
+	flags.emptyTrash = flags.String("empty-trash", "", "Permanently remove the deletions staged in this mirror or publish root's .trash more than -trash-retention ago, and exit")
+	flags.trashRetention = flags.Duration("trash-retention", DefaultTrashRetention, "How long -empty-trash keeps staged deletions")
+	flags.restore = flags.String("restore", "", "Move the most recently staged copy of this path back from the trash, and exit")
+	flags.repairPermissions = flags.Bool("repair-permissions", false, "Normalize the mode of existing metadata files to -file-mode and exit")
+	flags.reconcile = flags.Bool("reconcile", false, "Only classify existing metadata files against the documents generated from the index: identical, formatted differently, different, or foreign")
+	flags.reconcileRewrite = flags.Bool("reconcile-rewrite", false, "With -reconcile, rewrite formatted and different files into the generated form")
+	flags.reconcileKeep = flags.String("reconcile-keep", "", "Comma-separated top-level fields -reconcile carries over from existing files instead of treating them as differences")
+	flags.reconcileOut = flags.String("reconcile-out", "", "Write the -reconcile counts as JSON to this file")
+	flags.readOnly = flags.Bool("read-only", false, "Never modify the mirror or index: organize as a dry run, check the lock without taking it, refuse flags that write, and write the log and reports only under -report-dir")
+	flags.reportDir = flags.String("report-dir", "", "With -read-only, the only directory the log and reports may be written to; it must be outside the mirror and index")
+	return flags
+}
+
+// parseFlags parses the command line and returns the flags with the ones
+// given, by name. -read-only organizes as a dry run, so it is given as
+// -dry-run too, and a bool flag turned off, such as -dry-run=false, counts
+// as not given
+func parseFlags(args []string) (*runFlags, map[string]string) {
+	flags := newRunFlags()
+	flags.Parse(args)
+
+	given := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && f.Value.String() == "false" {
+			return
+		}
+		given[f.Name] = f.Value.String()
+	})
+	if *flags.readOnly {
+		*flags.dryRun = true
+		given["dry-run"] = "true"
+	}
+	return flags, given
+}
+
+// stringList is a flag.Value collecting every use of a repeatable flag
+type stringList []string
+
+// String implements flag.Value
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Labels are operator-provided key=value annotations of a run, such as why
+// it happened or a ticket number, recorded in its outputs
+type Labels map[string]string
+
+// String implements flag.Value, listing the labels sorted by key
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// Set implements flag.Value
+func (l Labels) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("want key=value, got %q", value)
+	}
+	l[value[:i]] = value[i+1:]
+	return nil
+}
+
+// FlagRule is a known interaction of one flag with others. It applies when
+// Flag is given (with Value, if set) and none of Unless are given.
+type FlagRule struct {
+	Flag     string
+	Value    string
+	Requires []string // at least one of these must also be given
+	Excludes []string // none of these may be given
+	Unless   []string
+	Hint     string
+}
+
+// standaloneModes each do one job and exit instead of organizing, so at
+// most one of them may be given
+var standaloneModes = []string{
+	"verify-only", "verify-raw-lines", "verify-aggregate", "verify-dir-manifests",
+	"list-missing", "dump-entry", "export-local-registry", "merge-report",
+	"summary-schema", "repair-permissions", "daemon", "publish",
+	"empty-trash", "restore", "reconcile", "compact-cache",
+}
+
+const oneModeHint = "only one mode runs per invocation; run them separately"
+
+// readOnlyExcludes are the flags that write to the mirror, the index, or
+// state kept beside them, so -read-only refuses them
+var readOnlyExcludes = []string{
+	"publish", "publish-deletions", "delete", "bootstrap", "repair-permissions",
+	"empty-trash", "restore", "daemon", "export-local-registry", "fix", "fix-mtimes",
+	"quarantine-removed", "checkpoint", "parse-cache", "snapshot", "missing-baseline",
+	"crate-names-baseline", "reset-baseline", "dir-manifests", "aggregate", "latest-links",
+	"record-raw-line", "s3-bucket", "github-output", "backfill-state", "reconcile-rewrite",
+	"compact-cache",
+}
+
+// FlagRules holds every known flag interaction. A new flag that depends
+// on, or makes no sense with, another flag belongs here.
+var FlagRules = []FlagRule{
+	{Flag: "diff", Requires: []string{"dry-run"}, Hint: "the diff compares planned writes against existing files, so add -dry-run"},
+	{Flag: "plan-file", Requires: []string{"diff"}, Hint: "the plan records the -diff of a dry run, so add -diff -dry-run"},
+	{Flag: "fix", Requires: []string{"verify-dir-manifests"}, Hint: "-fix rewrites stale directory manifests found by -verify-dir-manifests"},
+	{Flag: "date-layout", Excludes: []string{"layout"}, Hint: "-date-layout is shorthand for -layout date; give only one"},
+	{Flag: "s3-prefix", Requires: []string{"s3-bucket"}},
+	{Flag: "s3-endpoint", Requires: []string{"s3-bucket"}},
+	{Flag: "s3-bucket", Excludes: []string{
+		"skip-if-synced", "repair-permissions", "verify-raw-lines", "verify-dir-manifests",
+		"dir-manifests", "aggregate", "verify-aggregate", "latest-links",
+	}, Hint: "these read or write files under a local output root, which a bucket is not"},
+	{Flag: "s3-bucket", Excludes: []string{"archive-out"}, Unless: []string{"output-dir"}, Hint: "the archive is built from the first local output root, so add an -output-dir"},
+	{Flag: "s3-bucket", Excludes: []string{"max-files-per-dir"}, Unless: []string{"output-dir"}, Hint: "object keys have no directories to cap"},
+	{Flag: "record-raw-line", Value: RawLineFull, Excludes: []string{"strip-fields"}, Hint: "the raw line would still record the stripped fields; use -record-raw-line hash"},
+	{Flag: "reset-baseline", Requires: []string{"missing-baseline", "crate-names-baseline"}},
+	{Flag: "removed-report", Requires: []string{"crate-names-baseline"}, Hint: "removed crates are found by comparing against the names baseline"},
+	{Flag: "quarantine-removed", Requires: []string{"crate-names-baseline"}, Hint: "removed crates are found by comparing against the names baseline"},
+	{Flag: "bootstrap", Excludes: standaloneModes, Hint: "-bootstrap fetches crates and then organizes them in a normal run"},
+	{Flag: "bootstrap", Excludes: []string{"organize-from-lockfile", "snapshot", "skip-if-synced", "dry-run"}, Hint: "-bootstrap organizes exactly the versions it resolved; use -list-missing to see what is missing without fetching"},
+	{Flag: "bootstrap-workers", Requires: []string{"bootstrap"}},
+	{Flag: "bootstrap-rate", Requires: []string{"bootstrap"}},
+	{Flag: "organize-from-lockfile", Excludes: []string{"snapshot"}, Hint: "crates skipped as unchanged since the snapshot would be reported as not in the index"},
+	{Flag: "export-crates", Requires: []string{"export-local-registry"}},
+	{Flag: "list-missing-out", Requires: []string{"list-missing"}},
+	{Flag: "list-missing-format", Requires: []string{"list-missing"}},
+	{Flag: "list-missing-yanked", Requires: []string{"list-missing"}},
+	{Flag: "chunk-size", Requires: []string{"list-missing-out"}, Hint: "chunks are written to numbered files named after -list-missing-out"},
+	{Flag: "merge-out", Requires: []string{"merge-report"}},
+	{Flag: "verify-workers", Requires: []string{"verify-only"}, Unless: []string{"then-verify"}, Hint: "use -threads for the workers of a normal run"},
+	{Flag: "then-verify", Excludes: []string{"dry-run"}, Hint: "a dry run writes nothing to verify"},
+	{Flag: "then-verify", Excludes: standaloneModes, Hint: "-then-verify follows an organize run; the verify modes run on their own"},
+	{Flag: "latest-fallback", Requires: []string{"latest-links"}},
+	{Flag: "retry-delay", Requires: []string{"retry-passes"}},
+	{Flag: "compress-manifest", Requires: []string{"manifest-out"}},
+	{Flag: "registry", Requires: []string{"registries"}},
+	{Flag: "registries", Excludes: []string{"index-dir", "mirror-dir", "output-dir", "source-format", "daemon"}, Hint: "each registry's directories come from the registries file, and a daemon serves one registry"},
+	{Flag: "schedule", Requires: []string{"daemon"}},
+	{Flag: "status-addr", Requires: []string{"daemon"}},
+	{Flag: "backfill-state", Requires: []string{"daemon"}},
+	{Flag: "backfill-interval", Requires: []string{"backfill-state"}},
+	{Flag: "backfill-max", Requires: []string{"backfill-state"}},
+	{Flag: "backfill-window", Requires: []string{"backfill-state"}},
+	{Flag: "otel-sample", Requires: []string{"otel-endpoint"}},
+	{Flag: "otel-slow", Requires: []string{"otel-endpoint"}},
+	{Flag: "verify-only", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "verify-raw-lines", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "verify-aggregate", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "verify-dir-manifests", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "list-missing", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "dump-entry", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "export-local-registry", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "merge-report", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "summary-schema", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "repair-permissions", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "empty-trash", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "restore", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "read-only", Requires: []string{"report-dir"}, Hint: "-read-only writes its log and reports only to -report-dir"},
+	{Flag: "read-only", Excludes: readOnlyExcludes, Hint: "this flag writes to the mirror or its state, which -read-only never does"},
+	{Flag: "report-dir", Requires: []string{"read-only"}},
+	{Flag: "trash-retention", Requires: []string{"empty-trash"}},
+	{Flag: "reconcile", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "compact-cache", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "compact-cache-budget", Requires: []string{"parse-cache", "compact-cache"}},
+	{Flag: "reconcile-rewrite", Requires: []string{"reconcile"}},
+	{Flag: "reconcile-keep", Requires: []string{"reconcile"}},
+	{Flag: "reconcile-out", Requires: []string{"reconcile"}},
+	{Flag: "daemon", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "publish", Excludes: standaloneModes, Hint: oneModeHint},
+	{Flag: "publish", Requires: []string{"publish-manifest"}, Hint: "publish copies the files listed in a -manifest-out manifest"},
+	{Flag: "publish-manifest", Requires: []string{"publish"}},
+	{Flag: "publish-deletions", Requires: []string{"publish"}},
+	{Flag: "publish-deletions", Requires: []string{"delete"}, Hint: "deleting from the destination is opt-in"},
+	{Flag: "delete", Requires: []string{"publish-deletions"}, Hint: "-delete removes the crates listed in a -removed-report given as -publish-deletions"},
+}
+
+// CheckFlags returns every violation of rules by the given flags, which
+// map the name of each flag set on the command line to its value. Each
+// conflicting pair is reported once.
+func CheckFlags(given map[string]string, rules []FlagRule) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		value, ok := given[rule.Flag]
+		if !ok || (rule.Value != "" && value != rule.Value) {
+			continue
+		}
+		exempt := false
+		for _, name := range rule.Unless {
+			if _, ok := given[name]; ok {
+				exempt = true
+			}
+		}
+		if exempt {
+			continue
+		}
+
+		subject := "-" + rule.Flag
+		if rule.Value != "" {
+			subject += " " + rule.Value
+		}
+		hint := ""
+		if rule.Hint != "" {
+			hint = " (" + rule.Hint + ")"
+		}
+
+		if len(rule.Requires) > 0 {
+			found := false
+			for _, name := range rule.Requires {
+				if _, ok := given[name]; ok {
+					found = true
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s requires -%s%s", subject, strings.Join(rule.Requires, " or -"), hint))
+			}
+		}
+		for _, name := range rule.Excludes {
+			if _, ok := given[name]; !ok || name == rule.Flag {
+				continue
+			}
+			pair := []string{rule.Flag, name}
+			sort.Strings(pair)
+			if key := strings.Join(pair, " "); !seen[key] {
+				seen[key] = true
+				problems = append(problems, fmt.Sprintf("%s cannot be used with -%s%s", subject, name, hint))
+			}
+		}
+	}
+	return problems
+}
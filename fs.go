@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// readOnlyFS is set by -read-only. Every write to the filesystem goes
+// through the fs* wrappers below, which panic on a path outside reportDir:
+// a write in read-only mode is a bug, and must not be quietly skipped.
+var readOnlyFS struct {
+	enabled   bool
+	reportDir string
+}
+
+// EnableReadOnly confines all further writes to reportDir, which must be
+// an existing directory that neither contains nor is inside any of the
+// protected trees
+func EnableReadOnly(reportDir string, protected []string) error {
+	dir, err := resolvePath(reportDir)
+	if err != nil {
+		return fmt.Errorf("invalid -report-dir: %v", err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("-report-dir %s is not an existing directory", reportDir)
+	}
+	for _, tree := range protected {
+		if tree == "" {
+			continue
+		}
+		resolved, err := resolvePath(tree)
+		if err != nil {
+			return err
+		}
+		if dir == resolved || isWithin(resolved, dir) || isWithin(dir, resolved) {
+			return fmt.Errorf("-report-dir %s overlaps %s, which -read-only must not modify", reportDir, tree)
+		}
+	}
+	readOnlyFS.enabled, readOnlyFS.reportDir = true, dir
+	return nil
+}
+
+// resolvePath returns the absolute form of path with the symlinks of its
+// longest existing prefix resolved, so a path cannot reach outside a
+// directory through a link
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// ReadOnlyAllows reports whether a write to path is allowed: always,
+// unless -read-only is set and path is outside its report directory
+func ReadOnlyAllows(path string) bool {
+	if !readOnlyFS.enabled {
+		return true
+	}
+	resolved, err := resolvePath(path)
+	return err == nil && (resolved == readOnlyFS.reportDir || isWithin(readOnlyFS.reportDir, resolved))
+}
+
+// guardWrite panics if path may not be written
+func guardWrite(path string) {
+	if !ReadOnlyAllows(path) {
+		panic(fmt.Sprintf("BUG: write to %s attempted in -read-only mode, outside -report-dir %s", path, readOnlyFS.reportDir))
+	}
+}
+
+// fsFaults, if set, injects the ORGANIZE_FAULTS write faults into
+// fsWriteFile and fsRename
+var fsFaults *FaultInjector
+
+func fsWriteFile(path string, data []byte, mode os.FileMode) error {
+	guardWrite(path)
+	allowed, err := fsFaults.beforeWrite(len(data))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, data[:allowed], mode)
+	if err == nil && allowed < len(data) {
+		err = syscall.ENOSPC
+	}
+	fsFaults.afterWrite()
+	return err
+}
+
+func fsCreate(path string) (*os.File, error) {
+	guardWrite(path)
+	return os.Create(path)
+}
+
+func fsOpenFile(path string, flag int, mode os.FileMode) (*os.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		guardWrite(path)
+	}
+	return os.OpenFile(path, flag, mode)
+}
+
+func fsTempFile(dir, pattern string) (*os.File, error) {
+	guardWrite(filepath.Join(dir, pattern))
+	return ioutil.TempFile(dir, pattern)
+}
+
+func fsMkdirAll(path string, mode os.FileMode) error {
+	guardWrite(path)
+	return os.MkdirAll(path, mode)
+}
+
+func fsRename(from, to string) error {
+	guardWrite(from)
+	guardWrite(to)
+	if _, err := fsFaults.beforeWrite(0); err != nil {
+		return err
+	}
+	err := os.Rename(from, to)
+	fsFaults.afterWrite()
+	return err
+}
+
+func fsRemove(path string) error {
+	guardWrite(path)
+	return os.Remove(path)
+}
+
+func fsRemoveAll(path string) error {
+	guardWrite(path)
+	return os.RemoveAll(path)
+}
+
+func fsSymlink(target, path string) error {
+	guardWrite(path)
+	return os.Symlink(target, path)
+}
+
+func fsLink(target, path string) error {
+	guardWrite(path)
+	return os.Link(target, path)
+}
+
+func fsChmod(path string, mode os.FileMode) error {
+	guardWrite(path)
+	return os.Chmod(path, mode)
+}
+
+func fsChtimes(path string, atime, mtime time.Time) error {
+	guardWrite(path)
+	return os.Chtimes(path, atime, mtime)
+}
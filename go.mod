@@ -0,0 +1,3 @@
+module github.com/APTlantis/organize-crates
+
+go 1.16
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Latest pointer modes
+const (
+	LatestSymlink = "symlink"
+	LatestCopy    = "copy"
+	LatestPointer = "pointer"
+)
+
+// LatestSuffix marks a pointer to a crate's newest version, as in
+// serde-latest.crate. "latest" is not a valid version, so a pointer can never
+// be mistaken for a crate version.
+const LatestSuffix = "-latest"
+
+// PointerFileSuffix is appended to the name of a pointer file, which holds
+// the name of the file it points at
+const PointerFileSuffix = ".pointer"
+
+// LatestLinks maintains a "{name}-latest.crate" pointer beside each crate's
+// newest non-yanked, non-prerelease crate file, and a matching
+// "{name}-latest.metadata.json" pointer beside its metadata files. Pointers
+// are symlinks where the filesystem supports them, otherwise copies or
+// pointer files; each output root is probed on its own, as it may be on
+// another filesystem than the mirror.
+type LatestLinks struct {
+	// Mode is how pointers are made in the mirror, and Modes in each
+	// output root
+	Mode  string
+	Modes map[string]string
+
+	mirrorDir string
+}
+
+// latestCandidate is the newest stable version of a crate seen so far
+type latestCandidate struct {
+	name      string
+	version   Version
+	crateFile string
+	outputs   []string
+}
+
+// NewLatestLinks uses symlinks in the mirror and in each output root if
+// they can be created there, and otherwise the fallback mode (LatestCopy or
+// LatestPointer)
+func NewLatestLinks(mirrorDir string, roots []string, fallback string, logger *Logger) (*LatestLinks, error) {
+	if fallback != LatestCopy && fallback != LatestPointer {
+		return nil, fmt.Errorf("unknown latest pointer fallback %q (expected %s or %s)", fallback, LatestCopy, LatestPointer)
+	}
+	l := &LatestLinks{Mode: probeSymlinks(mirrorDir, fallback, logger), Modes: make(map[string]string), mirrorDir: mirrorDir}
+	for _, root := range roots {
+		if root != mirrorDir {
+			l.Modes[root] = probeSymlinks(root, fallback, logger)
+		}
+	}
+	return l, nil
+}
+
+// probeSymlinks returns LatestSymlink if a symlink can be created in dir, or
+// in its nearest existing parent if dir is yet to be created, and otherwise
+// fallback
+func probeSymlinks(dir, fallback string, logger *Logger) string {
+	existing := dir
+	for {
+		if info, err := os.Stat(existing); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	probe := filepath.Join(existing, fmt.Sprintf(".organize-symlink-probe-%d", os.Getpid()))
+	if err := fsSymlink(IgnoreFileName, probe); err != nil {
+		logger.Warning("Symlinks are not supported in %s (%v); latest pointers will be %s files", dir, err, fallback)
+		return fallback
+	}
+	fsRemove(probe)
+	return LatestSymlink
+}
+
+// modeFor returns how pointers are made in dir
+func (l *LatestLinks) modeFor(dir string) string {
+	for root, mode := range l.Modes {
+		if dir == root || isWithin(root, dir) {
+			return mode
+		}
+	}
+	return l.Mode
+}
+
+// UpdateCrate points the crate's latest pointers at the candidate's crate
+// file and metadata files, and returns how many pointers were changed
+func (l *LatestLinks) UpdateCrate(latest *latestCandidate, dryRun bool, logger *Logger) int {
+	updated := 0
+	point := func(dir, suffix, target string) {
+		link := filepath.Join(dir, latest.name+LatestSuffix+suffix)
+		changed, err := l.update(link, target, l.modeFor(dir), dryRun, logger)
+		if err != nil {
+			logger.Error("Failed to update latest pointer %s: %v", link, err)
+		} else if changed {
+			updated++
+		}
+	}
+
+	point(filepath.Dir(latest.crateFile), ".crate", latest.crateFile)
+	for _, output := range latest.outputs {
+		point(filepath.Dir(output), MetadataFileSuffix, output)
+	}
+	return updated
+}
+
+// RemoveCrate removes the latest pointers of a crate with no stable version
+// left from dirs, and returns how many were removed
+func (l *LatestLinks) RemoveCrate(name string, dirs []string, dryRun bool, logger *Logger) int {
+	removed := 0
+	for _, dir := range dirs {
+		for _, suffix := range []string{".crate", MetadataFileSuffix} {
+			link := filepath.Join(dir, name+LatestSuffix+suffix)
+			for _, path := range []string{link, link + PointerFileSuffix} {
+				if _, err := os.Lstat(path); err != nil {
+					continue
+				}
+				if dryRun {
+					logger.Info("DRY RUN: Would remove latest pointer %s, as %s has no stable version", path, name)
+				} else if err := fsRemove(path); err != nil {
+					logger.Error("Failed to remove latest pointer %s: %v", path, err)
+					continue
+				} else {
+					logger.Info("Removed latest pointer %s, as %s has no stable version", path, name)
+				}
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// update makes link point at target, replacing any stale pointer atomically
+// by creating the new one under a temporary name and renaming it into place.
+// It reports whether the pointer changed.
+func (l *LatestLinks) update(link, target, mode string, dryRun bool, logger *Logger) (bool, error) {
+	name := filepath.Base(target)
+	if mode == LatestPointer {
+		link += PointerFileSuffix
+	}
+
+	// Leave pointers that are already current alone
+	switch mode {
+	case LatestSymlink:
+		if current, err := os.Readlink(link); err == nil && current == name {
+			return false, nil
+		}
+	case LatestPointer:
+		if current, err := ioutil.ReadFile(link); err == nil && string(current) == name {
+			return false, nil
+		}
+	case LatestCopy:
+		linkInfo, linkErr := os.Stat(link)
+		targetInfo, targetErr := os.Stat(target)
+		if linkErr == nil && targetErr == nil && linkInfo.Size() == targetInfo.Size() && linkInfo.ModTime().Equal(targetInfo.ModTime()) {
+			return false, nil
+		}
+	}
+
+	if dryRun {
+		logger.Info("DRY RUN: Would point %s at %s", link, name)
+		return true, nil
+	}
+
+	temp := filepath.Join(filepath.Dir(link), "."+filepath.Base(link)+".tmp")
+	fsRemove(temp)
+	switch mode {
+	case LatestSymlink:
+		if err := fsSymlink(name, temp); err != nil {
+			return false, err
+		}
+	case LatestPointer:
+		if err := fsWriteFile(temp, []byte(name), 0644); err != nil {
+			return false, err
+		}
+	case LatestCopy:
+		info, err := os.Stat(target)
+		if err != nil {
+			return false, err
+		}
+		if _, err := copyHashed(target, temp, info.Mode().Perm()); err != nil {
+			fsRemove(temp)
+			return false, err
+		}
+		if err := fsChtimes(temp, info.ModTime(), info.ModTime()); err != nil {
+			fsRemove(temp)
+			return false, err
+		}
+	}
+
+	if err := fsRename(temp, link); err != nil {
+		fsRemove(temp)
+		return false, err
+	}
+	logger.Info("Pointed %s at %s", link, name)
+	return true, nil
+}
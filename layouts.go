@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PathGuard builds output paths and verifies they stay inside an output root
+type PathGuard struct {
+	root          string
+	resolvedRoot  string
+	allowSymlinks bool
+	resolved      sync.Map // directory -> error from resolving it
+
+	// sanitize renames file names Windows cannot create; renamed maps each
+	// renamed path, relative to the root, to its original file name
+	sanitize bool
+	renamed  sync.Map
+
+	// caseSuffixed holds the lowercased "name-version" stems whose metadata
+	// files get a hash suffix, because their crate files differ only by case
+	caseSuffixed map[string]bool
+}
+
+// SetCaseSuffixed sets the stems that are disambiguated by CaseSuffixedName.
+// It must be called before the run's workers start.
+func (g *PathGuard) SetCaseSuffixed(stems map[string][]string) {
+	if g == nil {
+		return
+	}
+	g.caseSuffixed = make(map[string]bool, len(stems))
+	for key := range stems {
+		g.caseSuffixed[key] = true
+	}
+}
+
+// CaseSuffixedName returns the metadata file name for a stem that collides
+// with another by case: the stem, a dot and the first 8 hex digits of the
+// SHA-256 of the stem as written, then the usual suffix. Each variant gets
+// its own name on every run, whatever order they are written in.
+func CaseSuffixedName(stem string) string {
+	sum := sha256.Sum256([]byte(stem))
+	return stem + "." + hex.EncodeToString(sum[:4]) + MetadataFileSuffix
+}
+
+// sanitizeFileNames is set where reserved file names must be avoided
+var sanitizeFileNames = runtime.GOOS == "windows"
+
+// RenamedNamesFile records, in each output root, the files that were given
+// a different name than usual because the usual name is reserved
+const RenamedNamesFile = ".organize-renamed-names.json"
+
+// windowsReservedNames are device names Windows reserves with any extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName returns name changed so Windows can create it: characters
+// Windows forbids become "_", as does a trailing dot or space, and a reserved
+// device name before the first dot ("con.versions.json") gets a "_" suffix
+func SanitizeFileName(name string) string {
+	safe := []byte(name)
+	for i, c := range safe {
+		if c < 0x20 || strings.IndexByte(`<>:"|?*`, c) >= 0 {
+			safe[i] = '_'
+		}
+	}
+	if n := len(safe); n > 0 && (safe[n-1] == '.' || safe[n-1] == ' ') {
+		safe[n-1] = '_'
+	}
+
+	result := string(safe)
+	stem := result
+	if i := strings.IndexByte(stem, '.'); i >= 0 {
+		stem = stem[:i]
+	}
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		result = stem + "_" + result[len(stem):]
+	}
+	return result
+}
+
+// safeName returns the file name to use in dir for name, recording the
+// rename if it had to change
+func (g *PathGuard) safeName(dir, name string) string {
+	if !g.sanitize {
+		return name
+	}
+	safe := SanitizeFileName(name)
+	if safe != name {
+		if rel, err := filepath.Rel(g.root, filepath.Join(dir, safe)); err == nil {
+			g.renamed.Store(filepath.ToSlash(rel), name)
+		}
+	}
+	return safe
+}
+
+// SaveRenamed writes the renamed file names to RenamedNamesFile in the root,
+// merged with those recorded by earlier runs. It returns how many there are.
+func (g *PathGuard) SaveRenamed() (int, error) {
+	if g == nil {
+		return 0, nil
+	}
+	path := filepath.Join(g.root, RenamedNamesFile)
+	renamed := make(map[string]string)
+	if content, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(content, &renamed)
+	}
+	added := 0
+	g.renamed.Range(func(key, value interface{}) bool {
+		if renamed[key.(string)] != value.(string) {
+			renamed[key.(string)] = value.(string)
+			added++
+		}
+		return true
+	})
+	if added == 0 {
+		return len(renamed), nil
+	}
+
+	data, err := json.MarshalIndent(renamed, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := fsWriteFile(path, data, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return len(renamed), nil
+}
+
+// NewPathGuard creates a guard for root. If allowSymlinks is true, output
+// directories may be symlinks that resolve outside the root.
+func NewPathGuard(root string, allowSymlinks bool) (*PathGuard, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve root %s: %v", root, err)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve root %s: %v", root, err)
+	}
+	return &PathGuard{
+		root:          filepath.Clean(absRoot),
+		resolvedRoot:  resolvedRoot,
+		allowSymlinks: allowSymlinks,
+		sanitize:      sanitizeFileNames,
+	}, nil
+}
+
+// isWithin reports whether path is strictly inside root (not root itself)
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// OutputPath returns the path of the metadata file for a crate version in
+// dir. It rejects names and versions that are not plain path components, and
+// any result that escapes the root, including through symlinked directories.
+func (g *PathGuard) OutputPath(dir, name, version string) (string, error) {
+	if err := checkPathComponents(name, version); err != nil {
+		return "", err
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("%s-%s%s", name, version, MetadataFileSuffix)
+	if stem := name + "-" + version; g.caseSuffixed[strings.ToLower(stem)] {
+		suffixed := CaseSuffixedName(stem)
+		if rel, err := filepath.Rel(g.root, filepath.Join(absDir, suffixed)); err == nil {
+			g.renamed.Store(filepath.ToSlash(rel), fileName)
+		}
+		fileName = suffixed
+	}
+	outputPath := filepath.Join(absDir, g.safeName(absDir, fileName))
+	if !isWithin(g.root, outputPath) {
+		return "", fmt.Errorf("%s is outside %s", outputPath, g.root)
+	}
+
+	if !g.allowSymlinks {
+		if err := g.checkResolved(absDir); err != nil {
+			return "", err
+		}
+	}
+
+	// Return the path relative to how the caller named the directory
+	return filepath.Join(dir, filepath.Base(outputPath)), nil
+}
+
+// checkPathComponents rejects parts that are not plain path components
+func checkPathComponents(parts ...string) error {
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `/\`) ||
+			filepath.IsAbs(part) || filepath.VolumeName(part) != "" || strings.ContainsRune(part, 0) {
+			return fmt.Errorf("unsafe path component %q", part)
+		}
+	}
+	return nil
+}
+
+// checkResolved verifies that dir, with symlinks resolved, is inside the
+// resolved root. Results are cached per directory.
+func (g *PathGuard) checkResolved(dir string) error {
+	if cached, ok := g.resolved.Load(dir); ok {
+		if cached == nil {
+			return nil
+		}
+		return cached.(error)
+	}
+
+	var checkErr error
+	resolved, err := evalExistingSymlinks(dir)
+	if err != nil {
+		checkErr = fmt.Errorf("failed to resolve %s: %v", dir, err)
+	} else if resolved != g.resolvedRoot && !isWithin(g.resolvedRoot, resolved) {
+		checkErr = fmt.Errorf("%s resolves to %s, outside %s", dir, resolved, g.resolvedRoot)
+	}
+
+	if checkErr == nil {
+		g.resolved.Store(dir, nil)
+	} else {
+		g.resolved.Store(dir, checkErr)
+	}
+	return checkErr
+}
+
+// evalExistingSymlinks resolves symlinks in the longest existing prefix of
+// path, so directories that have not been created yet can still be checked
+func evalExistingSymlinks(path string) (string, error) {
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, missing[i])
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(path))
+		path = parent
+	}
+}
+
+// DestStrategy decides which directory the metadata file for a crate
+// version is written to. Implementations must be safe for concurrent use.
+type DestStrategy interface {
+	Dir(crateFilePath string, metadata MetadataEntry) string
+}
+
+// Layouts accepted by NewDestStrategy
+const (
+	LayoutBeside = "beside"
+	LayoutFlat   = "flat"
+	LayoutDate   = "date"
+)
+
+// NewDestStrategy returns the strategy for a layout. Layouts other than
+// "beside" need an output directory.
+func NewDestStrategy(layout, mirrorDir, outputDir string) (DestStrategy, error) {
+	switch layout {
+	case LayoutBeside:
+		return &besideStrategy{mirrorDir: mirrorDir, outputDir: outputDir}, nil
+	case LayoutFlat, LayoutDate:
+		if outputDir == "" {
+			return nil, fmt.Errorf("the %s layout requires -output-dir", layout)
+		}
+		if layout == LayoutFlat {
+			return &flatStrategy{outputDir: outputDir}, nil
+		}
+		return &dateStrategy{outputDir: outputDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown layout %q (expected %s, %s, or %s)", layout, LayoutBeside, LayoutFlat, LayoutDate)
+	}
+}
+
+// besideStrategy writes metadata next to the crate file, or into the same
+// relative directory under the output directory if one is set
+type besideStrategy struct {
+	mirrorDir string
+	outputDir string
+}
+
+// Dir implements DestStrategy
+func (s *besideStrategy) Dir(crateFilePath string, metadata MetadataEntry) string {
+	crateDir := filepath.Dir(crateFilePath)
+	if s.outputDir == "" {
+		return crateDir
+	}
+	rel, err := filepath.Rel(s.mirrorDir, crateDir)
+	if err != nil {
+		return s.outputDir
+	}
+	return filepath.Join(s.outputDir, rel)
+}
+
+// flatStrategy writes all metadata files directly into the output directory
+type flatStrategy struct {
+	outputDir string
+}
+
+// Dir implements DestStrategy
+func (s *flatStrategy) Dir(crateFilePath string, metadata MetadataEntry) string {
+	return s.outputDir
+}
+
+// dateStrategy buckets metadata files by publish date into YYYY/MM/
+// directories, or unknown/ when no usable date is available
+type dateStrategy struct {
+	outputDir string
+}
+
+// Dir implements DestStrategy
+func (s *dateStrategy) Dir(crateFilePath string, metadata MetadataEntry) string {
+	published, ok := PublishDate(metadata, crateFilePath)
+	if !ok {
+		return filepath.Join(s.outputDir, "unknown")
+	}
+	return filepath.Join(s.outputDir, published.Format("2006"), published.Format("01"))
+}
+
+// publishDateFields are the metadata fields checked, in order, for a publish date
+var publishDateFields = []string{"pubtime", "created_at", "published_at", "timestamp"}
+
+// PublishDate returns the publish date of a version from its metadata if a
+// timestamp field is present, falling back to the crate file's mtime
+func PublishDate(metadata MetadataEntry, crateFilePath string) (time.Time, bool) {
+	for _, field := range publishDateFields {
+		switch value := metadata[field].(type) {
+		case string:
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+				if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+					return t.UTC(), true
+				}
+			}
+		case float64:
+			if value > 0 {
+				return time.Unix(int64(value), 0).UTC(), true
+			}
+		}
+	}
+
+	// Fall back to the crate file's mtime, unless the clock that set it was wrong
+	if crateFilePath != "" {
+		if info, err := os.Stat(crateFilePath); err == nil && PlausibleMtime(info.ModTime(), time.Now(), DefaultMtimeSkew) {
+			return info.ModTime().UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
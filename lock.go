@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LockFileName is the default name of the lock file in the mirror root
+const LockFileName = ".organize.lock"
+
+// Lock is an exclusive lock file that prevents concurrent runs against a mirror
+type Lock struct {
+	path string
+
+	// TakenOver is what a stale lock file left by a run whose process no
+	// longer exists held, if AcquireLock replaced one
+	TakenOver string
+}
+
+// AcquireLock creates the lock file, recording the process and host, and
+// fails if another run already holds it. A lock file left on this host by
+// a process that no longer exists, such as a crashed run, is taken over;
+// one from another host cannot be checked and is left alone.
+func AcquireLock(path, runID string) (*Lock, error) {
+	lock := &Lock{path: path}
+	file, err := fsOpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		holder, _ := ioutil.ReadFile(path)
+		lock.TakenOver = strings.TrimSpace(string(holder))
+		if !staleLock(lock.TakenOver) {
+			return nil, fmt.Errorf("lock file %s already exists (%s); remove it if no other run is active",
+				path, lock.TakenOver)
+		}
+		if err := takeOverLock(path, lock.TakenOver, runID); err != nil {
+			return nil, err
+		}
+		// Of several runs taking over the same stale lock, only the first
+		// to create it again proceeds
+		file, err = fsOpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("lock file %s was taken by another run while replacing a stale one", path)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock file: %v", err)
+	}
+	defer file.Close()
+
+	host, _ := os.Hostname()
+	fmt.Fprintf(file, "pid=%d host=%s run=%s started=%s\n", os.Getpid(), host, runID, time.Now().Format(time.RFC3339))
+	return lock, nil
+}
+
+// takeOverLock removes the stale lock file at path whose content was read
+// as holder. Removing it directly could remove a lock another run created
+// after taking it over first, so the file is moved aside under a name of
+// this run's own and checked: if it is no longer the stale holder, it is
+// put back and the lock is left to that run.
+func takeOverLock(path, holder, runID string) error {
+	aside := fmt.Sprintf("%s.stale-%d-%s", path, os.Getpid(), runID)
+	if err := fsRename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			// Another run moved it first; creating the lock decides
+			return nil
+		}
+		return fmt.Errorf("failed to move stale lock file aside: %v", err)
+	}
+	moved, _ := ioutil.ReadFile(aside)
+	if strings.TrimSpace(string(moved)) == holder {
+		fsRemove(aside)
+		return nil
+	}
+
+	// A link does not replace a lock created since, unlike a rename
+	err := fsLink(aside, path)
+	fsRemove(aside)
+	if err != nil {
+		return fmt.Errorf("lock file %s was taken by another run while replacing a stale one, and could not be put back: %v", path, err)
+	}
+	return fmt.Errorf("lock file %s was taken by another run while replacing a stale one", path)
+}
+
+// staleLock reports whether a lock file's content names a process on this
+// host that no longer exists. Lock files without a pid and host, such as
+// those of older versions, are never stale.
+func staleLock(holder string) bool {
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(holder) {
+		if eq := strings.IndexByte(field, '='); eq > 0 {
+			fields[field[:eq]] = field[eq+1:]
+		}
+	}
+	pid, err := strconv.Atoi(fields["pid"])
+	if err != nil || pid <= 0 || fields["host"] == "" {
+		return false
+	}
+	if host, err := os.Hostname(); err != nil || host != fields["host"] {
+		return false
+	}
+	return !processExists(pid)
+}
+
+// processExists reports whether a process with the pid is running. On
+// Windows, finding the process opens it, which fails once it has exited;
+// elsewhere signal 0 checks for it without affecting it.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer process.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// CheckLock reports who holds the lock file at path, if anyone, without
+// taking it
+func CheckLock(path string) (string, bool) {
+	holder, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(holder)), true
+}
+
+// Release removes the lock file
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	return fsRemove(l.path)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger for both file and console output
+type Logger struct {
+	fileLogger    *log.Logger
+	consoleLogger *log.Logger
+	debug         bool
+	file          *os.File
+	async         *asyncWriter
+}
+
+// NewLogger creates a new dual logger, creating the log file's parent
+// directory with dirMode if it does not exist yet
+func NewLogger(logPath string, dirMode os.FileMode) (*Logger, error) {
+	// Create the log directory
+	if err := fsMkdirAll(filepath.Dir(logPath), dirMode); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	// Create log file
+	logFile, err := fsCreate(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %v", err)
+	}
+
+	// Create loggers
+	fileLogger := log.New(logFile, "", log.LstdFlags)
+	consoleLogger := log.New(os.Stdout, "", log.LstdFlags)
+
+	return &Logger{
+		fileLogger:    fileLogger,
+		consoleLogger: consoleLogger,
+		file:          logFile,
+	}, nil
+}
+
+// SetAsync moves log file writes to a background goroutine with a queue of
+// queueSize messages, so a slow log file does not hold up the workers
+func (l *Logger) SetAsync(queueSize int) {
+	if l.async != nil {
+		return
+	}
+	l.async = newAsyncWriter(l.file, queueSize, os.Stderr)
+	l.fileLogger.SetOutput(l.async)
+}
+
+// Close flushes any queued messages and closes the log file
+func (l *Logger) Close() error {
+	if l.async != nil {
+		l.async.Close()
+	}
+	return l.file.Close()
+}
+
+// SetRunID tags every following message with the run ID
+func (l *Logger) SetRunID(id string) {
+	for _, logger := range []*log.Logger{l.fileLogger, l.consoleLogger} {
+		logger.SetPrefix("run=" + id + " ")
+		logger.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	}
+}
+
+// SetConsoleOutput redirects console messages, keeping stdout free for data
+func (l *Logger) SetConsoleOutput(w io.Writer) {
+	l.consoleLogger.SetOutput(w)
+}
+
+// SetDebug enables or disables debug messages
+func (l *Logger) SetDebug(enabled bool) {
+	l.debug = enabled
+}
+
+// Debug logs a debug message to both file and console if debug messages are enabled
+func (l *Logger) Debug(format string, v ...interface{}) {
+	if !l.debug {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	l.fileLogger.Printf("DEBUG - %s", msg)
+	l.consoleLogger.Printf("DEBUG - %s", msg)
+}
+
+// Info logs an info message to both file and console
+func (l *Logger) Info(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.fileLogger.Printf("INFO - %s", msg)
+	l.consoleLogger.Printf("INFO - %s", msg)
+}
+
+// Warning logs a warning message to both file and console
+func (l *Logger) Warning(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.fileLogger.Printf("WARNING - %s", msg)
+	l.consoleLogger.Printf("WARNING - %s", msg)
+}
+
+// Error logs an error message to both file and console
+func (l *Logger) Error(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.fileLogger.Printf("ERROR - %s", msg)
+	l.consoleLogger.Printf("ERROR - %s", msg)
+}
+
+// Log write modes of -async-log
+const (
+	AsyncLogAuto = "auto"
+	AsyncLogOn   = "on"
+	AsyncLogOff  = "off"
+)
+
+// AsyncLogQueue is how many messages the asynchronous logger queues before
+// it falls back to writing synchronously
+const AsyncLogQueue = 4096
+
+// SlowLogWrite is the median log write latency above which -async-log auto
+// logs asynchronously
+const SlowLogWrite = time.Millisecond
+
+// asyncWriter queues writes for a single writer goroutine. When the queue
+// is full it waits for the queue to drain and writes synchronously from
+// then on, so messages are never dropped and stay in order.
+type asyncWriter struct {
+	out    io.Writer
+	warn   io.Writer
+	queue  chan []byte
+	done   chan struct{}
+	mu     sync.Mutex
+	sync   bool
+	closed bool
+}
+
+func newAsyncWriter(out io.Writer, queueSize int, warn io.Writer) *asyncWriter {
+	w := &asyncWriter{
+		out:   out,
+		warn:  warn,
+		queue: make(chan []byte, queueSize),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		for msg := range w.queue {
+			w.out.Write(msg)
+		}
+	}()
+	return w
+}
+
+// Write queues a copy of p, since log.Logger reuses its buffer
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sync || w.closed {
+		return w.out.Write(p)
+	}
+	msg := append([]byte(nil), p...)
+	select {
+	case w.queue <- msg:
+		return len(p), nil
+	default:
+	}
+
+	// The queue backed up: flush it and log synchronously from now on
+	w.drain()
+	w.sync = true
+	warning := fmt.Sprintf("%s WARNING - Log queue of %d messages is full; logging synchronously from now on\n", time.Now().Format("2006/01/02 15:04:05"), cap(w.queue))
+	w.out.Write([]byte(warning))
+	if w.warn != nil {
+		io.WriteString(w.warn, warning)
+	}
+	return w.out.Write(p)
+}
+
+// drain stops the writer goroutine once it has written every queued message
+func (w *asyncWriter) drain() {
+	close(w.queue)
+	<-w.done
+}
+
+// Close writes out every queued message
+func (w *asyncWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	if !w.sync {
+		w.drain()
+	}
+}
+
+// MeasureLogLatency times small writes to a probe file beside logPath and
+// returns the median, which tells whether the log file is on slow storage
+func MeasureLogLatency(logPath string) (time.Duration, error) {
+	probe, err := fsTempFile(filepath.Dir(logPath), ".organize-log-probe-")
+	if err != nil {
+		return 0, err
+	}
+	defer fsRemove(probe.Name())
+	defer probe.Close()
+
+	line := []byte(strings.Repeat("x", 119) + "\n")
+	latencies := make([]time.Duration, 15)
+	for i := range latencies {
+		start := time.Now()
+		if _, err := probe.Write(line); err != nil {
+			return 0, err
+		}
+		latencies[i] = time.Since(start)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2], nil
+}
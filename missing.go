@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// RegistryDownloadTemplate returns the "dl" URL template from the index's
+// config.json, or "" if there is none
+func RegistryDownloadTemplate(indexDir string) string {
+	for _, path := range indexConfigPaths(indexDir) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var config struct {
+			DL string `json:"dl"`
+		}
+		if json.Unmarshal(data, &config) == nil && config.DL != "" {
+			return config.DL
+		}
+	}
+	return ""
+}
+
+// DownloadURL expands a registry's "dl" template for a crate version as
+// cargo does: the {crate}, {version}, {prefix}, {lowerprefix}, and
+// {sha256-checksum} markers are replaced, and a template with none of them
+// gets "/{crate}/{version}/download" appended
+func DownloadURL(template, name, version, cksum string) string {
+	// Same layout as indexentry.IndexPath without the final component, but keeping
+	// the crate name's case
+	var prefix string
+	switch len(name) {
+	case 1, 2:
+		prefix = strconv.Itoa(len(name))
+	case 3:
+		prefix = "3/" + name[:1]
+	default:
+		prefix = name[:2] + "/" + name[2:4]
+	}
+	markers := []string{"{crate}", "{version}", "{prefix}", "{lowerprefix}", "{sha256-checksum}"}
+	for _, marker := range markers {
+		if strings.Contains(template, marker) {
+			return strings.NewReplacer(
+				"{crate}", name,
+				"{version}", version,
+				"{prefix}", prefix,
+				"{lowerprefix}", strings.ToLower(prefix),
+				"{sha256-checksum}", cksum,
+			).Replace(template)
+		}
+	}
+	return strings.TrimSuffix(template, "/") + "/" + name + "/" + version + "/download"
+}
+
+// MissingListReport summarizes a -list-missing pass
+type MissingListReport struct {
+	Versions int           `json:"versions"`
+	Missing  int           `json:"missing"`
+	Yanked   int           `json:"yanked"`
+	Chunks   int           `json:"chunks"`
+	Errors   int           `json:"errors"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *MissingListReport) SummaryLine() string {
+	return fmt.Sprintf("list-missing: versions=%d missing=%d yanked=%d chunks=%d errors=%d dur=%s",
+		r.Versions, r.Missing, r.Yanked, r.Chunks, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// Formats of the -list-missing list
+const (
+	MissingFormatTSV   = "tsv"
+	MissingFormatAria2 = "aria2"
+	MissingFormatCurl  = "curl"
+)
+
+// MissingCrate is a crate version -list-missing found missing from the mirror
+type MissingCrate struct {
+	Crate   string
+	Version string
+	URL     string
+	SHA256  string
+	// Path is where the crate file belongs in the mirror
+	Path string
+}
+
+// MissingList writes missing crate versions in one of the MissingFormat
+// formats: tab-separated lines, an aria2c input file (aria2c -i), or a curl
+// config file (curl --config). With a positive chunk size the list is split
+// into numbered files of at most that many versions, so several hosts can
+// fetch in parallel.
+type MissingList struct {
+	Format    string
+	ChunkSize int
+	Chunks    int
+
+	path    string
+	out     *bufio.Writer
+	file    *os.File
+	inChunk int
+}
+
+// NewMissingList returns a list writing to w, or with a chunk size to
+// numbered files named after path
+func NewMissingList(w io.Writer, path, format string, chunkSize int) (*MissingList, error) {
+	switch format {
+	case MissingFormatTSV, MissingFormatAria2, MissingFormatCurl:
+	default:
+		return nil, fmt.Errorf("unknown format %q: must be %s, %s, or %s", format, MissingFormatTSV, MissingFormatAria2, MissingFormatCurl)
+	}
+	l := &MissingList{Format: format, ChunkSize: chunkSize, path: path}
+	if chunkSize > 0 {
+		if path == "" || path == "-" {
+			return nil, fmt.Errorf("chunks are written to files, so an output file is required")
+		}
+		return l, nil
+	}
+	l.out = bufio.NewWriter(w)
+	l.startChunk()
+	return l, nil
+}
+
+// ChunkPath returns the name of the nth chunk file, numbered from 1 before
+// the extension: missing.txt becomes missing-0001.txt
+func (l *MissingList) ChunkPath(n int) string {
+	ext := filepath.Ext(l.path)
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(l.path, ext), n, ext)
+}
+
+// startChunk writes the header of a new list or chunk
+func (l *MissingList) startChunk() {
+	if l.Format == MissingFormatCurl {
+		l.out.WriteString("create-dirs\n")
+	}
+}
+
+// Write adds a missing version to the list, starting a new chunk file
+// when the current one is full
+func (l *MissingList) Write(crate MissingCrate) error {
+	if l.ChunkSize > 0 && (l.file == nil || l.inChunk == l.ChunkSize) {
+		if err := l.closeChunk(); err != nil {
+			return err
+		}
+		file, err := fsCreate(l.ChunkPath(l.Chunks + 1))
+		if err != nil {
+			return err
+		}
+		l.Chunks++
+		l.file = file
+		l.out = bufio.NewWriter(file)
+		l.inChunk = 0
+		l.startChunk()
+	}
+	l.inChunk++
+
+	switch l.Format {
+	case MissingFormatAria2:
+		fmt.Fprintf(l.out, "%s\n  dir=%s\n  out=%s\n", crate.URL, filepath.Dir(crate.Path), filepath.Base(crate.Path))
+		if crate.SHA256 != "" {
+			fmt.Fprintf(l.out, "  checksum=sha-256=%s\n", crate.SHA256)
+		}
+	case MissingFormatCurl:
+		// curl checks no hashes; the comment keeps the expected one with the URL
+		quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+		fmt.Fprintf(l.out, "\n# %s %s sha256=%s\nurl = \"%s\"\noutput = \"%s\"\n",
+			crate.Crate, crate.Version, crate.SHA256, quote.Replace(crate.URL), quote.Replace(crate.Path))
+	default:
+		fmt.Fprintf(l.out, "%s\t%s\t%s\n", crate.Crate, crate.Version, crate.URL)
+	}
+	return nil
+}
+
+// closeChunk flushes the current chunk file, if any
+func (l *MissingList) closeChunk() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.out.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+// Close flushes the list
+func (l *MissingList) Close() error {
+	if l.ChunkSize > 0 {
+		return l.closeChunk()
+	}
+	return l.out.Flush()
+}
+
+// ListMissing writes every index version whose crate file is not in the
+// mirror to list, with its download URL (empty if the index has no
+// config.json), without organizing anything. Versions skipped by
+// -prereleases skip or -min-version are not listed, nor are yanked versions
+// unless opts.ListYanked is set.
+func ListMissing(opts *Options, list *MissingList, logger *Logger) (*MissingListReport, error) {
+	logger.Info("Listing missing crate files...")
+	startTime := time.Now()
+
+	crateIndex, err := BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, nil, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+	metadataFiles, err := FindMetadataFiles(opts.IndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find metadata files: %v", err)
+	}
+	if opts.LocalIndexDir != "" {
+		localFiles, err := FindMetadataFiles(opts.LocalIndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find local metadata files: %v", err)
+		}
+		metadataFiles = append(metadataFiles, localFiles...)
+	}
+	SortIndexFiles(metadataFiles, OrderName)
+
+	template := RegistryDownloadTemplate(opts.IndexDir)
+	if template == "" {
+		if list.Format != MissingFormatTSV {
+			return nil, fmt.Errorf("no config.json with a \"dl\" URL in %s, which the %s format needs", opts.IndexDir, list.Format)
+		}
+		logger.Warning("No config.json with a \"dl\" URL in %s; download URLs are left empty", opts.IndexDir)
+	}
+
+	report := &MissingListReport{}
+	seen := make(map[string]bool)
+	for _, file := range metadataFiles {
+		entries, err := readIndexEntries(file.Path)
+		if err != nil {
+			logger.Error("Failed to read metadata file %s: %v", file.Path, err)
+			report.Errors++
+			continue
+		}
+		crateName := filepath.Base(file.Path)
+		for _, entry := range entries {
+			name := crateName
+			if opts.CrateIDMode {
+				name, _ = entry["name"].(string)
+			}
+			version, _ := entry["vers"].(string)
+			if name == "" || version == "" || seen[name+"-"+version] {
+				continue
+			}
+			seen[name+"-"+version] = true
+			if opts.Prereleases == PrereleasesSkip {
+				if parsed, err := indexentry.ParseVersion(version); err == nil && parsed.IsPrerelease() {
+					continue
+				}
+			}
+			if opts.MinVersions.Below(name, version) {
+				continue
+			}
+			report.Versions++
+
+			_, present := crateIndex[name+"-"+version+".crate"]
+			for _, alias := range opts.RenameMap.Aliases(name) {
+				if present {
+					break
+				}
+				_, present = crateIndex[alias+"-"+version+".crate"]
+			}
+			if present {
+				continue
+			}
+			if yanked, _ := entry["yanked"].(bool); yanked && !opts.ListYanked {
+				report.Yanked++
+				continue
+			}
+
+			report.Missing++
+			cksum, _ := entry["cksum"].(string)
+			crate := MissingCrate{
+				Crate:   name,
+				Version: version,
+				SHA256:  cksum,
+				Path:    MirrorCratePath(opts.MirrorDir, name, version),
+			}
+			if template != "" {
+				// Use the entry's name, which keeps the published case
+				published, _ := entry["name"].(string)
+				if published == "" {
+					published = name
+				}
+				crate.URL = DownloadURL(template, published, version, cksum)
+			}
+			if err := list.Write(crate); err != nil {
+				return nil, fmt.Errorf("failed to write missing list: %v", err)
+			}
+		}
+	}
+	if err := list.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write missing list: %v", err)
+	}
+	report.Chunks = list.Chunks
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Listed %d missing out of %d versions in %v", report.Missing, report.Versions, report.Duration)
+	return report, nil
+}
@@ -6,437 +6,6857 @@
 // Last Modified: 2025-05-31
 //
 // Dependencies:
-// - None (standard library only)
+// - None (standard library only; pkg/indexentry is part of this module)
 //
 // Usage:
-//   go run organize_metadata.go [options]
+//   go run . [options]
 //
 // Options:
-//   -index string    Directory containing metadata index files (default "./index")
-//   -mirror string   Directory containing mirrored crate files (default "./mirror")
-//   -workers int     Number of parallel workers (default 4)
-//   -dry-run         Dry run (don't actually modify files)
-//   -log string      Path to log file (default "organize_metadata.log")
+//   -abort-on-sanity  Stop the run, exiting with status 3, if the -sanity-threshold check fails
+//   -aggregate  Merge each crate's organized versions into a per-crate .versions.json bundle, sorted by semver
+//   -allow-symlink-escape  Allow writing through symlinked crate directories that point outside the mirror
+//   -archive-out string  After the run, write every metadata file under the (first) output root to this reproducible .tar.gz. Its bytes depend only on the files' relative paths and canonical JSON contents (and the Go version's gzip compressor): files are sorted by path, with mode 0644, owner 0:0, and mtime 1970-01-01, and the gzip header has no name or mtime
+//   -async-log string  Write the log file from a background goroutine: auto (when a startup check finds log writes slow), on, or off (default "auto")
+//   -backfill-interval duration  How often the daemon looks for the crate files of recently missing versions between runs (default 1m0s)
+//   -backfill-max int  Most versions to remember as recently missing; the least recently reported are forgotten first (default 10000)
+//   -backfill-state string  File persisting the versions recently found missing; in daemon mode, each is organized as soon as its crate file appears
+//   -backfill-window duration  Forget versions that have not been reported missing for this long (default 24h0m0s)
+//   -bootstrap value  Fetch the crate versions in this crate list (name or name version per line) or Cargo.lock into the mirror, then organize only those (repeatable)
+//   -bootstrap-rate int  Limit -bootstrap downloads to this many bytes per second in total (0 = no limit)
+//   -bootstrap-workers int  Number of crate files -bootstrap downloads at once (default 4)
+//   -categories  Tally crates per category and keyword and log the top ones
+//   -categories-out string  Write the category and keyword tally to this JSON file (implies -categories)
+//   -categories-top int  Number of categories and keywords to list in -categories-out; 0 lists all (default 50)
+//   -check-case-collisions  Report mirror crate files and output paths that differ only by case (implies -check-collisions)
+//   -check-collisions  Report output paths claimed by more than one crate version
+//   -check-config  Check that the index's config.json is well-formed, with "dl" and "api" URLs, and warn if not
+//   -check-names  Flag versions whose metadata "name" disagrees with the name in their crate file's name (ignored with -crate-id-mode)
+//   -checkpoint string  Checkpoint file of progress and counts; an interrupted run resumes from it and reports on the whole job
+//   -chunk-size int  Split the -list-missing list into files of this many versions, numbered before the extension of -list-missing-out
+//   -compact-cache string  Only remove the entries of this parse cache that no current index file uses, and exit
+//   -compact-cache-budget duration  Time a run that read every index file may spend removing dead -parse-cache entries afterwards (0 disables); with -compact-cache, the time limit (default none) (default 30s)
+//   -compact-index-out string  Directory to write compacted index files to, holding only the entries that were organized
+//   -compress-manifest  Gzip the manifest even if its name does not end in .gz
+//   -compress-report  Gzip the -report-out reports even if their names do not end in .gz
+//   -cpuprofile string  Write a CPU profile to this file
+//   -crate-id-mode  Index files are named by crate ID; take crate names from each entry's name field
+//   -crate-names-baseline string  File of the crate names in the index at the last run; the mirrored files of crates removed since are reported
+//   -daemon  Run continuously, organizing on the -schedule until SIGTERM
+//   -date-layout  Shorthand for -layout date
+//   -debug  Log debug messages
+//   -delete  With -publish, delete the files of the crates in -publish-deletions from the destination
+//   -diff  In dry-run mode, show field-level changes against existing metadata files
+//   -dir-manifests  Write an index.json manifest of content hashes in every directory metadata files are written to
+//   -dir-mode string  Permission bits (octal) for directories created for metadata files (default "0755")
+//   -disambiguate-case  Give metadata files of crate files differing only by case a hash suffix, recorded in .organize-renamed-names.json (implies -check-case-collisions)
+//   -dry-run  Dry run mode (no files will be created)
+//   -dump-entry string  Only print the parsed entry, expected crate file, and destination paths of this crate at the version given as the first argument, as JSON
+//   -empty-trash string  Permanently remove the deletions staged in this mirror or publish root's .trash more than -trash-retention ago, and exit
+//   -env-out string  Append processed, linked, missing, errors, and duration_seconds as key=value lines to this file
+//   -eta-smoothing float  Weight (0-1] of the latest second's rate in the moving average of versions per second behind the progress ETA; higher reacts faster (default 0.2)
+//   -export-crates string  Comma-separated crates to export with -export-local-registry; all crates if empty
+//   -export-local-registry string  Only export the present crate versions as a cargo local registry (flat .crate files plus index/) in this directory
+//   -fail-on-bad-config  Exit with an error before processing if the index's config.json is malformed (implies -check-config)
+//   -fail-on-collision  Skip colliding writes and exit with an error if any output path is claimed twice (implies -check-collisions)
+//   -file-mode string  Permission bits (octal) for written metadata files (default "0644")
+//   -fix  With -verify-dir-manifests, rewrite the stale manifests
+//   -fix-mtimes  Clamp future file mtimes to now
+//   -follow-index-symlinks  Walk into symlinked directories in the index, skipping any that lead to a directory already walked
+//   -github-output  Append the -env-out lines to the file named by $GITHUB_OUTPUT
+//   -global-min-version string  Skip versions below this semver version for every crate without a -min-version floor of its own
+//   -html-report string  Write a self-contained HTML summary of the run (counts, top missing crates, categories) to this file
+//   -index-dir string  Directory containing the crates.io index (default "E:\\crates.io-index")
+//   -index-max-depth int  Fail if the index walk goes more than this many directories deep (0 for no limit) (default 32)
+//   -index-max-files int  Fail if the index walk finds more than this many files (0 for no limit) (default 2000000)
+//   -label value  Annotate the run with a key=value label, recorded in the log, summary JSON, reports, publish receipt, and checkpoint (repeatable)
+//   -latest-fallback string  Pointer kind when symlinks are unsupported: pointer or copy (default "pointer")
+//   -latest-links  Maintain {name}-latest pointers to each crate's newest stable version
+//   -latest-n int  Organize only the N highest semver versions of each crate, skipping older ones; prereleases don't take a place when -prereleases is skip (0 = all)
+//   -layout string  Output layout: beside (mirror the crate directories), flat, or date (YYYY/MM/ by publish date) (default "beside")
+//   -list-missing  Only list the index versions missing from the mirror as tab-separated name, version, and download URL
+//   -list-missing-format string  Format of the -list-missing list: tsv, aria2 (an aria2c -i input file), or curl (a curl --config file) (default "tsv")
+//   -list-missing-out string  Where to write the -list-missing list (- for stdout) (default "-")
+//   -list-missing-yanked  Include yanked versions in the -list-missing list
+//   -local-index-dir string  Secondary index directory of local or private crates; its versions take precedence
+//   -lock-file string  Lock file preventing concurrent runs (default: .organize.lock in the mirror root)
+//   -log-path string  Path to log file (default "E:\\metadata-organize-log.txt")
+//   -manifest-out string  Write an NDJSON manifest of the path, SHA-256, and size of every metadata file written or unchanged (gzipped if the name ends in .gz)
+//   -max-files-per-dir int  Put metadata files beyond this many per directory into part-001/, part-002/, ... subdirectories; 0 means no limit
+//   -memprofile string  Write a heap profile to this file at the end of the run
+//   -merge-out string  Where to write the merged report (- for stdout) (default "-")
+//   -merge-report  Merge the NDJSON reports (or directories of reports) given as arguments into one
+//   -min-version string  Comma-separated crate=version floors; versions of those crates below the floor are skipped (e.g. serde=1.0.0,rand=0.8.0)
+//   -mirror-dir string  Directory containing the mirrored crates (default "E:\\crates-mirror")
+//   -missing-baseline string  File of the versions missing in the last complete run; only changes from it are warned about
+//   -mtime-skew duration  How far in the future a file's mtime may be before it is reported as clock skew (default 24h0m0s)
+//   -no-ignore-file  Ignore the mirror's .organizeignore file and scan everything
+//   -normalize-schema  Rewrite v1 and v2 index entries into one form: features2 merged into features and "v" set to 2
+//   -order string  Order to process index files in: walk, size-desc (largest first), name, or mtime-desc (newest first) (default "walk")
+//   -organize-from-lockfile string  Only organize the registry crate versions pinned by this Cargo.lock, and report those not in the index or mirror
+//   -otel-endpoint string  OpenTelemetry collector to export traces to over OTLP/HTTP, e.g. http://localhost:4318
+//   -otel-sample float  Fraction of index files to export spans for (default 0.01)
+//   -otel-slow duration  Always export spans for index files that take at least this long (default 1s)
+//   -output-dir value  Directory to write metadata files under instead of next to the crate files (repeatable)
+//   -outputs-zero string  Write the paths of written metadata files, NUL-terminated, to this file (- for stdout)
+//   -parse-cache string  Directory caching parsed index files by content hash, so unchanged files are not parsed again
+//   -per-file-timeout duration  Abandon an index file that takes longer than this to process (e.g. 30s), counting it as an error; 0 means no limit
+//   -plan-file string  Path to write the dry-run diff plan to
+//   -prereleases string  Prerelease versions: include them, skip them, or write them to a separate prerelease/ subdirectory (default "include")
+//   -preserve-symlinks  Write through valid symlinks at metadata output paths instead of replacing them with real files
+//   -publish string  Only publish the organized metadata files listed in -publish-manifest to this destination root, hash-verified, writing a receipt there
+//   -publish-deletions string  The -removed-report of removed crates whose files -delete removes from the -publish destination
+//   -publish-manifest string  The -manifest-out manifest of the run whose files -publish copies
+//   -quarantine-removed string  Move the mirrored files of crates removed upstream to this directory, keeping their mirror paths (requires -crate-names-baseline)
+//   -read-only  Never modify the mirror or index: organize as a dry run, check the lock without taking it, refuse flags that write, and write the log and reports only under -report-dir
+//   -reconcile  Only classify existing metadata files against the documents generated from the index: identical, formatted differently, different, or foreign
+//   -reconcile-keep string  Comma-separated top-level fields -reconcile carries over from existing files instead of treating them as differences
+//   -reconcile-out string  Write the -reconcile counts as JSON to this file
+//   -reconcile-rewrite  With -reconcile, rewrite formatted and different files into the generated form
+//   -record-raw-line string  Record each entry's source index line in the _local block: hash (its SHA-256) or full (the line and its hash)
+//   -registries string  JSON file of registries (name, index_dir, mirror_dir, output_dirs, args) to organize one after another, each kept separate
+//   -registry string  Comma-separated names of the -registries to organize; all if empty
+//   -removed-report string  Write the crates removed upstream but still mirrored, with their files and sizes, as JSON to this file (requires -crate-names-baseline)
+//   -rename-map string  JSON or CSV file of old-name,new-name crate renames to retry lookups under
+//   -repair-permissions  Normalize the mode of existing metadata files to -file-mode and exit
+//   -report-dir string  With -read-only, the only directory the log and reports may be written to; it must be outside the mirror and index
+//   -report-out value  Write a streaming per-file report here, as CSV if the name ends in .csv and NDJSON otherwise (repeatable)
+//   -reset-baseline  Start the -missing-baseline and -crate-names-baseline afresh instead of comparing against them
+//   -restore string  Move the most recently staged copy of this path back from the trash, and exit
+//   -results-socket string  Unix socket to stream per-file results and progress to as JSON lines
+//   -retry-delay duration  Delay before each retry pass (default 1m0s)
+//   -retry-passes int  Extra passes over versions whose metadata writes failed, after the main pass
+//   -run-id string  ID for this run in logs, reports, and the lock file (default: a generated ULID)
+//   -s3-bucket string  Put metadata documents into this S3-compatible bucket, as another destination beside any -output-dir (instead of the mirror)
+//   -s3-endpoint string  S3 endpoint URL for -s3-bucket (default $AWS_ENDPOINT_URL_S3, $AWS_ENDPOINT_URL, or AWS)
+//   -s3-prefix string  Key prefix for -s3-bucket objects
+//   -sanity-threshold float  Warn that the index and mirror look mismatched if more than this percentage of the first versions are missing; 0 disables the check (default 95)
+//   -schedule string  Daemon schedule: an interval such as 30m, or a 5-field cron expression (default "1h")
+//   -shards string  Only process crates whose names start with a character in these ranges, e.g. "a-f" or "q-z,0-9"
+//   -skip-if-synced  Exit without scanning if the index is unchanged since the last fully successful run, recorded in .organize-state
+//   -skip-unchanged  Don't rewrite metadata files whose content would not change (checked per destination)
+//   -snapshot string  Snapshot file of index file hashes; crates unchanged since the last run are skipped
+//   -source-format string  Index format: auto, git (checkout), sparse (plain JSON-lines snapshot), or sparse-cache (cargo's .cache files) (default "auto")
+//   -status-addr string  Address (e.g. :9090) to serve /status and /metrics on in daemon mode
+//   -strict-json  Reject index entries with duplicate keys in a JSON object
+//   -strip-fields string  Comma-separated fields to remove from every entry before writing; dotted paths reach nested fields (e.g. deps.registry)
+//   -summary-json string  Write the run's summary report, including the per-outcome categories, as JSON to this file
+//   -summary-schema string  Only write the JSON Schema of the -summary-json report to this file (- for stdout)
+//   -then-verify  After a complete run, verify checksums and whatever else the run wrote (raw lines, bundles, directory manifests), exiting with status 4 if verification fails
+//   -threads int  Number of worker threads (default: the number of CPUs)
+//   -timeout duration  Stop dispatching new index files after this long (e.g. 2h); 0 means no limit
+//   -track-crate-files  Record each crate file's size and mtime in the metadata; with -snapshot, crates whose files changed in the mirror are processed again
+//   -trash-retention duration  How long -empty-trash keeps staged deletions (default 168h0m0s)
+//   -tree-out string  Write a sorted tree of the metadata files produced (or planned in a dry run) to this file (- for stdout)
+//   -validate-deps  Flag versions whose dependency requirements are not valid semver requirements
+//   -verify-aggregate  Only check that each crate's bundle matches its current index entries for present versions
+//   -verify-checksum  Hash each matched crate file while organizing; versions whose SHA-256 differs from the entry's cksum are logged, not written, and counted as failed
+//   -verify-dir-manifests  Only check the index.json directory manifests against the metadata files beside them
+//   -verify-index-manifest string  Before processing, check index files against a manifest of their entry counts and/or SHA-256s (JSON lines or sha256sum output), warning about truncated or altered files
+//   -verify-only  Only verify crate files against the index checksums, without organizing
+//   -verify-raw-lines  Only check that written metadata documents trace back to their recorded index lines
+//   -verify-workers int  Number of checksum verification workers, independent of -threads (default: the number of CPUs)
+//   -writers-per-dir int  Let at most this many workers write into one directory at once, for filesystems where concurrent creates in one directory contend; 0 means no limit
 // =========================================================
 
+//go:generate go test -run ^TestHeaderOptions$ -update-header .
+
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
-	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"io/ioutil"
-	"log"
+	"math"
+	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
 )
 
-// MetadataEntry represents a single entry in a metadata file
-type MetadataEntry map[string]interface{}
+// MetadataEntry represents a single entry in a metadata file. Parsing and
+// ordering entries is done by package indexentry, shared with other tools.
+type MetadataEntry = indexentry.Entry
+
+// Version is a parsed semantic version as used by crates.io
+type Version = indexentry.Version
 
 // FileIndex is a map of filename to full path
 type FileIndex map[string]string
 
-// Logger for both file and console output
-type Logger struct {
-	fileLogger    *log.Logger
-	consoleLogger *log.Logger
-}
+// LocalInfoKey is the key of the block of locally derived information added
+// to written metadata. It is never present in upstream index entries.
+const LocalInfoKey = "_local"
 
-// NewLogger creates a new dual logger
-func NewLogger(logPath string) (*Logger, error) {
-	// Create log file
-	logFile, err := os.Create(logPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create log file: %v", err)
-	}
+// MetadataFileSuffix is appended to "{crate}-{version}" to name metadata files
+const MetadataFileSuffix = ".metadata.json"
 
-	// Create loggers
-	fileLogger := log.New(logFile, "", log.LstdFlags)
-	consoleLogger := log.New(os.Stdout, "", log.LstdFlags)
+// Options holds the configuration for an organize run
+type Options struct {
+	IndexDir   string
+	MirrorDir  string
+	NumWorkers int
+	DryRun     bool
+	FileMode   os.FileMode
+	DirMode    os.FileMode
+	Ignore     *IgnoreMatcher
+	RenameMap  *RenameMap
+	Plan       *Plan
+	Snapshot   *Snapshot
 
-	return &Logger{
-		fileLogger:    fileLogger,
-		consoleLogger: consoleLogger,
-	}, nil
-}
+	// TrackCrateFiles records each crate file's size and mtime in the
+	// metadata's local info block, and makes -snapshot reprocess a crate
+	// whose index is unchanged when one of its crate files no longer matches
+	TrackCrateFiles bool
 
-// Info logs an info message to both file and console
-func (l *Logger) Info(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	l.fileLogger.Printf("INFO - %s", msg)
-	l.consoleLogger.Printf("INFO - %s", msg)
-}
+	// ParseCache, if set, stores parsed index files so unchanged ones are
+	// not parsed again by later runs
+	ParseCache *ParseCache
 
-// Warning logs a warning message to both file and console
-func (l *Logger) Warning(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	l.fileLogger.Printf("WARNING - %s", msg)
-	l.consoleLogger.Printf("WARNING - %s", msg)
-}
+	// CompactBudget, if positive, is how long a run that read every index
+	// file may spend compacting the parse cache afterwards
+	CompactBudget time.Duration
 
-// Error logs an error message to both file and console
-func (l *Logger) Error(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	l.fileLogger.Printf("ERROR - %s", msg)
-	l.consoleLogger.Printf("ERROR - %s", msg)
-}
+	// Baseline, if set, reports missing versions relative to the last run
+	Baseline *MissingBaseline
 
-// BuildCrateFileIndex builds an index of all crate files in the mirror directory
-func BuildCrateFileIndex(mirrorDir string, logger *Logger) (FileIndex, error) {
-	logger.Info("Building crate file index from %s...", mirrorDir)
-	startTime := time.Now()
+	// CrateNames, if set, reports the mirrored files of crates removed from
+	// the index since the last run, writing them to RemovedReport and moving
+	// them to QuarantineDir when those are set
+	CrateNames    *CrateNameBaseline
+	RemovedReport string
+	QuarantineDir string
 
-	index := make(FileIndex)
+	// Destinations are the roots every metadata document is written to
+	Destinations []*Destination
 
-	err := filepath.Walk(mirrorDir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	// SkipUnchanged leaves existing metadata files alone when their content
+	// would not change, evaluated separately for each destination
+	SkipUnchanged bool
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
+	// PreserveSymlinks writes through a valid symlink at a metadata output
+	// path instead of replacing it with a real file; dangling ones are
+	// replaced either way
+	PreserveSymlinks bool
 
-		// Only index .crate files
-		if strings.HasSuffix(info.Name(), ".crate") {
-			index[info.Name()] = path
-		}
+	// CompactIndexDir, if set, receives a copy of each index file holding
+	// only the entries that were organized, at the same relative path
+	CompactIndexDir string
 
-		return nil
-	})
+	// Tracer, if set, exports spans for run phases and sampled files
+	Tracer *Tracer
 
-	if err != nil {
-		return nil, fmt.Errorf("error walking mirror directory: %v", err)
-	}
+	// Latest, if set, maintains "{name}-latest" pointers to each crate's
+	// newest stable version
+	Latest *LatestLinks
 
-	logger.Info("Built index of %d crate files in %v", len(index), time.Since(startTime))
-	return index, nil
-}
+	// Bundles, if set, merges each crate's organized versions into a
+	// per-crate aggregate bundle in every destination
+	Bundles *BundleWriter
 
-// ProcessMetadataFile processes a single metadata file
-func ProcessMetadataFile(metadataFilePath string, crateIndex FileIndex, mirrorDir string, dryRun bool, logger *Logger) (int, int) {
-	// Skip .git directory and config.json
-	baseName := filepath.Base(metadataFilePath)
-	if baseName == ".git" || baseName == "config.json" {
-		return 0, 0
-	}
+	// Categories, if set, tallies crates per category and keyword
+	Categories *CategoryTally
 
-	// Get crate name from the filename
-	crateName := baseName
+	// RawLine records each entry's source index line in the local info
+	// block: RawLineHash stores its SHA-256, RawLineFull the line as well
+	RawLine string
 
-	// Read the metadata file
-	content, err := ioutil.ReadFile(metadataFilePath)
-	if err != nil {
-		logger.Error("Failed to read metadata file %s: %v", metadataFilePath, err)
-		return 0, 0
-	}
+	// VerifyChecksum hashes each matched crate file and fails versions
+	// whose SHA-256 differs from the entry's cksum field
+	VerifyChecksum bool
 
-	// Split content into lines
-	lines := strings.Split(string(content), "\n")
+	// StrictJSON rejects entries with a key repeated within one object,
+	// which encoding/json would otherwise silently accept
+	StrictJSON bool
 
-	successCount := 0
-	totalCount := 0
+	// CrateIDMode takes each entry's crate name from its "name" field rather
+	// than the index file name, for registries that name index files by ID
+	CrateIDMode bool
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	// RetryPasses is how many extra passes are made over versions whose
+	// writes failed, RetryDelay apart, after the main pass
+	RetryPasses int
+	RetryDelay  time.Duration
 
-		// Quick check if the line looks like JSON
-		if !strings.HasPrefix(line, "{") || !strings.HasSuffix(line, "}") {
-			continue
-		}
+	// Collisions, if set, checks that no two crate versions are written to
+	// the same output path
+	Collisions *CollisionDetector
 
-		// Parse the JSON
-		var metadata MetadataEntry
-		if err := json.Unmarshal([]byte(line), &metadata); err != nil {
-			logger.Error("Error parsing JSON in %s: %v", metadataFilePath, err)
-			continue
-		}
+	// DisambiguateCase gives the metadata files of crate files whose names
+	// differ only by case a CaseSuffixedName; it needs Collisions.FoldCase
+	DisambiguateCase bool
 
-		// Get version
-		version, ok := metadata["vers"].(string)
-		if !ok || version == "" {
-			continue
-		}
+	// Shards, if set, restricts the run to crates in the given name ranges
+	Shards *ShardSet
 
-		totalCount++
+	// IndexWalk guards the walk of the index directories
+	IndexWalk IndexWalkLimits
 
-		// Find the corresponding crate file
-		expectedFilename := fmt.Sprintf("%s-%s.crate", crateName, version)
-		crateFilePath, exists := crateIndex[expectedFilename]
+	// LocalIndexDir, if set, is a secondary index of local or private
+	// crates processed with the main one; its versions take precedence
+	LocalIndexDir string
 
-		if !exists {
-			logger.Warning("Could not find crate file for %s-%s", crateName, version)
-			continue
-		}
+	// ReportPaths are streaming per-file reports written during each run
+	// (CSV if the path ends in .csv, NDJSON otherwise)
+	ReportPaths []string
 
-		// Create metadata file path next to the crate file
-		crateDir := filepath.Dir(crateFilePath)
-		metadataOutputPath := filepath.Join(crateDir, fmt.Sprintf("%s-%s.metadata.json", crateName, version))
+	// HTMLReport is the path of a human-readable HTML summary of each run
+	HTMLReport string
 
-		// Write metadata to file
-		if !dryRun {
-			// Marshal with indentation for readability
-			metadataJSON, err := json.MarshalIndent(metadata, "", "  ")
-			if err != nil {
-				logger.Error("Error marshaling JSON for %s-%s: %v", crateName, version, err)
-				continue
-			}
+	// SummaryJSON is the path the Report of each run is written to as JSON
+	SummaryJSON string
 
-			if err := ioutil.WriteFile(metadataOutputPath, metadataJSON, 0644); err != nil {
-				logger.Error("Error writing metadata file for %s-%s: %v", crateName, version, err)
-				continue
-			}
+	// Checkpoint, if set, persists progress so an interrupted run resumes
+	Checkpoint *Checkpoint
 
-			successCount++
-		} else {
-			// In dry-run mode, just count
-			successCount++
-		}
-	}
+	// RunID identifies the run in its reports
+	RunID string
 
-	return successCount, totalCount
-}
+	// Labels annotate the run in its summary, reports, and checkpoint
+	Labels Labels
 
-// FindMetadataFiles finds all metadata files in the index directory
-func FindMetadataFiles(indexDir string, logger *Logger) ([]string, error) {
-	logger.Info("Finding metadata files in %s...", indexDir)
-	startTime := time.Now()
+	// Registry names the registry of a -registries run in its summary
+	Registry string
 
-	var metadataFiles []string
+	// CompressReports gzips the reports even if their paths do not end in .gz
+	CompressReports bool
 
-	err := filepath.Walk(indexDir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	// OutputList, if set, receives the path of every metadata file written
+	OutputList *OutputList
 
-		// Skip directories
-		if info.IsDir() {
-			// Skip common directories that might contain non-metadata files
-			if strings.Contains(path, ".git") ||
-				strings.Contains(path, ".venv") ||
-				strings.Contains(path, "site-packages") ||
-				strings.Contains(path, "pip") ||
-				strings.Contains(path, "python") ||
-				strings.Contains(path, "__pycache__") {
-				return filepath.SkipDir
-			}
-			return nil
-		}
+	// Tree, if set, receives every metadata file written, found unchanged,
+	// or planned in a dry run
+	Tree *OutputTree
 
-		// Skip config.json and common non-metadata file types
-		if info.Name() == "config.json" {
-			return nil
-		}
+	// Manifest, if set, receives the path and hash of every metadata file
+	// written or found unchanged
+	Manifest *Manifest
 
-		// Skip Python files and other non-metadata files
-		if strings.HasSuffix(info.Name(), ".py") ||
-			strings.HasSuffix(info.Name(), ".pyc") ||
-			strings.HasSuffix(info.Name(), ".pyd") ||
-			strings.HasSuffix(info.Name(), ".dll") ||
-			strings.HasSuffix(info.Name(), ".exe") ||
-			strings.HasSuffix(info.Name(), ".bat") ||
-			strings.HasSuffix(info.Name(), ".sh") ||
-			strings.HasSuffix(info.Name(), ".md") ||
-			strings.HasSuffix(info.Name(), ".txt") ||
-			strings.HasSuffix(info.Name(), ".html") {
-			return nil
-		}
+	// DirManifests writes a manifest of content hashes in every directory
+	// metadata files were written to
+	DirManifests bool
 
-		metadataFiles = append(metadataFiles, path)
-		return nil
-	})
+	// Mtimes detects implausible file modification times while indexing
+	Mtimes *MtimeCheck
 
-	if err != nil {
-		return nil, fmt.Errorf("error walking index directory: %v", err)
-	}
+	// Faults, if set, delays index reads; its write faults are injected
+	// through fsFaults
+	Faults *FaultInjector
 
-	logger.Info("Found %d metadata files in %v", len(metadataFiles), time.Since(startTime))
-	return metadataFiles, nil
-}
+	// EntryFilter, if set, is called for every parsed entry before it is
+	// matched or written; returning false skips the entry. It is called
+	// concurrently from all workers, so it must be safe for concurrent use
+	// and must not modify the entry.
+	EntryFilter func(MetadataEntry) bool
 
-// Worker represents a worker that processes metadata files
-type Worker struct {
-	id            int
-	metadataFiles chan string
-	crateIndex    FileIndex
-	mirrorDir     string
-	dryRun        bool
-	wg            *sync.WaitGroup
-	logger        *Logger
-	results       chan [2]int
+	// Lockfile, if set, restricts the run to the versions a Cargo.lock pins
+	Lockfile *Lockfile
+
+	// RecentlyMissing, if set, records the versions found missing, for a
+	// daemon to backfill when their crate files arrive
+	RecentlyMissing *RecentlyMissing
+
+	// Progress, if set, is called with a snapshot of the run every
+	// ProgressInterval (default one second) and when the phase changes.
+	// OnResult, if set, is called with the result of every index file. Both
+	// are called from the run's internal goroutines, so they must return
+	// quickly and must not block.
+	Progress         ProgressFunc
+	ProgressInterval time.Duration
+	OnResult         func(FileResult)
+
+	// ETASmoothing is the weight of the latest second in the moving average
+	// of versions per second the ETA uses; 0 means DefaultETASmoothing
+	ETASmoothing float64
+
+	// Order is the dispatch order of index files (see the Order constants)
+	Order string
+
+	// Timeout, if positive, stops dispatching new index files once it has
+	// elapsed; files already being processed are finished
+	Timeout time.Duration
+
+	// PerFileTimeout, if positive, abandons an index file that takes longer
+	// to process, counting it as an error, so the worker can move on
+	PerFileTimeout time.Duration
+
+	// WritersPerDir, if positive, is how many workers may write metadata
+	// files into one directory at once; the others wait for a slot
+	WritersPerDir int
+
+	// SanityThreshold, if positive, is the percentage of missing versions
+	// among the first SanityCheckVersions looked up above which the index
+	// and mirror are reported as mismatched; AbortOnSanity then stops
+	// dispatching like Timeout does
+	SanityThreshold float64
+	AbortOnSanity   bool
+
+	// ResultStream, if set, receives per-file results and progress events
+	ResultStream *ResultStream
+
+	// CrateIndexCache, if set, keeps the crate file index in memory between
+	// runs and refreshes only changed directories instead of a full rebuild
+	CrateIndexCache *CrateIndexCache
+
+	// NormalizeSchema rewrites v1 and v2 entries into one canonical form
+	NormalizeSchema bool
+
+	// StripFields are dotted paths of fields removed from every entry
+	// before it is written
+	StripFields []string
+
+	// MinVersions, if set, skips versions below per-crate or global floors
+	MinVersions *MinVersions
+
+	// LatestN, if positive, organizes only each crate's LatestN highest
+	// versions, not counting prereleases when they are skipped
+	LatestN int
+
+	// Prereleases is how semver prerelease versions are handled: one of
+	// PrereleasesInclude, PrereleasesSkip, or PrereleasesSeparate
+	Prereleases string
+
+	// ListYanked makes -list-missing include yanked versions
+	ListYanked bool
+
+	// ValidateDeps checks each dependency's "req" against semver requirement syntax
+	ValidateDeps bool
+
+	// CheckNames compares each entry's "name" with the name in its crate
+	// file's name; it does nothing in CrateIDMode, where names come from entries
+	CheckNames bool
 }
 
-// NewWorker creates a new worker
-func NewWorker(id int, metadataFiles chan string, crateIndex FileIndex, mirrorDir string, dryRun bool, wg *sync.WaitGroup, logger *Logger, results chan [2]int) *Worker {
-	return &Worker{
-		id:            id,
-		metadataFiles: metadataFiles,
-		crateIndex:    crateIndex,
-		mirrorDir:     mirrorDir,
-		dryRun:        dryRun,
-		wg:            wg,
-		logger:        logger,
-		results:       results,
-	}
+// FileResult holds the counts produced by processing a single metadata file
+type FileResult struct {
+	Path    string `json:"path"`
+	Crate   string `json:"crate"`
+	Success int    `json:"success"`
+	Total   int    `json:"total"`
+	Missing int    `json:"missing"`
+	Errors  int    `json:"errors"`
+	Aliased int    `json:"aliased,omitempty"`
+
+	// MissingVersions are the "{crate}-{version}" ids with no crate file
+	MissingVersions []string `json:"missing_versions,omitempty"`
+
+	// Source is the index the file came from (SourceMain or SourceLocal)
+	Source string `json:"source"`
+
+	// bytes is the size of the index file, for progress
+	bytes int64
+
+	// Overridden counts versions skipped because the local index has them
+	Overridden int `json:"overridden,omitempty"`
+
+	// PartialWrites counts versions written to some destinations but not all
+	PartialWrites int `json:"partial_writes,omitempty"`
+
+	// Filtered counts entries skipped by Options.EntryFilter
+	Filtered int `json:"filtered,omitempty"`
+
+	// Collisions counts output paths already claimed by another crate version
+	Collisions int `json:"collisions,omitempty"`
+
+	// CaseCollisions counts output paths differing only by case from one
+	// already claimed
+	CaseCollisions int `json:"case_collisions,omitempty"`
+
+	// DuplicateKeys counts entries rejected by the strict JSON check
+	DuplicateKeys int `json:"duplicate_keys,omitempty"`
+
+	// LatestUpdated counts latest pointers created or changed
+	LatestUpdated int `json:"latest_updated,omitempty"`
+
+	// BundlesUpdated counts aggregate bundles created or changed
+	BundlesUpdated int `json:"bundles_updated,omitempty"`
+
+	// Retries are the versions with failed writes, for the retry passes
+	Retries []*RetryVersion `json:"-"`
+
+	// Compacted counts entries kept in the compacted index
+	Compacted int `json:"compacted,omitempty"`
+
+	// SnapshotSkipped is 1 if the whole file was skipped as unchanged
+	SnapshotSkipped int `json:"snapshot_skipped,omitempty"`
+
+	// IndexChanged is 1 if the file was processed because its index file
+	// changed since the snapshot
+	IndexChanged int `json:"index_changed,omitempty"`
+
+	// MirrorChanged counts versions whose crate file changed since their
+	// metadata was written, with the index file unchanged
+	MirrorChanged int `json:"mirror_changed,omitempty"`
+
+	// NewlyMissing counts missing versions that were not missing in the baseline
+	NewlyMissing int `json:"newly_missing,omitempty"`
+
+	// Crate files that matched their entry's cksum with -verify-checksum,
+	// that did not or could not be read, and entries without a cksum
+	ChecksumPassed  int `json:"checksum_passed,omitempty"`
+	ChecksumFailed  int `json:"checksum_failed,omitempty"`
+	ChecksumMissing int `json:"checksum_missing,omitempty"`
+
+	// Stripped counts entries that had fields removed by -strip-fields
+	Stripped int `json:"stripped,omitempty"`
+
+	// Prereleases counts semver prerelease versions; PrereleasesSkipped of
+	// them were left out by -prereleases skip and are not in Total
+	Prereleases          int `json:"prereleases,omitempty"`
+	PrereleasesSkipped   int `json:"prereleases_skipped,omitempty"`
+	PrereleasesOrganized int `json:"prereleases_organized,omitempty"`
+
+	// ParseCacheHits is 1 if the file's entries came from the parse cache,
+	// and ParseCacheMisses is 1 if they were parsed and stored in it
+	ParseCacheHits   int `json:"parse_cache_hits,omitempty"`
+	ParseCacheMisses int `json:"parse_cache_misses,omitempty"`
+
+	// BelowMin counts versions skipped as below the crate's -min-version
+	// floor; they are not in Total. NoVersionAboveMin is 1 if that was all of them.
+	BelowMin          int `json:"below_min,omitempty"`
+	NoVersionAboveMin int `json:"no_version_above_min,omitempty"`
+
+	// SkippedOld counts versions skipped as older than the crate's newest
+	// Options.LatestN; they are not in Total
+	SkippedOld int `json:"skipped_old,omitempty"`
+
+	// ParseCacheRebuilt is 1 if the file's cache entry was corrupt or of
+	// another format version and was rebuilt
+	ParseCacheRebuilt int `json:"parse_cache_rebuilt,omitempty"`
+
+	// InvalidDeps counts versions with at least one malformed dependency requirement
+	InvalidDeps int `json:"invalid_deps,omitempty"`
+
+	// InvalidDepVersions are the "{crate}-{version}" ids counted in InvalidDeps
+	InvalidDepVersions []string `json:"invalid_dep_versions,omitempty"`
+
+	// NameMismatches are the "{crate}-{version}" ids whose entry name
+	// disagrees with their crate file's name
+	NameMismatches []string `json:"name_mismatches,omitempty"`
+
+	// NormalizedV1 and NormalizedV2 count entries rewritten by -normalize-schema
+	// by their original schema version; UnknownSchema counts entries with a
+	// schema version newer than this tool knows, passed through unmodified
+	NormalizedV1  int `json:"normalized_v1,omitempty"`
+	NormalizedV2  int `json:"normalized_v2,omitempty"`
+	UnknownSchema int `json:"unknown_schema,omitempty"`
+
+	// InvalidLinks counts entries whose links field is neither a string nor null
+	InvalidLinks int `json:"invalid_links,omitempty"`
+
+	// InvalidName is 1 if the index file name is not a valid crate name
+	InvalidName int `json:"invalid_name,omitempty"`
+
+	// TimedOut is 1 if the file was abandoned after Options.PerFileTimeout
+	TimedOut int `json:"timed_out,omitempty"`
+
+	// Dry-run diff classification of the files that would be written
+	DiffCreated   int `json:"diff_created,omitempty"`
+	DiffChanged   int `json:"diff_changed,omitempty"`
+	DiffUnchanged int `json:"diff_unchanged,omitempty"`
+
+	// Entries counts the index lines read, and Outcomes how many of them
+	// ended in each terminal outcome; every entry ends in exactly one
+	Entries  int            `json:"entries,omitempty"`
+	Outcomes map[string]int `json:"outcomes,omitempty"`
 }
 
-// Start starts the worker
-func (w *Worker) Start() {
-	defer w.wg.Done()
+// Terminal outcomes of an index entry. Entries ending in the first four are
+// counted in Versions; the rest were left out before that.
+const (
+	OutcomeOrganized         = "organized"
+	OutcomeMissing           = "missing"
+	OutcomeFailed            = "failed"
+	OutcomeRejected          = "rejected"
+	OutcomeParseError        = "parse_error"
+	OutcomeNoVersion         = "no_version"
+	OutcomeOverridden        = "overridden"
+	OutcomeFiltered          = "filtered"
+	OutcomePrereleaseSkipped = "prerelease_skipped"
+	OutcomeBelowMin          = "below_min"
+	OutcomeSkippedOld        = "skipped_old"
+)
 
-	for metadataFile := range w.metadataFiles {
-		success, total := ProcessMetadataFile(metadataFile, w.crateIndex, w.mirrorDir, w.dryRun, w.logger)
-		w.results <- [2]int{success, total}
+// versionOutcomes are the outcomes of entries counted in Versions
+var versionOutcomes = []string{OutcomeOrganized, OutcomeMissing, OutcomeFailed, OutcomeRejected}
+
+// outcome records an entry's terminal outcome
+func (r *FileResult) outcome(category string) {
+	if r.Outcomes == nil {
+		r.Outcomes = make(map[string]int)
 	}
+	r.Outcomes[category]++
 }
 
-// OrganizeMetadata organizes metadata files from index directory to be alongside crate files
-func OrganizeMetadata(indexDir, mirrorDir string, numWorkers int, dryRun bool, logger *Logger) (int, int, error) {
-	// Build index of crate files
-	crateIndex, err := BuildCrateFileIndex(mirrorDir, logger)
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to build crate file index: %v", err)
-	}
+// Report summarizes the outcome of an organize run
+type Report struct {
+	Files    int           `json:"files"`
+	Versions int           `json:"versions"`
+	Success  int           `json:"success"`
+	Missing  int           `json:"missing"`
+	Errors   int           `json:"errors"`
+	Aliased  int           `json:"aliased"`
+	Duration time.Duration `json:"duration_ns"`
 
-	// Find all metadata files
-	metadataFiles, err := FindMetadataFiles(indexDir, logger)
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to find metadata files: %v", err)
-	}
+	// RunID identifies the run in logs, reports, and the lock file
+	RunID string `json:"run_id,omitempty"`
 
-	totalFiles := len(metadataFiles)
-	logger.Info("Processing %d metadata files...", totalFiles)
+	// Labels are the run's -label annotations
+	Labels Labels `json:"labels,omitempty"`
 
-	if dryRun {
-		logger.Info("DRY RUN: No files will be created")
-	}
+	// Registry is the registry of a -registries run
+	Registry string `json:"registry,omitempty"`
 
-	// Create channel for metadata files
-	metadataFileChan := make(chan string, totalFiles)
+	// Canonicalization is the CanonicalizationVersion of the content hashes
+	// recorded in manifests, if any were
+	Canonicalization int `json:"canonicalization,omitempty"`
 
-	// Create channel for results
-	resultsChan := make(chan [2]int, totalFiles)
+	// DirManifests counts the directory manifests written
+	DirManifests int `json:"dir_manifests,omitempty"`
 
-	// Create wait group for workers
-	var wg sync.WaitGroup
+	// Shards is the shard expression the run was restricted to, if any
+	Shards string `json:"shards,omitempty"`
 
-	// Start workers
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		worker := NewWorker(i, metadataFileChan, crateIndex, mirrorDir, dryRun, &wg, logger, resultsChan)
-		go worker.Start()
-	}
+	// TrashFiles and TrashBytes are what the mirror's trash holds after the run
+	TrashFiles int   `json:"trash_files"`
+	TrashBytes int64 `json:"trash_bytes"`
 
-	// Send metadata files to workers
-	for _, file := range metadataFiles {
-		metadataFileChan <- file
-	}
-	close(metadataFileChan)
+	// SymlinksReplaced counts symlinks at metadata output paths replaced
+	// by real files, and SymlinksWrittenThrough the valid ones written
+	// through with -preserve-symlinks
+	SymlinksReplaced       int `json:"symlinks_replaced"`
+	SymlinksWrittenThrough int `json:"symlinks_written_through"`
 
-	// Create a goroutine to close the results channel when all workers are done
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-	}()
+	PartialWrites  int                          `json:"partial_writes"`
+	Overridden     int                          `json:"overridden"`
+	Sources        map[string]*SourceCounts     `json:"sources,omitempty"`
+	Filtered       int                          `json:"filtered"`
+	Collisions     int                          `json:"collisions"`
+	CaseCollisions int                          `json:"case_collisions"`
+	DuplicateKeys  int                          `json:"duplicate_keys"`
+	LatestUpdated  int                          `json:"latest_updated"`
+	BundlesUpdated int                          `json:"bundles_updated"`
+	Rescued        int                          `json:"rescued"`
+	RetryFailed    int                          `json:"retry_failed"`
+	Compacted      int                          `json:"compacted"`
+	FutureMtimes   int                          `json:"future_mtimes"`
+	AncientMtimes  int                          `json:"ancient_mtimes"`
+	FixedMtimes    int                          `json:"fixed_mtimes"`
+	Destinations   map[string]DestinationCounts `json:"destinations,omitempty"`
 
-	// Collect results
-	successCount := 0
-	totalVersions := 0
-	processed := 0
+	// MirrorCaseCollisions counts the mirror's crate files whose names
+	// differ from another's only by case
+	MirrorCaseCollisions int `json:"mirror_case_collisions,omitempty"`
 
-	// Create a ticker for progress updates
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	// Partial is set when the run stopped before dispatching every index file
+	Partial      bool `json:"partial"`
+	FilesPending int  `json:"files_pending"`
 
-	// Create a done channel that will be closed when all results are collected
-	done := make(chan struct{})
+	// LockfileNotInIndex and LockfileMissing count the versions pinned by
+	// Options.Lockfile that are not in the index or not in the mirror
+	LockfileNotInIndex int `json:"lockfile_not_in_index,omitempty"`
+	LockfileMissing    int `json:"lockfile_missing,omitempty"`
 
-	// Start a goroutine to collect results
-	go func() {
-		for result := range resultsChan {
-			successCount += result[0]
-			totalVersions += result[1]
-			processed++
+	// SanityFailed is set when the sanity check found the index and mirror
+	// mismatched, and SanityAborted when the run was stopped for it
+	SanityFailed  bool `json:"sanity_failed,omitempty"`
+	SanityAborted bool `json:"sanity_aborted,omitempty"`
 
-			// Print progress every 1000 files
-			if processed%1000 == 0 {
-				logger.Info("Progress: %d/%d files processed (%.2f%%)", processed, totalFiles, float64(processed)/float64(totalFiles)*100)
-			}
-		}
-		close(done)
-	}()
+	// Backfilled counts the missing versions a daemon organized after the
+	// run, when their crate files arrived
+	Backfilled int `json:"backfilled,omitempty"`
 
-	// Wait for all results to be collected or print progress every second
-	for {
-		select {
-		case <-done:
-			return successCount, totalVersions, nil
-		case <-ticker.C:
-			logger.Info("Progress: %d/%d files processed (%.2f%%)", processed, totalFiles, float64(processed)/float64(totalFiles)*100)
-		}
-	}
-}
+	// ETAChecks compare the ETA at milestones of the run with the time the
+	// rest of it actually took
+	ETAChecks []ETACheck `json:"eta_checks,omitempty"`
 
-func main() {
-	// Parse command line arguments
-	indexDir := flag.String("index-dir", "E:\\crates.io-index", "Directory containing the crates.io index")
-	mirrorDir := flag.String("mirror-dir", "E:\\crates-mirror", "Directory containing the mirrored crates")
-	logPath := flag.String("log-path", "E:\\metadata-organize-log.txt", "Path to log file")
-	threads := flag.Int("threads", runtime.NumCPU(), "Number of worker threads")
-	dryRun := flag.Bool("dry-run", false, "Dry run mode (no files will be created)")
+	// Verified is set when -then-verify checked the run's outputs, and
+	// VerifyFailures counts the verification passes that found problems
+	Verified       bool `json:"verified,omitempty"`
+	VerifyFailures int  `json:"verify_failures,omitempty"`
 
-	flag.Parse()
+	// Segments is how many runs a job resumed from a checkpoint took
+	Segments int `json:"segments,omitempty"`
 
-	// Create logger
-	logger, err := NewLogger(*logPath)
-	if err != nil {
-		fmt.Printf("Failed to create logger: %v\n", err)
-		os.Exit(1)
-	}
+	// missingByCrate counts missing versions per crate for the HTML report
+	missingByCrate map[string]int
 
-	logger.Info("Starting organization of metadata from %s to %s", *indexDir, *mirrorDir)
+	// Tail is how long the workers ran after the last file was dispatched,
+	// while fewer than all of them had work
+	Tail time.Duration `json:"tail_ns"`
 
-	// Check if directories exist
-	if _, err := os.Stat(*indexDir); os.IsNotExist(err) {
-		logger.Error("Index directory %s does not exist", *indexDir)
-		os.Exit(1)
-	}
+	SnapshotSkipped   int `json:"snapshot_skipped"`
+	IndexChanged      int `json:"index_changed"`
+	MirrorChanged     int `json:"mirror_changed"`
+	ParseCacheHits    int `json:"parse_cache_hits"`
+	ParseCacheMisses  int `json:"parse_cache_misses"`
+	ParseCacheRebuilt int `json:"parse_cache_rebuilt"`
 
-	if _, err := os.Stat(*mirrorDir); os.IsNotExist(err) {
-		logger.Error("Mirror directory %s does not exist", *mirrorDir)
-		os.Exit(1)
-	}
+	// CacheCompaction is the parse cache compaction after the run, if any
+	CacheCompaction *CompactReport `json:"cache_compaction,omitempty"`
 
-	// Record start time
-	startTime := time.Now()
+	// BelowMin counts versions below their crate's floor, and
+	// NoVersionAboveMin the crates with no version at or above it
+	BelowMin          int `json:"below_min"`
+	NoVersionAboveMin int `json:"no_version_above_min"`
 
-	// Organize metadata
-	successCount, totalVersions, err := OrganizeMetadata(*indexDir, *mirrorDir, *threads, *dryRun, logger)
-	if err != nil {
-		logger.Error("Failed to organize metadata: %v", err)
-		os.Exit(1)
-	}
+	// SkippedOld counts versions older than their crate's newest -latest-n
+	SkippedOld int `json:"skipped_old,omitempty"`
 
-	// Record end time
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
+	// NewlyMissing and NoLongerMissing compare the missing versions with
+	// the baseline of the last run
+	NewlyMissing    int `json:"newly_missing"`
+	NoLongerMissing int `json:"no_longer_missing"`
 
-	// Log results
-	if *dryRun {
-		logger.Info("DRY RUN COMPLETE: Would have organized %d out of %d version metadata files in %v", successCount, totalVersions, duration)
-	} else {
-		logger.Info("Organization complete: %d out of %d version metadata files successfully organized in %v", successCount, totalVersions, duration)
+	// Results of -verify-checksum
+	ChecksumPassed  int `json:"checksum_passed"`
+	ChecksumFailed  int `json:"checksum_failed"`
+	ChecksumMissing int `json:"checksum_missing"`
+
+	// RemovedCrates counts crates gone from the index since the last run,
+	// RemovedMirrored their crate files still in the mirror, and
+	// Quarantined those moved to the quarantine directory
+	RemovedCrates   int `json:"removed_crates,omitempty"`
+	RemovedMirrored int `json:"removed_mirrored,omitempty"`
+	Quarantined     int `json:"quarantined,omitempty"`
+
+	Stripped       int `json:"stripped"`
+	InvalidDeps    int `json:"invalid_deps"`
+	NameMismatches int `json:"name_mismatches"`
+
+	// Prereleases are counted apart so stable coverage can be reported
+	Prereleases          int `json:"prereleases"`
+	PrereleasesSkipped   int `json:"prereleases_skipped"`
+	PrereleasesOrganized int `json:"prereleases_organized"`
+	NormalizedV1         int `json:"normalized_v1"`
+	NormalizedV2         int `json:"normalized_v2"`
+	UnknownSchema        int `json:"unknown_schema"`
+	InvalidLinks         int `json:"invalid_links"`
+	InvalidNames         int `json:"invalid_names"`
+	TimedOut             int `json:"timed_out"`
+
+	DiffCreated   int `json:"diff_created"`
+	DiffChanged   int `json:"diff_changed"`
+	DiffUnchanged int `json:"diff_unchanged"`
+
+	// Entries counts the index lines read, and Categories how many ended in
+	// each terminal outcome (the Outcome constants); see CheckAccounting
+	Entries    int            `json:"entries"`
+	Categories map[string]int `json:"categories"`
+}
+
+// CheckAccounting verifies that every entry read ended in exactly one
+// terminal outcome, and that the outcomes of the versions counted add up to
+// Versions
+func (r *Report) CheckAccounting() error {
+	total := 0
+	for _, count := range r.Categories {
+		total += count
+	}
+	if total != r.Entries {
+		return fmt.Errorf("%d entries read but %d outcomes recorded", r.Entries, total)
 	}
+	versions := 0
+	for _, category := range versionOutcomes {
+		versions += r.Categories[category]
+	}
+	if versions != r.Versions {
+		return fmt.Errorf("%d versions counted but %d version outcomes recorded", r.Versions, versions)
+	}
+	return nil
+}
+
+// SourceCounts are the counts for the index files from one index source
+type SourceCounts struct {
+	Files    int `json:"files"`
+	Versions int `json:"versions"`
+	Success  int `json:"success"`
+	Missing  int `json:"missing"`
+}
 
-	os.Exit(0)
+// Add folds the counts from one processed metadata file into the report
+func (r *Report) Add(result FileResult) {
+	r.Files++
+	r.Versions += result.Total
+	r.Success += result.Success
+	r.Missing += result.Missing
+	r.Errors += result.Errors
+	r.Aliased += result.Aliased
+	r.PartialWrites += result.PartialWrites
+	r.Overridden += result.Overridden
+	if result.Source != "" {
+		if r.Sources == nil {
+			r.Sources = make(map[string]*SourceCounts)
+		}
+		counts, ok := r.Sources[result.Source]
+		if !ok {
+			counts = &SourceCounts{}
+			r.Sources[result.Source] = counts
+		}
+		counts.Files++
+		counts.Versions += result.Total
+		counts.Success += result.Success
+		counts.Missing += result.Missing
+	}
+	r.Filtered += result.Filtered
+	r.Collisions += result.Collisions
+	r.CaseCollisions += result.CaseCollisions
+	r.DuplicateKeys += result.DuplicateKeys
+	r.LatestUpdated += result.LatestUpdated
+	r.BundlesUpdated += result.BundlesUpdated
+	r.Compacted += result.Compacted
+	r.SnapshotSkipped += result.SnapshotSkipped
+	r.IndexChanged += result.IndexChanged
+	r.MirrorChanged += result.MirrorChanged
+	r.ParseCacheHits += result.ParseCacheHits
+	r.NewlyMissing += result.NewlyMissing
+	r.ChecksumPassed += result.ChecksumPassed
+	r.ChecksumFailed += result.ChecksumFailed
+	r.ChecksumMissing += result.ChecksumMissing
+	r.Stripped += result.Stripped
+	r.Prereleases += result.Prereleases
+	r.PrereleasesSkipped += result.PrereleasesSkipped
+	r.PrereleasesOrganized += result.PrereleasesOrganized
+	r.ParseCacheMisses += result.ParseCacheMisses
+	r.ParseCacheRebuilt += result.ParseCacheRebuilt
+	r.BelowMin += result.BelowMin
+	r.NoVersionAboveMin += result.NoVersionAboveMin
+	r.SkippedOld += result.SkippedOld
+	r.InvalidDeps += result.InvalidDeps
+	r.NameMismatches += len(result.NameMismatches)
+	r.NormalizedV1 += result.NormalizedV1
+	r.NormalizedV2 += result.NormalizedV2
+	r.UnknownSchema += result.UnknownSchema
+	r.InvalidLinks += result.InvalidLinks
+	r.InvalidNames += result.InvalidName
+	r.TimedOut += result.TimedOut
+	r.DiffCreated += result.DiffCreated
+	r.DiffChanged += result.DiffChanged
+	r.DiffUnchanged += result.DiffUnchanged
+	r.Entries += result.Entries
+	for category, count := range result.Outcomes {
+		if r.Categories == nil {
+			r.Categories = make(map[string]int)
+		}
+		r.Categories[category] += count
+	}
+}
+
+// Merge adds the counts of other, a report built by Add such as a worker's
+// tally of the files it processed, to r
+func (r *Report) Merge(other *Report) {
+	r.Files += other.Files
+	r.Versions += other.Versions
+	r.Success += other.Success
+	r.Missing += other.Missing
+	r.Errors += other.Errors
+	r.Aliased += other.Aliased
+	r.PartialWrites += other.PartialWrites
+	r.Overridden += other.Overridden
+	for source, counts := range other.Sources {
+		if r.Sources == nil {
+			r.Sources = make(map[string]*SourceCounts)
+		}
+		total, ok := r.Sources[source]
+		if !ok {
+			total = &SourceCounts{}
+			r.Sources[source] = total
+		}
+		total.Files += counts.Files
+		total.Versions += counts.Versions
+		total.Success += counts.Success
+		total.Missing += counts.Missing
+	}
+	r.Filtered += other.Filtered
+	r.Collisions += other.Collisions
+	r.CaseCollisions += other.CaseCollisions
+	r.DuplicateKeys += other.DuplicateKeys
+	r.LatestUpdated += other.LatestUpdated
+	r.BundlesUpdated += other.BundlesUpdated
+	r.Compacted += other.Compacted
+	r.SnapshotSkipped += other.SnapshotSkipped
+	r.IndexChanged += other.IndexChanged
+	r.MirrorChanged += other.MirrorChanged
+	r.ParseCacheHits += other.ParseCacheHits
+	r.NewlyMissing += other.NewlyMissing
+	r.ChecksumPassed += other.ChecksumPassed
+	r.ChecksumFailed += other.ChecksumFailed
+	r.ChecksumMissing += other.ChecksumMissing
+	r.Stripped += other.Stripped
+	r.Prereleases += other.Prereleases
+	r.PrereleasesSkipped += other.PrereleasesSkipped
+	r.PrereleasesOrganized += other.PrereleasesOrganized
+	r.ParseCacheMisses += other.ParseCacheMisses
+	r.ParseCacheRebuilt += other.ParseCacheRebuilt
+	r.BelowMin += other.BelowMin
+	r.NoVersionAboveMin += other.NoVersionAboveMin
+	r.SkippedOld += other.SkippedOld
+	r.InvalidDeps += other.InvalidDeps
+	r.NameMismatches += other.NameMismatches
+	r.NormalizedV1 += other.NormalizedV1
+	r.NormalizedV2 += other.NormalizedV2
+	r.UnknownSchema += other.UnknownSchema
+	r.InvalidLinks += other.InvalidLinks
+	r.InvalidNames += other.InvalidNames
+	r.TimedOut += other.TimedOut
+	r.DiffCreated += other.DiffCreated
+	r.DiffChanged += other.DiffChanged
+	r.DiffUnchanged += other.DiffUnchanged
+	r.Entries += other.Entries
+	for category, count := range other.Categories {
+		if r.Categories == nil {
+			r.Categories = make(map[string]int)
+		}
+		r.Categories[category] += count
+	}
+}
+
+// crockfordBase32 is the alphabet ULIDs are encoded in
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewRunID returns a ULID: a 48-bit millisecond timestamp and 80 random
+// bits in 26 Crockford base32 characters, so IDs sort by start time
+func NewRunID() string {
+	var id [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*uint(i)))
+	}
+	rand.Read(id[6:])
+
+	// 128 bits as 26 five-bit groups, the first holding only 3 bits
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		bit := 128 - 5*(26-i)
+		var v int
+		for b := 0; b < 5; b++ {
+			pos := bit + b
+			if pos >= 0 && id[pos/8]&(0x80>>uint(pos%8)) != 0 {
+				v |= 0x10 >> uint(b)
+			}
+		}
+		out[i] = crockfordBase32[v]
+	}
+	return string(out)
+}
+
+// ValidateRunID checks that a run ID given with -run-id can be used in logs
+// and file names
+func ValidateRunID(id string) error {
+	if id == "" || len(id) > 64 {
+		return fmt.Errorf("run ID must be 1 to 64 characters")
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("run ID %q may only contain letters, digits, '-', '_', and '.'", id)
+		}
+	}
+	return nil
+}
+
+// isRemoteURL reports whether a path is a URL such as sftp://host/dir
+func isRemoteURL(path string) bool {
+	i := strings.Index(path, "://")
+	return i > 0 && !strings.ContainsAny(path[:i], `/\`)
+}
+
+// RunIDPlaceholder in an output path is replaced by the run ID
+const RunIDPlaceholder = "{run}"
+
+// IgnoreFileName is the name of the ignore file read from the mirror root
+const IgnoreFileName = ".organizeignore"
+
+// IgnorePattern is a single gitignore-style pattern from the ignore file
+type IgnorePattern struct {
+	Raw      string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	Matched  int
+}
+
+// IgnoreMatcher matches paths below the mirror root against ignore patterns
+type IgnoreMatcher struct {
+	root     string
+	patterns []*IgnorePattern
+	mu       sync.Mutex
+}
+
+// LoadIgnoreFile reads the ignore file from the mirror root. It returns a nil
+// matcher (which ignores nothing) if the file does not exist.
+func LoadIgnoreFile(mirrorDir string) (*IgnoreMatcher, error) {
+	content, err := ioutil.ReadFile(filepath.Join(mirrorDir, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", IgnoreFileName, err)
+	}
+
+	matcher := &IgnoreMatcher{root: mirrorDir}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern := &IgnorePattern{Raw: line}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A pattern containing a slash (other than a trailing one) is relative to the root
+		if strings.Contains(line, "/") {
+			pattern.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		pattern.segments = strings.Split(line, "/")
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+
+	return matcher, nil
+}
+
+// Match reports whether a path below the mirror root is ignored. The last
+// matching pattern wins, so a later negated pattern re-includes a path.
+func (m *IgnoreMatcher) Match(path string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+
+	var decided *IgnorePattern
+	for _, pattern := range m.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.matches(segments) {
+			decided = pattern
+		}
+	}
+	if decided == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	decided.Matched++
+	m.mu.Unlock()
+
+	return !decided.negate
+}
+
+// matches checks the pattern against the segments of a root-relative path
+func (p *IgnorePattern) matches(segments []string) bool {
+	if p.anchored {
+		return matchSegments(p.segments, segments)
+	}
+	// Unanchored patterns match the final path component at any depth
+	return matchSegments(p.segments, segments[len(segments)-1:])
+}
+
+// matchSegments matches glob segments against path segments, with "**"
+// matching zero or more whole segments
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// ResetCounts clears the per-pattern match counts before a new run
+func (m *IgnoreMatcher) ResetCounts() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pattern := range m.patterns {
+		pattern.Matched = 0
+	}
+}
+
+// LogCounts logs how many paths each ignore pattern decided
+func (m *IgnoreMatcher) LogCounts(logger *Logger) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pattern := range m.patterns {
+		logger.Info("Ignore pattern %q matched %d paths", pattern.Raw, pattern.Matched)
+	}
+}
+
+// RenameMap maps renamed crates between their old and new names
+type RenameMap struct {
+	canonical map[string]string
+	aliases   map[string][]string
+}
+
+// LoadRenameMap reads old-name to new-name pairs from a JSON object
+// ({"old": "new"}) or, for any other extension, a two-column CSV file
+func LoadRenameMap(path string) (*RenameMap, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rename map: %v", err)
+	}
+
+	pairs := make(map[string]string)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(content, &pairs); err != nil {
+			return nil, fmt.Errorf("failed to parse rename map %s: %v", path, err)
+		}
+	} else {
+		reader := csv.NewReader(strings.NewReader(string(content)))
+		reader.Comment = '#'
+		reader.FieldsPerRecord = 2
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rename map %s: %v", path, err)
+		}
+		for i, record := range records {
+			// Allow an optional header row
+			if i == 0 && strings.EqualFold(record[0], "old") && strings.EqualFold(record[1], "new") {
+				continue
+			}
+			pairs[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+		}
+	}
+
+	renames := &RenameMap{
+		canonical: make(map[string]string),
+		aliases:   make(map[string][]string),
+	}
+	for oldName, newName := range pairs {
+		if oldName == newName {
+			return nil, fmt.Errorf("invalid rename map entry %q -> %q", oldName, newName)
+		}
+		for _, name := range []string{oldName, newName} {
+			if err := indexentry.ValidateName(name); err != nil {
+				return nil, fmt.Errorf("invalid rename map entry %q -> %q: %v", oldName, newName, err)
+			}
+		}
+		renames.canonical[oldName] = newName
+		renames.aliases[oldName] = append(renames.aliases[oldName], newName)
+		renames.aliases[newName] = append(renames.aliases[newName], oldName)
+	}
+	for name := range renames.aliases {
+		sort.Strings(renames.aliases[name])
+	}
+
+	return renames, nil
+}
+
+// Len returns the number of rename pairs in the map
+func (r *RenameMap) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.canonical)
+}
+
+// Aliases returns the other names a crate has been known by, in either direction
+func (r *RenameMap) Aliases(name string) []string {
+	if r == nil {
+		return nil
+	}
+	return r.aliases[name]
+}
+
+// Canonical returns the current name for a crate, following renames
+func (r *RenameMap) Canonical(name string) string {
+	if r == nil {
+		return name
+	}
+	// Follow chains of renames, guarding against cycles in the map
+	for i := 0; i < len(r.canonical); i++ {
+		newName, ok := r.canonical[name]
+		if !ok {
+			break
+		}
+		name = newName
+	}
+	return name
+}
+
+// NormalizedSchemaVersion is the "v" of every entry written with
+// -normalize-schema: features2 merged into features, which is the v2 form
+const NormalizedSchemaVersion = 2
+
+// schemaVersion returns an entry's "v" field, 1 if it has none, and whether
+// it is a version this tool understands
+func schemaVersion(entry MetadataEntry) (int, bool) {
+	raw, ok := entry["v"]
+	if !ok || raw == nil {
+		return 1, true
+	}
+	f, ok := raw.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), f == 1 || f == 2
+}
+
+// normalizeSchema rewrites a v1 or v2 entry into canonical form: features2
+// is merged into features, appending any values a feature has in both, and
+// "v" is set to NormalizedSchemaVersion. It returns the entry's original
+// schema version and whether it was known; unknown versions are untouched.
+func normalizeSchema(entry MetadataEntry) (int, bool) {
+	version, known := schemaVersion(entry)
+	if !known {
+		return version, false
+	}
+
+	if features2, ok := entry["features2"].(map[string]interface{}); ok {
+		features, _ := entry["features"].(map[string]interface{})
+		if features == nil {
+			features = make(map[string]interface{}, len(features2))
+		}
+		for name, values := range features2 {
+			existing, _ := features[name].([]interface{})
+			added, _ := values.([]interface{})
+			seen := make(map[interface{}]bool, len(existing))
+			for _, value := range existing {
+				seen[value] = true
+			}
+			for _, value := range added {
+				if !seen[value] {
+					existing = append(existing, value)
+					seen[value] = true
+				}
+			}
+			if existing == nil {
+				existing = []interface{}{}
+			}
+			features[name] = existing
+		}
+		entry["features"] = features
+	}
+	delete(entry, "features2")
+	entry["v"] = NormalizedSchemaVersion
+	return version, true
+}
+
+// MinVersions are version floors: versions of a crate below its floor are
+// skipped. Crates without a floor of their own use the global one, if any.
+// A nil MinVersions skips nothing.
+type MinVersions struct {
+	Global *Version
+	Crates map[string]Version
+}
+
+// ParseMinVersions parses the comma-separated crate=version floors of
+// -min-version and the -global-min-version floor. It returns nil if both are empty.
+func ParseMinVersions(spec, global string) (*MinVersions, error) {
+	if spec == "" && global == "" {
+		return nil, nil
+	}
+
+	floors := &MinVersions{Crates: make(map[string]Version)}
+	if global != "" {
+		v, err := indexentry.ParseVersion(global)
+		if err != nil {
+			return nil, err
+		}
+		floors.Global = &v
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not crate=version", pair)
+		}
+		v, err := indexentry.ParseVersion(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		floors.Crates[strings.ToLower(strings.TrimSpace(parts[0]))] = v
+	}
+	return floors, nil
+}
+
+// Floor returns the floor that applies to a crate, if any
+func (m *MinVersions) Floor(crate string) (Version, bool) {
+	if m == nil {
+		return Version{}, false
+	}
+	if v, ok := m.Crates[strings.ToLower(crate)]; ok {
+		return v, true
+	}
+	if m.Global != nil {
+		return *m.Global, true
+	}
+	return Version{}, false
+}
+
+// Below reports whether a version of a crate is below the crate's floor.
+// Versions that are not valid semver are never below it.
+func (m *MinVersions) Below(crate, version string) bool {
+	floor, ok := m.Floor(crate)
+	if !ok {
+		return false
+	}
+	v, err := indexentry.ParseVersion(version)
+	return err == nil && v.Compare(floor) < 0
+}
+
+// newestVersions returns the n highest versions among a crate's entries,
+// leaving out prereleases if stableOnly and the versions in skip. Versions
+// that are not valid semver are not ranked; the caller keeps them.
+func newestVersions(lines []parsedLine, n int, stableOnly bool, skip map[string]bool) map[string]bool {
+	seen := make(map[string]bool)
+	var versions []Version
+	var names []string
+	for _, parsed := range lines {
+		name := strings.TrimSpace(parsed.Entry.Version())
+		if name == "" || seen[name] || skip[name] {
+			continue
+		}
+		seen[name] = true
+		v, err := indexentry.ParseVersion(name)
+		if err != nil || (stableOnly && v.IsPrerelease()) {
+			continue
+		}
+		versions = append(versions, v)
+		names = append(names, name)
+	}
+
+	order := make([]int, len(versions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return versions[order[i]].Compare(versions[order[j]]) > 0
+	})
+	if len(order) > n {
+		order = order[:n]
+	}
+	newest := make(map[string]bool, len(order))
+	for _, i := range order {
+		newest[names[i]] = true
+	}
+	return newest
+}
+
+// ParseStripFields parses the comma-separated dotted paths of -strip-fields.
+// The fields that identify an entry, and the local info block, cannot be
+// stripped, so stripped documents still name their crate and version.
+func ParseStripFields(spec string) ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(spec, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		parts := strings.Split(path, ".")
+		for _, part := range parts {
+			if part == "" {
+				return nil, fmt.Errorf("invalid field path %q", path)
+			}
+		}
+		if len(parts) == 1 && (path == "name" || path == "vers") || parts[0] == LocalInfoKey {
+			return nil, fmt.Errorf("field %q cannot be stripped", path)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// stripField removes the field at a dotted path from value. When the path
+// reaches an array, the rest of the path is removed from each of its
+// elements, so "deps.registry" strips the registry of every dependency. It
+// reports whether anything was removed.
+func stripField(value interface{}, parts []string) bool {
+	switch v := value.(type) {
+	case MetadataEntry:
+		return stripField(map[string]interface{}(v), parts)
+	case map[string]interface{}:
+		child, ok := v[parts[0]]
+		if !ok {
+			return false
+		}
+		if len(parts) == 1 {
+			delete(v, parts[0])
+			return true
+		}
+		return stripField(child, parts[1:])
+	case []interface{}:
+		removed := false
+		for _, item := range v {
+			if stripField(item, parts) {
+				removed = true
+			}
+		}
+		return removed
+	default:
+		return false
+	}
+}
+
+// replayTransforms applies to an index entry the transformations recorded
+// in the local info block of the document written from it, so the two can
+// be compared
+func replayTransforms(doc, entry MetadataEntry) {
+	info, _ := doc[LocalInfoKey].(map[string]interface{})
+	if _, ok := info["normalized_from_v"]; ok {
+		normalizeSchema(entry)
+	}
+	stripped, _ := info["stripped_fields"].([]interface{})
+	for _, path := range stripped {
+		if path, ok := path.(string); ok {
+			stripField(entry, strings.Split(path, "."))
+		}
+	}
+}
+
+// invalidDependencyReqs returns the dependency names and requirements in a
+// metadata entry that fail indexentry.ValidateVersionReq
+func invalidDependencyReqs(metadata MetadataEntry) []string {
+	deps, ok := metadata["deps"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var invalid []string
+	for _, dep := range deps {
+		depMap, ok := dep.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		req, _ := depMap["req"].(string)
+		if err := indexentry.ValidateVersionReq(req); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%v %q (%v)", depMap["name"], req, err))
+		}
+	}
+	return invalid
+}
+
+// FieldChange is a single top-level field difference between two metadata documents
+type FieldChange struct {
+	Key string
+	Op  string // "+" added, "-" removed, "~" changed
+	Old interface{}
+	New interface{}
+}
+
+// String formats the change for the plan file and log
+func (c FieldChange) String() string {
+	switch {
+	case c.Key == "yanked" && c.Op == "~":
+		return fmt.Sprintf("! YANKED %s -> %s", formatDiffValue(c.Old), formatDiffValue(c.New))
+	case c.Op == "+":
+		return fmt.Sprintf("+ %s: %s", c.Key, formatDiffValue(c.New))
+	case c.Op == "-":
+		return fmt.Sprintf("- %s: %s", c.Key, formatDiffValue(c.Old))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Key, formatDiffValue(c.Old), formatDiffValue(c.New))
+	}
+}
+
+// formatDiffValue renders a field value compactly, truncating long values
+func formatDiffValue(v interface{}) string {
+	const maxLen = 80
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	if len(data) > maxLen {
+		return string(data[:maxLen]) + "..."
+	}
+	return string(data)
+}
+
+// DiffMetadata compares the top-level fields of two metadata documents and
+// returns the changes sorted by key
+func DiffMetadata(oldDoc, newDoc map[string]interface{}) []FieldChange {
+	var changes []FieldChange
+	for key, newValue := range newDoc {
+		oldValue, ok := oldDoc[key]
+		if !ok {
+			changes = append(changes, FieldChange{Key: key, Op: "+", New: newValue})
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, FieldChange{Key: key, Op: "~", Old: oldValue, New: newValue})
+		}
+	}
+	for key, oldValue := range oldDoc {
+		if _, ok := newDoc[key]; !ok {
+			changes = append(changes, FieldChange{Key: key, Op: "-", Old: oldValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// Plan records, during a dry run, how each metadata file that would be
+// written differs from the file already on disk
+type Plan struct {
+	mu       sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	logged   int
+	logLimit int
+}
+
+// maxPlanChanges caps the number of field changes listed for a single file
+const maxPlanChanges = 20
+
+// NewPlan creates a plan. If planPath is empty, diffs are only logged.
+// Diffs are logged for at most logLimit changed files.
+func NewPlan(planPath string, logLimit int) (*Plan, error) {
+	plan := &Plan{logLimit: logLimit}
+	if planPath != "" {
+		file, err := fsCreate(planPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create plan file: %v", err)
+		}
+		plan.file = file
+		plan.writer = bufio.NewWriter(file)
+	}
+	return plan, nil
+}
+
+// Compare classifies the metadata that would be written to outputPath as a
+// new file, a change, or a no-op, and records the field-level diff for changes
+func (p *Plan) Compare(outputPath string, metadata MetadataEntry, result *FileResult, logger *Logger) {
+	newJSON, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		logger.Error("Error marshaling JSON for %s: %v", outputPath, err)
+		return
+	}
+
+	existing, err := ioutil.ReadFile(outputPath)
+	if os.IsNotExist(err) {
+		result.DiffCreated++
+		p.record(outputPath, "CREATE", nil, logger)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read existing metadata file %s: %v", outputPath, err)
+		return
+	}
+
+	if bytes.Equal(existing, newJSON) {
+		result.DiffUnchanged++
+		p.record(outputPath, "NOOP", nil, logger)
+		return
+	}
+
+	// Compare via a JSON round trip so both sides have the same value types
+	var oldDoc, newDoc map[string]interface{}
+	if err := json.Unmarshal(existing, &oldDoc); err != nil {
+		oldDoc = map[string]interface{}{}
+	}
+	if err := json.Unmarshal(newJSON, &newDoc); err != nil {
+		logger.Error("Error re-parsing JSON for %s: %v", outputPath, err)
+		return
+	}
+
+	changes := DiffMetadata(oldDoc, newDoc)
+	if len(changes) == 0 {
+		// Same content, different formatting; the file would still be rewritten
+		result.DiffChanged++
+		p.record(outputPath, "REFORMAT", nil, logger)
+		return
+	}
+
+	result.DiffChanged++
+	p.record(outputPath, "CHANGE", changes, logger)
+}
+
+// record writes a plan entry to the plan file and, for the first changed
+// files, to the log
+func (p *Plan) record(outputPath, action string, changes []FieldChange, logger *Logger) {
+	lines := []string{fmt.Sprintf("%s %s", action, outputPath)}
+	for i, change := range changes {
+		if i == maxPlanChanges {
+			lines = append(lines, fmt.Sprintf("  ... %d more changes truncated", len(changes)-maxPlanChanges))
+			break
+		}
+		lines = append(lines, "  "+change.String())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.writer != nil {
+		for _, line := range lines {
+			p.writer.WriteString(line + "\n")
+		}
+	}
+
+	if action == "CHANGE" || action == "REFORMAT" {
+		if p.logged < p.logLimit {
+			logger.Info("Plan: %s", strings.Join(lines, "\n"))
+		} else if p.logged == p.logLimit && p.logLimit > 0 {
+			logger.Info("Plan: more than %d files would change; further diffs are only written to the plan file", p.logLimit)
+		}
+		p.logged++
+	}
+}
+
+// Close flushes and closes the plan file
+func (p *Plan) Close() error {
+	if p == nil || p.file == nil {
+		return nil
+	}
+	if err := p.writer.Flush(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// snapshotVersion is the format version of the snapshot file
+const snapshotVersion = 1
+
+// parsedLine is one JSON line of an index file, parsed. Err is the parse
+// error, if any, kept as text so it can be cached.
+type parsedLine struct {
+	Line  string
+	Entry MetadataEntry
+	Err   string
+}
+
+// parseIndexLines parses the lines of an index file that look like JSON
+// objects, skipping blank and other lines
+func parseIndexLines(content []byte) []parsedLine {
+	var parsed []parsedLine
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		entry, err := indexentry.ParseLine([]byte(line))
+		switch {
+		case err == indexentry.ErrNotEntry:
+		case err != nil:
+			parsed = append(parsed, parsedLine{Line: line, Err: err.Error()})
+		default:
+			parsed = append(parsed, parsedLine{Line: line, Entry: entry})
+		}
+	}
+	return parsed
+}
+
+// Snapshot maps crate names to the content hash of their index file as of
+// the last run, so crates whose index file is unchanged can be skipped
+type Snapshot struct {
+	path     string
+	previous map[string]string
+	mu       sync.Mutex
+	current  map[string]string
+}
+
+// snapshotFile is the on-disk form of a Snapshot
+type snapshotFile struct {
+	Version int               `json:"version"`
+	Crates  map[string]string `json:"crates"`
+}
+
+// LoadSnapshot reads the snapshot at path. A missing file yields an empty snapshot.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	snapshot := &Snapshot{
+		path:     path,
+		previous: make(map[string]string),
+		current:  make(map[string]string),
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	var data snapshotFile
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %v", path, err)
+	}
+	if data.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot %s has unsupported version %d", path, data.Version)
+	}
+	if data.Crates != nil {
+		snapshot.previous = data.Crates
+	}
+
+	return snapshot, nil
+}
+
+// Len returns the number of crates recorded by the previous run
+func (s *Snapshot) Len() int {
+	return len(s.previous)
+}
+
+// Unchanged reports whether a crate's index file hash matches the previous run
+func (s *Snapshot) Unchanged(crateName, hash string) bool {
+	return s.previous[crateName] == hash
+}
+
+// Record stores a crate's index file hash for the next run
+func (s *Snapshot) Record(crateName, hash string) {
+	s.mu.Lock()
+	s.current[crateName] = hash
+	s.mu.Unlock()
+}
+
+// Save writes the hashes recorded during this run, replacing the old snapshot
+func (s *Snapshot) Save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(snapshotFile{Version: snapshotVersion, Crates: s.current})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := fsWriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := fsRename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	// The saved hashes become the baseline for the next run in this process
+	s.mu.Lock()
+	s.previous = s.current
+	s.current = make(map[string]string)
+	s.mu.Unlock()
+	return nil
+}
+
+// DefaultMtimeSkew is how far in the future a file's mtime may be before it
+// is reported as clock skew
+const DefaultMtimeSkew = 24 * time.Hour
+
+// MinPlausibleMtime is the earliest plausible mtime for mirror and index
+// files; crates.io did not exist before 2014
+var MinPlausibleMtime = time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxMtimeExamples is how many example paths are kept for each kind of bad mtime
+const maxMtimeExamples = 5
+
+// PlausibleMtime reports whether modTime is neither before crates.io existed
+// nor more than skew after now
+func PlausibleMtime(modTime, now time.Time, skew time.Duration) bool {
+	return !modTime.Before(MinPlausibleMtime) && !modTime.After(now.Add(skew))
+}
+
+// MtimeCheck detects files with implausible modification times while the
+// mirror and index are walked: mtimes further in the future than the allowed
+// clock skew, and mtimes from before crates.io existed. With Fix set, future
+// mtimes are clamped to the start of the run.
+type MtimeCheck struct {
+	Skew   time.Duration
+	Fix    bool
+	DryRun bool
+
+	mu              sync.Mutex
+	now             time.Time
+	future          int
+	ancient         int
+	fixed           int
+	futureExamples  []string
+	ancientExamples []string
+}
+
+// NewMtimeCheck creates a check allowing the given clock skew
+func NewMtimeCheck(skew time.Duration, fix, dryRun bool) *MtimeCheck {
+	return &MtimeCheck{Skew: skew, Fix: fix, DryRun: dryRun, now: time.Now()}
+}
+
+// Reset clears the counts and takes a new reference time before a run
+func (m *MtimeCheck) Reset() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = time.Now()
+	m.future, m.ancient, m.fixed = 0, 0, 0
+	m.futureExamples, m.ancientExamples = nil, nil
+}
+
+// Check records a file's mtime if it is implausible, clamping future mtimes
+// to now when fixing is enabled
+func (m *MtimeCheck) Check(path string, modTime time.Time, logger *Logger) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if modTime.Before(MinPlausibleMtime) {
+		m.ancient++
+		if len(m.ancientExamples) < maxMtimeExamples {
+			m.ancientExamples = append(m.ancientExamples, fmt.Sprintf("%s (%s)", path, modTime.Format(time.RFC3339)))
+		}
+		return
+	}
+
+	if !modTime.After(m.now.Add(m.Skew)) {
+		return
+	}
+
+	m.future++
+	if len(m.futureExamples) < maxMtimeExamples {
+		m.futureExamples = append(m.futureExamples, fmt.Sprintf("%s (%s)", path, modTime.Format(time.RFC3339)))
+	}
+
+	if !m.Fix {
+		return
+	}
+	if m.DryRun {
+		logger.Info("DRY RUN: Would clamp mtime of %s from %s to now", path, modTime.Format(time.RFC3339))
+		m.fixed++
+		return
+	}
+	if err := fsChtimes(path, m.now, m.now); err != nil {
+		logger.Error("Failed to clamp mtime of %s: %v", path, err)
+		return
+	}
+	m.fixed++
+}
+
+// Summarize copies the counts into the report and logs them with examples
+func (m *MtimeCheck) Summarize(report *Report, logger *Logger) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report.FutureMtimes = m.future
+	report.AncientMtimes = m.ancient
+	report.FixedMtimes = m.fixed
+
+	if m.future > 0 {
+		logger.Warning("%d files have mtimes more than %v in the future (clock skew?), e.g. %s",
+			m.future, m.Skew, strings.Join(m.futureExamples, ", "))
+		if m.Fix && m.DryRun {
+			logger.Info("DRY RUN: Would clamp %d future mtimes to now", m.fixed)
+		} else if m.Fix {
+			logger.Info("Clamped %d future mtimes to %s", m.fixed, m.now.Format(time.RFC3339))
+		}
+	}
+	if m.ancient > 0 {
+		logger.Warning("%d files have mtimes before %s, e.g. %s",
+			m.ancient, MinPlausibleMtime.Format("2006-01-02"), strings.Join(m.ancientExamples, ", "))
+	}
+}
+
+// RetryVersion is a crate version with failed writes, queued for retry
+type RetryVersion struct {
+	ID     string
+	Source string
+	Data   []byte
+	Writes []*RetryWrite
+
+	// NoneWritten is set if the version failed on every destination
+	NoneWritten bool
+}
+
+// RetryWrite is one failed write of a RetryVersion
+type RetryWrite struct {
+	Dest *Destination
+	Path string
+	Done bool
+}
+
+// RetryFailedWrites makes up to opts.RetryPasses passes over the queued
+// versions, opts.RetryDelay apart, retrying only the writes that are still
+// failing. The report is updated so each version's status reflects its last
+// attempt, and the number of rescued and still failing versions is recorded.
+func RetryFailedWrites(queue []*RetryVersion, report *Report, opts *Options, logger *Logger) {
+	pending := queue
+	for pass := 1; pass <= opts.RetryPasses && len(pending) > 0; pass++ {
+		logger.Info("Retry pass %d/%d: retrying %d versions in %v", pass, opts.RetryPasses, len(pending), opts.RetryDelay)
+		time.Sleep(opts.RetryDelay)
+
+		var still []*RetryVersion
+		for _, version := range pending {
+			remaining := 0
+			for _, write := range version.Writes {
+				if write.Done {
+					continue
+				}
+				// Write counts each attempt, so undo the failure counted by the previous one
+				atomic.AddInt64(&write.Dest.failed, -1)
+				written, err := write.Dest.Write(write.Path, version.Data, opts)
+				if err != nil {
+					logger.Warning("Retry %d of %s under %s failed: %v", pass, version.ID, write.Dest.Root, err)
+					remaining++
+					continue
+				}
+				write.Done = true
+				if written {
+					opts.OutputList.Add(write.Path)
+				}
+				opts.Tree.Add(write.Dest, write.Path)
+				opts.Manifest.Add(write.Path, version.Data, written)
+			}
+			if remaining > 0 {
+				still = append(still, version)
+			}
+		}
+		pending = still
+	}
+
+	// Settle each version's final status
+	for _, version := range queue {
+		done := 0
+		for _, write := range version.Writes {
+			if write.Done {
+				done++
+			}
+		}
+		if done == len(version.Writes) {
+			report.Rescued++
+			logger.Info("Rescued %s by retrying", version.ID)
+		} else {
+			report.RetryFailed++
+		}
+
+		switch {
+		case version.NoneWritten && done > 0:
+			// Was an error; now written to at least one destination
+			report.Errors--
+			report.Success++
+			report.Categories[OutcomeFailed]--
+			report.Categories[OutcomeOrganized]++
+			if counts := report.Sources[version.Source]; counts != nil {
+				counts.Success++
+			}
+			if done < len(version.Writes) {
+				report.PartialWrites++
+			}
+		case !version.NoneWritten && done == len(version.Writes):
+			// Was a partial write; now written everywhere
+			report.PartialWrites--
+		}
+	}
+}
+
+// CategoryTally counts the crates in the mirror per category and keyword,
+// for entries that carry "categories" or "keywords" arrays. A crate counts
+// once per category or keyword any of its organized versions lists. A nil
+// CategoryTally counts nothing.
+type CategoryTally struct {
+	// Path, if set, is where the summary is written after each run, and
+	// Top is how many categories and keywords it lists
+	Path string
+	Top  int
+
+	mu         sync.Mutex
+	crates     int
+	categories map[string]int
+	keywords   map[string]int
+}
+
+// NewCategoryTally creates an empty tally
+func NewCategoryTally(path string, top int) *CategoryTally {
+	return &CategoryTally{Path: path, Top: top, categories: make(map[string]int), keywords: make(map[string]int)}
+}
+
+// collectStrings adds the strings in an entry's array field to set,
+// ignoring a missing field and elements that are not strings
+func collectStrings(entry MetadataEntry, field string, set map[string]bool) {
+	values, _ := entry[field].([]interface{})
+	for _, value := range values {
+		if s, ok := value.(string); ok && strings.TrimSpace(s) != "" {
+			set[strings.ToLower(strings.TrimSpace(s))] = true
+		}
+	}
+}
+
+// AddCrate counts one crate under each of its categories and keywords
+func (t *CategoryTally) AddCrate(categories, keywords map[string]bool) {
+	if t == nil || len(categories) == 0 && len(keywords) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.crates++
+	for category := range categories {
+		t.categories[category]++
+	}
+	for keyword := range keywords {
+		t.keywords[keyword]++
+	}
+}
+
+// Reset clears the tally before a run
+func (t *CategoryTally) Reset() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.crates = 0
+	t.categories = make(map[string]int)
+	t.keywords = make(map[string]int)
+}
+
+// TallyCount is a category or keyword and the number of crates listing it
+type TallyCount struct {
+	Name   string `json:"name"`
+	Crates int    `json:"crates"`
+}
+
+// topCounts returns the n largest counts, most crates first and then by
+// name; n <= 0 returns them all
+func topCounts(counts map[string]int, n int) []TallyCount {
+	top := make([]TallyCount, 0, len(counts))
+	for name, crates := range counts {
+		top = append(top, TallyCount{Name: name, Crates: crates})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Crates != top[j].Crates {
+			return top[i].Crates > top[j].Crates
+		}
+		return top[i].Name < top[j].Name
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// CategorySummary is the JSON written by -categories-out
+type CategorySummary struct {
+	Crates     int          `json:"crates_with_categories_or_keywords"`
+	Categories []TallyCount `json:"categories"`
+	Keywords   []TallyCount `json:"keywords"`
+}
+
+// Summary returns the top n categories and keywords
+func (t *CategoryTally) Summary(n int) CategorySummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return CategorySummary{
+		Crates:     t.crates,
+		Categories: topCounts(t.categories, n),
+		Keywords:   topCounts(t.keywords, n),
+	}
+}
+
+// CollisionDetector tracks the output path claimed by each crate version so
+// that layouts mapping two versions to the same file are caught before one
+// silently overwrites the other
+type CollisionDetector struct {
+	// Fail skips colliding writes and fails the run
+	Fail bool
+
+	// FoldCase also detects paths that differ only by case, which collide
+	// once the tree is copied to a case-insensitive filesystem
+	FoldCase bool
+
+	mu     sync.Mutex
+	claims map[string]string
+	folded map[string]string // lowercased path -> the first path claimed
+}
+
+// NewCollisionDetector creates an empty detector
+func NewCollisionDetector(fail bool) *CollisionDetector {
+	return &CollisionDetector{Fail: fail, claims: make(map[string]string), folded: make(map[string]string)}
+}
+
+// Claim records that the crate version id is about to write path. If a
+// different crate version already claimed it, Claim returns that version and false.
+func (c *CollisionDetector) Claim(path, id string) (string, bool) {
+	if c == nil {
+		return "", true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner, ok := c.claims[path]; ok && owner != id {
+		return owner, false
+	}
+	c.claims[path] = id
+	return id, true
+}
+
+// ClaimCase records path by its lowercased form when FoldCase is set. If a
+// path differing only by case was claimed, ClaimCase returns it and false.
+func (c *CollisionDetector) ClaimCase(path string) (string, bool) {
+	if c == nil || !c.FoldCase {
+		return "", true
+	}
+
+	key := strings.ToLower(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if other, ok := c.folded[key]; ok && other != path {
+		return other, false
+	}
+	c.folded[key] = path
+	return path, true
+}
+
+// CaseCollisions returns the crate files in the mirror whose names differ
+// only by case, grouped by the lowercased name stem ("name-version"),
+// each group sorted
+func CaseCollisions(index FileIndex) map[string][]string {
+	groups := make(map[string][]string)
+	for name := range index {
+		stem := strings.TrimSuffix(name, ".crate")
+		key := strings.ToLower(stem)
+		groups[key] = append(groups[key], stem)
+	}
+	for key, names := range groups {
+		if len(names) < 2 {
+			delete(groups, key)
+			continue
+		}
+		sort.Strings(names)
+	}
+	return groups
+}
+
+// Reset forgets all claims before a new run
+func (c *CollisionDetector) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.claims = make(map[string]string)
+	c.folded = make(map[string]string)
+}
+
+// CanonicalizationVersion identifies the rules ContentHash canonicalizes
+// documents by. It must change whenever the rules do, so hashes recorded by
+// different versions of this tool are never compared as if equal.
+const CanonicalizationVersion = 1
+
+// ContentHash returns the hex SHA-256 of a metadata document's canonical
+// form, which is independent of how the document was indented. Version 1
+// canonicalization: object keys sorted bytewise at every level, no
+// whitespace between tokens, numbers exactly as written, strings escaped as
+// by encoding/json without HTML escaping, and no trailing newline.
+func ContentHash(data []byte) (string, error) {
+	canonical, err := CanonicalJSON(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CanonicalJSON returns a metadata document in the canonical form that
+// ContentHash hashes
+func CanonicalJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), nil
+}
+
+// BuildCrateFileIndex builds an index of all crate files in the mirror directory
+func BuildCrateFileIndex(mirrorDir string, ignore *IgnoreMatcher, mtimes *MtimeCheck, logger *Logger) (FileIndex, error) {
+	logger.Info("Building crate file index from %s...", mirrorDir)
+	startTime := time.Now()
+
+	index := make(FileIndex)
+
+	err := filepath.Walk(mirrorDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Staged deletions are not mirror content
+		if isTrashDir(info) {
+			return filepath.SkipDir
+		}
+
+		// Skip anything matched by the mirror's ignore file
+		if ignore.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			return nil
+		}
+
+		// Only index .crate files, not latest pointers
+		if strings.HasSuffix(info.Name(), ".crate") && !strings.HasSuffix(info.Name(), LatestSuffix+".crate") {
+			index[info.Name()] = path
+			mtimes.Check(path, info.ModTime(), logger)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error walking mirror directory: %v", err)
+	}
+
+	logger.Info("Built index of %d crate files in %v", len(index), time.Since(startTime))
+	return index, nil
+}
+
+// StateFileName is the name of the sync marker written in each output root
+const StateFileName = ".organize-state"
+
+// SyncState is the content of a sync marker: the index state a run fully
+// organized, and when
+type SyncState struct {
+	IndexState string    `json:"index_state"`
+	Completed  time.Time `json:"completed"`
+}
+
+// gitHead returns the commit checked out in a git working tree, or "" if dir
+// is not one
+func gitHead(dir string) string {
+	gitDir := filepath.Join(dir, ".git")
+	head, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: ") {
+		return ref
+	}
+	ref = strings.TrimPrefix(ref, "ref: ")
+	if commit, err := ioutil.ReadFile(filepath.Join(gitDir, filepath.FromSlash(ref))); err == nil {
+		return strings.TrimSpace(string(commit))
+	}
+	packed, err := ioutil.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == ref {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// indexDirState identifies the content of one index directory: its git
+// commit if it is a git checkout, otherwise a hash of every file's path,
+// size, and modification time
+func indexDirState(dir string) (string, error) {
+	if commit := gitHead(dir); commit != "" {
+		return "git:" + commit, nil
+	}
+	return treeState(dir, func(string) bool { return true })
+}
+
+// treeState hashes the path, size, and modification time of every file
+// under dir whose name include accepts
+func treeState(dir string, include func(name string) bool) (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !include(info.Name()) {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", filepath.ToSlash(rel), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error walking %s: %v", dir, err)
+	}
+	return "files:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// outputSettings hashes the options that change what a run writes, so a
+// marker left by a run with other settings does not count as in sync
+func outputSettings(opts *Options) string {
+	hash := sha256.New()
+	for _, dest := range opts.Destinations {
+		fmt.Fprintf(hash, "destination %s %T\n", dest.Root, dest.Dest)
+	}
+	fmt.Fprintf(hash, "strip %s\n", strings.Join(opts.StripFields, ","))
+	fmt.Fprintf(hash, "prereleases %s\n", opts.Prereleases)
+	fmt.Fprintf(hash, "normalize %v raw-line %s crate-id %v\n", opts.NormalizeSchema, opts.RawLine, opts.CrateIDMode)
+	if opts.MinVersions != nil {
+		if opts.MinVersions.Global != nil {
+			fmt.Fprintf(hash, "min %s\n", opts.MinVersions.Global)
+		}
+		fmt.Fprintf(hash, "min %v\n", opts.MinVersions.Crates)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// IndexState identifies what a run would organize: the index content,
+// including the local index and shard restriction, the crate files in the
+// mirror, and the output settings, so that an unchanged state means an
+// unchanged run
+func IndexState(opts *Options) (string, error) {
+	state, err := indexDirState(opts.IndexDir)
+	if err != nil {
+		return "", err
+	}
+	// Only crate files count; the mirror may also hold this run's output
+	mirror, err := treeState(opts.MirrorDir, func(name string) bool { return strings.HasSuffix(name, ".crate") })
+	if err != nil {
+		return "", err
+	}
+	state += " mirror=" + mirror + " settings=" + outputSettings(opts)
+	if opts.LocalIndexDir != "" {
+		local, err := indexDirState(opts.LocalIndexDir)
+		if err != nil {
+			return "", err
+		}
+		state += " local=" + local
+	}
+	if opts.Shards != nil {
+		state += " shards=" + opts.Shards.Expr
+	}
+	return state, nil
+}
+
+// InSync reports whether every destination's sync marker records state
+func InSync(destinations []*Destination, state string) bool {
+	for _, dest := range destinations {
+		content, err := ioutil.ReadFile(filepath.Join(dest.Root, StateFileName))
+		if err != nil {
+			return false
+		}
+		var marker SyncState
+		if err := json.Unmarshal(content, &marker); err != nil || marker.IndexState != state {
+			return false
+		}
+	}
+	return len(destinations) > 0
+}
+
+// WriteSyncState records state as fully organized in every destination
+func WriteSyncState(destinations []*Destination, state string) error {
+	data, err := json.MarshalIndent(SyncState{IndexState: state, Completed: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, dest := range destinations {
+		path := filepath.Join(dest.Root, StateFileName)
+		tmp := path + ".tmp"
+		if err := fsWriteFile(tmp, data, 0644); err != nil {
+			return fmt.Errorf("failed to write sync marker: %v", err)
+		}
+		if err := fsRename(tmp, path); err != nil {
+			fsRemove(tmp)
+			return fmt.Errorf("failed to write sync marker: %v", err)
+		}
+	}
+	return nil
+}
+
+// cachedDir is the cached listing of one mirror directory
+type cachedDir struct {
+	modTime time.Time
+	subdirs []string
+	crates  []string
+}
+
+// CrateIndexCache keeps the crate file index in memory between runs. On each
+// refresh, directories whose modification time is unchanged reuse their
+// cached listing, so only directories with added or removed entries are read.
+type CrateIndexCache struct {
+	mirrorDir string
+	ignore    *IgnoreMatcher
+	mtimes    *MtimeCheck
+	dirs      map[string]*cachedDir
+}
+
+// NewCrateIndexCache creates an empty cache for the mirror directory. Only
+// crate files in rescanned directories are passed to the mtime check.
+func NewCrateIndexCache(mirrorDir string, ignore *IgnoreMatcher, mtimes *MtimeCheck) *CrateIndexCache {
+	return &CrateIndexCache{
+		mirrorDir: mirrorDir,
+		ignore:    ignore,
+		mtimes:    mtimes,
+		dirs:      make(map[string]*cachedDir),
+	}
+}
+
+// Refresh brings the cache up to date with the mirror and returns the index
+func (c *CrateIndexCache) Refresh(logger *Logger) (FileIndex, error) {
+	logger.Info("Refreshing crate file index from %s...", c.mirrorDir)
+	startTime := time.Now()
+
+	index := make(FileIndex)
+	seen := make(map[string]bool)
+	rescanned := 0
+
+	var visit func(dir string) error
+	visit = func(dir string) error {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		seen[dir] = true
+
+		cached, ok := c.dirs[dir]
+		if !ok || !cached.modTime.Equal(info.ModTime()) {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			rescanned++
+
+			cached = &cachedDir{modTime: info.ModTime()}
+			for _, entry := range entries {
+				path := filepath.Join(dir, entry.Name())
+				if c.ignore.Match(path, entry.IsDir()) {
+					continue
+				}
+				if entry.IsDir() {
+					cached.subdirs = append(cached.subdirs, path)
+				} else if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".crate") && !strings.HasSuffix(entry.Name(), LatestSuffix+".crate") {
+					cached.crates = append(cached.crates, entry.Name())
+					if c.mtimes != nil {
+						if info, err := entry.Info(); err == nil {
+							c.mtimes.Check(path, info.ModTime(), logger)
+						}
+					}
+				}
+			}
+			c.dirs[dir] = cached
+		}
+
+		for _, name := range cached.crates {
+			index[name] = filepath.Join(dir, name)
+		}
+		for _, subdir := range cached.subdirs {
+			if err := visit(subdir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := visit(c.mirrorDir); err != nil {
+		return nil, fmt.Errorf("error walking mirror directory: %v", err)
+	}
+
+	// Forget directories that no longer exist
+	for dir := range c.dirs {
+		if !seen[dir] {
+			delete(c.dirs, dir)
+		}
+	}
+
+	logger.Info("Refreshed index of %d crate files in %v (%d of %d directories rescanned)",
+		len(index), time.Since(startTime), rescanned, len(c.dirs))
+	return index, nil
+}
+
+// ProcessMetadataFile processes a single metadata file
+func ProcessMetadataFile(file IndexFile, crateIndex FileIndex, opts *Options, logger *Logger) FileResult {
+	return ProcessMetadataFileContext(context.Background(), file, crateIndex, opts, logger)
+}
+
+// ProcessMetadataFileContext processes a single metadata file, stopping
+// before the next version, or the next per-crate write after the versions,
+// once ctx is done. The partial result it then returns is not meant to be
+// counted.
+func ProcessMetadataFileContext(ctx context.Context, file IndexFile, crateIndex FileIndex, opts *Options, logger *Logger) FileResult {
+	metadataFilePath := file.Path
+	result := FileResult{Path: metadataFilePath, Source: file.Source}
+
+	// Skip .git directory and config.json
+	baseName := filepath.Base(metadataFilePath)
+	if baseName == ".git" || baseName == "config.json" {
+		return result
+	}
+
+	// Get crate name from the filename; in crate ID mode it is an ID and
+	// each entry carries the name
+	crateName := baseName
+	result.Crate = crateName
+	if err := indexentry.ValidateName(crateName); err != nil && !opts.CrateIDMode {
+		logger.Warning("Index file %s: %v", metadataFilePath, err)
+		result.InvalidName = 1
+	}
+
+	// Read the metadata file
+	opts.Faults.BeforeRead(ctx)
+	content, err := readIndexContent(metadataFilePath)
+	if err != nil {
+		logger.Error("Failed to read metadata file %s: %v", metadataFilePath, err)
+		result.Errors++
+		return result
+	}
+	if ctx.Err() != nil {
+		return result
+	}
+
+	// Versions of this crate in the local index take precedence over ours
+	var overlay []byte
+	var overridden map[string]bool
+	if file.Overlay != "" {
+		overlay, err = ioutil.ReadFile(file.Overlay)
+		if err != nil {
+			logger.Error("Failed to read local index file %s: %v", file.Overlay, err)
+			result.Errors++
+			return result
+		}
+		overridden = indexVersions(overlay)
+	}
+
+	// Skip the whole crate if its index file is unchanged since the snapshot
+	var contentHash string
+	snapshotKey := crateName
+	if file.Source == SourceLocal {
+		snapshotKey = SourceLocal + "/" + crateName
+	}
+	if opts.Snapshot != nil {
+		hash := sha256.New()
+		hash.Write(content)
+		hash.Write(overlay)
+		contentHash = hex.EncodeToString(hash.Sum(nil))
+		if !opts.Snapshot.Unchanged(snapshotKey, contentHash) {
+			result.IndexChanged = 1
+		} else if changed := mirrorChanged(content, crateName, crateIndex, opts); changed > 0 {
+			// A crate file replaced in the mirror leaves the index as it
+			// was, so the whole crate is processed again
+			logger.Info("Reprocessing %s: %d crate files changed in the mirror since their metadata was written", crateName, changed)
+			result.MirrorChanged = changed
+		} else {
+			opts.Snapshot.Record(snapshotKey, contentHash)
+			result.SnapshotSkipped = 1
+			return result
+		}
+	}
+
+	// Parse the lines, or take them from the parse cache
+	lines, cached, rebuilt := opts.ParseCache.Parse(content, logger)
+	if opts.ParseCache != nil {
+		if cached {
+			result.ParseCacheHits = 1
+		} else {
+			result.ParseCacheMisses = 1
+		}
+		if rebuilt {
+			result.ParseCacheRebuilt = 1
+		}
+	}
+
+	// Entries kept for the compacted index, in their original order
+	var kept []string
+
+	// Newest stable version seen, for the latest pointers
+	var latest *latestCandidate
+
+	// Entries written to each destination, for the aggregate bundles
+	bundled := make([][]MetadataEntry, len(opts.Destinations))
+
+	// Whether any version is at or above the -min-version floor
+	aboveMin := false
+
+	// The versions that -latest-n keeps; prereleases only count when they
+	// can be organized
+	var newest map[string]bool
+	if opts.LatestN > 0 {
+		newest = newestVersions(lines, opts.LatestN, opts.Prereleases == PrereleasesSkip, overridden)
+	}
+
+	// Versions missing since the baseline, for the per-file log line
+	var newlyMissing []string
+
+	// Categories and keywords of the organized versions, for the tally
+	categories := make(map[string]bool)
+	keywords := make(map[string]bool)
+
+	for _, parsed := range lines {
+		// An abandoned file must not keep writing after it was counted
+		if ctx.Err() != nil {
+			return result
+		}
+		line := parsed.Line
+		result.Entries++
+		if parsed.Err != "" {
+			logger.Error("Error parsing JSON in %s: %s", metadataFilePath, parsed.Err)
+			result.Errors++
+			result.outcome(OutcomeParseError)
+			continue
+		}
+		metadata := parsed.Entry
+
+		// Stray whitespace in key fields would break the crate file name
+		for _, field := range trimEntryFields(metadata) {
+			logger.Debug("Trimmed whitespace from %q in %s", field, metadataFilePath)
+		}
+
+		// Get version
+		version, ok := metadata["vers"].(string)
+		if !ok || version == "" {
+			result.outcome(OutcomeNoVersion)
+			continue
+		}
+
+		if overridden[version] {
+			result.Overridden++
+			result.outcome(OutcomeOverridden)
+			continue
+		}
+
+		// Let embedders drop entries they don't want written
+		if opts.EntryFilter != nil && !opts.EntryFilter(metadata) {
+			result.Filtered++
+			result.outcome(OutcomeFiltered)
+			continue
+		}
+		lockName := crateName
+		if opts.CrateIDMode {
+			lockName, _ = metadata["name"].(string)
+		}
+		if !opts.Lockfile.Pinned(lockName, version) {
+			result.Filtered++
+			result.outcome(OutcomeFiltered)
+			continue
+		}
+
+		// Prereleases are detected by semver, since crate names contain hyphens too
+		prerelease := false
+		if parsed, err := indexentry.ParseVersion(version); err == nil {
+			prerelease = parsed.IsPrerelease()
+		}
+		separate := prerelease && opts.Prereleases == PrereleasesSeparate
+		if prerelease {
+			result.Prereleases++
+			if opts.Prereleases == PrereleasesSkip {
+				result.PrereleasesSkipped++
+				result.outcome(OutcomePrereleaseSkipped)
+				continue
+			}
+			if separate {
+				setLocalInfo(metadata, "prerelease", true)
+			}
+		}
+
+		// Versions below the crate's floor are left out entirely
+		if opts.MinVersions != nil {
+			floorName := crateName
+			if opts.CrateIDMode {
+				floorName, _ = metadata["name"].(string)
+			}
+			if opts.MinVersions.Below(floorName, version) {
+				result.BelowMin++
+				result.outcome(OutcomeBelowMin)
+				continue
+			}
+			aboveMin = true
+		}
+
+		// Only the newest -latest-n versions of each crate are organized
+		if newest != nil && !newest[version] {
+			if _, err := indexentry.ParseVersion(version); err == nil {
+				result.SkippedOld++
+				result.outcome(OutcomeSkippedOld)
+				continue
+			}
+		}
+
+		result.Total++
+
+		entryName := crateName
+		if opts.CrateIDMode {
+			entryName, _ = metadata["name"].(string)
+			if err := indexentry.ValidateName(entryName); err != nil {
+				logger.Warning("Entry %s in index file %s: %v", version, metadataFilePath, err)
+				result.Errors++
+				result.outcome(OutcomeRejected)
+				continue
+			}
+		}
+
+		// Duplicate keys mean corruption, and the value kept may be the wrong one
+		if opts.StrictJSON {
+			if dups, err := duplicateKeys([]byte(line)); err != nil || len(dups) > 0 {
+				if err == nil {
+					err = fmt.Errorf("duplicate keys %s", strings.Join(dups, ", "))
+				}
+				logger.Error("Rejected entry %s-%s in %s: %v", entryName, version, metadataFilePath, err)
+				result.DuplicateKeys++
+				result.Errors++
+				result.outcome(OutcomeRejected)
+				opts.Lockfile.Mark(entryName, version, OutcomeFailed)
+				continue
+			}
+		}
+
+		// Rewrite v1 and v2 entries into one canonical form
+		if opts.NormalizeSchema {
+			if links, ok := metadata["links"]; ok && links != nil {
+				if _, ok := links.(string); !ok {
+					logger.Warning("Entry %s-%s in %s has a links field that is not a string: %v", entryName, version, metadataFilePath, links)
+					result.InvalidLinks++
+				}
+			}
+			if from, known := normalizeSchema(metadata); known {
+				setLocalInfo(metadata, "normalized_from_v", from)
+				if from == 1 {
+					result.NormalizedV1++
+				} else {
+					result.NormalizedV2++
+				}
+			} else {
+				logger.Warning("Entry %s-%s in %s has unknown schema version %v; passing it through unmodified", entryName, version, metadataFilePath, metadata["v"])
+				result.UnknownSchema++
+			}
+		}
+
+		// Flag malformed dependency requirements
+		if opts.ValidateDeps {
+			if invalid := invalidDependencyReqs(metadata); len(invalid) > 0 {
+				result.InvalidDeps++
+				result.InvalidDepVersions = append(result.InvalidDepVersions, entryName+"-"+version)
+				logger.Debug("Invalid dependency requirements in %s-%s: %s", entryName, version, strings.Join(invalid, "; "))
+			}
+		}
+
+		// Find the corresponding crate file
+		fileName := entryName
+		expectedFilename := fmt.Sprintf("%s-%s.crate", entryName, version)
+		crateFilePath, exists := crateIndex[expectedFilename]
+
+		// Retry under any names the crate was renamed from or to
+		if !exists {
+			for _, alias := range opts.RenameMap.Aliases(entryName) {
+				if aliasPath, ok := crateIndex[fmt.Sprintf("%s-%s.crate", alias, version)]; ok {
+					fileName = alias
+					crateFilePath = aliasPath
+					exists = true
+					break
+				}
+			}
+			if exists {
+				result.Aliased++
+				logger.Info("Matched %s-%s under alias %s", entryName, version, fileName)
+				setLocalInfo(metadata, "canonical_name", opts.RenameMap.Canonical(entryName))
+				setLocalInfo(metadata, "matched_alias", fileName)
+			}
+		}
+
+		if !exists {
+			logger.Debug("Could not find crate file for %s-%s", entryName, version)
+			if opts.Baseline != nil && opts.Baseline.Missing(entryName+"-"+version) {
+				newlyMissing = append(newlyMissing, entryName+"-"+version)
+				result.NewlyMissing++
+			}
+			result.Missing++
+			result.MissingVersions = append(result.MissingVersions, entryName+"-"+version)
+			result.outcome(OutcomeMissing)
+			opts.Lockfile.Mark(entryName, version, OutcomeMissing)
+			opts.RecentlyMissing.Missed(expectedFilename, entryName, version, file)
+			continue
+		}
+
+		// The crate file's name and the entry's name should agree, allowing
+		// for case and for the names of a rename
+		if opts.CheckNames && !opts.CrateIDMode {
+			name, _ := metadata["name"].(string)
+			if fromFile := crateFileName(crateFilePath, version); !namesAgree(name, fromFile, opts.RenameMap) {
+				logger.Debug("Name mismatch for %s-%s: entry name %q, crate file %s", entryName, version, name, filepath.Base(crateFilePath))
+				result.NameMismatches = append(result.NameMismatches, entryName+"-"+version)
+			}
+		}
+
+		// A crate file that does not hash to the entry's cksum is corrupt or
+		// for another version; check before -strip-fields can remove cksum
+		if opts.VerifyChecksum {
+			if cksum, _ := metadata["cksum"].(string); cksum == "" {
+				result.ChecksumMissing++
+			} else if actual, err := hashFile(crateFilePath); err != nil {
+				logger.Error("Failed to hash %s: %v", crateFilePath, err)
+				result.ChecksumFailed++
+				result.Errors++
+				result.outcome(OutcomeFailed)
+				opts.Lockfile.Mark(entryName, version, OutcomeFailed)
+				continue
+			} else if !strings.EqualFold(actual, cksum) {
+				logger.Error("Checksum mismatch for %s-%s: index has %s, %s has %s", entryName, version, cksum, crateFilePath, actual)
+				result.ChecksumFailed++
+				result.Errors++
+				result.outcome(OutcomeFailed)
+				opts.Lockfile.Mark(entryName, version, OutcomeFailed)
+				continue
+			} else {
+				result.ChecksumPassed++
+			}
+		}
+
+		if file.Source == SourceLocal {
+			setLocalInfo(metadata, "index_source", SourceLocal)
+		}
+
+		// Redact internal fields before anything is written
+		if len(opts.StripFields) > 0 {
+			var stripped []string
+			for _, path := range opts.StripFields {
+				if stripField(metadata, strings.Split(path, ".")) {
+					stripped = append(stripped, path)
+				}
+			}
+			if len(stripped) > 0 {
+				setLocalInfo(metadata, "stripped_fields", stripped)
+				result.Stripped++
+			}
+		}
+
+		// Make the document traceable to the exact index line it came from
+		if opts.RawLine != "" {
+			sum := sha256.Sum256([]byte(line))
+			setLocalInfo(metadata, "raw_sha256", hex.EncodeToString(sum[:]))
+			if opts.RawLine == RawLineFull {
+				setLocalInfo(metadata, "raw_line", line)
+			}
+		}
+
+		// Record the crate file's identity so a later replacement is noticed
+		if opts.TrackCrateFiles {
+			if info, err := os.Stat(crateFilePath); err == nil {
+				setLocalInfo(metadata, "crate_size", info.Size())
+				setLocalInfo(metadata, "crate_mtime", info.ModTime().UTC().Format(time.RFC3339Nano))
+			}
+		}
+
+		// Marshal with indentation for readability
+		var metadataJSON []byte
+		if !opts.DryRun {
+			metadataJSON, err = json.MarshalIndent(metadata, "", "  ")
+			if err != nil {
+				logger.Error("Error marshaling JSON for %s-%s: %v", entryName, version, err)
+				result.Errors++
+				result.outcome(OutcomeFailed)
+				opts.Lockfile.Mark(entryName, version, OutcomeFailed)
+				continue
+			}
+		}
+
+		// Write metadata to every destination, named to match the crate file.
+		// A failure on one destination does not fail the others.
+		failed := 0
+		var retry *RetryVersion
+		var outputs []string
+		for i, dest := range opts.Destinations {
+			metadataOutputPath, err := dest.OutputPath(crateFilePath, fileName, version, metadata, separate)
+			if err != nil {
+				logger.Error("Rejected unsafe output path for %s-%s under %s: %v", entryName, version, dest.Root, err)
+				atomic.AddInt64(&dest.failed, 1)
+				failed++
+				continue
+			}
+			if usual := fmt.Sprintf("%s-%s%s", fileName, version, MetadataFileSuffix); filepath.Base(metadataOutputPath) != usual {
+				if written := filepath.Base(metadataOutputPath); written == CaseSuffixedName(fileName+"-"+version) {
+					logger.Info("Writing %s as %s, since another crate file differs from it only by case", usual, written)
+				} else {
+					logger.Warning("Writing %s as %s, since %s is not a valid file name here", usual, written, usual)
+				}
+			}
+
+			// Never let one crate version overwrite another's metadata
+			if owner, ok := opts.Collisions.Claim(metadataOutputPath, entryName+"-"+version); !ok {
+				logger.Warning("Output path collision: %s is claimed by both %s and %s-%s", metadataOutputPath, owner, entryName, version)
+				result.Collisions++
+				if opts.Collisions.Fail {
+					atomic.AddInt64(&dest.failed, 1)
+					failed++
+					continue
+				}
+			}
+			if other, ok := opts.Collisions.ClaimCase(metadataOutputPath); !ok {
+				logger.Warning("Case collision: %s (%s-%s) and %s differ only by case", metadataOutputPath, entryName, version, other)
+				result.CaseCollisions++
+				if opts.Collisions.Fail {
+					atomic.AddInt64(&dest.failed, 1)
+					failed++
+					continue
+				}
+			}
+
+			if opts.DryRun {
+				// In dry-run mode, just count and optionally diff against what is on disk
+				if opts.Plan != nil {
+					opts.Plan.Compare(metadataOutputPath, metadata, &result, logger)
+				}
+				opts.Tree.Add(dest, metadataOutputPath)
+				outputs = append(outputs, metadataOutputPath)
+				continue
+			}
+
+			written, err := dest.Write(metadataOutputPath, metadataJSON, opts)
+			if err != nil {
+				logger.Error("Error writing metadata file for %s-%s under %s: %v", entryName, version, dest.Root, err)
+				failed++
+				if opts.RetryPasses > 0 {
+					if retry == nil {
+						retry = &RetryVersion{ID: entryName + "-" + version, Source: file.Source, Data: metadataJSON}
+					}
+					retry.Writes = append(retry.Writes, &RetryWrite{Dest: dest, Path: metadataOutputPath})
+				}
+			} else {
+				if written {
+					opts.OutputList.Add(metadataOutputPath)
+				}
+				opts.Manifest.Add(metadataOutputPath, metadataJSON, written)
+				opts.Tree.Add(dest, metadataOutputPath)
+				outputs = append(outputs, metadataOutputPath)
+				if opts.Bundles != nil {
+					bundled[i] = append(bundled[i], metadata)
+				}
+			}
+		}
+
+		if retry != nil {
+			retry.NoneWritten = failed == len(opts.Destinations)
+			result.Retries = append(result.Retries, retry)
+		}
+
+		switch {
+		case failed == len(opts.Destinations):
+			result.Errors++
+			result.outcome(OutcomeFailed)
+			opts.Lockfile.Mark(entryName, version, OutcomeFailed)
+			continue
+		case failed > 0:
+			result.PartialWrites++
+			result.Success++
+		default:
+			result.Success++
+		}
+		result.outcome(OutcomeOrganized)
+		opts.Lockfile.Mark(entryName, version, OutcomeOrganized)
+		opts.RecentlyMissing.Found(expectedFilename)
+		if prerelease {
+			result.PrereleasesOrganized++
+		}
+		opts.Baseline.Found(entryName + "-" + version)
+
+		yanked, _ := metadata["yanked"].(bool)
+		if !yanked && result.InvalidName == 0 {
+			kept = append(kept, line)
+		}
+
+		if opts.Categories != nil {
+			collectStrings(metadata, "categories", categories)
+			collectStrings(metadata, "keywords", keywords)
+		}
+
+		// Remember the newest stable version for the latest pointers
+		if opts.Latest != nil && !yanked {
+			if parsed, err := indexentry.ParseVersion(version); err == nil && !parsed.IsPrerelease() &&
+				(latest == nil || parsed.Compare(latest.version) > 0) {
+				latest = &latestCandidate{name: fileName, version: parsed, crateFile: crateFilePath, outputs: outputs}
+			}
+		}
+	}
+
+	// A file abandoned while writing its last version writes nothing more:
+	// each step below checks again, since the ones before it may be slow
+	if ctx.Err() != nil {
+		return result
+	}
+
+	if latest != nil {
+		result.LatestUpdated = opts.Latest.UpdateCrate(latest, opts.DryRun, logger)
+	} else if opts.Latest != nil && result.Errors == 0 {
+		// Pointers of a crate with no stable version left are removed from
+		// its mirror directory and the matching directory of each output
+		crateFile := MirrorCratePath(opts.MirrorDir, crateName, "0.0.0")
+		dirs := []string{filepath.Dir(crateFile)}
+		for _, dest := range opts.Destinations {
+			if dest.Store == nil && !dest.InMirror {
+				dirs = append(dirs, dest.Dest.Dir(crateFile, MetadataEntry{}))
+			}
+		}
+		result.LatestUpdated = opts.Latest.RemoveCrate(crateName, dirs, opts.DryRun, logger)
+	}
+
+	opts.Categories.AddCrate(categories, keywords)
+
+	// One line per file rather than per version, so crates with thousands
+	// of versions do not flood the log; the full lists go to the reports
+	var problems []string
+	switch {
+	case opts.Baseline == nil && result.Missing > 0:
+		problems = append(problems, fmt.Sprintf("%d missing (%s)", result.Missing, logExamples(result.MissingVersions)))
+	case len(newlyMissing) > 0:
+		problems = append(problems, fmt.Sprintf("%d newly missing (%s)", len(newlyMissing), logExamples(newlyMissing)))
+	}
+	if len(result.InvalidDepVersions) > 0 {
+		problems = append(problems, fmt.Sprintf("%d with invalid dependency requirements (%s)", len(result.InvalidDepVersions), logExamples(result.InvalidDepVersions)))
+	}
+	if len(result.NameMismatches) > 0 {
+		problems = append(problems, fmt.Sprintf("%d with a mismatched name (%s)", len(result.NameMismatches), logExamples(result.NameMismatches)))
+	}
+	if len(problems) > 0 {
+		logger.Warning("%s: %d organized, %s", crateName, result.Success, strings.Join(problems, ", "))
+	}
+
+	// A crate whose every version is below its floor is left out entirely
+	if result.BelowMin > 0 && !aboveMin {
+		floor, _ := opts.MinVersions.Floor(crateName)
+		logger.Warning("Crate %s has no versions at or above %s; all %d were skipped", crateName, floor, result.BelowMin)
+		result.NoVersionAboveMin = 1
+	}
+
+	// Rebuild each destination's bundle for the crate from this run's
+	// versions, or merge them in when some may be missing from them: after
+	// a failure, with a lockfile, or when the main and local index share it
+	rebuild := !opts.DryRun && result.Errors == 0 && result.PartialWrites == 0 && opts.Lockfile == nil && file.Overlay == "" && !file.Overlays
+	for i, entries := range bundled {
+		if opts.Bundles == nil || len(entries) == 0 && !rebuild {
+			continue
+		}
+		if ctx.Err() != nil {
+			return result
+		}
+		changed, err := opts.Bundles.Merge(opts.Destinations[i], crateName, entries, rebuild, opts, logger)
+		if err != nil {
+			logger.Error("Failed to update bundle for %s under %s: %v", crateName, opts.Destinations[i].Root, err)
+			result.Errors++
+		} else if changed {
+			result.BundlesUpdated++
+		}
+	}
+
+	// A crate in both indexes gets one compacted file, written by its main
+	// file with the local versions added, since both map to the same path
+	if ctx.Err() != nil {
+		return result
+	}
+	if opts.CompactIndexDir != "" && !file.Overlays {
+		if file.Overlay != "" {
+			kept = append(kept, overlayKept(overlay, crateName, crateIndex, opts)...)
+		}
+		if err := writeCompactIndex(file, kept, opts, logger); err != nil {
+			logger.Error("Failed to write compacted index for %s: %v", crateName, err)
+			result.Errors++
+		} else {
+			result.Compacted = len(kept)
+		}
+	}
+
+	// Only remember crates that processed cleanly so failures, including
+	// a write that reached only some destinations, are retried
+	if ctx.Err() != nil {
+		return result
+	}
+	if opts.Snapshot != nil && result.Errors == 0 && result.PartialWrites == 0 {
+		opts.Snapshot.Record(snapshotKey, contentHash)
+	}
+
+	return result
+}
+
+// IndexFile is a metadata file found in the index directory
+type IndexFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+
+	// Root is the index directory the file was found under
+	Root string
+
+	// Source is SourceMain or SourceLocal
+	Source string
+
+	// Overlay is the local index file for the same crate, whose versions
+	// take precedence over this file's
+	Overlay string
+
+	// Overlays is set on a local index file that is some main file's Overlay
+	Overlays bool
+}
+
+// Index sources a crate's entries can come from
+const (
+	SourceMain  = "main"
+	SourceLocal = "local"
+)
+
+// MergeLocalIndex combines the main and local index files. A crate present in
+// both keeps both files, with the local file set as the main file's overlay
+// so its versions take precedence. It returns the number of overlaid crates.
+func MergeLocalIndex(mainFiles, localFiles []IndexFile) ([]IndexFile, int) {
+	local := make(map[string]int, len(localFiles))
+	for i := range localFiles {
+		localFiles[i].Source = SourceLocal
+		local[strings.ToLower(filepath.Base(localFiles[i].Path))] = i
+	}
+
+	overlaid := 0
+	for i := range mainFiles {
+		if j, ok := local[strings.ToLower(filepath.Base(mainFiles[i].Path))]; ok {
+			mainFiles[i].Overlay = localFiles[j].Path
+			localFiles[j].Overlays = true
+			overlaid++
+		}
+	}
+	return append(mainFiles, localFiles...), overlaid
+}
+
+// Orders in which index files can be dispatched to workers
+const (
+	OrderWalk      = "walk"
+	OrderName      = "name"
+	OrderMtimeDesc = "mtime-desc"
+	OrderSizeDesc  = "size-desc"
+)
+
+// ShardSet restricts a run to the crates whose names start with a character
+// in one of a set of ranges, so work can be split across hosts. Shards are
+// assigned by the first character of the lowercased crate name, which is also
+// what places a crate in its index directory, so every crate belongs to
+// exactly one shard of a partition however the index is laid out.
+type ShardSet struct {
+	Expr   string
+	ranges [][2]byte
+}
+
+// ParseShards parses a comma-separated list of character ranges such as
+// "a-f", "g-p", or "q-z,0-9". A single character is a range of one.
+func ParseShards(expr string) (*ShardSet, error) {
+	shards := &ShardSet{Expr: expr}
+	for _, part := range strings.Split(strings.ToLower(expr), ",") {
+		part = strings.TrimSpace(part)
+		var lo, hi byte
+		switch {
+		case len(part) == 1:
+			lo, hi = part[0], part[0]
+		case len(part) == 3 && part[1] == '-':
+			lo, hi = part[0], part[2]
+		default:
+			return nil, fmt.Errorf("invalid shard range %q (expected a character or a range such as a-f)", part)
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("invalid shard range %q: start is after end", part)
+		}
+		shards.ranges = append(shards.ranges, [2]byte{lo, hi})
+	}
+	return shards, nil
+}
+
+// containsChar reports whether c falls in one of the ranges
+func (s *ShardSet) containsChar(c byte) bool {
+	if c >= 'A' && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	for _, r := range s.ranges {
+		if c >= r[0] && c <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether a crate belongs to the shards. A nil set contains every crate.
+func (s *ShardSet) Contains(crateName string) bool {
+	if s == nil || crateName == "" {
+		return s == nil
+	}
+	return s.containsChar(crateName[0])
+}
+
+// AllowsIndexDir reports whether an index directory, relative to the index
+// root, can hold crates in the shards. The 1/ and 2/ directories hold crates
+// with any first character and are always allowed; 3/{c}/ and {ab}/ are
+// allowed only if their first character is.
+func (s *ShardSet) AllowsIndexDir(rel string) bool {
+	if s == nil || rel == "." {
+		return true
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	switch segments[0] {
+	case "1", "2":
+		return true
+	case "3":
+		return len(segments) < 2 || s.containsChar(segments[1][0])
+	}
+	return s.containsChar(segments[0][0])
+}
+
+// Lockfile holds the registry crate versions pinned by a Cargo.lock, to
+// organize only those, and what became of each during a run
+type Lockfile struct {
+	Path string
+
+	// pinned maps "name version", with the name lowercased, to the
+	// pinned name and version and the outcome of its entry in this run
+	pinned map[string]*lockedVersion
+	names  map[string]bool
+	mu     sync.Mutex
+}
+
+// lockedVersion is one [[package]] of a Cargo.lock
+type lockedVersion struct {
+	name, version string
+	outcome       string // "" until the index entry is seen, then lockSeen or its outcome
+}
+
+// lockSeen is the outcome of a pinned version whose entry was read but that
+// was neither organized nor found missing, e.g. because it was skipped
+const lockSeen = "seen"
+
+// LoadLockfile reads the name and version of every [[package]] in a
+// Cargo.lock that comes from a registry. Workspace members and path or git
+// dependencies have no registry source and are left out.
+func LoadLockfile(path string) (*Lockfile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %v", err)
+	}
+
+	lock := &Lockfile{Path: path, pinned: make(map[string]*lockedVersion), names: make(map[string]bool)}
+	var pkg map[string]string
+	skipped := 0
+	finish := func() {
+		if pkg == nil {
+			return
+		}
+		source := pkg["source"]
+		if pkg["name"] == "" || pkg["version"] == "" || !(strings.HasPrefix(source, "registry+") || strings.HasPrefix(source, "sparse+")) {
+			skipped++
+		} else {
+			lock.pin(pkg["name"], pkg["version"])
+		}
+		pkg = nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "[[package]]":
+			finish()
+			pkg = make(map[string]string)
+		case strings.HasPrefix(line, "["):
+			finish()
+		case pkg != nil:
+			eq := strings.IndexByte(line, '=')
+			if eq < 0 {
+				continue
+			}
+			key := strings.TrimSpace(line[:eq])
+			value := strings.TrimSpace(line[eq+1:])
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				pkg[key] = unquoted
+			}
+		}
+	}
+	finish()
+
+	if len(lock.pinned) == 0 {
+		return nil, fmt.Errorf("%s has no registry packages (%d other packages)", path, skipped)
+	}
+	return lock, nil
+}
+
+// Len returns the number of pinned registry versions
+func (l *Lockfile) Len() int {
+	return len(l.pinned)
+}
+
+// pin adds a version to the pinned set
+func (l *Lockfile) pin(name, version string) {
+	lower := strings.ToLower(name)
+	l.pinned[lower+" "+version] = &lockedVersion{name: name, version: version}
+	l.names[lower] = true
+}
+
+// Organized returns how many pinned versions were organized in this run
+func (l *Lockfile) Organized() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	organized := 0
+	for _, locked := range l.pinned {
+		if locked.outcome == OutcomeOrganized {
+			organized++
+		}
+	}
+	return organized
+}
+
+// Reset forgets the outcomes of the previous run
+func (l *Lockfile) Reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, locked := range l.pinned {
+		locked.outcome = ""
+	}
+}
+
+// FilterFiles keeps the index files of pinned crates. With crate IDs for
+// file names, the names are only known from the entries, so all are kept.
+func (l *Lockfile) FilterFiles(files []IndexFile, crateIDMode bool) []IndexFile {
+	if l == nil || crateIDMode {
+		return files
+	}
+	kept := files[:0]
+	for _, file := range files {
+		if l.names[strings.ToLower(filepath.Base(file.Path))] {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// Pinned reports whether a version is pinned, recording that its index
+// entry was seen. A nil lockfile pins every version.
+func (l *Lockfile) Pinned(name, version string) bool {
+	if l == nil {
+		return true
+	}
+	return l.Mark(name, version, lockSeen)
+}
+
+// Mark records the outcome of a pinned version's entry, if it is pinned
+func (l *Lockfile) Mark(name, version, outcome string) bool {
+	if l == nil {
+		return false
+	}
+	locked := l.pinned[strings.ToLower(name)+" "+version]
+	if locked == nil {
+		return false
+	}
+	l.mu.Lock()
+	locked.outcome = outcome
+	l.mu.Unlock()
+	return true
+}
+
+// Summarize counts the pinned versions that were not in the index or whose
+// crate file was not in the mirror into the report, and logs each of them
+// and those that failed or were skipped
+func (l *Lockfile) Summarize(report *Report, logger *Logger) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var notInIndex, missing, failed, other []string
+	for _, locked := range l.pinned {
+		id := locked.name + "-" + locked.version
+		switch locked.outcome {
+		case OutcomeOrganized:
+		case "":
+			notInIndex = append(notInIndex, id)
+		case OutcomeMissing:
+			missing = append(missing, id)
+		case OutcomeFailed:
+			failed = append(failed, id)
+		default:
+			other = append(other, id)
+		}
+	}
+	sort.Strings(notInIndex)
+	sort.Strings(missing)
+	sort.Strings(failed)
+	sort.Strings(other)
+	report.LockfileNotInIndex = len(notInIndex)
+	report.LockfileMissing = len(missing)
+
+	logger.Info("Lockfile %s: %d of %d pinned versions organized", l.Path,
+		len(l.pinned)-len(notInIndex)-len(missing)-len(failed)-len(other), len(l.pinned))
+	for _, id := range notInIndex {
+		logger.Warning("Lockfile version %s is not in the index", id)
+	}
+	for _, id := range missing {
+		logger.Warning("Lockfile version %s has no crate file in the mirror", id)
+	}
+	for _, id := range failed {
+		logger.Warning("Lockfile version %s is in the index but failed to organize (see above)", id)
+	}
+	for _, id := range other {
+		logger.Warning("Lockfile version %s is in the index but was skipped (see above)", id)
+	}
+}
+
+// SortIndexFiles orders index files for dispatch: walk keeps discovery
+// order, name sorts by crate name, and mtime-desc puts the most recently
+// modified files first
+func SortIndexFiles(files []IndexFile, order string) error {
+	switch order {
+	case OrderWalk, "":
+	case OrderName:
+		sort.SliceStable(files, func(i, j int) bool {
+			return filepath.Base(files[i].Path) < filepath.Base(files[j].Path)
+		})
+	case OrderMtimeDesc:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].ModTime.After(files[j].ModTime)
+		})
+	case OrderSizeDesc:
+		// Largest first, so the giant index files are not left for the end
+		// of the run while the other workers sit idle
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Size > files[j].Size
+		})
+	default:
+		return fmt.Errorf("unknown order %q (expected %s, %s, %s, or %s)", order, OrderWalk, OrderSizeDesc, OrderName, OrderMtimeDesc)
+	}
+	return nil
+}
+
+// ownOutputSuffixes are the suffixes of files this tool writes, plus crate
+// files, none of which can be index files
+var ownOutputSuffixes = []string{
+	MetadataFileSuffix,
+	".versions.json",
+	".crate",
+	".json",
+	".ndjson",
+	".csv",
+	".prof",
+	PartialTransferSuffix,
+	StateFileName,
+	GzipSuffix,
+	PointerFileSuffix,
+}
+
+// isOwnOutput reports whether a file name is one of the tool's own outputs or
+// a crate file rather than an index file
+func isOwnOutput(name string) bool {
+	if name == LockFileName || name == IgnoreFileName {
+		return true
+	}
+	for _, suffix := range ownOutputSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlappingRoots reports whether two directories are the same or one
+// contains the other
+func OverlappingRoots(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return absA == absB || isWithin(absA, absB) || isWithin(absB, absA)
+}
+
+// Index source formats for -source-format
+const (
+	SourceFormatAuto        = "auto"
+	SourceFormatGit         = "git"
+	SourceFormatSparse      = "sparse"
+	SourceFormatSparseCache = "sparse-cache"
+)
+
+// SparseCacheDir is the directory of a sparse registry holding cargo's index
+// cache files
+const SparseCacheDir = ".cache"
+
+// sparseCacheVersion is the version byte of the cargo index cache files we
+// read; it is followed by the index format version as a little-endian uint32
+const sparseCacheVersion = 3
+
+// isSparseCache reports whether content starts with a cargo index cache header
+func isSparseCache(content []byte) bool {
+	return len(content) >= 5 && content[0] == sparseCacheVersion &&
+		binary.LittleEndian.Uint32(content[1:5]) <= 2
+}
+
+// DecodeSparseCache converts a cargo index cache file into JSON lines. After
+// the header comes the NUL-terminated revision, then a NUL-terminated version
+// and JSON entry for each version.
+func DecodeSparseCache(content []byte) ([]byte, error) {
+	if !isSparseCache(content) {
+		return nil, fmt.Errorf("not a version %d index cache file", sparseCacheVersion)
+	}
+	fields := bytes.Split(content[5:], []byte{0})
+	// The revision is first, and the last NUL leaves an empty field
+	if len(fields) < 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("truncated index cache file")
+	}
+	fields = fields[1 : len(fields)-1]
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("index cache file has a version without an entry")
+	}
+
+	var lines bytes.Buffer
+	for i := 1; i < len(fields); i += 2 {
+		lines.Write(fields[i])
+		lines.WriteByte('\n')
+	}
+	return lines.Bytes(), nil
+}
+
+// readIndexContent reads an index file, decoding it if it is an index cache file
+func readIndexContent(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil || !isSparseCache(content) {
+		return content, err
+	}
+	return DecodeSparseCache(content)
+}
+
+// DetectSourceFormat inspects the index directory and returns its format. A
+// git checkout has .git beside its JSON-lines files; a sparse cache has only
+// cache files under .cache; a sparse snapshot has plain JSON-lines files and,
+// normally, a config.json with a "dl" key. When the format cannot be told
+// apart, the error lists what was found.
+func DetectSourceFormat(indexDir string) (string, error) {
+	var found []string
+
+	_, err := os.Stat(filepath.Join(indexDir, ".git"))
+	hasGit := err == nil
+	if hasGit {
+		found = append(found, ".git")
+	}
+
+	hasConfig := false
+	if data, err := ioutil.ReadFile(filepath.Join(indexDir, "config.json")); err == nil {
+		var config map[string]interface{}
+		if json.Unmarshal(data, &config) == nil {
+			_, hasConfig = config["dl"]
+		}
+	}
+	if hasConfig {
+		found = append(found, `config.json with "dl"`)
+	}
+
+	hasCache := firstIndexFile(filepath.Join(indexDir, SparseCacheDir), isSparseCache)
+	if hasCache {
+		found = append(found, SparseCacheDir+" with index cache files")
+	}
+
+	hasPlain := firstIndexFile(indexDir, func(content []byte) bool {
+		return bytes.HasPrefix(bytes.TrimSpace(content), []byte("{"))
+	})
+	if hasPlain {
+		found = append(found, "JSON-lines index files")
+	}
+
+	switch {
+	case hasGit && hasPlain:
+		return SourceFormatGit, nil
+	case hasCache && !hasPlain:
+		return SourceFormatSparseCache, nil
+	case hasPlain && !hasCache:
+		return SourceFormatSparse, nil
+	}
+	if len(found) == 0 {
+		found = append(found, "nothing recognizable")
+	}
+	return "", fmt.Errorf("cannot tell the index format of %s (found %s); pass -source-format", indexDir, strings.Join(found, ", "))
+}
+
+// firstIndexFile reports whether the first index file found under dir,
+// skipping .git, .cache, and config.json, satisfies match
+func firstIndexFile(dir string, match func(content []byte) bool) bool {
+	matched := false
+	filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && (info.Name() == ".git" || info.Name() == SparseCacheDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == "config.json" || isOwnOutput(info.Name()) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		matched = match(content)
+		return io.EOF
+	})
+	return matched
+}
+
+// Defaults of the index walk guards. The crates.io index is a few hundred
+// thousand files three directories deep, so these only trip on a tree that
+// is not an index or that loops back on itself.
+const (
+	DefaultIndexMaxDepth = 32
+	DefaultIndexMaxFiles = 2000000
+)
+
+// IndexWalkLimits guards the index walk against runaway directory trees
+type IndexWalkLimits struct {
+	// MaxDepth is how many directories deep the walk may go (0 for no limit)
+	MaxDepth int
+	// MaxFiles is how many files the walk may find (0 for no limit)
+	MaxFiles int
+	// FollowSymlinks walks into symlinked directories, walking each
+	// directory only once however many paths lead to it
+	FollowSymlinks bool
+}
+
+// indexWalk is the state of one walkIndex call
+type indexWalk struct {
+	limits IndexWalkLimits
+	fn     filepath.WalkFunc
+	logger *Logger
+	files  int
+	// walked maps the resolved path of every directory entered so far to
+	// the path it was entered by, when following symlinks
+	walked map[string]string
+}
+
+// walkIndex walks root in lexical order like filepath.Walk, within limits.
+// Exceeding the depth or file limit fails the walk with an error naming the
+// path it tripped on; a symlink leading back into the walk is skipped with
+// a warning naming where it leads.
+func walkIndex(root string, limits IndexWalkLimits, logger *Logger, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	w := &indexWalk{limits: limits, fn: fn, logger: logger, walked: make(map[string]string)}
+	if err := w.walk(root, info, 0); err != nil && err != filepath.SkipDir {
+		return err
+	}
+	return nil
+}
+
+func (w *indexWalk) walk(path string, info os.FileInfo, depth int) error {
+	if !info.IsDir() {
+		w.files++
+		if w.limits.MaxFiles > 0 && w.files > w.limits.MaxFiles {
+			return fmt.Errorf("found more than %d files, the last %s; this is far more than an index holds, so check what is under it (or raise -index-max-files)", w.limits.MaxFiles, path)
+		}
+		return w.fn(path, info, nil)
+	}
+	if w.limits.MaxDepth > 0 && depth > w.limits.MaxDepth {
+		return fmt.Errorf("%s is more than %d directories deep; check for a directory linked into itself (or raise -index-max-depth)", path, w.limits.MaxDepth)
+	}
+	if w.limits.FollowSymlinks {
+		// A directory reached through a symlink may also be reached
+		// directly or through another symlink; walk it only once
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			resolved, err = filepath.Abs(resolved)
+		}
+		if err != nil {
+			return w.fn(path, info, err)
+		}
+		if seen, ok := w.walked[resolved]; ok {
+			if strings.HasPrefix(path, seen+string(filepath.Separator)) {
+				w.logger.Warning("Not following %s: it loops back to %s", path, seen)
+			} else {
+				w.logger.Warning("Not walking %s: it is the same directory as %s, which is already walked", path, seen)
+			}
+			return nil
+		}
+		w.walked[resolved] = path
+	}
+	if err := w.fn(path, info, nil); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := filepath.Join(path, name)
+		childInfo, err := os.Lstat(child)
+		if err != nil {
+			if err := w.fn(child, childInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if childInfo.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(child); err == nil && target.IsDir() {
+				if !w.limits.FollowSymlinks {
+					w.logger.Debug("Not following the directory symlink %s", child)
+					continue
+				}
+				childInfo = target
+			}
+		}
+		if err := w.walk(child, childInfo, depth+1); err == filepath.SkipDir {
+			if !childInfo.IsDir() {
+				return nil
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindMetadataFiles finds all metadata files in the index directory
+func FindMetadataFiles(indexDir string, shards *ShardSet, mtimes *MtimeCheck, limits IndexWalkLimits, logger *Logger) ([]IndexFile, error) {
+	logger.Info("Finding metadata files in %s...", indexDir)
+	startTime := time.Now()
+
+	var metadataFiles []IndexFile
+
+	err := walkIndex(indexDir, limits, logger, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			// Skip common directories that might contain non-metadata files
+			if strings.Contains(path, ".git") ||
+				(info.Name() == SparseCacheDir && path != indexDir) ||
+				isTrashDir(info) ||
+				strings.Contains(path, ".venv") ||
+				strings.Contains(path, "site-packages") ||
+				strings.Contains(path, "pip") ||
+				strings.Contains(path, "python") ||
+				strings.Contains(path, "__pycache__") {
+				return filepath.SkipDir
+			}
+			// Skip index directories that cannot hold crates in our shards
+			if rel, err := filepath.Rel(indexDir, path); err == nil && !shards.AllowsIndexDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !shards.Contains(info.Name()) {
+			return nil
+		}
+
+		// Skip config.json and common non-metadata file types
+		if info.Name() == "config.json" {
+			return nil
+		}
+
+		// Skip Python files and other non-metadata files
+		if strings.HasSuffix(info.Name(), ".py") ||
+			strings.HasSuffix(info.Name(), ".pyc") ||
+			strings.HasSuffix(info.Name(), ".pyd") ||
+			strings.HasSuffix(info.Name(), ".dll") ||
+			strings.HasSuffix(info.Name(), ".exe") ||
+			strings.HasSuffix(info.Name(), ".bat") ||
+			strings.HasSuffix(info.Name(), ".sh") ||
+			strings.HasSuffix(info.Name(), ".md") ||
+			strings.HasSuffix(info.Name(), ".txt") ||
+			strings.HasSuffix(info.Name(), ".html") {
+			return nil
+		}
+
+		// Never read back our own outputs or crate files, in case the index
+		// and mirror share a tree
+		if isOwnOutput(info.Name()) {
+			return nil
+		}
+
+		mtimes.Check(path, info.ModTime(), logger)
+		metadataFiles = append(metadataFiles, IndexFile{Path: path, Size: info.Size(), ModTime: info.ModTime(), Root: indexDir, Source: SourceMain})
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error walking index directory: %v", err)
+	}
+
+	logger.Info("Found %d metadata files in %v", len(metadataFiles), time.Since(startTime))
+	return metadataFiles, nil
+}
+
+// duplicateKeys returns the dotted paths (such as "deps.0.name") of keys
+// that appear more than once within the same JSON object
+func duplicateKeys(data []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var dups []string
+
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := token.(json.Delim)
+		if !ok {
+			return nil
+		}
+
+		switch delim {
+		case '{':
+			seen := make(map[string]bool)
+			for decoder.More() {
+				token, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := token.(string)
+				if seen[key] {
+					dups = append(dups, prefix+key)
+				}
+				seen[key] = true
+				if err := walk(prefix + key + "."); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for i := 0; decoder.More(); i++ {
+				if err := walk(prefix + strconv.Itoa(i) + "."); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Consume the closing delimiter
+		_, err = decoder.Token()
+		return err
+	}
+
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+// crateFileName returns the crate name in a crate file's name, which is
+// "{name}-{version}.crate"
+func crateFileName(crateFilePath, version string) string {
+	return strings.TrimSuffix(filepath.Base(crateFilePath), "-"+version+".crate")
+}
+
+// namesAgree reports whether an entry name and a crate file name name the
+// same crate: equal ignoring case, as crates.io treats them, or related by
+// the rename map
+func namesAgree(name, fromFile string, renames *RenameMap) bool {
+	if strings.EqualFold(name, fromFile) {
+		return true
+	}
+	for _, alias := range renames.Aliases(strings.ToLower(name)) {
+		if strings.EqualFold(alias, fromFile) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxLogExamples is how many example versions a per-file log line lists
+const maxLogExamples = 5
+
+// logExamples lists up to maxLogExamples ids, noting how many more there are
+func logExamples(ids []string) string {
+	if len(ids) <= maxLogExamples {
+		return strings.Join(ids, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(ids[:maxLogExamples], ", "), len(ids)-maxLogExamples)
+}
+
+// setLocalInfo sets a field in the entry's local info block, creating the block if needed
+func setLocalInfo(metadata MetadataEntry, key string, value interface{}) {
+	info, ok := metadata[LocalInfoKey].(map[string]interface{})
+	if !ok {
+		info = make(map[string]interface{})
+		metadata[LocalInfoKey] = info
+	}
+	info[key] = value
+}
+
+// mirrorChanged counts the versions in an index file's content whose crate
+// file no longer has the size and mtime recorded in its metadata file. Only
+// the first destination on the filesystem is read; versions without a
+// metadata file or without a recorded identity count as unchanged.
+func mirrorChanged(content []byte, crateName string, crateIndex FileIndex, opts *Options) int {
+	if !opts.TrackCrateFiles {
+		return 0
+	}
+	var dest *Destination
+	for _, d := range opts.Destinations {
+		if d.Store == nil {
+			dest = d
+			break
+		}
+	}
+	if dest == nil {
+		return 0
+	}
+
+	changed := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		entry, err := indexentry.ParseLine([]byte(line))
+		if err != nil {
+			continue
+		}
+		version := entry.Version()
+		name := crateName
+		if opts.CrateIDMode {
+			name, _ = entry["name"].(string)
+		}
+		if version == "" || name == "" {
+			continue
+		}
+		fileName := name
+		crateFilePath, exists := crateIndex[name+"-"+version+".crate"]
+		if !exists {
+			for _, alias := range opts.RenameMap.Aliases(name) {
+				if crateFilePath, exists = crateIndex[alias+"-"+version+".crate"]; exists {
+					fileName = alias
+					break
+				}
+			}
+		}
+		if !exists {
+			continue
+		}
+		separate := false
+		if parsed, err := indexentry.ParseVersion(version); err == nil {
+			separate = parsed.IsPrerelease() && opts.Prereleases == PrereleasesSeparate
+		}
+		outputPath, err := dest.ExistingPath(crateFilePath, fileName, version, entry, separate)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(outputPath)
+		if err != nil {
+			continue
+		}
+		var doc struct {
+			Local struct {
+				CrateSize  *int64 `json:"crate_size"`
+				CrateMtime string `json:"crate_mtime"`
+			} `json:"_local"`
+		}
+		if json.Unmarshal(data, &doc) != nil || doc.Local.CrateSize == nil {
+			continue
+		}
+		info, err := os.Stat(crateFilePath)
+		if err != nil {
+			continue
+		}
+		if info.Size() != *doc.Local.CrateSize || info.ModTime().UTC().Format(time.RFC3339Nano) != doc.Local.CrateMtime {
+			changed++
+		}
+	}
+	return changed
+}
+
+// indexVersions returns the set of versions listed in an index file's content
+func indexVersions(content []byte) map[string]bool {
+	versions := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		entry, err := indexentry.ParseLine([]byte(line))
+		if err != nil {
+			continue
+		}
+		if version := entry.Version(); version != "" {
+			versions[strings.TrimSpace(version)] = true
+		}
+	}
+	return versions
+}
+
+// trimmedFields are the string fields of an entry that are trimmed of
+// surrounding whitespace before use
+var trimmedFields = []string{"name", "vers", "cksum"}
+
+// trimEntryFields trims surrounding whitespace from the entry's key string
+// fields and returns the names of the fields that changed
+func trimEntryFields(metadata MetadataEntry) []string {
+	var changed []string
+	for _, field := range trimmedFields {
+		value, ok := metadata[field].(string)
+		if !ok {
+			continue
+		}
+		if trimmed := strings.TrimSpace(value); trimmed != value {
+			metadata[field] = trimmed
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// writeCompactIndex writes the kept entries of an index file to the same
+// relative path under the compacted index directory. Crates with no kept
+// entries get no file.
+func writeCompactIndex(file IndexFile, kept []string, opts *Options, logger *Logger) error {
+	if len(kept) == 0 {
+		return nil
+	}
+
+	rel, err := filepath.Rel(file.Root, file.Path)
+	if err != nil {
+		return err
+	}
+	outputPath := filepath.Join(opts.CompactIndexDir, rel)
+
+	if opts.DryRun {
+		logger.Info("DRY RUN: Would write %d entries to %s", len(kept), outputPath)
+		return nil
+	}
+
+	if err := fsMkdirAll(filepath.Dir(outputPath), opts.DirMode); err != nil {
+		return err
+	}
+	return fsWriteFile(outputPath, []byte(strings.Join(kept, "\n")+"\n"), opts.FileMode)
+}
+
+// overlayKept returns the lines of a local index file that a compacted
+// index keeps: entries that are not yanked and whose crate file is present
+func overlayKept(content []byte, crateName string, crateIndex FileIndex, opts *Options) []string {
+	var kept []string
+	for _, line := range strings.Split(string(content), "\n") {
+		entry, err := indexentry.ParseLine([]byte(line))
+		if err != nil {
+			continue
+		}
+		version := entry.Version()
+		if yanked, _ := entry["yanked"].(bool); yanked || version == "" {
+			continue
+		}
+		name := crateName
+		if opts.CrateIDMode {
+			name = entry.Name()
+		}
+		_, present := crateIndex[name+"-"+version+".crate"]
+		for _, alias := range opts.RenameMap.Aliases(name) {
+			if present {
+				break
+			}
+			_, present = crateIndex[alias+"-"+version+".crate"]
+		}
+		if present {
+			kept = append(kept, strings.TrimSpace(line))
+		}
+	}
+	return kept
+}
+
+// Worker represents a worker that processes metadata files
+type Worker struct {
+	id            int
+	metadataFiles chan IndexFile
+	crateIndex    FileIndex
+	opts          *Options
+	wg            *sync.WaitGroup
+	logger        *Logger
+	results       chan FileResult
+
+	// span is the run's trace span, parent of the file spans
+	span *Span
+
+	// counted is called with every result for the live progress counts
+	counted func(FileResult)
+
+	// tally and retries hold the counts and failed writes of the files the
+	// worker processed when results is nil, for merging after the workers
+	// finish; per-file results are only sent when something consumes them
+	tally   Report
+	retries []*RetryVersion
+}
+
+// NewWorker creates a new worker
+func NewWorker(id int, metadataFiles chan IndexFile, crateIndex FileIndex, opts *Options, wg *sync.WaitGroup, logger *Logger, results chan FileResult) *Worker {
+	return &Worker{
+		id:            id,
+		metadataFiles: metadataFiles,
+		crateIndex:    crateIndex,
+		opts:          opts,
+		wg:            wg,
+		logger:        logger,
+		results:       results,
+	}
+}
+
+// Start starts the worker
+func (w *Worker) Start() {
+	defer w.wg.Done()
+
+	for metadataFile := range w.metadataFiles {
+		span := w.opts.Tracer.StartFile("organize.file", w.span)
+		result := w.process(metadataFile)
+		result.bytes = metadataFile.Size
+		if span != nil {
+			span.SetString("crate", result.Crate)
+			span.SetString("index.source", result.Source)
+			span.SetInt("versions", result.Total)
+			span.SetInt("missing", result.Missing)
+			span.SetInt("errors", result.Errors)
+			span.End()
+		}
+		if w.counted != nil {
+			w.counted(result)
+		}
+		if w.results != nil {
+			w.results <- result
+			continue
+		}
+		w.tally.Add(result)
+		w.retries = append(w.retries, result.Retries...)
+	}
+}
+
+// process processes one index file, abandoning it if it takes longer than
+// the per-file timeout. An abandoned file's goroutine stops before its next
+// version or per-crate write, or as soon as a blocked read returns, and its
+// result is dropped.
+func (w *Worker) process(file IndexFile) FileResult {
+	if w.opts.PerFileTimeout <= 0 {
+		return ProcessMetadataFile(file, w.crateIndex, w.opts, w.logger)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.opts.PerFileTimeout)
+	defer cancel()
+	done := make(chan FileResult, 1)
+	go func() {
+		done <- ProcessMetadataFileContext(ctx, file, w.crateIndex, w.opts, w.logger)
+	}()
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		w.logger.Error("Abandoned index file %s after %v", file.Path, w.opts.PerFileTimeout)
+		return FileResult{Path: file.Path, Source: file.Source, Crate: filepath.Base(file.Path), Errors: 1, TimedOut: 1}
+	}
+}
+
+// checkpointVersion is the format version of the checkpoint file
+const checkpointVersion = 1
+
+// checkpointEvery is how many processed index files go between checkpoint saves
+const checkpointEvery = 1000
+
+// Checkpoint persists the progress of a run: the index files already
+// processed, the cumulative counts, and when the job started, so that a run
+// restarted after an interruption skips the finished files and its progress,
+// ETA, and summary cover the whole job. It is only touched by the result
+// collector.
+type Checkpoint struct {
+	path  string
+	state checkpointFile
+
+	// segmentStart is when the current segment of the job started
+	segmentStart time.Time
+}
+
+// checkpointFile is the on-disk form of a Checkpoint
+type checkpointFile struct {
+	Version int `json:"version"`
+
+	// Job identifies the index and shards the checkpoint belongs to
+	Job string `json:"job"`
+
+	Started  time.Time       `json:"started"`
+	Segments int             `json:"segments"`
+	Done     map[string]bool `json:"done"`
+	Report   Report          `json:"report"`
+
+	// Labels are the -label annotations of the job
+	Labels Labels `json:"labels,omitempty"`
+}
+
+// LoadCheckpoint reads the checkpoint at path for the job described by job.
+// A missing file, or one left by a different job, yields a fresh checkpoint.
+func LoadCheckpoint(path, job string, logger *Logger) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{path: path}
+	checkpoint.reset(job)
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+
+	var state checkpointFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", path, err)
+	}
+	if state.Version != checkpointVersion {
+		return nil, fmt.Errorf("checkpoint %s has unsupported version %d", path, state.Version)
+	}
+	if state.Job != job {
+		logger.Warning("Ignoring checkpoint %s, which is for %s rather than %s", path, state.Job, job)
+		return checkpoint, nil
+	}
+	if state.Done == nil {
+		state.Done = make(map[string]bool)
+	}
+	checkpoint.state = state
+	return checkpoint, nil
+}
+
+// reset starts a fresh job
+func (c *Checkpoint) reset(job string) {
+	c.state = checkpointFile{Version: checkpointVersion, Job: job, Started: time.Now(), Done: make(map[string]bool)}
+}
+
+// Resume starts a new segment of the job and returns the files still to be
+// processed and the report to continue counting into
+func (c *Checkpoint) Resume(files []IndexFile, runID string) ([]IndexFile, *Report) {
+	c.segmentStart = time.Now()
+	c.state.Segments++
+	report := &Report{RunID: runID}
+	if len(c.state.Done) == 0 {
+		return files, report
+	}
+
+	*report = c.state.Report
+	report.RunID = runID
+	report.Partial = false
+	report.FilesPending = 0
+	report.SanityFailed = false
+	report.SanityAborted = false
+	report.Segments = c.state.Segments
+
+	pending := make([]IndexFile, 0, len(files))
+	for _, file := range files {
+		if !c.state.Done[file.Path] {
+			pending = append(pending, file)
+		}
+	}
+	return pending, report
+}
+
+// MergeLabels returns the labels of the job: those recorded by earlier
+// segments, plus any new ones given to this segment. A label given a
+// different value than before keeps its first value, so every segment of
+// a job carries the same annotations.
+func (c *Checkpoint) MergeLabels(labels Labels, logger *Logger) Labels {
+	merged := make(Labels)
+	for key, value := range labels {
+		merged[key] = value
+	}
+	if len(c.state.Done) > 0 {
+		for key, value := range c.state.Labels {
+			if given, ok := labels[key]; ok && given != value {
+				logger.Warning("Keeping the checkpoint's label %s=%s rather than %s=%s, so the job's segments match", key, value, key, given)
+			} else if !ok {
+				logger.Info("Carrying the label %s=%s over from the checkpoint", key, value)
+			}
+			merged[key] = value
+		}
+	}
+	c.state.Labels = merged
+	return merged
+}
+
+// Resumed reports whether the job was started by an earlier segment
+func (c *Checkpoint) Resumed() bool {
+	return c != nil && c.state.Segments > 1
+}
+
+// Finished records that an index file has been processed, saving the
+// checkpoint every checkpointEvery files
+func (c *Checkpoint) Finished(path string, report *Report, logger *Logger) {
+	if c == nil {
+		return
+	}
+	c.state.Done[path] = true
+	if len(c.state.Done)%checkpointEvery == 0 {
+		if err := c.Save(report); err != nil {
+			logger.Error("%v", err)
+		}
+	}
+}
+
+// Elapsed returns the time spent on the job in earlier segments and this
+// one; the time between segments does not count
+func (c *Checkpoint) Elapsed() time.Duration {
+	return c.state.Report.Duration + time.Since(c.segmentStart)
+}
+
+// Save writes the checkpoint with the counts so far
+func (c *Checkpoint) Save(report *Report) error {
+	state := c.state
+	state.Report = *report
+	state.Report.Duration = c.Elapsed()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+
+	temp := c.path + ".tmp"
+	if err := fsWriteFile(temp, data, 0644); err != nil {
+		fsRemove(temp)
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := fsRename(temp, c.path); err != nil {
+		fsRemove(temp)
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Complete removes the checkpoint of a finished job, so the next run starts
+// a new one
+func (c *Checkpoint) Complete() error {
+	job := c.state.Job
+	c.reset(job)
+	if err := fsRemove(c.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Phases of a run reported in progress snapshots
+const (
+	PhaseIndexBuild = "index_build"
+	PhaseDiscovery  = "discovery"
+	PhaseProcessing = "processing"
+	PhaseFinishing  = "finishing"
+)
+
+// ProgressSnapshot is the state of a run passed to Options.Progress
+type ProgressSnapshot struct {
+	Phase          string
+	FilesProcessed int
+	FilesTotal     int
+	BytesProcessed int64
+	BytesTotal     int64
+	Versions       int
+	Success        int
+	Missing        int
+	Errors         int
+	Elapsed        time.Duration
+
+	// ETA estimates the time left processing index files; 0 if unknown
+	ETA time.Duration
+}
+
+// ProgressFunc receives progress snapshots of a run
+type ProgressFunc func(ProgressSnapshot)
+
+// OrganizeMetadata organizes metadata files from index directory to be alongside crate files
+func OrganizeMetadata(opts *Options, logger *Logger) (*Report, error) {
+	return OrganizeMetadataContext(context.Background(), opts, logger)
+}
+
+// OrganizeMetadataContext is OrganizeMetadata with cancellation: once ctx is
+// done, no further index files are dispatched, and the returned report is
+// marked partial with accurate counts for the files that were processed
+func OrganizeMetadataContext(ctx context.Context, opts *Options, logger *Logger) (*Report, error) {
+	// Stop dispatching new files once the timeout has elapsed
+	var deadline <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	runStart := time.Now()
+	if opts.Progress != nil {
+		opts.Progress(ProgressSnapshot{Phase: PhaseIndexBuild})
+	}
+
+	for _, dest := range opts.Destinations {
+		dest.ResetCounts()
+	}
+
+	// Build index of crate files, or refresh the warm one in daemon mode
+	var crateIndex FileIndex
+	var err error
+	opts.Ignore.ResetCounts()
+	opts.Categories.Reset()
+	opts.Baseline.Reset()
+	opts.Lockfile.Reset()
+	opts.Mtimes.Reset()
+	opts.Collisions.Reset()
+
+	runSpan := opts.Tracer.Start("organize.run", nil)
+	defer runSpan.End()
+
+	// Discover the metadata files while the crate index is built; the two
+	// walks touch different trees, so running them together saves the
+	// shorter one's wall-clock time
+	type discoveryResult struct {
+		files []IndexFile
+		err   error
+	}
+	discovered := make(chan discoveryResult, 1)
+	discoverySpan := opts.Tracer.Start("organize.discovery", runSpan)
+	go func() {
+		files, err := FindMetadataFiles(opts.IndexDir, opts.Shards, opts.Mtimes, opts.IndexWalk, logger)
+		if err != nil {
+			discovered <- discoveryResult{err: fmt.Errorf("failed to find metadata files: %v", err)}
+			return
+		}
+		if opts.LocalIndexDir != "" {
+			localFiles, err := FindMetadataFiles(opts.LocalIndexDir, opts.Shards, opts.Mtimes, opts.IndexWalk, logger)
+			if err != nil {
+				discovered <- discoveryResult{err: fmt.Errorf("failed to find local metadata files: %v", err)}
+				return
+			}
+			var overlaid int
+			files, overlaid = MergeLocalIndex(files, localFiles)
+			if overlaid > 0 {
+				logger.Info("%d crates are in both indexes; local versions take precedence", overlaid)
+			}
+		}
+		discovered <- discoveryResult{files: files}
+	}()
+
+	indexSpan := opts.Tracer.Start("organize.index_build", runSpan)
+	if opts.CrateIndexCache != nil {
+		crateIndex, err = opts.CrateIndexCache.Refresh(logger)
+	} else {
+		crateIndex, err = BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, opts.Mtimes, logger)
+	}
+	if err != nil {
+		indexSpan.End()
+		<-discovered
+		discoverySpan.End()
+		return nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+	indexSpan.SetInt("crate_files", len(crateIndex))
+	indexSpan.End()
+	opts.Ignore.LogCounts(logger)
+
+	// Crate files differing only by case collide on case-insensitive
+	// filesystems, and so would their metadata files
+	mirrorCaseCollisions := 0
+	if opts.Collisions != nil && opts.Collisions.FoldCase {
+		hazards := CaseCollisions(crateIndex)
+		keys := make([]string, 0, len(hazards))
+		for key := range hazards {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			logger.Warning("Case collision in the mirror: %s differ only by case", strings.Join(hazards[key], " and "))
+			mirrorCaseCollisions += len(hazards[key])
+		}
+		if opts.DisambiguateCase {
+			for _, dest := range opts.Destinations {
+				dest.Guard.SetCaseSuffixed(hazards)
+			}
+			if len(hazards) > 0 {
+				logger.Info("Metadata files of %d crate versions whose names differ only by case get a hash suffix; see %s", len(hazards), RenamedNamesFile)
+			}
+		}
+	}
+
+	// Wait for the discovery walk if it is still running
+	if opts.Progress != nil {
+		opts.Progress(ProgressSnapshot{Phase: PhaseDiscovery, Elapsed: time.Since(runStart)})
+	}
+	discovery := <-discovered
+	if discovery.err != nil {
+		discoverySpan.End()
+		return nil, discovery.err
+	}
+	metadataFiles := discovery.files
+	opts.CrateNames.Record(metadataFiles)
+	if opts.Lockfile != nil {
+		metadataFiles = opts.Lockfile.FilterFiles(metadataFiles, opts.CrateIDMode)
+		logger.Info("Organizing the %d pinned versions of %s from %d index files", opts.Lockfile.Len(), opts.Lockfile.Path, len(metadataFiles))
+	}
+	discoverySpan.SetInt("index_files", len(metadataFiles))
+	discoverySpan.End()
+	if err := SortIndexFiles(metadataFiles, opts.Order); err != nil {
+		return nil, err
+	}
+
+	// A resumed job skips the files finished before the interruption, but its
+	// progress and counts cover the whole job
+	totalFiles := len(metadataFiles)
+	report := &Report{RunID: opts.RunID}
+	if opts.Checkpoint != nil {
+		metadataFiles, report = opts.Checkpoint.Resume(metadataFiles, opts.RunID)
+	}
+	report.Labels = opts.Labels
+	if opts.Checkpoint != nil {
+		if opts.Checkpoint.Resumed() {
+			logger.Info("Resuming from checkpoint: %d of %d index files already processed (segment %d of a job started %s)",
+				totalFiles-len(metadataFiles), totalFiles, report.Segments, opts.Checkpoint.state.Started.Format(time.RFC3339))
+		}
+	}
+	resumedFiles := totalFiles - len(metadataFiles)
+	meter := newProgressMeter(metadataFiles, opts.ETASmoothing)
+	logger.Info("Processing %d metadata files...", len(metadataFiles))
+
+	if opts.DryRun {
+		logger.Info("DRY RUN: No files will be created")
+	}
+
+	// Create channel for metadata files; it is kept small so dispatch can stop on timeout
+	metadataFileChan := make(chan IndexFile, opts.NumWorkers)
+
+	// Per-file results are only sent to the collector when something
+	// consumes them; otherwise each worker tallies its own files and the
+	// tallies are merged once the workers finish
+	detailed := len(opts.ReportPaths) > 0 || opts.HTMLReport != "" || opts.Checkpoint != nil ||
+		opts.OnResult != nil || opts.ResultStream != nil
+	resultsChan := make(chan FileResult)
+	var workerResults chan FileResult
+	if detailed {
+		resultsChan = make(chan FileResult, totalFiles)
+		workerResults = resultsChan
+	}
+
+	// The live counts of a resumed job start from its checkpoint
+	resumed := struct{ versions, success, missing, errors int }{report.Versions, report.Success, report.Missing, report.Errors}
+
+	// The sanity check runs once, in the worker whose file takes the
+	// versions looked up past SanityCheckVersions
+	var sanityOnce sync.Once
+	insane := make(chan struct{})
+	var sanityChecked, sanityFailed, sanityAborted bool
+	counted := func(result FileResult) {
+		processed := resumedFiles + meter.Done(result)
+		if processed%1000 == 0 {
+			logger.Info("%s", progressLine(processed, totalFiles, meter))
+		}
+		if opts.SanityThreshold <= 0 {
+			return
+		}
+		success := resumed.success + int(atomic.LoadInt64(&meter.success))
+		missing := resumed.missing + int(atomic.LoadInt64(&meter.missing))
+		if success+missing < SanityCheckVersions {
+			return
+		}
+		sanityOnce.Do(func() {
+			sanityChecked = true
+			sanityFailed = checkSanity(success, missing, opts, logger)
+			if sanityFailed && opts.AbortOnSanity {
+				sanityAborted = true
+				close(insane)
+			}
+		})
+	}
+
+	// Create wait group for workers
+	var wg sync.WaitGroup
+
+	// Start workers
+	workers := make([]*Worker, opts.NumWorkers)
+	for i := range workers {
+		wg.Add(1)
+		worker := NewWorker(i, metadataFileChan, crateIndex, opts, &wg, logger, workerResults)
+		worker.span = runSpan
+		worker.counted = counted
+		workers[i] = worker
+		go worker.Start()
+	}
+
+	// Send metadata files to workers until all are sent or the run times out
+	dispatched := make(chan int, 1)
+	var lastDispatch, workersDone time.Time
+	go func() {
+		sent := 0
+	dispatch:
+		for _, file := range metadataFiles {
+			select {
+			case <-deadline:
+				break dispatch
+			case <-ctx.Done():
+				break dispatch
+			case <-insane:
+				break dispatch
+			default:
+			}
+			select {
+			case metadataFileChan <- file:
+				sent++
+			case <-deadline:
+				break dispatch
+			case <-ctx.Done():
+				break dispatch
+			case <-insane:
+				break dispatch
+			}
+		}
+		lastDispatch = time.Now()
+		close(metadataFileChan)
+		dispatched <- sent
+	}()
+
+	// Create a goroutine to close the results channel when all workers are done
+	go func() {
+		wg.Wait()
+		workersDone = time.Now()
+		close(resultsChan)
+	}()
+
+	// Progress snapshots read the live counts of the meter
+	snapshot := func(phase string) ProgressSnapshot {
+		return ProgressSnapshot{
+			Phase:          phase,
+			FilesProcessed: resumedFiles + int(atomic.LoadInt64(&meter.files)),
+			FilesTotal:     totalFiles,
+			BytesProcessed: atomic.LoadInt64(&meter.bytes),
+			BytesTotal:     meter.totalBytes,
+			Versions:       resumed.versions + int(atomic.LoadInt64(&meter.versions)),
+			Success:        resumed.success + int(atomic.LoadInt64(&meter.success)),
+			Missing:        resumed.missing + int(atomic.LoadInt64(&meter.missing)),
+			Errors:         resumed.errors + int(atomic.LoadInt64(&meter.errors)),
+			Elapsed:        time.Since(runStart),
+			ETA:            meter.ETA(),
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(snapshot(PhaseProcessing))
+	}
+	var retryQueue []*RetryVersion
+
+	// Missing versions per crate are kept only for the HTML report
+	if opts.HTMLReport != "" {
+		report.missingByCrate = make(map[string]int)
+	}
+	report.MirrorCaseCollisions = mirrorCaseCollisions
+	report.Registry = opts.Registry
+	if opts.Shards != nil {
+		report.Shards = opts.Shards.Expr
+		logger.Info("Restricted to shards %s", opts.Shards.Expr)
+	}
+
+	// Streaming reports are written as results arrive; the collector is
+	// their only writer, and only the numeric summary is kept in memory
+	var reportWriters []ReportWriter
+	var reportPaths []string
+	for _, path := range opts.ReportPaths {
+		writer, err := OpenReportWriter(path, opts.CompressReports, opts.RunID, opts.Labels)
+		if err != nil {
+			logger.Error("%v", err)
+			continue
+		}
+		reportWriters = append(reportWriters, writer)
+		reportPaths = append(reportPaths, path)
+	}
+	opts.Mtimes.Summarize(report, logger)
+
+	// Create a ticker for progress updates, and one for the progress callback
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	var progressTick <-chan time.Time
+	if opts.Progress != nil {
+		interval := opts.ProgressInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		progressTicker := time.NewTicker(interval)
+		defer progressTicker.Stop()
+		progressTick = progressTicker.C
+	}
+
+	// Create a done channel that will be closed when all results are collected
+	done := make(chan struct{})
+
+	// Start a goroutine to collect the per-file results, then merge the
+	// workers' tallies
+	go func() {
+		for result := range resultsChan {
+			report.Add(result)
+			opts.Checkpoint.Finished(result.Path, report, logger)
+			retryQueue = append(retryQueue, result.Retries...)
+			if report.missingByCrate != nil && result.Missing > 0 {
+				report.missingByCrate[result.Crate] += result.Missing
+			}
+			if opts.OnResult != nil {
+				opts.OnResult(result)
+			}
+			if opts.ResultStream != nil {
+				fileResult := result
+				opts.ResultStream.Send(ResultEvent{Type: "file", File: &fileResult})
+			}
+			for i, writer := range reportWriters {
+				if writer == nil {
+					continue
+				}
+				if err := writer.WriteResult(result); err != nil {
+					logger.Error("Failed to write report %s: %v", reportPaths[i], err)
+					writer.Finish(nil)
+					reportWriters[i] = nil
+				}
+			}
+		}
+		for _, worker := range workers {
+			report.Merge(&worker.tally)
+			retryQueue = append(retryQueue, worker.retries...)
+		}
+		report.SanityFailed = report.SanityFailed || sanityFailed
+		report.SanityAborted = sanityAborted
+		close(done)
+	}()
+
+	// Wait for all results to be collected or print progress every second
+	for {
+		select {
+		case <-progressTick:
+			opts.Progress(snapshot(PhaseProcessing))
+		case <-done:
+			if opts.Progress != nil {
+				opts.Progress(snapshot(PhaseFinishing))
+			}
+			if len(retryQueue) > 0 {
+				RetryFailedWrites(retryQueue, report, opts, logger)
+				logger.Info("Retries: %d versions rescued, %d still failing after %d passes", report.Rescued, report.RetryFailed, opts.RetryPasses)
+			}
+			if len(report.Categories) > 0 {
+				categories := make([]string, 0, len(report.Categories))
+				for category := range report.Categories {
+					categories = append(categories, category)
+				}
+				sort.Strings(categories)
+				for i, category := range categories {
+					categories[i] = fmt.Sprintf("%s=%d", category, report.Categories[category])
+				}
+				logger.Info("Outcomes of %d entries: %s", report.Entries, strings.Join(categories, " "))
+			}
+			if err := report.CheckAccounting(); err != nil {
+				logger.Error("Accounting error: %v", err)
+			}
+			opts.Lockfile.Summarize(report, logger)
+			if !sanityChecked && opts.SanityThreshold > 0 {
+				logger.Info("Sanity check not evaluated: only %d versions were looked up in the mirror, fewer than %d", report.Success+report.Missing, SanityCheckVersions)
+			}
+			sent := <-dispatched
+			if totalFiles > 0 {
+				report.Tail = workersDone.Sub(lastDispatch)
+				logger.Info("Tail: workers finished %v after the last index file was dispatched (order %s)", report.Tail.Round(time.Millisecond), opts.Order)
+			}
+			report.ETAChecks = meter.Finish(workersDone)
+			for _, check := range report.ETAChecks {
+				logger.Info("ETA accuracy: at %.0f%% of index bytes the ETA was %v; the rest took %v", check.Percent,
+					check.Predicted.Round(time.Second), check.Actual.Round(time.Second))
+			}
+			if sent < len(metadataFiles) {
+				report.Partial = true
+				report.FilesPending = len(metadataFiles) - sent
+				if ctx.Err() != nil {
+					logger.Warning("PARTIAL RUN: canceled with %d of %d index files processed", resumedFiles+sent, totalFiles)
+				} else if report.SanityAborted {
+					logger.Warning("PARTIAL RUN: aborted by the sanity check with %d of %d index files processed", resumedFiles+sent, totalFiles)
+				} else {
+					logger.Warning("PARTIAL RUN: timed out after %v with %d of %d index files processed", opts.Timeout, resumedFiles+sent, totalFiles)
+				}
+				if opts.Order == OrderMtimeDesc && sent > 0 {
+					cutoff := metadataFiles[sent-1].ModTime
+					logger.Warning("PARTIAL RUN: every index file modified since %s (the newest %v of changes) was processed",
+						cutoff.Format(time.RFC3339), time.Since(cutoff).Round(time.Second))
+				}
+			}
+			if !opts.DryRun {
+				for _, dest := range opts.Destinations {
+					dest.LogWriteLatency(logger, 3)
+				}
+			}
+			if len(opts.Destinations) > 1 || opts.SkipUnchanged || opts.WritersPerDir > 0 {
+				report.Destinations = make(map[string]DestinationCounts)
+				for _, dest := range opts.Destinations {
+					counts := dest.Counts()
+					report.Destinations[dest.Root] = counts
+					logger.Info("Destination %s: %d written, %d unchanged, %d failed", dest.Root, counts.Written, counts.Unchanged, counts.Failed)
+				}
+				if report.PartialWrites > 0 {
+					logger.Warning("%d versions were written to some destinations but not all", report.PartialWrites)
+				}
+			}
+			for _, dest := range opts.Destinations {
+				counts := dest.Counts()
+				report.SymlinksReplaced += counts.SymlinksReplaced
+				report.SymlinksWrittenThrough += counts.SymlinksWrittenThrough
+			}
+			if report.SymlinksReplaced > 0 || report.SymlinksWrittenThrough > 0 {
+				logger.Info("Symlinks at metadata output paths: %d replaced with real files, %d written through", report.SymlinksReplaced, report.SymlinksWrittenThrough)
+			}
+			if opts.DirManifests && !opts.DryRun {
+				for _, dest := range opts.Destinations {
+					written, err := dest.WriteDirManifests(logger)
+					report.DirManifests += written
+					if err != nil {
+						logger.Error("%v", err)
+						report.Errors++
+					}
+				}
+				logger.Info("Wrote %d directory manifests", report.DirManifests)
+			}
+			if opts.Manifest != nil || opts.DirManifests {
+				report.Canonicalization = CanonicalizationVersion
+				logger.Info("Content hashes use canonicalization version %d", CanonicalizationVersion)
+			}
+			if !opts.DryRun {
+				for _, dest := range opts.Destinations {
+					if renamed, err := dest.Guard.SaveRenamed(); err != nil {
+						logger.Error("Failed to record renamed file names: %v", err)
+					} else if renamed > 0 {
+						logger.Warning("%d files under %s have sanitized or case-disambiguated names; see %s", renamed, dest.Root, RenamedNamesFile)
+					}
+					if parted, err := dest.Spill.Save(); err != nil {
+						logger.Error("Failed to record part directory placements: %v", err)
+					} else if parted > 0 {
+						logger.Info("%d metadata files under %s are in part directories; see %s", parted, dest.Root, PartsFileName)
+					}
+				}
+			}
+			if opts.CompactIndexDir != "" {
+				logger.Info("Compacted index: %d entries kept in %s", report.Compacted, opts.CompactIndexDir)
+			}
+			if opts.LocalIndexDir != "" {
+				for _, source := range []string{SourceMain, SourceLocal} {
+					if counts := report.Sources[source]; counts != nil {
+						logger.Info("Index source %s: %d files, %d versions, %d organized, %d missing",
+							source, counts.Files, counts.Versions, counts.Success, counts.Missing)
+					}
+				}
+				if report.Overridden > 0 {
+					logger.Info("%d main index versions were overridden by the local index", report.Overridden)
+				}
+			}
+			if report.Filtered > 0 {
+				logger.Info("%d entries were skipped by the entry filter", report.Filtered)
+			}
+			if opts.Latest != nil {
+				logger.Info("Latest pointers: %d created or updated (%s mode)", report.LatestUpdated, opts.Latest.Mode)
+			}
+			if opts.Bundles != nil {
+				logger.Info("Aggregate bundles: %d created or updated", report.BundlesUpdated)
+			}
+			if opts.StrictJSON {
+				logger.Info("Strict JSON: %d entries rejected for duplicate keys", report.DuplicateKeys)
+			}
+			if report.Collisions > 0 {
+				logger.Error("Found %d output path collisions between different crate versions", report.Collisions)
+			} else if opts.Collisions != nil {
+				logger.Info("No output path collisions found")
+			}
+			if report.CaseCollisions > 0 {
+				logger.Error("Found %d output paths that differ from another only by case", report.CaseCollisions)
+			}
+			if report.MirrorCaseCollisions > 0 {
+				logger.Warning("Found %d crate files in the mirror whose names differ from another only by case", report.MirrorCaseCollisions)
+			}
+			if report.CaseCollisions == 0 && report.MirrorCaseCollisions == 0 && opts.Collisions != nil && opts.Collisions.FoldCase {
+				logger.Info("No case collisions found")
+			}
+			if report.Aliased > 0 {
+				logger.Info("%d versions were matched under a renamed crate alias", report.Aliased)
+			}
+			if report.InvalidNames > 0 {
+				logger.Warning("Found %d index files whose names are not valid crate names", report.InvalidNames)
+			}
+			if report.TimedOut > 0 {
+				logger.Error("Abandoned %d index files that took longer than %v", report.TimedOut, opts.PerFileTimeout)
+			}
+			if opts.ValidateDeps {
+				logger.Info("Found %d versions with invalid dependency requirements", report.InvalidDeps)
+			}
+			if opts.CheckNames && !opts.CrateIDMode {
+				logger.Info("Found %d versions whose entry name disagrees with their crate file", report.NameMismatches)
+			}
+			if len(opts.StripFields) > 0 {
+				logger.Info("Stripped %s from %d entries", strings.Join(opts.StripFields, ", "), report.Stripped)
+			}
+			if opts.MinVersions != nil {
+				logger.Info("Skipped %d versions below their minimum version; %d crates have no version at or above it", report.BelowMin, report.NoVersionAboveMin)
+			}
+			if opts.LatestN > 0 {
+				logger.Info("Skipped %d versions older than their crate's newest %d", report.SkippedOld, opts.LatestN)
+			}
+			if report.Prereleases > 0 {
+				stable := report.Versions - (report.Prereleases - report.PrereleasesSkipped)
+				organized := report.Success - report.PrereleasesOrganized
+				coverage := 100.0
+				if stable > 0 {
+					coverage = 100 * float64(organized) / float64(stable)
+				}
+				logger.Info("Stable versions: %d out of %d organized (%.1f%%); prereleases: %d seen, %d skipped, %d organized",
+					organized, stable, coverage, report.Prereleases, report.PrereleasesSkipped, report.PrereleasesOrganized)
+			}
+			if opts.NormalizeSchema {
+				logger.Info("Normalized schema: %d v1 entries, %d v2 entries; %d entries with an unknown schema version passed through; %d with an invalid links field",
+					report.NormalizedV1, report.NormalizedV2, report.UnknownSchema, report.InvalidLinks)
+			}
+			if opts.VerifyChecksum {
+				logger.Info("Checksums: %d crate files passed, %d failed, %d entries had no cksum",
+					report.ChecksumPassed, report.ChecksumFailed, report.ChecksumMissing)
+			}
+			if opts.Snapshot != nil {
+				logger.Info("Skipped %d crates whose index file is unchanged since the snapshot", report.SnapshotSkipped)
+				logger.Info("Reprocessed %d crates whose index file changed", report.IndexChanged)
+				if opts.TrackCrateFiles {
+					logger.Info("Reprocessed %d versions whose crate file changed in the mirror with the index unchanged", report.MirrorChanged)
+				}
+			}
+			if opts.ParseCache != nil {
+				logger.Info("Parse cache: %d index files reused, %d parsed", report.ParseCacheHits, report.ParseCacheMisses)
+				if report.ParseCacheRebuilt > 0 {
+					logger.Warning("Parse cache: rebuilt %d corrupt or outdated entries", report.ParseCacheRebuilt)
+				}
+
+				// Entries no run looked up are only known to be dead when
+				// this run read every index file
+				if opts.CompactBudget > 0 && !opts.DryRun {
+					if report.Partial || opts.Shards != nil || opts.Checkpoint.Resumed() || opts.Snapshot != nil || opts.Lockfile != nil {
+						logger.Info("Parse cache: not compacted, since this run did not read every index file")
+					} else if compact, err := opts.ParseCache.Compact(opts.ParseCache.Used(), opts.CompactBudget, false, logger); err != nil {
+						logger.Warning("Parse cache: %v", err)
+					} else {
+						report.CacheCompaction = compact
+						logger.Info("Parse cache: compacted in %v, removing %d dead, %d outdated, and %d temp files (%d bytes reclaimed)",
+							compact.Duration.Round(time.Millisecond), compact.Dead, compact.Stale, compact.Temps, compact.Reclaimed)
+						if !compact.Complete {
+							logger.Info("Parse cache: compaction ran out of its %v budget; the next run continues it", opts.CompactBudget)
+						}
+					}
+				}
+			}
+			if opts.Baseline != nil {
+				summarizeBaseline(report, opts, logger)
+			}
+			if opts.CrateNames != nil {
+				summarizeRemoved(report, crateIndex, opts, logger)
+			}
+			if opts.Categories != nil {
+				summary := opts.Categories.Summary(opts.Categories.Top)
+				logger.Info("Categories: %d crates list categories or keywords", summary.Crates)
+				for i, count := range summary.Categories {
+					if i == 10 {
+						break
+					}
+					logger.Info("  category %s: %d crates", count.Name, count.Crates)
+				}
+				for i, count := range summary.Keywords {
+					if i == 10 {
+						break
+					}
+					logger.Info("  keyword %s: %d crates", count.Name, count.Crates)
+				}
+				if opts.Categories.Path != "" {
+					if data, err := json.MarshalIndent(summary, "", "  "); err != nil {
+						logger.Error("Failed to encode categories: %v", err)
+					} else if err := fsWriteFile(opts.Categories.Path, data, 0644); err != nil {
+						logger.Error("Failed to write categories: %v", err)
+					} else {
+						logger.Info("Wrote categories to %s", opts.Categories.Path)
+					}
+				}
+			}
+			if opts.Plan != nil {
+				logger.Info("Dry-run diff: %d new, %d changed, %d unchanged (no-op) metadata files", report.DiffCreated, report.DiffChanged, report.DiffUnchanged)
+			}
+			reportSpan := opts.Tracer.Start("organize.report", runSpan)
+			reportSpan.SetInt("reports", len(reportWriters))
+			defer reportSpan.End()
+			runSpan.SetInt("files", report.Files)
+			runSpan.SetInt("versions", report.Versions)
+			runSpan.SetInt("success", report.Success)
+			runSpan.SetInt("missing", report.Missing)
+			runSpan.SetInt("errors", report.Errors)
+			for i, writer := range reportWriters {
+				if writer == nil {
+					continue
+				}
+				if err := writer.Finish(report); err != nil {
+					logger.Error("Failed to finish report %s: %v", reportPaths[i], err)
+				} else {
+					logger.Info("Wrote report %s", reportPaths[i])
+				}
+			}
+			return report, nil
+		case now := <-ticker.C:
+			meter.Tick(now)
+			processed := resumedFiles + int(atomic.LoadInt64(&meter.files))
+			line := progressLine(processed, totalFiles, meter)
+			event := ResultEvent{Type: "progress", Processed: processed, Total: totalFiles, Bytes: atomic.LoadInt64(&meter.bytes), TotalBytes: meter.totalBytes}
+			logger.Info("%s", line)
+			opts.ResultStream.Send(event)
+		}
+	}
+}
+
+// DefaultETASmoothing is the weight of the latest second's rate in the
+// moving average the ETA is computed from
+const DefaultETASmoothing = 0.2
+
+// ETAMilestones are the fractions of the index bytes at which a run records
+// its ETA, to compare with how long the rest of the run actually took
+var ETAMilestones = []float64{0.25, 0.5, 0.75}
+
+// ETACheck is the ETA recorded at a milestone and the actual time left
+type ETACheck struct {
+	Percent   float64       `json:"percent"`
+	Predicted time.Duration `json:"predicted_ns"`
+	Actual    time.Duration `json:"actual_ns"`
+}
+
+// progressMeter measures a run by bytes of index files as well as by
+// files, since a few large files can hold much of the work. The versions
+// left are estimated from the bytes left at the versions per byte seen so
+// far, and the ETA divides them by an exponentially weighted moving
+// average of versions per second. It covers the current segment of a job.
+type progressMeter struct {
+	totalBytes int64
+	smoothing  float64
+	start      time.Time
+
+	// The counts of files processed so far are updated atomically by the
+	// workers, so progress needs no channel round trip per file
+	files    int64
+	bytes    int64
+	versions int64
+	success  int64
+	missing  int64
+	errors   int64
+
+	// mu guards the moving average and the milestones. nextCheck is the
+	// bytes at which the next milestone is reached.
+	mu        sync.Mutex
+	nextCheck int64
+
+	// rate is the moving average, updated on every tick
+	rate         float64
+	lastTick     time.Time
+	lastVersions int64
+
+	checks    []ETACheck
+	checkedAt []time.Time
+}
+
+// newProgressMeter starts measuring the processing of files
+func newProgressMeter(files []IndexFile, smoothing float64) *progressMeter {
+	if smoothing <= 0 {
+		smoothing = DefaultETASmoothing
+	}
+	now := time.Now()
+	m := &progressMeter{smoothing: smoothing, start: now, lastTick: now}
+	for _, file := range files {
+		m.totalBytes += file.Size
+	}
+	return m
+}
+
+// Done counts a processed index file, recording the ETA at each milestone
+// it passes, and returns the number of files done. Workers call it
+// concurrently.
+func (m *progressMeter) Done(result FileResult) int {
+	atomic.AddInt64(&m.versions, int64(result.Total))
+	atomic.AddInt64(&m.success, int64(result.Success))
+	atomic.AddInt64(&m.missing, int64(result.Missing))
+	atomic.AddInt64(&m.errors, int64(result.Errors))
+	bytes := atomic.AddInt64(&m.bytes, result.bytes)
+	files := int(atomic.AddInt64(&m.files, 1))
+	if bytes < atomic.LoadInt64(&m.nextCheck) {
+		return files
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.checks) < len(ETAMilestones) && m.totalBytes > 0 &&
+		float64(bytes) >= ETAMilestones[len(m.checks)]*float64(m.totalBytes) {
+		m.checks = append(m.checks, ETACheck{Percent: ETAMilestones[len(m.checks)] * 100, Predicted: m.eta()})
+		m.checkedAt = append(m.checkedAt, time.Now())
+	}
+	next := int64(math.MaxInt64)
+	if len(m.checks) < len(ETAMilestones) && m.totalBytes > 0 {
+		next = int64(math.Ceil(ETAMilestones[len(m.checks)] * float64(m.totalBytes)))
+	}
+	atomic.StoreInt64(&m.nextCheck, next)
+	return files
+}
+
+// Tick folds the rate since the last tick into the moving average
+func (m *progressMeter) Tick(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elapsed := now.Sub(m.lastTick).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	versions := atomic.LoadInt64(&m.versions)
+	current := float64(versions-m.lastVersions) / elapsed
+	if m.rate == 0 {
+		m.rate = current
+	} else {
+		m.rate = m.smoothing*current + (1-m.smoothing)*m.rate
+	}
+	m.lastTick, m.lastVersions = now, versions
+}
+
+// ETA estimates the time left processing index files; 0 if unknown
+func (m *progressMeter) ETA() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.eta()
+}
+
+// eta is ETA with mu held
+func (m *progressMeter) eta() time.Duration {
+	versions := int(atomic.LoadInt64(&m.versions))
+	if atomic.LoadInt64(&m.bytes) == 0 || versions == 0 {
+		return 0
+	}
+	rate := m.rate
+	if rate <= 0 {
+		// No tick yet, so only the average so far is known
+		rate = float64(versions) / time.Since(m.start).Seconds()
+	}
+	left := m.VersionsTotal() - versions
+	return time.Duration(float64(left) / rate * float64(time.Second))
+}
+
+// VersionsTotal estimates the versions in all the index files from the
+// versions per byte seen so far
+func (m *progressMeter) VersionsTotal() int {
+	bytes := atomic.LoadInt64(&m.bytes)
+	if bytes == 0 {
+		return 0
+	}
+	return int(float64(atomic.LoadInt64(&m.versions)) / float64(bytes) * float64(m.totalBytes))
+}
+
+// Percent returns the percentage of the index bytes processed
+func (m *progressMeter) Percent() float64 {
+	if m.totalBytes == 0 {
+		return 100
+	}
+	return float64(atomic.LoadInt64(&m.bytes)) / float64(m.totalBytes) * 100
+}
+
+// Finish returns the ETAs recorded at the milestones with the time each
+// milestone actually was before end
+func (m *progressMeter) Finish(end time.Time) []ETACheck {
+	for i := range m.checks {
+		m.checks[i].Actual = end.Sub(m.checkedAt[i])
+	}
+	return m.checks
+}
+
+// progressLine formats the progress of a run for the log
+func progressLine(processed, totalFiles int, meter *progressMeter) string {
+	line := fmt.Sprintf("Progress: %d/%d files processed (%.2f%%), %d/~%d versions (%.2f%% of index bytes)",
+		processed, totalFiles, float64(processed)/float64(totalFiles)*100, atomic.LoadInt64(&meter.versions), meter.VersionsTotal(), meter.Percent())
+	if eta := meter.ETA(); eta > 0 && atomic.LoadInt64(&meter.bytes) < meter.totalBytes {
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return line
+}
+
+// summarizeBaseline reports the missing versions relative to the baseline
+// and, after a complete run, saves them as the new baseline
+func summarizeBaseline(report *Report, opts *Options, logger *Logger) {
+	// Versions the run never looked at drop out of the baseline, so a run
+	// that skipped some cannot say what is no longer missing
+	var incomplete string
+	switch {
+	case report.Partial || opts.Shards != nil || opts.Checkpoint.Resumed():
+		incomplete = "the run did not cover the whole index"
+	case report.SnapshotSkipped > 0:
+		incomplete = fmt.Sprintf("%d crates unchanged since the snapshot were skipped", report.SnapshotSkipped)
+	case opts.Lockfile != nil:
+		incomplete = "only the lockfile's versions were organized"
+	case report.TimedOut > 0:
+		incomplete = fmt.Sprintf("%d index files timed out", report.TimedOut)
+	}
+
+	switch {
+	case !opts.Baseline.Existed():
+		logger.Info("Missing: %d versions; no baseline to compare against yet", report.Missing)
+	case incomplete != "":
+		logger.Info("Missing: %d versions, %d newly missing; not counting those no longer missing: %s", report.Missing, report.NewlyMissing, incomplete)
+	default:
+		gone, found := opts.Baseline.Delta()
+		report.NoLongerMissing = gone
+		logger.Info("Missing: %d versions, %d newly missing, %d no longer missing since the last run", report.Missing, report.NewlyMissing, gone)
+		for _, id := range found {
+			logger.Info("Newly found crate file for %s", id)
+		}
+	}
+
+	switch {
+	case opts.DryRun:
+		logger.Info("DRY RUN: Not updating the missing baseline")
+	case incomplete != "":
+		logger.Warning("Not updating the missing baseline: %s", incomplete)
+	default:
+		if err := opts.Baseline.Save(); err != nil {
+			logger.Error("%v", err)
+		} else {
+			logger.Info("Updated missing baseline %s", opts.Baseline.path)
+		}
+	}
+}
+
+// RunOrganize performs one complete organize run: it organizes the
+// metadata, saves the snapshot after a real run, and logs the result
+func RunOrganize(opts *Options, logger *Logger) (*Report, error) {
+	return RunOrganizeContext(context.Background(), opts, logger)
+}
+
+// RunOrganizeContext is RunOrganize with cancellation from ctx; see
+// OrganizeMetadataContext
+func RunOrganizeContext(ctx context.Context, opts *Options, logger *Logger) (*Report, error) {
+	// Record start time
+	startTime := time.Now()
+
+	// Organize metadata
+	report, err := OrganizeMetadataContext(ctx, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the snapshot only after a real, completed run
+	if opts.Snapshot != nil && !opts.DryRun {
+		if err := opts.Snapshot.Save(); err != nil {
+			logger.Error("Failed to save snapshot: %v", err)
+		} else {
+			logger.Info("Updated snapshot %s", opts.Snapshot.path)
+		}
+	}
+
+	// Record end time
+	endTime := time.Now()
+	report.Duration = endTime.Sub(startTime)
+
+	// Staged deletions still take disk space until the trash is emptied
+	if files, bytes, err := TrashUsage(opts.MirrorDir); err != nil {
+		logger.Warning("Failed to measure the trash: %v", err)
+	} else if files > 0 {
+		report.TrashFiles, report.TrashBytes = files, bytes
+		logger.Info("Trash %s holds %d files (%d bytes); -empty-trash removes those staged over -trash-retention ago",
+			filepath.Join(opts.MirrorDir, TrashDirName), files, bytes)
+	}
+
+	// Keep the checkpoint of an interrupted job; a finished one starts afresh
+	if opts.Checkpoint != nil {
+		resumed := opts.Checkpoint.Resumed()
+		if resumed {
+			report.Duration = opts.Checkpoint.Elapsed()
+		}
+		if report.Partial {
+			if err := opts.Checkpoint.Save(report); err != nil {
+				logger.Error("%v", err)
+			} else {
+				logger.Info("Saved checkpoint %s; rerun to resume", opts.Checkpoint.path)
+			}
+		} else {
+			if resumed {
+				logger.Info("Job complete across %d runs, started %s", report.Segments, opts.Checkpoint.state.Started.Format(time.RFC3339))
+			}
+			if err := opts.Checkpoint.Complete(); err != nil {
+				logger.Error("%v", err)
+			}
+		}
+	}
+
+	if opts.HTMLReport != "" {
+		var categories *CategorySummary
+		if opts.Categories != nil {
+			summary := opts.Categories.Summary(opts.Categories.Top)
+			categories = &summary
+		}
+		if err := WriteHTMLReport(opts.HTMLReport, report, report.missingByCrate, categories); err != nil {
+			logger.Error("%v", err)
+		} else {
+			logger.Info("Wrote HTML report to %s", opts.HTMLReport)
+		}
+	}
+
+	if opts.SummaryJSON != "" {
+		writeSummaryJSON(opts.SummaryJSON, report, logger)
+	}
+
+	opts.ResultStream.Send(ResultEvent{Type: "summary", Processed: report.Files, Total: report.Files + report.FilesPending, Report: report})
+
+	// Log results
+	if opts.DryRun {
+		logger.Info("DRY RUN COMPLETE: Would have organized %d out of %d version metadata files in %v", report.Success, report.Versions, report.Duration)
+	} else {
+		logger.Info("Organization complete: %d out of %d version metadata files successfully organized in %v", report.Success, report.Versions, report.Duration)
+	}
+
+	return report, nil
+}
+
+// RepairPermissions normalizes the mode of existing metadata files in every
+// destination to opts.FileMode without touching their content. It returns the
+// number of files whose mode was (or in dry-run mode would be) changed.
+func RepairPermissions(opts *Options, logger *Logger) (int, error) {
+	repaired := 0
+	for _, dest := range opts.Destinations {
+		count, err := repairDestinationPermissions(dest, opts, logger)
+		repaired += count
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// repairDestinationPermissions normalizes metadata file modes under one destination
+func repairDestinationPermissions(dest *Destination, opts *Options, logger *Logger) (int, error) {
+	logger.Info("Repairing metadata file permissions in %s (mode %04o)...", dest.Root, opts.FileMode)
+	startTime := time.Now()
+
+	checked := 0
+	repaired := 0
+
+	err := filepath.Walk(dest.Root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isTrashDir(info) {
+			return filepath.SkipDir
+		}
+
+		if dest.InMirror && opts.Ignore.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() || !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), MetadataFileSuffix) {
+			return nil
+		}
+
+		checked++
+		if info.Mode().Perm() == opts.FileMode.Perm() {
+			return nil
+		}
+
+		if !opts.DryRun {
+			if err := fsChmod(path, opts.FileMode); err != nil {
+				logger.Error("Failed to change mode of %s: %v", path, err)
+				return nil
+			}
+		}
+		repaired++
+		return nil
+	})
+
+	if err != nil {
+		return repaired, fmt.Errorf("error walking output directory: %v", err)
+	}
+
+	logger.Info("Checked %d metadata files in %v", checked, time.Since(startTime))
+	return repaired, nil
+}
+
+// Raw line recording modes
+const (
+	RawLineHash = "hash"
+	RawLineFull = "full"
+)
+
+// indexConfigPaths returns where the index's config.json may be. A sparse
+// cache's config.json is in the directory above its .cache directory.
+func indexConfigPaths(indexDir string) []string {
+	paths := []string{filepath.Join(indexDir, "config.json")}
+	if filepath.Base(indexDir) == SparseCacheDir {
+		paths = append(paths, filepath.Join(filepath.Dir(indexDir), "config.json"))
+	}
+	return paths
+}
+
+// CheckIndexConfig checks that the index's config.json is a JSON object
+// whose "dl" and "api" fields are absolute URLs ("dl" may hold cargo's
+// markers). It returns the path checked and every problem found.
+func CheckIndexConfig(indexDir string) (string, []string) {
+	var path string
+	var data []byte
+	for _, candidate := range indexConfigPaths(indexDir) {
+		content, err := ioutil.ReadFile(candidate)
+		if err == nil {
+			path, data = candidate, content
+			break
+		}
+		if !os.IsNotExist(err) {
+			return candidate, []string{fmt.Sprintf("cannot be read: %v", err)}
+		}
+	}
+	if path == "" {
+		return filepath.Join(indexDir, "config.json"), []string{"does not exist"}
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return path, []string{fmt.Sprintf("is not a valid JSON object: %v", err)}
+	}
+	var problems []string
+	for _, field := range []string{"dl", "api"} {
+		value, ok := config[field]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("has no %q field", field))
+			continue
+		}
+		str, ok := value.(string)
+		if !ok || str == "" {
+			problems = append(problems, fmt.Sprintf("%q is not a non-empty string", field))
+			continue
+		}
+		u, err := url.Parse(strings.NewReplacer("{", "", "}", "").Replace(str))
+		if err != nil || u.Scheme == "" || (u.Host == "" && u.Path == "") {
+			problems = append(problems, fmt.Sprintf("%q is not an absolute URL: %q", field, str))
+		}
+	}
+	return path, problems
+}
+
+// IndexManifestEntry is what an index manifest expects of one index file:
+// its entry count, its SHA-256, or both
+type IndexManifestEntry struct {
+	Path   string `json:"path"`
+	Lines  *int   `json:"lines,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// LoadIndexManifest reads a manifest of index files, relative to the index
+// directory. Each line is either a JSON object with "path" and "lines"
+// and/or "sha256", or sha256sum output ("<sha256>  <path>"). Blank lines
+// and lines starting with # are skipped.
+func LoadIndexManifest(path string) ([]IndexManifestEntry, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index manifest: %v", err)
+	}
+
+	var entries []IndexManifestEntry
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var entry IndexManifestEntry
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+			}
+		} else if fields := strings.Fields(line); len(fields) == 2 {
+			entry = IndexManifestEntry{SHA256: strings.ToLower(fields[0]), Path: strings.TrimPrefix(fields[1], "*")}
+		}
+		if entry.Path == "" || (entry.Lines == nil && entry.SHA256 == "") {
+			return nil, fmt.Errorf("%s:%d: expected a path with a line count or SHA-256", path, i+1)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// VerifyIndexManifest compares every index file listed in the manifest
+// with what it expects, returning a problem for each file that is missing,
+// has a different number of entries, or has a different hash
+func VerifyIndexManifest(indexDir string, entries []IndexManifestEntry) []string {
+	var problems []string
+	for _, entry := range entries {
+		path := filepath.Join(indexDir, filepath.FromSlash(entry.Path))
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				problems = append(problems, fmt.Sprintf("%s is missing", path))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s cannot be read: %v", path, err))
+			}
+			continue
+		}
+
+		if entry.SHA256 != "" {
+			sum := sha256.Sum256(raw)
+			if actual := hex.EncodeToString(sum[:]); actual != entry.SHA256 {
+				problems = append(problems, fmt.Sprintf("%s has SHA-256 %s, but the manifest expects %s", path, actual, entry.SHA256))
+			}
+		}
+		if entry.Lines != nil {
+			content := raw
+			if isSparseCache(raw) {
+				if content, err = DecodeSparseCache(raw); err != nil {
+					problems = append(problems, fmt.Sprintf("%s cannot be decoded: %v", path, err))
+					continue
+				}
+			}
+			count := 0
+			for _, line := range bytes.Split(content, []byte("\n")) {
+				if _, err := indexentry.ParseLine(line); err != indexentry.ErrNotEntry {
+					count++
+				}
+			}
+			switch {
+			case count < *entry.Lines:
+				problems = append(problems, fmt.Sprintf("%s has %d entries, but the manifest expects %d; it may be truncated", path, count, *entry.Lines))
+			case count > *entry.Lines:
+				problems = append(problems, fmt.Sprintf("%s has %d entries, but the manifest expects %d", path, count, *entry.Lines))
+			}
+		}
+	}
+	return problems
+}
+
+// MirrorCratePath returns where a crate file belongs in a mirror laid out
+// like the index: under the prefix directories of the crate's index file
+func MirrorCratePath(mirrorDir, name, version string) string {
+	return filepath.Join(mirrorDir, filepath.Dir(filepath.FromSlash(indexentry.IndexPath(name))), name+"-"+version+".crate")
+}
+
+// EntryDump is what -dump-entry reports about one crate version: the entry
+// as parsed, and how a run would resolve its crate file and outputs
+type EntryDump struct {
+	Crate             string        `json:"crate"`
+	Version           string        `json:"version"`
+	IndexFile         string        `json:"index_file"`
+	Source            string        `json:"source"`
+	Line              int           `json:"line"`
+	Entry             MetadataEntry `json:"entry"`
+	Prerelease        bool          `json:"prerelease"`
+	Skipped           string        `json:"skipped,omitempty"`
+	ExpectedCrateFile string        `json:"expected_crate_file"`
+	Found             bool          `json:"found"`
+	CrateFile         string        `json:"crate_file,omitempty"`
+	MatchedAlias      string        `json:"matched_alias,omitempty"`
+	Destinations      []string      `json:"destinations,omitempty"`
+}
+
+// DumpEntry finds a crate version's line in its index file (the local
+// index's file, if it has one, as in a run) and resolves it the way
+// ProcessMetadataFile would, without writing anything
+func DumpEntry(opts *Options, name, version string, logger *Logger) (*EntryDump, error) {
+	dump := &EntryDump{Crate: name, Version: version, ExpectedCrateFile: name + "-" + version + ".crate"}
+
+	sources := []struct{ dir, source string }{{opts.LocalIndexDir, SourceLocal}, {opts.IndexDir, SourceMain}}
+	for _, candidate := range sources {
+		if candidate.dir == "" {
+			continue
+		}
+		path := filepath.Join(candidate.dir, filepath.FromSlash(indexentry.IndexPath(name)))
+		entries, err := readIndexEntries(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index file %s: %v", path, err)
+		}
+		for i, entry := range entries {
+			if vers, _ := entry["vers"].(string); vers == version {
+				dump.IndexFile, dump.Source, dump.Line, dump.Entry = path, candidate.source, i+1, entry
+				break
+			}
+		}
+		if dump.Entry == nil {
+			return nil, fmt.Errorf("index file %s has no version %s", path, version)
+		}
+		break
+	}
+	if dump.Entry == nil {
+		return nil, fmt.Errorf("no index file for crate %s", name)
+	}
+
+	separate := false
+	if parsed, err := indexentry.ParseVersion(version); err == nil && parsed.IsPrerelease() {
+		dump.Prerelease = true
+		switch opts.Prereleases {
+		case PrereleasesSkip:
+			dump.Skipped = "prerelease"
+		case PrereleasesSeparate:
+			separate = true
+		}
+	}
+	if opts.MinVersions.Below(name, version) {
+		dump.Skipped = "below minimum version"
+	}
+
+	crateIndex, err := BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, nil, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+	fileName := name
+	dump.CrateFile, dump.Found = crateIndex[dump.ExpectedCrateFile]
+	if !dump.Found {
+		for _, alias := range opts.RenameMap.Aliases(name) {
+			if aliasPath, ok := crateIndex[alias+"-"+version+".crate"]; ok {
+				fileName, dump.CrateFile, dump.Found, dump.MatchedAlias = alias, aliasPath, true, alias
+				break
+			}
+		}
+	}
+	if !dump.Found || dump.Skipped != "" {
+		return dump, nil
+	}
+
+	for _, dest := range opts.Destinations {
+		path, err := dest.OutputPath(dump.CrateFile, fileName, version, dump.Entry, separate)
+		if err != nil {
+			return nil, fmt.Errorf("unsafe output path under %s: %v", dest.Root, err)
+		}
+		dump.Destinations = append(dump.Destinations, path)
+	}
+	return dump, nil
+}
+
+// SanityCheckVersions is how many versions must have been looked up in the
+// mirror before the missing rate is checked against -sanity-threshold, so
+// the first few crates do not decide it and tiny runs are not checked
+const SanityCheckVersions = 2000
+
+// checkSanity compares the missing rate so far against the threshold and
+// logs the result either way. It reports whether the rate is too high.
+func checkSanity(success, missing int, opts *Options, logger *Logger) bool {
+	looked := success + missing
+	rate := float64(missing) / float64(looked) * 100
+	if rate <= opts.SanityThreshold {
+		logger.Info("Sanity check passed: %d of the first %d versions (%.1f%%) are missing from the mirror, threshold %.1f%%",
+			missing, looked, rate, opts.SanityThreshold)
+		return false
+	}
+
+	logger.Warning("SANITY CHECK FAILED: %d of the first %d versions (%.1f%%) are missing from the mirror, above the %.1f%% threshold",
+		missing, looked, rate, opts.SanityThreshold)
+	logger.Warning("SANITY CHECK FAILED: check that -mirror-dir %s is the mirror of -index-dir %s and is mounted", opts.MirrorDir, opts.IndexDir)
+	return true
+}
+
+func run(args []string, registry string) int {
+	flags, given := parseFlags(args)
+
+	// Reject contradictory flags before anything is created
+	if problems := CheckFlags(given, FlagRules); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		fmt.Fprintln(os.Stderr, "Run with -help for the list of flags")
+		return 2
+	}
+
+	// Each registry is a run of its own, with the shared flags and its own
+	if *flags.registriesPath != "" {
+		registries, err := LoadRegistries(*flags.registriesPath, *flags.registrySelection)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return RunRegistries(args, registries, *flags.logPath)
+	}
+
+	dmode, err := strconv.ParseUint(*flags.dirMode, 8, 32)
+	if err != nil || dmode > 0777 {
+		fmt.Printf("Invalid -dir-mode %q: must be octal permission bits such as 0755\n", *flags.dirMode)
+		return 1
+	}
+
+	// From here on, any write outside -report-dir is a bug and panics
+	if *flags.readOnly {
+		if err := EnableReadOnly(*flags.reportDir, []string{*flags.indexDir, *flags.mirrorDir, *flags.localIndexDir}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		outputs := [][2]string{
+			{"log-path", *flags.logPath}, {"summary-json", *flags.summaryJSON}, {"html-report", *flags.htmlReport},
+			{"manifest-out", *flags.manifestOut}, {"categories-out", *flags.categoriesOut}, {"list-missing-out", *flags.listMissingOut},
+			{"merge-out", *flags.mergeOut}, {"env-out", *flags.envOut}, {"plan-file", *flags.planFile}, {"removed-report", *flags.removedReport},
+			{"tree-out", *flags.treeOut}, {"outputs-zero", *flags.outputsZero}, {"archive-out", *flags.archiveOut},
+			{"summary-schema", *flags.summarySchema}, {"cpuprofile", *flags.cpuProfile}, {"memprofile", *flags.memProfile},
+			{"compact-index-out", *flags.compactIndexOut}, {"reconcile-out", *flags.reconcileOut},
+		}
+		for _, path := range flags.reportPaths {
+			outputs = append(outputs, [2]string{"report-out", path})
+		}
+		refused := false
+		for _, output := range outputs {
+			if output[1] != "" && output[1] != "-" && !ReadOnlyAllows(output[1]) {
+				fmt.Fprintf(os.Stderr, "-%s %s is outside -report-dir %s, and -read-only writes nowhere else\n", output[0], output[1], *flags.reportDir)
+				refused = true
+			}
+		}
+		if refused {
+			return 2
+		}
+	}
+
+	// Create logger
+	logger, err := NewLogger(*flags.logPath, os.FileMode(dmode))
+	if err != nil {
+		fmt.Printf("Failed to create logger: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+	logger.SetDebug(*flags.debug)
+
+	// Log asynchronously when writes to the log file are slow
+	switch *flags.asyncLog {
+	case AsyncLogOff:
+	case AsyncLogOn:
+		logger.SetAsync(AsyncLogQueue)
+	case AsyncLogAuto:
+		if latency, err := MeasureLogLatency(*flags.logPath); err != nil {
+			logger.Warning("Failed to measure log write latency: %v", err)
+		} else if latency > SlowLogWrite {
+			logger.SetAsync(AsyncLogQueue)
+			logger.Info("Log writes take %v (over %v); logging asynchronously", latency, SlowLogWrite)
+		} else {
+			logger.Debug("Log writes take %v; logging synchronously", latency)
+		}
+	default:
+		logger.Error("Invalid -async-log %q: must be %s, %s, or %s", *flags.asyncLog, AsyncLogAuto, AsyncLogOn, AsyncLogOff)
+		return 1
+	}
+
+	// Every artifact of the run carries its ID so overlapping runs can be told apart
+	runID := *flags.runIDFlag
+	if runID == "" {
+		runID = NewRunID()
+	} else if err := ValidateRunID(runID); err != nil {
+		logger.Error("Invalid -run-id: %v", err)
+		return 1
+	}
+	logger.SetRunID(runID)
+	for i := range flags.reportPaths {
+		flags.reportPaths[i] = strings.ReplaceAll(flags.reportPaths[i], RunIDPlaceholder, runID)
+	}
+	*flags.manifestOut = strings.ReplaceAll(*flags.manifestOut, RunIDPlaceholder, runID)
+	*flags.htmlReport = strings.ReplaceAll(*flags.htmlReport, RunIDPlaceholder, runID)
+	*flags.summaryJSON = strings.ReplaceAll(*flags.summaryJSON, RunIDPlaceholder, runID)
+
+	if *flags.outputsZero == "-" || *flags.treeOut == "-" || (*flags.mergeReport && *flags.mergeOut == "-") || (*flags.listMissing && *flags.listMissingOut == "-") || *flags.dumpEntry != "" || *flags.summarySchema == "-" {
+		logger.SetConsoleOutput(os.Stderr)
+	}
+
+	// Profiles are written by deferred calls so they are flushed on every return path
+	if *flags.cpuProfile != "" {
+		stop, err := StartCPUProfile(*flags.cpuProfile)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		defer stop()
+	}
+	if *flags.memProfile != "" {
+		defer func() {
+			if err := WriteHeapProfile(*flags.memProfile); err != nil {
+				logger.Error("%v", err)
+			} else {
+				logger.Info("Wrote heap profile to %s", *flags.memProfile)
+			}
+		}()
+	}
+
+	// The summary schema depends only on this build
+	if *flags.summarySchema != "" {
+		data, err := json.MarshalIndent(ReportJSONSchema(), "", "  ")
+		if err != nil {
+			logger.Error("Failed to encode summary schema: %v", err)
+			return 1
+		}
+		data = append(data, '\n')
+		if *flags.summarySchema == "-" {
+			os.Stdout.Write(data)
+		} else if err := fsWriteFile(*flags.summarySchema, data, 0644); err != nil {
+			logger.Error("Failed to write summary schema: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	// Merging reports from other runs touches neither the index nor the mirror
+	if *flags.mergeReport {
+		paths, err := ReportFiles(flags.Args())
+		if err != nil {
+			logger.Error("Failed to list reports: %v", err)
+			return 1
+		}
+		merged, err := MergeReports(paths, logger)
+		if err != nil {
+			logger.Error("Failed to merge reports: %v", err)
+			return 1
+		}
+		data, err := json.MarshalIndent(merged, "", "  ")
+		if err != nil {
+			logger.Error("Failed to encode merged report: %v", err)
+			return 1
+		}
+		if *flags.mergeOut == "-" {
+			fmt.Println(string(data))
+		} else if err := fsWriteFile(*flags.mergeOut, append(data, '\n'), 0644); err != nil {
+			logger.Error("Failed to write merged report: %v", err)
+			return 1
+		} else {
+			logger.Info("Merged %d reports into %s", len(paths), *flags.mergeOut)
+		}
+		fmt.Fprintln(os.Stderr, merged.Report.SummaryLine())
+		return 0
+	}
+
+	// Trash maintenance works on any mirror or publish root
+	if *flags.emptyTrash != "" {
+		trashReport, err := EmptyTrash(*flags.emptyTrash, *flags.trashRetention, *flags.dryRun, logger)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, trashReport.SummaryLine())
+		if trashReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+	if *flags.restore != "" {
+		staged, err := RestoreFromTrash(*flags.restore, os.FileMode(dmode))
+		if err != nil {
+			logger.Error("Failed to restore %s: %v", *flags.restore, err)
+			return 1
+		}
+		logger.Info("Restored %s from %s", *flags.restore, staged)
+		return 0
+	}
+
+	logger.Info("Starting organization of metadata from %s to %s", *flags.indexDir, *flags.mirrorDir)
+	if len(flags.labels) > 0 {
+		logger.Info("Labels: %s", flags.labels)
+	}
+
+	// Only local paths are supported; a URL would otherwise be taken as a
+	// relative directory named after its scheme
+	for _, dir := range append([]string{*flags.indexDir, *flags.mirrorDir}, flags.outputDirs...) {
+		if isRemoteURL(dir) {
+			logger.Error("%s is a URL; remote mirrors are not supported, so run on the mirror host or point at a local mount", dir)
+			return 1
+		}
+	}
+
+	// Check if directories exist
+	if _, err := os.Stat(*flags.indexDir); os.IsNotExist(err) {
+		logger.Error("Index directory %s does not exist", *flags.indexDir)
+		return 1
+	}
+
+	if _, err := os.Stat(*flags.mirrorDir); os.IsNotExist(err) {
+		// A bootstrap may start from nothing
+		if len(flags.bootstrapSources) == 0 {
+			logger.Error("Mirror directory %s does not exist", *flags.mirrorDir)
+			return 1
+		}
+		if err := fsMkdirAll(*flags.mirrorDir, os.FileMode(dmode)); err != nil {
+			logger.Error("Failed to create mirror directory: %v", err)
+			return 1
+		}
+		logger.Info("Created mirror directory %s", *flags.mirrorDir)
+	}
+
+	// Detect the index format unless given; a sparse cache is read from its .cache directory
+	detected, detectErr := DetectSourceFormat(*flags.indexDir)
+	switch *flags.sourceFormat {
+	case SourceFormatAuto:
+		if detectErr != nil {
+			logger.Error("%v", detectErr)
+			return 1
+		}
+		*flags.sourceFormat = detected
+		logger.Info("Detected %s index format in %s", detected, *flags.indexDir)
+	case SourceFormatGit, SourceFormatSparse, SourceFormatSparseCache:
+		if detectErr == nil && detected != *flags.sourceFormat {
+			logger.Warning("-source-format is %s, but %s looks like a %s index", *flags.sourceFormat, *flags.indexDir, detected)
+		}
+	default:
+		logger.Error("Invalid -source-format %q: must be %s, %s, %s, or %s", *flags.sourceFormat, SourceFormatAuto, SourceFormatGit, SourceFormatSparse, SourceFormatSparseCache)
+		return 1
+	}
+	if *flags.sourceFormat == SourceFormatSparse {
+		if _, err := os.Stat(filepath.Join(*flags.indexDir, "config.json")); err != nil {
+			logger.Warning("Sparse index %s has no config.json", *flags.indexDir)
+		}
+	}
+	if *flags.sourceFormat == SourceFormatSparseCache {
+		*flags.indexDir = filepath.Join(*flags.indexDir, SparseCacheDir)
+	}
+
+	// A broken config.json often means the index sync itself went wrong
+	if *flags.checkConfig || *flags.failOnBadConfig {
+		configPath, problems := CheckIndexConfig(*flags.indexDir)
+		for _, problem := range problems {
+			if *flags.failOnBadConfig {
+				logger.Error("%s %s", configPath, problem)
+			} else {
+				logger.Warning("%s %s", configPath, problem)
+			}
+		}
+		if len(problems) == 0 {
+			logger.Info("%s is well-formed", configPath)
+		} else if *flags.failOnBadConfig {
+			return 1
+		}
+	}
+
+	// A truncated or altered index file would otherwise only show up as
+	// missing versions
+	if *flags.verifyIndexManifest != "" {
+		entries, err := LoadIndexManifest(*flags.verifyIndexManifest)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		problems := VerifyIndexManifest(*flags.indexDir, entries)
+		for _, problem := range problems {
+			logger.Warning("Index file %s", problem)
+		}
+		if len(problems) == 0 {
+			logger.Info("All %d index files listed in %s match it", len(entries), *flags.verifyIndexManifest)
+		} else {
+			logger.Warning("%d problems with the %d index files listed in %s; the index sync may be incomplete", len(problems), len(entries), *flags.verifyIndexManifest)
+		}
+	}
+
+	// A combined tree works, but only because index discovery skips our own outputs
+	if OverlappingRoots(*flags.indexDir, *flags.mirrorDir) {
+		logger.Warning("The index directory %s and mirror directory %s overlap; metadata files, crate files, and reports inside the index tree will be ignored as index files", *flags.indexDir, *flags.mirrorDir)
+	}
+	for _, outputDir := range flags.outputDirs {
+		if OverlappingRoots(*flags.indexDir, outputDir) {
+			logger.Warning("The index directory %s and output directory %s overlap; metadata files inside the index tree will be ignored as index files", *flags.indexDir, outputDir)
+		}
+	}
+
+	if *flags.localIndexDir != "" {
+		if _, err := os.Stat(*flags.localIndexDir); os.IsNotExist(err) {
+			logger.Error("Local index directory %s does not exist", *flags.localIndexDir)
+			return 1
+		}
+	}
+
+	// The compacted index must not be written over the index being read
+	if *flags.compactIndexOut != "" {
+		absIndex, _ := filepath.Abs(*flags.indexDir)
+		absCompact, _ := filepath.Abs(*flags.compactIndexOut)
+		if absIndex == absCompact || isWithin(absIndex, absCompact) {
+			logger.Error("-compact-index-out %s must not be inside the index directory", *flags.compactIndexOut)
+			return 1
+		}
+	}
+
+	// An exported registry inside the mirror or index would be read back as mirror content
+	if *flags.exportLocalRegistry != "" {
+		absExport, _ := filepath.Abs(*flags.exportLocalRegistry)
+		for _, dir := range []string{*flags.mirrorDir, *flags.indexDir} {
+			absDir, _ := filepath.Abs(dir)
+			if absDir == absExport || isWithin(absDir, absExport) {
+				logger.Error("-export-local-registry %s must not be inside %s", *flags.exportLocalRegistry, dir)
+				return 1
+			}
+		}
+	}
+
+	mode, err := strconv.ParseUint(*flags.fileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		logger.Error("Invalid -file-mode %q: must be octal permission bits such as 0644", *flags.fileMode)
+		return 1
+	}
+
+	// Work out where metadata files are written
+	if *flags.dateLayout {
+		*flags.layout = LayoutDate
+	}
+	if len(flags.outputDirs) == 0 && *flags.s3Bucket == "" {
+		if _, err := NewDestStrategy(*flags.layout, *flags.mirrorDir, ""); err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+	for _, outputDir := range flags.outputDirs {
+		if !*flags.dryRun {
+			if err := fsMkdirAll(outputDir, os.FileMode(dmode)); err != nil {
+				logger.Error("Failed to create output directory: %v", err)
+				return 1
+			}
+		}
+	}
+
+	// Load the mirror's ignore file unless disabled
+	var ignore *IgnoreMatcher
+	if !*flags.noIgnoreFile {
+		ignore, err = LoadIgnoreFile(*flags.mirrorDir)
+		if err != nil {
+			logger.Error("Failed to load ignore file: %v", err)
+			return 1
+		}
+		if ignore != nil {
+			logger.Info("Loaded %d patterns from %s", len(ignore.patterns), filepath.Join(*flags.mirrorDir, IgnoreFileName))
+		}
+	}
+
+	// Load the crate rename map if given
+	var renames *RenameMap
+	if *flags.renameMapPath != "" {
+		renames, err = LoadRenameMap(*flags.renameMapPath)
+		if err != nil {
+			logger.Error("Failed to load rename map: %v", err)
+			return 1
+		}
+		logger.Info("Loaded %d crate renames from %s", renames.Len(), *flags.renameMapPath)
+	}
+
+	// Set up the dry-run diff plan
+	var plan *Plan
+	if *flags.diff {
+		plan, err = NewPlan(*flags.planFile, 50)
+		if err != nil {
+			logger.Error("Failed to create plan: %v", err)
+			return 1
+		}
+	}
+
+	// Load the snapshot of index file hashes from the last run
+	var snapshot *Snapshot
+	var checkpoint *Checkpoint
+	if *flags.checkpointPath != "" && *flags.dryRun {
+		logger.Warning("-checkpoint is ignored in dry-run mode")
+	} else if *flags.checkpointPath != "" {
+		job, _ := filepath.Abs(*flags.indexDir)
+		if *flags.localIndexDir != "" {
+			local, _ := filepath.Abs(*flags.localIndexDir)
+			job += " local=" + local
+		}
+		if *flags.shardExpr != "" {
+			job += " shards=" + *flags.shardExpr
+		}
+		if *flags.lockfilePath != "" {
+			lockfile, _ := filepath.Abs(*flags.lockfilePath)
+			job += " lockfile=" + lockfile
+		}
+		for _, source := range flags.bootstrapSources {
+			source, _ = filepath.Abs(source)
+			job += " bootstrap=" + source
+		}
+		checkpoint, err = LoadCheckpoint(*flags.checkpointPath, job, logger)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		flags.labels = checkpoint.MergeLabels(flags.labels, logger)
+	}
+
+	if *flags.snapshotPath != "" {
+		snapshot, err = LoadSnapshot(*flags.snapshotPath)
+		if err != nil {
+			logger.Error("Failed to load snapshot: %v", err)
+			return 1
+		}
+		logger.Info("Loaded snapshot of %d crates from %s", snapshot.Len(), *flags.snapshotPath)
+	}
+
+	if *flags.rawLine != "" && *flags.rawLine != RawLineHash && *flags.rawLine != RawLineFull {
+		logger.Error("Invalid -record-raw-line %q (expected %s or %s)", *flags.rawLine, RawLineHash, RawLineFull)
+		return 1
+	}
+
+	// Fault injection is for testing recovery and is only configured from
+	// the environment, in builds that enable it
+	var faults *FaultInjector
+	if spec := faultSpec(); spec != "" {
+		faults, err = ParseFaults(spec)
+		if err != nil {
+			logger.Error("Invalid %s: %v", FaultsEnvVar, err)
+			return 1
+		}
+		logger.Warning("FAULT INJECTION ENABLED (%s=%s); do not use this run's output", FaultsEnvVar, spec)
+		fsFaults = faults
+		defer func() { fsFaults = nil }()
+	}
+
+	if *flags.checkNames && *flags.crateIDMode {
+		logger.Warning("-check-names is ignored with -crate-id-mode, where names come from the entries")
+	}
+
+	minVersions, err := ParseMinVersions(*flags.minVersion, *flags.globalMinVersion)
+	if err != nil {
+		logger.Error("Invalid -min-version or -global-min-version: %v", err)
+		return 1
+	}
+	if *flags.thenVerify && *flags.verifyWorkers < 1 {
+		logger.Error("-verify-workers must be at least 1")
+		return 1
+	}
+	if *flags.etaSmoothing <= 0 || *flags.etaSmoothing > 1 {
+		logger.Error("Invalid -eta-smoothing %v: must be greater than 0 and at most 1", *flags.etaSmoothing)
+		return 1
+	}
+	if *flags.latestN < 0 {
+		logger.Error("Invalid -latest-n %d: must not be negative", *flags.latestN)
+		return 1
+	}
+
+	switch *flags.prereleases {
+	case PrereleasesInclude, PrereleasesSkip, PrereleasesSeparate:
+	default:
+		logger.Error("Invalid -prereleases %q: must be %s, %s, or %s", *flags.prereleases, PrereleasesInclude, PrereleasesSkip, PrereleasesSeparate)
+		return 1
+	}
+
+	stripPaths, err := ParseStripFields(*flags.stripFields)
+	if err != nil {
+		logger.Error("Invalid -strip-fields: %v", err)
+		return 1
+	}
+
+	var baseline *MissingBaseline
+	if *flags.missingBaseline != "" {
+		baseline, err = LoadMissingBaseline(*flags.missingBaseline, *flags.resetBaseline)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+
+	var crateNames *CrateNameBaseline
+	if *flags.crateNamesBaseline != "" {
+		crateNames, err = LoadCrateNameBaseline(*flags.crateNamesBaseline, *flags.resetBaseline)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+
+	// Quarantined files must not be indexed again as mirror content
+	if *flags.quarantineRemoved != "" {
+		absMirror, _ := filepath.Abs(*flags.mirrorDir)
+		absQuarantine, _ := filepath.Abs(*flags.quarantineRemoved)
+		rel, _ := filepath.Rel(absMirror, absQuarantine)
+		if absMirror == absQuarantine || (isWithin(absMirror, absQuarantine) && !ignore.Match(filepath.Join(*flags.mirrorDir, rel), true)) {
+			logger.Error("-quarantine-removed %s must be outside the mirror or ignored by its %s", *flags.quarantineRemoved, IgnoreFileName)
+			return 1
+		}
+	}
+
+	var parseCache *ParseCache
+	if *flags.parseCacheDir != "" {
+		parseCache, err = OpenParseCache(*flags.parseCacheDir)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+
+	var categories *CategoryTally
+	if *flags.categoriesOut != "" || *flags.categoriesLog {
+		categories = NewCategoryTally(*flags.categoriesOut, *flags.categoriesTop)
+	}
+
+	var bundles *BundleWriter
+	if *flags.aggregate {
+		bundles = &BundleWriter{}
+	}
+
+	var lockfile *Lockfile
+	if *flags.lockfilePath != "" {
+		lockfile, err = LoadLockfile(*flags.lockfilePath)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		logger.Info("Loaded %d pinned registry versions from %s", lockfile.Len(), *flags.lockfilePath)
+	}
+
+	var shards *ShardSet
+	if *flags.shardExpr != "" {
+		shards, err = ParseShards(*flags.shardExpr)
+		if err != nil {
+			logger.Error("Invalid -shards: %v", err)
+			return 1
+		}
+	}
+
+	// Latest pointers use symlinks if the mirror's filesystem supports them
+	var latest *LatestLinks
+	if *flags.latestLinks {
+		latest, err = NewLatestLinks(*flags.mirrorDir, flags.outputDirs, *flags.latestFallback, logger)
+		if err != nil {
+			logger.Error("Invalid -latest-fallback: %v", err)
+			return 1
+		}
+	}
+
+	// Traces are exported in the background; Close flushes the last batch
+	var tracer *Tracer
+	if *flags.otelEndpoint != "" {
+		tracer = NewTracer(*flags.otelEndpoint, *flags.otelSample, *flags.otelSlow, logger)
+		defer tracer.Close()
+	}
+
+	var collisions *CollisionDetector
+	if *flags.checkCollisions || *flags.failOnCollision || *flags.checkCaseCollisions || *flags.disambiguateCase {
+		collisions = NewCollisionDetector(*flags.failOnCollision)
+		collisions.FoldCase = *flags.checkCaseCollisions || *flags.disambiguateCase
+	}
+
+	// Each destination checks its output paths against its own root
+	var destinations []*Destination
+	if len(flags.outputDirs) == 0 && *flags.s3Bucket == "" {
+		dest, err := NewDestination(*flags.mirrorDir, *flags.layout, *flags.mirrorDir, true, *flags.allowSymlinkEscape)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		destinations = append(destinations, dest)
+	}
+	for _, outputDir := range flags.outputDirs {
+		dest, err := NewDestination(outputDir, *flags.layout, *flags.mirrorDir, false, *flags.allowSymlinkEscape)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		destinations = append(destinations, dest)
+	}
+	if *flags.s3Bucket != "" {
+		store, err := NewS3Store(*flags.s3Bucket, *flags.s3Prefix, *flags.s3Endpoint, *flags.threads)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		dest, err := NewObjectDestination(store, *flags.layout, *flags.mirrorDir)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		destinations = append(destinations, dest)
+	}
+	if *flags.writersPerDir < 0 {
+		logger.Error("Invalid -writers-per-dir %d: must not be negative", *flags.writersPerDir)
+		return 1
+	}
+	if *flags.maxFilesPerDir < 0 {
+		logger.Error("Invalid -max-files-per-dir %d: must not be negative", *flags.maxFilesPerDir)
+		return 1
+	}
+	if *flags.maxFilesPerDir > 0 {
+		for _, dest := range destinations {
+			if dest.Store != nil {
+				continue
+			}
+			dest.Spill, err = LoadDirSpill(dest.Root, *flags.maxFilesPerDir)
+			if err != nil {
+				logger.Error("%v", err)
+				return 1
+			}
+		}
+	}
+
+	opts := &Options{
+		IndexDir:        *flags.indexDir,
+		MirrorDir:       *flags.mirrorDir,
+		NumWorkers:      *flags.threads,
+		DryRun:          *flags.dryRun,
+		FileMode:        os.FileMode(mode),
+		DirMode:         os.FileMode(dmode),
+		Ignore:          ignore,
+		RenameMap:       renames,
+		Plan:            plan,
+		Snapshot:        snapshot,
+		TrackCrateFiles: *flags.trackCrateFiles,
+		ParseCache:      parseCache,
+		CompactBudget:   *flags.compactBudget,
+		Baseline:        baseline,
+		CrateNames:      crateNames,
+		RemovedReport:   *flags.removedReport,
+		QuarantineDir:   *flags.quarantineRemoved,
+
+		Destinations:  destinations,
+		SkipUnchanged: *flags.skipUnchanged,
+		Mtimes:        NewMtimeCheck(*flags.mtimeSkew, *flags.fixMtimes, *flags.dryRun),
+
+		PreserveSymlinks: *flags.preserveSymlinks,
+
+		CompactIndexDir: *flags.compactIndexOut,
+		LocalIndexDir:   *flags.localIndexDir,
+		ReportPaths:     flags.reportPaths,
+		HTMLReport:      *flags.htmlReport,
+		SummaryJSON:     *flags.summaryJSON,
+		Checkpoint:      checkpoint,
+		RunID:           runID,
+		Labels:          flags.labels,
+		Registry:        registry,
+		CompressReports: *flags.compressReport,
+		DirManifests:    *flags.dirManifests,
+		Shards:          shards,
+		IndexWalk:       IndexWalkLimits{MaxDepth: *flags.indexMaxDepth, MaxFiles: *flags.indexMaxFiles, FollowSymlinks: *flags.followIndexSymlinks},
+		Lockfile:        lockfile,
+		Collisions:      collisions,
+		RetryPasses:     *flags.retryPasses,
+		CrateIDMode:     *flags.crateIDMode,
+		StrictJSON:      *flags.strictJSON,
+		Latest:          latest,
+		RawLine:         *flags.rawLine,
+		VerifyChecksum:  *flags.verifyChecksum,
+		Bundles:         bundles,
+		Categories:      categories,
+		Faults:          faults,
+		Tracer:          tracer,
+		RetryDelay:      *flags.retryDelay,
+
+		ValidateDeps:    *flags.validateDeps,
+		CheckNames:      *flags.checkNames,
+		NormalizeSchema: *flags.normalizeSchema,
+		StripFields:     stripPaths,
+		Prereleases:     *flags.prereleases,
+		MinVersions:     minVersions,
+		LatestN:         *flags.latestN,
+		ListYanked:      *flags.listMissingYanked,
+		Order:           *flags.order,
+		Timeout:         *flags.timeout,
+		PerFileTimeout:  *flags.perFileTimeout,
+		ETASmoothing:    *flags.etaSmoothing,
+		WritersPerDir:   *flags.writersPerDir,
+		SanityThreshold: *flags.sanityThreshold,
+		AbortOnSanity:   *flags.abortOnSanity,
+
+		DisambiguateCase: *flags.disambiguateCase,
+	}
+	if err := SortIndexFiles(nil, *flags.order); err != nil {
+		logger.Error("Invalid -order: %v", err)
+		return 1
+	}
+
+	// Only one run may modify a mirror at a time; dry runs and verification
+	// only read, and read-only runs just note a writer that holds the lock
+	if *flags.lockPath == "" {
+		*flags.lockPath = filepath.Join(*flags.mirrorDir, LockFileName)
+	}
+	locked := false
+	if *flags.readOnly {
+		if holder, held := CheckLock(*flags.lockPath); held {
+			logger.Warning("Lock file %s is held (%s); the mirror may be changing during this read-only run", *flags.lockPath, holder)
+		}
+	} else if !*flags.dryRun && !*flags.verifyOnly && !*flags.verifyRawLines && !*flags.verifyAggregate && !*flags.listMissing && *flags.exportLocalRegistry == "" && *flags.dumpEntry == "" && (!*flags.verifyDirManifests || *flags.fix) && (!*flags.reconcile || *flags.reconcileRewrite) {
+		lock, err := AcquireLock(*flags.lockPath, runID)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		if lock.TakenOver != "" {
+			logger.Warning("Took over lock file %s from a run that is no longer running (%s)", *flags.lockPath, lock.TakenOver)
+		}
+		defer lock.Release()
+		locked = true
+	}
+
+	// Partial files left by an interrupted run are removed by the next run
+	// that takes the lock, since until then they may be another run's; a
+	// dry or read-only run only lists them
+	if locked || *flags.dryRun {
+		roots := []string{*flags.mirrorDir}
+		for _, dest := range opts.Destinations {
+			if dest.Store == nil && !dest.InMirror {
+				roots = append(roots, dest.Root)
+			}
+		}
+		for _, root := range roots {
+			if _, err := os.Stat(root); os.IsNotExist(err) {
+				continue
+			}
+			removed, err := CleanupPartialTransfers(root, *flags.dryRun, logger)
+			if err != nil {
+				logger.Error("Failed to clean up partial files: %v", err)
+			} else if removed > 0 {
+				logger.Info("Cleaned up %d partial files under %s", removed, root)
+			}
+		}
+	}
+
+	// Stream results to a local monitoring socket
+	if *flags.resultsSocket != "" {
+		stream, err := OpenResultStream(*flags.resultsSocket, logger)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		defer stream.Close()
+		opts.ResultStream = stream
+	}
+
+	// List written metadata paths for xargs -0
+	if *flags.outputsZero != "" {
+		outputList, err := OpenOutputList(*flags.outputsZero)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		defer func() {
+			if err := outputList.Close(); err != nil {
+				logger.Error("Failed to write output list: %v", err)
+			}
+		}()
+		opts.OutputList = outputList
+	}
+
+	// Render the produced files as a tree once all runs are done
+	if *flags.treeOut != "" {
+		tree := NewOutputTree(*flags.treeOut)
+		defer func() {
+			if err := tree.Close(); err != nil {
+				logger.Error("%v", err)
+			}
+		}()
+		opts.Tree = tree
+	}
+
+	// Bundle verification is another read-only check
+	if *flags.verifyAggregate {
+		bundleReport, err := VerifyBundles(opts, logger)
+		if err != nil {
+			logger.Error("Failed to verify bundles: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, bundleReport.SummaryLine())
+		if bundleReport.Mismatched > 0 || bundleReport.Missing > 0 || bundleReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if *flags.publish != "" {
+		deletions := ""
+		if *flags.deleteRemoved {
+			deletions = *flags.publishDeletions
+		}
+		receipt, err := Publish(opts.Destinations[0], *flags.publish, *flags.publishManifest, deletions, opts.Labels, &Trash{Root: *flags.publish, RunID: runID, DirMode: opts.DirMode}, opts.FileMode, opts.DirMode, logger)
+		if err != nil {
+			logger.Error("Failed to publish: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, receipt.SummaryLine())
+		if receipt.Mismatched > 0 || receipt.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if *flags.verifyDirManifests {
+		roots := make([]string, len(opts.Destinations))
+		for i, dest := range opts.Destinations {
+			roots[i] = dest.Root
+		}
+		manifestReport, err := VerifyDirManifests(roots, *flags.fix, logger)
+		if err != nil {
+			logger.Error("Failed to verify directory manifests: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, manifestReport.SummaryLine())
+		if manifestReport.Errors > 0 || manifestReport.Stale > manifestReport.Fixed {
+			return 1
+		}
+		return 0
+	}
+
+	// Listing missing versions reads the index and mirror without writing to either
+	if *flags.listMissing {
+		out := os.Stdout
+		if *flags.listMissingOut != "-" && *flags.chunkSize == 0 {
+			file, err := fsCreate(*flags.listMissingOut)
+			if err != nil {
+				logger.Error("Failed to create missing list: %v", err)
+				return 1
+			}
+			defer file.Close()
+			out = file
+		}
+		list, err := NewMissingList(out, *flags.listMissingOut, *flags.listMissingFormat, *flags.chunkSize)
+		if err != nil {
+			logger.Error("Invalid -list-missing options: %v", err)
+			return 1
+		}
+		listReport, err := ListMissing(opts, list, logger)
+		if err != nil {
+			logger.Error("Failed to list missing versions: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, listReport.SummaryLine())
+		if listReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// Show how a single crate version resolves, for troubleshooting
+	if *flags.dumpEntry != "" {
+		if flags.NArg() != 1 {
+			logger.Error("-dump-entry requires the version as its only argument, e.g. -dump-entry serde 1.0.0")
+			return 1
+		}
+		dump, err := DumpEntry(opts, *flags.dumpEntry, flags.Arg(0), logger)
+		if err != nil {
+			logger.Error("Failed to dump %s-%s: %v", *flags.dumpEntry, flags.Arg(0), err)
+			return 1
+		}
+		data, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			logger.Error("Failed to encode entry dump: %v", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+
+	// Exporting writes only to the registry directory, never the mirror
+	if *flags.exportLocalRegistry != "" {
+		var names []string
+		for _, name := range strings.Split(*flags.exportCrates, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		exportReport, err := ExportLocalRegistry(opts, *flags.exportLocalRegistry, names, logger)
+		if err != nil {
+			logger.Error("Failed to export local registry: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, exportReport.SummaryLine())
+		if exportReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// Record the path and hash of every metadata file
+	if *flags.manifestOut != "" {
+		manifest, err := OpenManifest(*flags.manifestOut, *flags.compressManifest)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		defer func() {
+			if err := manifest.Close(); err != nil {
+				logger.Error("Failed to write manifest: %v", err)
+			} else {
+				logger.Info("Wrote manifest %s", *flags.manifestOut)
+			}
+		}()
+		opts.Manifest = manifest
+	}
+
+	// Compacting checks the parse cache against the index files as they are now
+	if *flags.compactCache != "" {
+		cache, err := OpenParseCache(*flags.compactCache)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		files, err := FindMetadataFiles(opts.IndexDir, nil, nil, opts.IndexWalk, logger)
+		if err == nil && opts.LocalIndexDir != "" {
+			var localFiles []IndexFile
+			localFiles, err = FindMetadataFiles(opts.LocalIndexDir, nil, nil, opts.IndexWalk, logger)
+			files = append(files, localFiles...)
+		}
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		live, err := ParseCacheLive(files)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		budget := time.Duration(0)
+		if _, ok := given["compact-cache-budget"]; ok {
+			budget = *flags.compactBudget
+		}
+		compactReport, err := cache.Compact(live, budget, *flags.dryRun, logger)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		logger.Info("Compacted parse cache %s against %d index files: %d entries scanned, %d dead, %d outdated, %d temp files, %d bytes reclaimed",
+			*flags.compactCache, len(files), compactReport.Scanned, compactReport.Dead, compactReport.Stale, compactReport.Temps, compactReport.Reclaimed)
+		fmt.Fprintln(os.Stderr, compactReport.SummaryLine())
+		if compactReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// Reconciling classifies existing metadata files, rewriting them only on request
+	if *flags.reconcile {
+		var keep []string
+		for _, field := range strings.Split(*flags.reconcileKeep, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				keep = append(keep, field)
+			}
+		}
+		reconcileReport, err := ReconcileMetadata(opts, keep, *flags.reconcileRewrite, logger)
+		if err != nil {
+			logger.Error("Failed to reconcile: %v", err)
+			return 1
+		}
+		if *flags.reconcileOut != "" {
+			if data, err := json.MarshalIndent(reconcileReport, "", "  "); err != nil {
+				logger.Error("Failed to encode reconcile report: %v", err)
+			} else if err := fsWriteFile(*flags.reconcileOut, append(data, '\n'), 0644); err != nil {
+				logger.Error("Failed to write reconcile report: %v", err)
+			} else {
+				logger.Info("Wrote reconcile report to %s", *flags.reconcileOut)
+			}
+		}
+		fmt.Fprintln(os.Stderr, reconcileReport.SummaryLine())
+		if reconcileReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// Tracing documents back to index lines is another read-only check
+	if *flags.verifyRawLines {
+		rawReport, err := VerifyRawLines(opts, logger)
+		if err != nil {
+			logger.Error("Failed to verify raw lines: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, rawReport.SummaryLine())
+		if rawReport.Untraceable > 0 || rawReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// Checksum verification is a separate, read-only phase with its own pool
+	if *flags.verifyOnly {
+		if *flags.verifyWorkers < 1 {
+			logger.Error("-verify-workers must be at least 1")
+			return 1
+		}
+		verifyReport, err := VerifyChecksums(opts, *flags.verifyWorkers, logger)
+		if err != nil {
+			logger.Error("Failed to verify checksums: %v", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, verifyReport.SummaryLine())
+		if verifyReport.Mismatched > 0 || verifyReport.Errors > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// Permission repair is a separate maintenance operation
+	if *flags.repairPermissions {
+		repaired, err := RepairPermissions(opts, logger)
+		if err != nil {
+			logger.Error("Failed to repair permissions: %v", err)
+			return 1
+		}
+		if *flags.dryRun {
+			logger.Info("DRY RUN COMPLETE: Would have changed the mode of %d metadata files", repaired)
+		} else {
+			logger.Info("Permission repair complete: changed the mode of %d metadata files", repaired)
+		}
+		return 0
+	}
+
+	// In daemon mode, runs happen on a schedule until shutdown
+	if *flags.daemon {
+		schedule, err := ParseSchedule(*flags.scheduleSpec)
+		if err != nil {
+			logger.Error("Invalid -schedule: %v", err)
+			return 1
+		}
+		opts.CrateIndexCache = NewCrateIndexCache(*flags.mirrorDir, ignore, opts.Mtimes)
+		d := NewDaemon(opts, schedule, logger)
+		if *flags.backfillState != "" {
+			opts.RecentlyMissing, err = LoadRecentlyMissing(*flags.backfillState, *flags.backfillMax, *flags.backfillWindow)
+			if err != nil {
+				logger.Error("%v", err)
+				return 1
+			}
+			logger.Info("Backfilling %d recently missing versions from %s every %v", opts.RecentlyMissing.Len(), *flags.backfillState, *flags.backfillInterval)
+			d.BackfillInterval = *flags.backfillInterval
+		}
+		if err := d.Run(*flags.statusAddr); err != nil {
+			logger.Error("Daemon failed: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	// Skip the whole run when the index has not changed since the last full success
+	var indexState string
+	if *flags.skipIfSynced {
+		indexState, err = IndexState(opts)
+		if err != nil {
+			logger.Error("Failed to determine index state: %v", err)
+			return 1
+		}
+		if InSync(opts.Destinations, indexState) {
+			logger.Info("Index unchanged since the last successful run (%s); nothing to do", indexState)
+			return 0
+		}
+	}
+
+	// Fetch the requested crate versions into the mirror, then organize only those
+	var bootstrapReport *BootstrapReport
+	if len(flags.bootstrapSources) > 0 {
+		opts.Lockfile, bootstrapReport, err = Bootstrap(opts, flags.bootstrapSources, *flags.bootstrapWorkers, *flags.bootstrapRate, logger)
+		if err != nil {
+			logger.Error("Bootstrap failed: %v", err)
+			return 1
+		}
+	}
+
+	// Organize metadata
+	report, err := RunOrganize(opts, logger)
+	if err != nil {
+		logger.Error("Failed to organize metadata: %v", err)
+		return 1
+	}
+	if bootstrapReport != nil {
+		bootstrapReport.Organized = opts.Lockfile.Organized()
+		bootstrapReport.Duration += report.Duration
+	}
+
+	if err := plan.Close(); err != nil {
+		logger.Error("Failed to write plan file: %v", err)
+	} else if *flags.planFile != "" {
+		logger.Info("Wrote dry-run plan to %s", *flags.planFile)
+	}
+
+	// Only a complete, error-free run marks the outputs as in sync
+	if *flags.skipIfSynced && !*flags.dryRun {
+		if report.Errors == 0 && report.PartialWrites == 0 && !report.Partial {
+			if err := WriteSyncState(opts.Destinations, indexState); err != nil {
+				logger.Error("%v", err)
+			} else {
+				logger.Info("Recorded index state %s", indexState)
+			}
+		} else {
+			logger.Warning("Not recording index state: the run was partial or had errors")
+		}
+	}
+
+	// Archive the outputs reproducibly for compliance snapshots
+	if *flags.archiveOut != "" && !*flags.dryRun {
+		files, sum, err := WriteArchive(*flags.archiveOut, opts.Destinations[0].Root)
+		if err != nil {
+			logger.Error("%v", err)
+		} else {
+			logger.Info("Wrote archive %s of %d metadata files (sha256 %s)", *flags.archiveOut, files, sum)
+		}
+	}
+
+	// Verify with the exact options of the run, unless it did not finish
+	var verifyLines []string
+	if *flags.thenVerify {
+		if report.Partial || report.SanityAborted {
+			logger.Warning("Not verifying: the run did not process every index file")
+		} else {
+			verifyLines, report.VerifyFailures = VerifyAfterRun(opts, *flags.verifyWorkers, logger)
+			report.Verified = true
+			if report.VerifyFailures > 0 {
+				logger.Error("Verification failed: %d of %d passes found problems", report.VerifyFailures, len(verifyLines))
+			} else {
+				logger.Info("Verification passed: %d passes", len(verifyLines))
+			}
+			// The summary was written at the end of the run, before verifying
+			if opts.SummaryJSON != "" {
+				writeSummaryJSON(opts.SummaryJSON, report, logger)
+			}
+		}
+	}
+
+	// Hand the counts to CI as step outputs
+	if *flags.githubOutput && *flags.envOut == "" {
+		*flags.envOut = os.Getenv("GITHUB_OUTPUT")
+		if *flags.envOut == "" {
+			logger.Warning("-github-output was given but GITHUB_OUTPUT is not set; not writing step outputs")
+		}
+	}
+	if *flags.envOut != "" {
+		if err := report.WriteEnvFile(*flags.envOut); err != nil {
+			logger.Error("Failed to write step outputs: %v", err)
+		} else {
+			logger.Info("Wrote step outputs to %s", *flags.envOut)
+		}
+	}
+
+	// Emit the machine-readable summary last, separate from the log on stdout
+	fmt.Fprintln(os.Stderr, report.SummaryLine())
+	if bootstrapReport != nil {
+		fmt.Fprintln(os.Stderr, bootstrapReport.SummaryLine())
+	}
+	for _, line := range verifyLines {
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	// A distinct status, so a scheduler can tell a misconfiguration from errors
+	if report.SanityAborted {
+		return 3
+	}
+	if report.VerifyFailures > 0 {
+		return 4
+	}
+	if *flags.failOnCollision && report.Collisions > 0 {
+		return 1
+	}
+	if bootstrapReport != nil && bootstrapReport.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], ""))
 }
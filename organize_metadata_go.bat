@@ -96,7 +96,7 @@ REM Check if the Go executable exists
 if not exist "%SCRIPT_DIR%organize_metadata.exe" (
     echo Building Go executable...
     cd "%SCRIPT_DIR%"
-    go build -o organize_metadata.exe organize_metadata.go
+    go build -o organize_metadata.exe .
     if errorlevel 1 (
         echo Failed to build Go executable.
         exit /b 1
@@ -0,0 +1,3838 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// fixture is an index and mirror in a temporary directory
+type fixture struct {
+	t      testing.TB
+	dir    string
+	index  string
+	mirror string
+}
+
+func newFixture(t testing.TB) *fixture {
+	t.Helper()
+	dir := t.TempDir()
+	f := &fixture{t: t, dir: dir, index: filepath.Join(dir, "index"), mirror: filepath.Join(dir, "mirror")}
+	f.write(filepath.Join(f.index, "config.json"), `{"dl":"https://static.crates.io/crates","api":"https://crates.io"}`+"\n")
+	if err := os.MkdirAll(f.mirror, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// write creates a file and its parent directories
+func (f *fixture) write(path, content string) {
+	f.t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// read returns a file's content, failing the test if it cannot be read
+func (f *fixture) read(path string) string {
+	f.t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return string(data)
+}
+
+// entry returns an index line for a crate version; extra holds raw JSON
+// fields to add, such as `"yanked":true`
+func entry(name, version, cksum string, extra ...string) string {
+	fields := []string{fmt.Sprintf(`"name":%q`, name), fmt.Sprintf(`"vers":%q`, version), `"deps":[]`}
+	if cksum != "" {
+		fields = append(fields, fmt.Sprintf(`"cksum":%q`, cksum))
+	}
+	fields = append(fields, `"features":{}`)
+	fields = append(fields, extra...)
+	if !strings.Contains(strings.Join(extra, ","), `"yanked"`) {
+		fields = append(fields, `"yanked":false`)
+	}
+	return "{" + strings.Join(fields, ",") + "}"
+}
+
+// indexFile writes a crate's index file from its lines
+func (f *fixture) indexFile(name string, lines ...string) {
+	f.t.Helper()
+	f.write(filepath.Join(f.index, filepath.FromSlash(indexentry.IndexPath(name))), strings.Join(lines, "\n")+"\n")
+}
+
+// crate puts a crate file in the mirror and returns its SHA-256
+func (f *fixture) crate(name, version, content string) string {
+	f.t.Helper()
+	f.write(MirrorCratePath(f.mirror, name, version), content)
+	return sha256Hex(content)
+}
+
+// metadataPath is where a run writes a version's metadata beside its crate file
+func (f *fixture) metadataPath(name, version string) string {
+	return filepath.Join(filepath.Dir(MirrorCratePath(f.mirror, name, version)), name+"-"+version+MetadataFileSuffix)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// args returns the organizer arguments for the fixture followed by args
+func (f *fixture) args(args ...string) []string {
+	base := []string{
+		"-index-dir", f.index,
+		"-mirror-dir", f.mirror,
+		"-log-path", filepath.Join(f.dir, "organize.log"),
+		"-summary-json", filepath.Join(f.dir, "summary.json"),
+		"-threads", "2",
+	}
+	return append(base, args...)
+}
+
+// run runs the organizer on the fixture with args and returns its exit code
+// and summary report
+func (f *fixture) run(args ...string) (int, *Report) {
+	f.t.Helper()
+	summary := filepath.Join(f.dir, "summary.json")
+	os.Remove(summary)
+	code := run(f.args(args...), "")
+	data, err := ioutil.ReadFile(summary)
+	if err != nil {
+		return code, nil
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		f.t.Fatalf("bad summary: %v", err)
+	}
+	return code, &report
+}
+
+// childEnv names the environment variable holding the JSON arguments of an
+// organizer run that the test binary performs instead of running tests
+const childEnv = "ORGANIZE_TEST_CHILD"
+
+// releaseFaultSpec is faultSpec as a release build has it
+var releaseFaultSpec = faultSpec
+
+func TestMain(m *testing.M) {
+	// The test binary, and the children it runs, inject faults from the
+	// environment as a build with the faults tag does
+	faultSpec = func() string { return os.Getenv(FaultsEnvVar) }
+
+	if encoded := os.Getenv(childEnv); encoded != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(run(args, ""))
+	}
+	os.Exit(m.Run())
+}
+
+// runFaulted runs the organizer on the fixture in a child process with the
+// fault injection spec, so that a kill ends only the child, and returns
+// its exit code
+func (f *fixture) runFaulted(spec string, args ...string) int {
+	f.t.Helper()
+	encoded, err := json.Marshal(f.args(args...))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), childEnv+"="+string(encoded), FaultsEnvVar+"="+spec)
+	err = cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		// A killed child reports its signal as a shell would
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exit.ExitCode()
+	}
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return 0
+}
+
+// files returns the content of every file under dir by slash-separated
+// relative path
+func files(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	found := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		found[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// log returns the log of the fixture's runs so far
+func (f *fixture) log() string {
+	data, _ := ioutil.ReadFile(filepath.Join(f.dir, "organize.log"))
+	return string(data)
+}
+
+func TestBootstrapRejectsUnsafeEntries(t *testing.T) {
+	f := newFixture(t)
+	good := "serde crate"
+	served := map[string]string{
+		"/serde/1.0.0/download":   good,
+		"/evil/1.0.0/download":    "evil",
+		"/nocksum/1.0.0/download": "unverified",
+	}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if body, ok := served[r.URL.Path]; ok {
+			fmt.Fprint(w, body)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	f.write(filepath.Join(f.index, "config.json"), fmt.Sprintf(`{"dl":%q}`, server.URL))
+
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex(good)))
+	f.indexFile("evil", entry("evil", "1.0.0/../../../../escaped", sha256Hex("evil")), entry("evil", "1.0.1", sha256Hex("evil")))
+	f.indexFile("nocksum", entry("nocksum", "1.0.0", ""))
+	f.indexFile("other", entry("serde", "1.0.0", sha256Hex(good)))
+	list := filepath.Join(f.dir, "crates.txt")
+	f.write(list, "serde\nevil 1.0.0/../../../../escaped\nevil 1.0.1\nnocksum\nother\n../../etc\n")
+
+	code, report := f.run("-bootstrap", list, "-bootstrap-workers", "1")
+	if code != 1 {
+		t.Errorf("exit code %d, want 1 for the failed download of evil 1.0.1", code)
+	}
+	if report == nil {
+		t.Fatal("no summary written")
+	}
+	if _, err := os.Stat(MirrorCratePath(f.mirror, "serde", "1.0.0")); err != nil {
+		t.Errorf("serde was not fetched: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(f.dir, "escaped")); err == nil {
+		t.Errorf("a download escaped the mirror")
+	}
+	if _, err := os.Stat(MirrorCratePath(f.mirror, "nocksum", "1.0.0")); err == nil {
+		t.Errorf("an entry without a cksum was fetched")
+	}
+	for _, path := range requests {
+		if strings.Contains(path, "nocksum") || strings.Contains(path, "..") {
+			t.Errorf("requested %s", path)
+		}
+	}
+	log := f.log()
+	for _, want := range []string{"evil 1.0.0/../../../../escaped", "nocksum", "entry is for crate \"serde\"", "../../etc"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log does not mention %q", want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limit := &rateLimiter{rate: 10000}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		limit.Wait(1000)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("4000 bytes at 10000 bytes/s took %v", elapsed)
+	}
+	var unlimited *rateLimiter
+	unlimited.Wait(1 << 30)
+}
+
+func TestExportLocalRegistry(t *testing.T) {
+	f := newFixture(t)
+	serde := f.crate("serde", "1.0.0", "serde")
+	f.indexFile("serde",
+		entry("serde", "1.0.0", serde, `"internal":{"owner":"team-a"}`),
+		entry("serde", "1.0.0-..-..-x", serde),
+		entry("serde", "1.0.1/../../../x", serde))
+	out := filepath.Join(f.dir, "registry")
+
+	code, _ := f.run("-export-local-registry", out, "-strip-fields", "internal")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	index := f.read(filepath.Join(out, "index", "se", "rd", "serde"))
+	lines := strings.Split(strings.TrimSpace(index), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("exported index has %d lines, want 1:\n%s", len(lines), index)
+	}
+	if strings.Contains(index, "internal") || strings.Contains(index, "team-a") {
+		t.Errorf("stripped field leaked into the exported index: %s", index)
+	}
+	if !strings.Contains(f.log(), `unsafe path component "1.0.1/../../../x"`) {
+		t.Errorf("traversal version was not rejected")
+	}
+	if _, err := os.Stat(filepath.Join(out, "serde-1.0.0.crate")); err != nil {
+		t.Errorf("crate file not exported: %v", err)
+	}
+
+	code, _ = f.run("-export-local-registry", filepath.Join(f.dir, "bad"), "-strip-fields", "cksum")
+	if code == 0 {
+		t.Errorf("stripping cksum from a local registry succeeded")
+	}
+}
+
+func TestExportLocalRegistryCrateIDMode(t *testing.T) {
+	f := newFixture(t)
+	serde := f.crate("serde", "1.0.0", "serde")
+	rand := f.crate("rand", "0.8.5", "rand")
+	f.write(filepath.Join(f.index, "ids", "1001"), entry("serde", "1.0.0", serde)+"\n")
+	f.write(filepath.Join(f.index, "ids", "1002"), entry("rand", "0.8.5", rand)+"\n")
+	out := filepath.Join(f.dir, "registry")
+
+	code, _ := f.run("-export-local-registry", out, "-crate-id-mode", "-export-crates", "serde")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if _, err := os.Stat(filepath.Join(out, "index", "se", "rd", "serde")); err != nil {
+		t.Errorf("serde not exported under its name: %v", err)
+	}
+	for _, unwanted := range []string{filepath.Join("index", "10", "01", "1001"), filepath.Join("index", "ra", "nd", "rand"), "rand-0.8.5.crate"} {
+		if _, err := os.Stat(filepath.Join(out, unwanted)); err == nil {
+			t.Errorf("%s was exported", unwanted)
+		}
+	}
+}
+
+func TestCompactIndexMergesLocalIndex(t *testing.T) {
+	f := newFixture(t)
+	old := f.crate("serde", "1.0.0", "serde 1.0.0")
+	patched := f.crate("serde", "1.0.1", "serde 1.0.1 local")
+	f.indexFile("serde", entry("serde", "1.0.0", old), entry("serde", "1.0.1", sha256Hex("serde 1.0.1 upstream")))
+	local := filepath.Join(f.dir, "local")
+	f.write(filepath.Join(local, "se", "rd", "serde"), entry("serde", "1.0.1", patched)+"\n")
+	out := filepath.Join(f.dir, "compact")
+
+	code, _ := f.run("-local-index-dir", local, "-compact-index-out", out)
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	lines := strings.Split(strings.TrimSpace(f.read(filepath.Join(out, "se", "rd", "serde"))), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"1.0.0"`) || !strings.Contains(lines[1], patched) {
+		t.Errorf("compacted index = %q, want 1.0.0 from the main index and 1.0.1 from the local one", lines)
+	}
+}
+
+func TestSnapshotRetriesPartialWrites(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde")))
+	good, bad := filepath.Join(f.dir, "good"), filepath.Join(f.dir, "bad")
+	f.write(filepath.Join(bad, "se"), "not a directory")
+	snapshot := filepath.Join(f.dir, "snapshot.json")
+
+	_, report := f.run("-output-dir", good, "-output-dir", bad, "-snapshot", snapshot)
+	if report == nil || report.PartialWrites != 1 {
+		t.Fatalf("first run did not write to only one destination: %+v\n%s", report, f.log())
+	}
+	if err := os.Remove(filepath.Join(bad, "se")); err != nil {
+		t.Fatal(err)
+	}
+	_, report = f.run("-output-dir", good, "-output-dir", bad, "-snapshot", snapshot)
+	if report == nil || report.SnapshotSkipped != 0 {
+		t.Fatalf("crate with a partial write was skipped by the snapshot: %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(bad, "se", "rd", "serde-1.0.0"+MetadataFileSuffix)); err != nil {
+		t.Errorf("second run did not complete the write: %v", err)
+	}
+}
+
+func TestBaselineKeptWhenSnapshotSkips(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde")))
+	baseline := filepath.Join(f.dir, "baseline")
+	snapshot := filepath.Join(f.dir, "snapshot.json")
+
+	if _, report := f.run("-missing-baseline", baseline, "-snapshot", snapshot); report == nil || report.Missing != 1 {
+		t.Fatalf("first run: %+v\n%s", report, f.log())
+	}
+	saved := f.read(baseline)
+
+	_, report := f.run("-missing-baseline", baseline, "-snapshot", snapshot)
+	if report == nil || report.SnapshotSkipped != 1 {
+		t.Fatalf("second run did not skip serde: %+v", report)
+	}
+	if report.NoLongerMissing != 0 {
+		t.Errorf("%d versions no longer missing, want 0 for a skipped crate", report.NoLongerMissing)
+	}
+	if got := f.read(baseline); got != saved {
+		t.Errorf("baseline rewritten by a run that skipped crates:\n%s\nwas:\n%s", got, saved)
+	}
+}
+
+func TestSkipIfSynced(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde")), entry("serde", "1.0.1", sha256Hex("serde 1.0.1")))
+
+	if _, report := f.run("-skip-if-synced"); report == nil {
+		t.Fatalf("first run short-circuited\n%s", f.log())
+	}
+	if code, report := f.run("-skip-if-synced"); code != 0 || report != nil {
+		t.Errorf("unchanged run was not skipped: exit code %d, report %+v", code, report)
+	}
+
+	f.crate("serde", "1.0.1", "serde 1.0.1")
+	if _, report := f.run("-skip-if-synced"); report == nil || report.Success != 2 {
+		t.Errorf("run after a crate file was mirrored: %+v", report)
+	}
+	if _, report := f.run("-skip-if-synced", "-strip-fields", "features"); report == nil {
+		t.Errorf("run with different -strip-fields was skipped")
+	}
+
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde")))
+	if _, report := f.run("-skip-if-synced", "-strip-fields", "features"); report == nil || report.Versions != 1 {
+		t.Errorf("run after the index changed: %+v", report)
+	}
+}
+
+// crashFixture is a fixture of several crates, enough writes for a crash
+// to land in the middle of a run
+func crashFixture(t *testing.T) *fixture {
+	f := newFixture(t)
+	for _, name := range []string{"serde", "rand", "log", "tokio", "syn", "quote"} {
+		for _, version := range []string{"1.0.0", "1.0.1"} {
+			content := name + " " + version
+			f.crate(name, version, content)
+		}
+		f.indexFile(name, entry(name, "1.0.0", sha256Hex(name+" 1.0.0")), entry(name, "1.0.1", sha256Hex(name+" 1.0.1")))
+	}
+	return f
+}
+
+func TestCrashLeavesNoPartialFiles(t *testing.T) {
+	reference := crashFixture(t)
+	if code, _ := reference.run(); code != 0 {
+		t.Fatalf("uninterrupted run: exit code %d\n%s", code, reference.log())
+	}
+	want := files(t, reference.mirror)
+
+	for _, kill := range []int{1, 2, 3, 8, 15} {
+		t.Run(fmt.Sprintf("kill-after-writes=%d", kill), func(t *testing.T) {
+			f := crashFixture(t)
+			checkpoint := filepath.Join(f.dir, "checkpoint.json")
+			if code := f.runFaulted(fmt.Sprintf("kill-after-writes=%d", kill), "-checkpoint", checkpoint); code != 137 {
+				t.Fatalf("exit code %d, want 137 from the injected kill", code)
+			}
+			// The resumed run takes over the killed run's lock
+			if _, err := os.Stat(filepath.Join(f.mirror, LockFileName)); err != nil {
+				t.Fatalf("killed run left no lock file: %v", err)
+			}
+			for path, content := range files(t, f.mirror) {
+				if strings.HasSuffix(path, MetadataFileSuffix) && content != want[path] {
+					t.Errorf("%s after the crash is partial:\n%s", path, content)
+				}
+			}
+
+			if code, _ := f.run("-checkpoint", checkpoint); code != 0 {
+				t.Fatalf("resumed run: exit code %d\n%s", code, f.log())
+			}
+			got := files(t, f.mirror)
+			for path, content := range want {
+				if got[path] != content {
+					t.Errorf("%s after resuming = %q, want %q", path, got[path], content)
+				}
+			}
+			for path := range got {
+				if _, ok := want[path]; !ok {
+					t.Errorf("%s left behind after resuming", path)
+				}
+			}
+		})
+	}
+}
+
+func TestStaleLockTakenOver(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	lock := filepath.Join(f.mirror, LockFileName)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A process that has exited, and been waited for, no longer exists
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	gone := exited.Process.Pid
+
+	tests := []struct {
+		name, holder string
+		takeover     bool
+	}{
+		{"live process", fmt.Sprintf("pid=%d host=%s run=live started=2026-01-01T00:00:00Z", os.Getpid(), host), false},
+		{"exited process", fmt.Sprintf("pid=%d host=%s run=crashed started=2026-01-01T00:00:00Z", gone, host), true},
+		{"another host", fmt.Sprintf("pid=%d host=%s-elsewhere run=remote started=2026-01-01T00:00:00Z", gone, host), false},
+		{"no host", fmt.Sprintf("pid=%d run=old started=2026-01-01T00:00:00Z", gone), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f.write(lock, test.holder+"\n")
+			code, _ := f.run()
+			if !test.takeover {
+				if code != 1 || !strings.Contains(f.log(), "already exists ("+test.holder+")") {
+					t.Errorf("exit code %d, want 1 with the holder named\n%s", code, f.log())
+				}
+				if got := strings.TrimSpace(f.read(lock)); got != test.holder {
+					t.Errorf("lock file = %q, want it untouched", got)
+				}
+				return
+			}
+			if code != 0 || !strings.Contains(f.log(), "Took over lock file "+lock+" from a run that is no longer running ("+test.holder+")") {
+				t.Errorf("exit code %d, want 0 with the takeover logged\n%s", code, f.log())
+			}
+			if _, err := os.Stat(lock); !os.IsNotExist(err) {
+				t.Errorf("lock file kept after the run: %v", err)
+			}
+		})
+	}
+
+	// The lock file names this process and host while held
+	os.Remove(lock)
+	held, err := AcquireLock(lock, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+	if want := fmt.Sprintf("pid=%d host=%s run=test ", os.Getpid(), host); !strings.HasPrefix(f.read(lock), want) {
+		t.Errorf("lock file = %q, want it to start with %q", f.read(lock), want)
+	}
+}
+
+func TestStaleLockTakeoverRace(t *testing.T) {
+	dir := t.TempDir()
+	lock := filepath.Join(dir, LockFileName)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stale := fmt.Sprintf("pid=%d host=%s run=crashed started=2026-01-01T00:00:00Z\n", exited.Process.Pid, host)
+
+	// A run that read the dead holder, but moves the lock file only after
+	// another run has taken it over, must leave the new lock in place
+	if err := ioutil.WriteFile(lock, []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, err := AcquireLock(lock, "first")
+	if err != nil || first.TakenOver != strings.TrimSpace(stale) {
+		t.Fatalf("first takeover: %v", err)
+	}
+	if err := takeOverLock(lock, strings.TrimSpace(stale), "late"); err == nil || !strings.Contains(err.Error(), "taken by another run") {
+		t.Errorf("late takeover error = %v, want the lock reported as taken", err)
+	}
+	if held, err := ioutil.ReadFile(lock); err != nil || !strings.Contains(string(held), " run=first ") {
+		t.Fatalf("lock file after the late takeover = %q (%v), want the first run's", held, err)
+	}
+	if _, err := AcquireLock(lock, "late"); err == nil {
+		t.Errorf("the first run's live lock was taken")
+	}
+	first.Release()
+
+	// Runs that all read the same dead holder take over its lock at once;
+	// exactly one may hold it
+	const runs = 8
+	for round := 0; round < 50; round++ {
+		if err := ioutil.WriteFile(lock, []byte(stale), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var winners []string
+		start := make(chan struct{})
+		for i := 0; i < runs; i++ {
+			wg.Add(1)
+			go func(runID string) {
+				defer wg.Done()
+				<-start
+				if _, err := AcquireLock(lock, runID); err == nil {
+					mu.Lock()
+					winners = append(winners, runID)
+					mu.Unlock()
+				}
+			}(fmt.Sprintf("run%d-%d", round, i))
+		}
+		close(start)
+		wg.Wait()
+
+		if len(winners) != 1 {
+			t.Fatalf("round %d: %d runs took the lock: %v", round, len(winners), winners)
+		}
+		held, err := ioutil.ReadFile(lock)
+		if err != nil || !strings.Contains(string(held), " run="+winners[0]+" ") {
+			t.Fatalf("round %d: lock file = %q (%v), want the winner %s", round, held, err, winners[0])
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+			t.Fatalf("round %d: %d files beside the lock, want none", round, len(entries)-1)
+		}
+		os.Remove(lock)
+	}
+}
+
+func TestFailedWritesKeepPreviousOutput(t *testing.T) {
+	f := crashFixture(t)
+	if code, _ := f.run(); code != 0 {
+		t.Fatalf("first run: exit code %d\n%s", code, f.log())
+	}
+	before := files(t, f.mirror)
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde 1.0.0"), `"links":"serde"`), entry("serde", "1.0.1", sha256Hex("serde 1.0.1"), `"links":"serde"`))
+
+	for _, spec := range []string{"write-fail=1", "enospc-after=10", "seed=7,write-fail=0.5"} {
+		os.Setenv(FaultsEnvVar, spec)
+		// The summary is not read: with enospc-after it cannot be written either
+		run(f.args(), "")
+		os.Unsetenv(FaultsEnvVar)
+		after := files(t, f.mirror)
+		for path, content := range after {
+			if old, ok := before[path]; !ok {
+				t.Errorf("%s: left %s behind", spec, path)
+			} else if content != old && !strings.Contains(content, `"links": "serde"`) {
+				t.Errorf("%s: %s is neither the old nor the new document:\n%s", spec, path, content)
+			}
+		}
+		for path := range before {
+			if _, ok := after[path]; !ok {
+				t.Errorf("%s: %s was removed", spec, path)
+			}
+		}
+	}
+}
+
+func TestReleaseBuildIgnoresFaults(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	testFaultSpec := faultSpec
+	faultSpec = releaseFaultSpec
+	defer func() { faultSpec = testFaultSpec }()
+	setenv(t, FaultsEnvVar, "write-fail=1")
+
+	if code, report := f.run(); code != 0 || report == nil || report.Success != 1 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if strings.Contains(f.log(), "FAULT INJECTION") {
+		t.Errorf("faults enabled in a release build\n%s", f.log())
+	}
+}
+
+func TestPartialTransfersCleanedUp(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde")))
+	out := filepath.Join(f.dir, "out")
+	partials := []string{
+		MirrorCratePath(f.mirror, "serde", "1.0.1") + PartialTransferSuffix,
+		filepath.Join(out, "se", "rd", "serde-1.0.0"+MetadataFileSuffix+PartialTransferSuffix),
+	}
+	for _, path := range partials {
+		f.write(path, "incomplete")
+	}
+
+	if code, _ := f.run("-output-dir", out, "-dry-run"); code != 0 {
+		t.Fatalf("dry run: exit code %d\n%s", code, f.log())
+	}
+	for _, path := range partials {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("dry run removed %s", path)
+		}
+	}
+
+	if code, _ := f.run("-output-dir", out); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	for _, path := range partials {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s was not cleaned up", path)
+		}
+	}
+}
+
+func TestPublishDeletesThroughLayout(t *testing.T) {
+	for _, layout := range []string{LayoutBeside, LayoutFlat, LayoutDate} {
+		t.Run(layout, func(t *testing.T) {
+			f := newFixture(t)
+			f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde"), `"pubtime":"2023-05-01T00:00:00Z"`))
+			f.indexFile("rand", entry("rand", "0.8.5", f.crate("rand", "0.8.5", "rand"), `"pubtime":"2023-06-01T00:00:00Z"`))
+			out, pub := filepath.Join(f.dir, "out"), filepath.Join(f.dir, "pub")
+			manifest := filepath.Join(f.dir, "manifest.ndjson")
+			if code, _ := f.run("-output-dir", out, "-layout", layout, "-manifest-out", manifest); code != 0 {
+				t.Fatalf("exit code %d\n%s", code, f.log())
+			}
+
+			deletions := filepath.Join(f.dir, "removed.json")
+			f.write(deletions, fmt.Sprintf(`{"removed_crates":2,"files":[{"crate":"serde","version":"1.0.0","path":%q},{"crate":"gone","version":"0.1.0","path":%q}]}`,
+				MirrorCratePath(f.mirror, "serde", "1.0.0"), MirrorCratePath(f.mirror, "gone", "0.1.0")))
+			code, _ := f.run("-output-dir", out, "-layout", layout, "-publish", pub, "-publish-manifest", manifest, "-publish-deletions", deletions, "-delete")
+			if code != 0 {
+				t.Fatalf("publish: exit code %d\n%s", code, f.log())
+			}
+
+			published := files(t, pub)
+			var receipt PublishReceipt
+			if err := json.Unmarshal([]byte(published[PublishReceiptName]), &receipt); err != nil {
+				t.Fatal(err)
+			}
+			if receipt.Deleted != 1 || receipt.Unmatched != 1 || len(receipt.Problems) != 1 || !strings.Contains(receipt.Problems[0].Path, "gone") {
+				t.Errorf("receipt deleted=%d unmatched=%d problems=%+v", receipt.Deleted, receipt.Unmatched, receipt.Problems)
+			}
+			var kept []string
+			for path := range published {
+				if !strings.HasPrefix(path, TrashDirName+"/") && path != PublishReceiptName {
+					kept = append(kept, path)
+				}
+			}
+			if len(kept) != 1 || !strings.HasSuffix(kept[0], "rand-0.8.5"+MetadataFileSuffix) {
+				t.Errorf("published files after deleting serde: %v", kept)
+			}
+		})
+	}
+}
+
+func TestDisambiguateCase(t *testing.T) {
+	f := newFixture(t)
+	upper := f.crate("MS-DOS", "1.0.0", "upper")
+	lower := f.crate("ms-dos", "1.0.0", "lower")
+	f.write(filepath.Join(f.index, "ids", "1"), entry("MS-DOS", "1.0.0", upper)+"\n")
+	f.write(filepath.Join(f.index, "ids", "2"), entry("ms-dos", "1.0.0", lower)+"\n")
+
+	code, report := f.run("-crate-id-mode", "-disambiguate-case")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.MirrorCaseCollisions == 0 {
+		t.Errorf("mirror case collision not reported")
+	}
+	dir := filepath.Dir(MirrorCratePath(f.mirror, "ms-dos", "1.0.0"))
+	for _, stem := range []string{"MS-DOS-1.0.0", "ms-dos-1.0.0"} {
+		if _, err := os.Stat(filepath.Join(dir, CaseSuffixedName(stem))); err != nil {
+			t.Errorf("%s was not written with its case suffix: %v", stem, err)
+		}
+	}
+	if log := f.log(); strings.Contains(log, "not a valid file name") || !strings.Contains(log, "differs from it only by case") {
+		t.Errorf("case suffix logged as an invalid file name:\n%s", log)
+	}
+	var renamed map[string]string
+	if err := json.Unmarshal([]byte(f.read(filepath.Join(f.mirror, RenamedNamesFile))), &renamed); err != nil || len(renamed) != 2 {
+		t.Errorf("renamed names = %v (%v), want both variants", renamed, err)
+	}
+}
+
+func BenchmarkOrderTail(b *testing.B) {
+	// A few giant index files among many small ones, the giants last in
+	// walk order, as on crates.io
+	f := newFixture(b)
+	for i := 0; i < 200; i++ {
+		versions := 20
+		if i >= 196 {
+			versions = 2000
+		}
+		name := fmt.Sprintf("crate%03d", i)
+		lines := make([]string, versions)
+		for v := range lines {
+			version := fmt.Sprintf("0.%d.0", v)
+			lines[v] = entry(name, version, f.crate(name, version, name+version))
+		}
+		f.indexFile(name, lines...)
+	}
+
+	for _, order := range []string{OrderWalk, OrderSizeDesc} {
+		b.Run(order, func(b *testing.B) {
+			var tail time.Duration
+			for i := 0; i < b.N; i++ {
+				code, report := f.run("-order", order, "-threads", "4")
+				if code != 0 || report == nil {
+					b.Fatalf("exit code %d\n%s", code, f.log())
+				}
+				tail += report.Tail
+			}
+			b.ReportMetric(float64(tail.Milliseconds())/float64(b.N), "tail-ms/op")
+		})
+	}
+}
+
+func TestMergeReports(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde")), entry("serde", "1.0.1", sha256Hex("wrong"), `"yanked":false`))
+	f.crate("serde", "1.0.1", "tampered")
+	f.indexFile("rand", entry("rand", "0.8.5", f.crate("rand", "0.8.5", "rand")), entry("rand", "0.9.0", sha256Hex("rand 0.9.0")))
+	reports := filepath.Join(f.dir, "reports")
+	if err := os.MkdirAll(reports, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range []string{"a-m,0-9", "n-z"} {
+		report := filepath.Join(reports, fmt.Sprintf("shard%d.ndjson", i))
+		if code, _ := f.run("-shards", shard, "-verify-checksum", "-report-out", report); code != 0 {
+			t.Fatalf("shard %s: exit code %d\n%s", shard, code, f.log())
+		}
+	}
+	// A summary beside the reports is not a report
+	f.write(filepath.Join(reports, "summary.json"), f.read(filepath.Join(f.dir, "summary.json")))
+
+	out := filepath.Join(f.dir, "merged.json")
+	code := run([]string{"-log-path", filepath.Join(f.dir, "organize.log"), "-merge-report", "-merge-out", out, reports}, "")
+	if code != 0 {
+		t.Fatalf("merge: exit code %d\n%s", code, f.log())
+	}
+	var merged MergedReport
+	if err := json.Unmarshal([]byte(f.read(out)), &merged); err != nil {
+		t.Fatal(err)
+	}
+	got := merged.Report
+	if len(merged.Sources) != 2 || got.Files != 2 || got.Versions != 4 || got.Success != 2 || got.Missing != 1 || got.ChecksumFailed != 1 || got.ChecksumPassed != 2 {
+		t.Errorf("merged %v: files=%d versions=%d success=%d missing=%d checksum passed=%d failed=%d",
+			merged.Sources, got.Files, got.Versions, got.Success, got.Missing, got.ChecksumPassed, got.ChecksumFailed)
+	}
+	if !merged.Complete || len(merged.Missing) != 1 || merged.Missing[0] != "rand-0.9.0" {
+		t.Errorf("complete=%v missing=%v", merged.Complete, merged.Missing)
+	}
+}
+
+func TestBundlesRebuiltFromCurrentEntries(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")),
+		entry("serde", "1.0.2", f.crate("serde", "1.0.2", "serde 1.0.2")))
+	bundle := filepath.Join(f.mirror, "se", "rd", "serde"+BundleSuffix)
+	versions := func() []string {
+		var entries []MetadataEntry
+		if err := json.Unmarshal([]byte(f.read(bundle)), &entries); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Version())
+		}
+		return got
+	}
+
+	if code, _ := f.run("-aggregate"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if got := versions(); len(got) != 3 {
+		t.Fatalf("bundle holds %v, want 3 versions", got)
+	}
+
+	// 1.0.1 leaves the mirror and 1.0.2 the index
+	if err := os.Remove(MirrorCratePath(f.mirror, "serde", "1.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde 1.0.0")), entry("serde", "1.0.1", sha256Hex("serde 1.0.1")))
+	if code, _ := f.run("-aggregate"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if got := versions(); len(got) != 1 || got[0] != "1.0.0" {
+		t.Errorf("bundle holds %v, want only 1.0.0", got)
+	}
+
+	if err := os.Remove(MirrorCratePath(f.mirror, "serde", "1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := f.run("-aggregate"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if _, err := os.Stat(bundle); !os.IsNotExist(err) {
+		t.Errorf("bundle of a crate with no versions left was kept: %v", err)
+	}
+}
+
+func TestLatestPointersRemoved(t *testing.T) {
+	f := newFixture(t)
+	stable := f.crate("serde", "1.0.0", "serde 1.0.0")
+	beta := f.crate("serde", "1.1.0-beta.1", "serde 1.1.0-beta.1")
+	f.indexFile("serde", entry("serde", "1.0.0", stable), entry("serde", "1.1.0-beta.1", beta))
+	out := filepath.Join(f.dir, "out")
+	pointers := []string{
+		filepath.Join(f.mirror, "se", "rd", "serde"+LatestSuffix+".crate"),
+		filepath.Join(out, "se", "rd", "serde"+LatestSuffix+MetadataFileSuffix),
+	}
+
+	if code, _ := f.run("-latest-links", "-output-dir", out); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	for _, pointer := range pointers {
+		if _, err := os.Lstat(pointer); err != nil {
+			t.Errorf("latest pointer missing: %v", err)
+		}
+	}
+
+	// Yanking the only stable version leaves no version to point at
+	f.indexFile("serde", entry("serde", "1.0.0", stable, `"yanked":true`), entry("serde", "1.1.0-beta.1", beta))
+	if code, _ := f.run("-latest-links", "-output-dir", out); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	for _, pointer := range pointers {
+		if _, err := os.Lstat(pointer); !os.IsNotExist(err) {
+			t.Errorf("stale latest pointer %s was kept: %v", pointer, err)
+		}
+	}
+}
+
+// setenv sets an environment variable for the rest of the test
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// mockS3 is an in-memory S3 bucket that checks each request's Signature
+// Version 4 against the credentials it was given
+type mockS3 struct {
+	t         *testing.T
+	mu        sync.Mutex
+	objects   map[string][]byte
+	puts      []string
+	heads     int
+	secretKey string
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := m.verify(r); err != nil {
+		m.t.Errorf("%s %s: %v", r.Method, r.URL.EscapedPath(), err)
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	key, err := url.PathUnescape(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		m.objects[key] = data
+		m.puts = append(m.puts, key)
+	case http.MethodHead:
+		m.heads++
+		data, ok := m.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sum := md5.Sum(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verify recomputes a request's signature from what was received
+func (m *mockS3) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	var credential, signedHeaders, signature string
+	if _, err := fmt.Sscanf(strings.Replace(auth, ",", "", -1), "AWS4-HMAC-SHA256 Credential=%s SignedHeaders=%s Signature=%s", &credential, &signedHeaders, &signature); err != nil {
+		return fmt.Errorf("malformed Authorization %q: %v", auth, err)
+	}
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 || scope[0] != "AKIDTEST" || !strings.HasSuffix(scope[1], "/eu-west-1/s3/aws4_request") {
+		return fmt.Errorf("unexpected credential %q", credential)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	payload := sha256Hex(string(body))
+	if r.Header.Get("X-Amz-Content-Sha256") != payload {
+		return fmt.Errorf("payload hash %q does not match the body", r.Header.Get("X-Amz-Content-Sha256"))
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, headers.String(), signedHeaders, payload}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope[1] + "\n" + sha256Hex(canonical)
+	key := []byte("AWS4" + m.secretKey)
+	for _, part := range strings.Split(scope[1], "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want {
+		return fmt.Errorf("signature %s, want %s", signature, want)
+	}
+	return nil
+}
+
+// putKeys returns the keys put since the last call, sorted
+func (m *mockS3) putKeys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.puts
+	m.puts = nil
+	sort.Strings(keys)
+	return keys
+}
+
+func TestS3Destination(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")), entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	bucket := &mockS3{t: t, objects: make(map[string][]byte), secretKey: "secret/test+key"}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	setenv(t, "AWS_ACCESS_KEY_ID", "AKIDTEST")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", bucket.secretKey)
+	setenv(t, "AWS_REGION", "eu-west-1")
+	args := []string{"-s3-bucket", "crates", "-s3-prefix", "meta", "-s3-endpoint", server.URL}
+
+	if code, _ := f.run(args...); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	want := []string{
+		"/crates/meta/3/l/log-0.4.0.metadata.json",
+		"/crates/meta/se/rd/serde-1.0.0.metadata.json",
+		"/crates/meta/se/rd/serde-1.0.1.metadata.json",
+	}
+	if got := bucket.putKeys(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("put %v, want %v", got, want)
+	}
+	var metadata MetadataEntry
+	if err := json.Unmarshal(bucket.objects[want[1]], &metadata); err != nil || metadata.Name() != "serde" || metadata.Version() != "1.0.0" {
+		t.Errorf("object %s = %s (%v)", want[1], bucket.objects[want[1]], err)
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("metadata was written to the mirror as well: %v", err)
+	}
+
+	// Objects whose ETag matches are left alone, and only the changed one
+	// is put again
+	bucket.objects[want[2]] = []byte("{}")
+	if code, _ := f.run(append(args, "-skip-unchanged")...); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if got := bucket.putKeys(); len(got) != 1 || got[0] != want[2] {
+		t.Errorf("put %v with -skip-unchanged, want only %s", got, want[2])
+	}
+	if bucket.heads != len(want) {
+		t.Errorf("%d HEAD requests, want %d", bucket.heads, len(want))
+	}
+}
+
+// flakyStore is an object store whose first put of each key fails
+type flakyStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	failed  map[string]bool
+}
+
+func (s *flakyStore) Key(outputPath string) string {
+	return strings.TrimPrefix(filepath.ToSlash(outputPath), "/")
+}
+
+func (s *flakyStore) Put(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failed[key] {
+		s.failed[key] = true
+		return fmt.Errorf("put %s: connection reset", key)
+	}
+	s.objects[key] = data
+	return nil
+}
+
+func (s *flakyStore) Unchanged(key string, data []byte) (bool, error) {
+	return false, nil
+}
+
+func (s *flakyStore) String() string {
+	return "flaky://bucket"
+}
+
+func TestAccountingCoversEveryOutcome(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "0.9.0", f.crate("serde", "0.9.0", "serde 0.9.0")),
+		entry("serde", "1.1.0-rc.1", f.crate("serde", "1.1.0-rc.1", "serde 1.1.0-rc.1")),
+		entry("serde", "1.0.1", sha256Hex("not what the mirror has")),
+		entry("serde", "1.0.2", sha256Hex("serde 1.0.2")),
+		entry("serde", "1.0.3", f.crate("serde", "1.0.3", "serde 1.0.3")),
+		`{"name":"serde","deps":[]}`,
+		`{"name":"serde",}`)
+	f.crate("serde", "1.0.1", "serde 1.0.1")
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+
+	logger, err := NewLogger(filepath.Join(f.dir, "organize.log"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	store := &flakyStore{objects: make(map[string][]byte), failed: make(map[string]bool)}
+	dest, err := NewObjectDestination(store, LayoutBeside, f.mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minVersions, err := ParseMinVersions("serde=1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{
+		IndexDir:       f.index,
+		MirrorDir:      f.mirror,
+		NumWorkers:     2,
+		FileMode:       0644,
+		DirMode:        0755,
+		Destinations:   []*Destination{dest},
+		VerifyChecksum: true,
+		Prereleases:    PrereleasesSkip,
+		MinVersions:    minVersions,
+		RetryPasses:    1,
+		RetryDelay:     time.Millisecond,
+		EntryFilter: func(entry MetadataEntry) bool {
+			return entry.Version() != "1.0.3"
+		},
+	}
+	report, err := OrganizeMetadataContext(context.Background(), opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := report.CheckAccounting(); err != nil {
+		t.Errorf("CheckAccounting: %v\n%s", err, f.log())
+	}
+	want := map[string]int{
+		OutcomeOrganized:         2,
+		OutcomeFailed:            1,
+		OutcomeMissing:           1,
+		OutcomeFiltered:          1,
+		OutcomePrereleaseSkipped: 1,
+		OutcomeBelowMin:          1,
+		OutcomeNoVersion:         1,
+		OutcomeParseError:        1,
+	}
+	for category, count := range report.Categories {
+		if count != want[category] {
+			t.Errorf("%s = %d, want %d", category, count, want[category])
+		}
+	}
+	for category, count := range want {
+		if _, ok := report.Categories[category]; !ok {
+			t.Errorf("%s missing, want %d", category, count)
+		}
+	}
+	if report.Entries != 9 || report.Rescued != 2 || report.ChecksumFailed != 1 {
+		t.Errorf("entries %d, rescued %d, checksum failures %d; want 9, 2 and 1", report.Entries, report.Rescued, report.ChecksumFailed)
+	}
+}
+
+// tallyFixture is a synthetic index of many small crates whose versions end
+// in every common outcome
+func tallyFixture(t testing.TB, crates int) *fixture {
+	f := newFixture(t)
+	for i := 0; i < crates; i++ {
+		name := fmt.Sprintf("crate%04d", i)
+		f.crate(name, "0.3.0", "corrupt")
+		f.indexFile(name,
+			entry(name, "0.1.0", f.crate(name, "0.1.0", name)),
+			entry(name, "0.2.0", sha256Hex("missing")),
+			entry(name, "0.3.0", sha256Hex(name+"0.3.0")),
+			entry(name, "1.0.0-rc.1", f.crate(name, "1.0.0-rc.1", name+"rc"), `"yanked":true`))
+	}
+	return f
+}
+
+// tallyArgs are the arguments of a run over a tallyFixture; -report-out
+// makes the workers send each file's result to the collector instead of
+// tallying it themselves
+func tallyArgs(f *fixture, perFile bool) []string {
+	args := []string{"-dry-run", "-verify-checksum", "-threads", "32"}
+	if perFile {
+		args = append(args, "-report-out", filepath.Join(f.dir, "report.ndjson"))
+	}
+	return args
+}
+
+func TestTalliedCountsMatchPerFile(t *testing.T) {
+	f := tallyFixture(t, 500)
+	summaries := make([]string, 2)
+	for i, perFile := range []bool{false, true} {
+		code, report := f.run(tallyArgs(f, perFile)...)
+		if code != 0 || report == nil {
+			t.Fatalf("exit code %d\n%s", code, f.log())
+		}
+		if err := report.CheckAccounting(); err != nil {
+			t.Errorf("CheckAccounting: %v", err)
+		}
+		// Timings and the run ID differ from run to run
+		report.Duration, report.Tail, report.ETAChecks, report.RunID = 0, 0, nil, ""
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaries[i] = string(data)
+	}
+	if summaries[0] != summaries[1] {
+		t.Errorf("tallied summary\n%s\ndiffers from per-file summary\n%s", summaries[0], summaries[1])
+	}
+	var report Report
+	json.Unmarshal([]byte(summaries[0]), &report)
+	if report.Files != 500 || report.Success != 1000 || report.Missing != 500 || report.ChecksumFailed != 500 || report.PrereleasesOrganized != 500 {
+		t.Errorf("unexpected counts:\n%s", summaries[0])
+	}
+}
+
+func BenchmarkTally(b *testing.B) {
+	f := tallyFixture(b, 5000)
+	for _, perFile := range []bool{false, true} {
+		name := "tallied"
+		if perFile {
+			name = "per-file"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if code, report := f.run(tallyArgs(f, perFile)...); code != 0 || report == nil {
+					b.Fatalf("exit code %d\n%s", code, f.log())
+				}
+			}
+		})
+	}
+}
+
+func TestMaxFilesPerDir(t *testing.T) {
+	f := newFixture(t)
+	var lines []string
+	add := func(versions ...string) {
+		for _, version := range versions {
+			lines = append(lines, entry("serde", version, f.crate("serde", version, "serde "+version)))
+		}
+		f.indexFile("serde", lines...)
+	}
+	dir := filepath.Join(f.mirror, "se", "rd")
+	placed := func() map[string]string {
+		parts := make(map[string]string)
+		if data, err := ioutil.ReadFile(filepath.Join(f.mirror, PartsFileName)); err == nil {
+			if err := json.Unmarshal(data, &parts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return parts
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path)))
+		return err == nil
+	}
+
+	// Files already in a directory with room are not counted twice
+	add("1.0.0", "1.0.1")
+	if code, _ := f.run("-max-files-per-dir", "3"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	add("1.0.2")
+	if code, _ := f.run("-max-files-per-dir", "3"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if !exists("serde-1.0.2.metadata.json") || len(placed()) != 0 {
+		t.Fatalf("third file was not kept in its usual directory; placements %v", placed())
+	}
+
+	// A file whose write fails is not recorded in a part directory
+	add("1.0.3")
+	f.write(filepath.Join(dir, PartDirPrefix+"001"), "blocks the part directory")
+	f.run("-max-files-per-dir", "3")
+	if parts := placed(); len(parts) != 0 {
+		t.Errorf("failed write was recorded as placed: %v", parts)
+	}
+	if err := os.Remove(filepath.Join(dir, PartDirPrefix+"001")); err != nil {
+		t.Fatal(err)
+	}
+
+	add("1.0.4", "1.0.5", "1.0.6")
+	if code, _ := f.run("-max-files-per-dir", "3"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	for _, path := range []string{
+		"serde-1.0.0.metadata.json", "serde-1.0.1.metadata.json", "serde-1.0.2.metadata.json",
+		"part-001/serde-1.0.3.metadata.json", "part-001/serde-1.0.4.metadata.json", "part-001/serde-1.0.5.metadata.json",
+		"part-002/serde-1.0.6.metadata.json",
+	} {
+		if !exists(path) {
+			t.Errorf("%s is missing", path)
+		}
+	}
+	if parts := placed(); len(parts) != 4 || parts["se/rd/serde-1.0.6.metadata.json"] != "part-002" {
+		t.Errorf("placements %v, want 1.0.3 to 1.0.6", parts)
+	}
+
+	// A rerun keeps every file where it is
+	before := files(t, f.mirror)
+	if code, _ := f.run("-max-files-per-dir", "3"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	after := files(t, f.mirror)
+	for path := range after {
+		if _, ok := before[path]; !ok && !strings.HasPrefix(path, ".organize") {
+			t.Errorf("rerun added %s", path)
+		}
+	}
+}
+
+func TestFalseBoolFlagsNotGiven(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+
+	// -diff needs -dry-run, unless it is turned off itself
+	if code, _ := f.run("-diff=false"); code != 0 {
+		t.Errorf("-diff=false: exit code %d, want 0", code)
+	}
+	if code, _ := f.run("-diff", "-dry-run=false"); code != 2 {
+		t.Errorf("-diff -dry-run=false: exit code %d, want 2", code)
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.0")); err != nil {
+		t.Errorf("-diff=false run did not organize: %v", err)
+	}
+}
+
+var updateHeader = flag.Bool("update-header", false, "Rewrite the option list in the header of organize_metadata.go")
+
+// headerOptions lists the flags of a run, one line each, as the header of
+// organize_metadata.go does
+func headerOptions() string {
+	var b strings.Builder
+	newRunFlags().VisitAll(func(f *flag.Flag) {
+		kind, usage := flag.UnquoteUsage(f)
+		name := "-" + f.Name
+		if kind != "" {
+			name += " " + kind
+		}
+		fmt.Fprintf(&b, "//   %s  %s", name, usage)
+		switch {
+		case f.Name == "threads" || f.Name == "verify-workers":
+			// Depends on the machine, so the header says what it is
+			b.WriteString(" (default: the number of CPUs)")
+		case f.DefValue == "" || f.DefValue == "0" || f.DefValue == "false" || f.DefValue == "0s":
+		case kind == "string":
+			fmt.Fprintf(&b, " (default %q)", f.DefValue)
+		default:
+			fmt.Fprintf(&b, " (default %s)", f.DefValue)
+		}
+		b.WriteString("\n")
+	})
+	return b.String()
+}
+
+func TestHeaderOptions(t *testing.T) {
+	const path = "organize_metadata.go"
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := string(data)
+	start := strings.Index(source, "// Options:\n")
+	if start < 0 {
+		t.Fatalf("%s has no option list", path)
+	}
+	start += len("// Options:\n")
+	end := start + strings.Index(source[start:], "// ====")
+
+	want := headerOptions()
+	if source[start:end] == want {
+		return
+	}
+	if *updateHeader {
+		if err := ioutil.WriteFile(path, []byte(source[:start]+want+source[end:]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Errorf("the option list in the header of %s is out of date; run go generate to update it", path)
+}
+
+func TestLockfileMarksChecksumFailures(t *testing.T) {
+	f := newFixture(t)
+	f.crate("serde", "1.0.0", "serde 1.0.0")
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("something else")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")), entry("log", "0.4.1", ""))
+	lock := filepath.Join(f.dir, "Cargo.lock")
+	f.write(lock, `version = 3
+
+[[package]]
+name = "log"
+version = "0.4.0"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+
+[[package]]
+name = "log"
+version = "0.4.1"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+
+[[package]]
+name = "serde"
+version = "1.0.0"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+`)
+
+	if code, _ := f.run("-organize-from-lockfile", lock, "-verify-checksum"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	log := f.log()
+	for _, want := range []string{
+		"1 of 3 pinned versions organized",
+		"Lockfile version serde-1.0.0 is in the index but failed to organize",
+		"Lockfile version log-0.4.1 has no crate file in the mirror",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "serde-1.0.0 is in the index but was skipped") {
+		t.Errorf("checksum failure logged as skipped")
+	}
+}
+
+func TestOutputPathCollisions(t *testing.T) {
+	// A renamed crate whose old index file falls back to the new name's
+	// crate file claims the same output path as the new index file
+	f := newFixture(t)
+	sum := f.crate("new-name", "1.0.0", "new-name 1.0.0")
+	f.indexFile("old-name", entry("old-name", "1.0.0", sum))
+	f.indexFile("new-name", entry("new-name", "1.0.0", sum), entry("new-name", "1.0.1", f.crate("new-name", "1.0.1", "new-name 1.0.1")))
+	renames := filepath.Join(f.dir, "renames.json")
+	f.write(renames, `{"old-name": "new-name"}`)
+	out := filepath.Join(f.dir, "out")
+
+	code, report := f.run("-rename-map", renames, "-layout", "flat", "-output-dir", out, "-check-collisions")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.Collisions != 1 || !strings.Contains(f.log(), "Output path collision: "+filepath.Join(out, "new-name-1.0.0.metadata.json")) {
+		t.Errorf("collisions = %d, want 1\n%s", report.Collisions, f.log())
+	}
+
+	code, report = f.run("-rename-map", renames, "-layout", "flat", "-output-dir", out, "-fail-on-collision")
+	if code != 1 || report == nil {
+		t.Fatalf("exit code %d with -fail-on-collision, want 1\n%s", code, f.log())
+	}
+	if report.Collisions != 1 || report.Success != 2 || report.Errors != 1 {
+		t.Errorf("collisions %d, organized %d, errors %d; want 1, 2 and 1", report.Collisions, report.Success, report.Errors)
+	}
+
+	// Without the check, the second write silently wins
+	if code, report := f.run("-rename-map", renames, "-layout", "flat", "-output-dir", out); code != 0 || report.Collisions != 0 {
+		t.Errorf("exit code %d and %d collisions without the check", code, report.Collisions)
+	}
+}
+
+func TestCrateIDMode(t *testing.T) {
+	// Index files named by numeric crate IDs, with the names in the entries
+	f := newFixture(t)
+	f.indexFile("1001",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")))
+	f.indexFile("1002",
+		entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")),
+		entry("not a name", "0.4.1", ""))
+
+	code, report := f.run("-crate-id-mode")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.Files != 2 || report.Success != 3 || report.Errors != 1 || report.InvalidNames != 0 {
+		t.Errorf("files %d, organized %d, errors %d, invalid names %d; want 2, 3, 1 and 0", report.Files, report.Success, report.Errors, report.InvalidNames)
+	}
+	for _, version := range [][2]string{{"serde", "1.0.0"}, {"serde", "1.0.1"}, {"log", "0.4.0"}} {
+		var metadata MetadataEntry
+		if err := json.Unmarshal([]byte(f.read(f.metadataPath(version[0], version[1]))), &metadata); err != nil || metadata.Name() != version[0] {
+			t.Errorf("metadata of %s-%s: %v %v", version[0], version[1], metadata, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(f.mirror, "*", "*", "1001*")); len(matches) > 0 {
+		t.Errorf("output named after the index file: %v", matches)
+	}
+
+	// Without the mode, the ID is taken for the crate name and nothing matches
+	code, report = f.run()
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d without -crate-id-mode\n%s", code, f.log())
+	}
+	if report.Success != 0 || report.InvalidNames != 2 {
+		t.Errorf("without -crate-id-mode: organized %d, invalid names %d; want 0 and 2", report.Success, report.InvalidNames)
+	}
+}
+
+func TestVerifyOnly(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")),
+		entry("serde", "1.0.2", ""))
+	f.crate("serde", "1.0.2", "serde 1.0.2")
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")), entry("log", "0.4.1", sha256Hex("log 0.4.1")))
+
+	if code, _ := f.run("-verify-only", "-verify-workers", "3", "-threads", "1"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	log := f.log()
+	for _, want := range []string{
+		"Verifying crate file checksums with 3 workers",
+		"3 of 3 crate files match their checksum, 0 mismatched, 1 without a checksum",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q\n%s", want, log)
+		}
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("-verify-only organized: %v", err)
+	}
+
+	f.write(MirrorCratePath(f.mirror, "log", "0.4.0"), "corrupted")
+	if code, _ := f.run("-verify-only", "-verify-workers", "1"); code != 1 {
+		t.Errorf("exit code %d with a corrupt crate file, want 1", code)
+	}
+	if !strings.Contains(f.log(), "Checksum mismatch for log-0.4.0") {
+		t.Errorf("mismatch not logged\n%s", f.log())
+	}
+	if code, _ := f.run("-verify-only", "-verify-workers", "0"); code != 1 {
+		t.Errorf("exit code %d with no verify workers, want 1", code)
+	}
+}
+
+func TestCombinedIndexAndMirror(t *testing.T) {
+	// A combined dump: index files, crate files and outputs in one tree
+	f := newFixture(t)
+	f.mirror = f.index
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")), entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	args := []string{"-aggregate", "-report-out", filepath.Join(f.index, "report.ndjson"), "-manifest-out", filepath.Join(f.index, "manifest.json")}
+
+	for run := 1; run <= 2; run++ {
+		code, report := f.run(args...)
+		if code != 0 || report == nil {
+			t.Fatalf("run %d: exit code %d\n%s", run, code, f.log())
+		}
+		if report.Files != 2 || report.Success != 3 || report.Errors != 0 || report.InvalidNames != 0 {
+			t.Errorf("run %d: files %d, organized %d, errors %d, invalid names %d; want 2, 3, 0 and 0",
+				run, report.Files, report.Success, report.Errors, report.InvalidNames)
+		}
+		if !strings.Contains(f.log(), "overlap; metadata files, crate files, and reports inside the index tree will be ignored") {
+			t.Errorf("run %d: overlapping roots not warned about", run)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(f.index, "se", "rd", "serde"+BundleSuffix)); err != nil {
+		t.Errorf("bundle missing: %v", err)
+	}
+}
+
+func TestStrictJSONDuplicateKeys(t *testing.T) {
+	f := newFixture(t)
+	f.crate("serde", "1.0.0", "serde 1.0.0")
+	f.crate("serde", "2.0.0", "serde 2.0.0")
+	f.indexFile("serde",
+		`{"name":"serde","vers":"1.0.0","vers":"2.0.0","deps":[],"features":{},"yanked":false}`,
+		`{"name":"serde","vers":"1.0.1","deps":[{"name":"a","name":"b"}],"features":{},"yanked":false}`)
+	f.crate("serde", "1.0.1", "serde 1.0.1")
+
+	// The standard parser keeps the last value
+	if code, report := f.run(); code != 0 || report == nil || report.Success != 2 || report.DuplicateKeys != 0 {
+		t.Fatalf("exit code %d without -strict-json\n%s", code, f.log())
+	}
+
+	if err := os.Remove(f.metadataPath("serde", "2.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	code, report := f.run("-strict-json")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.DuplicateKeys != 2 || report.Errors != 2 || report.Success != 0 {
+		t.Errorf("duplicate keys %d, errors %d, organized %d; want 2, 2 and 0", report.DuplicateKeys, report.Errors, report.Success)
+	}
+	log := f.log()
+	for _, want := range []string{"Rejected entry serde-2.0.0", "duplicate keys vers", "Rejected entry serde-1.0.1", "duplicate keys deps.0.name"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q\n%s", want, log)
+		}
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "2.0.0")); !os.IsNotExist(err) {
+		t.Errorf("rejected entry was written: %v", err)
+	}
+}
+
+func TestReservedFileNames(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("con", entry("con", "0.1.0", f.crate("con", "0.1.0", "con 0.1.0")))
+	dir := filepath.Join(f.mirror, "3", "c")
+
+	if runtime.GOOS != "windows" {
+		// Names are left alone elsewhere, unless the Windows rules are forced
+		if code, _ := f.run("-aggregate"); code != 0 {
+			t.Fatalf("exit code %d\n%s", code, f.log())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "con"+BundleSuffix)); err != nil {
+			t.Errorf("bundle renamed off Windows: %v", err)
+		}
+		if err := os.RemoveAll(f.mirror); err != nil {
+			t.Fatal(err)
+		}
+		f.crate("con", "0.1.0", "con 0.1.0")
+		sanitizeFileNames = true
+		defer func() { sanitizeFileNames = false }()
+	}
+
+	if code, _ := f.run("-aggregate"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	bundle := filepath.Join(dir, "con_"+BundleSuffix)
+	var entries []MetadataEntry
+	if err := json.Unmarshal([]byte(f.read(bundle)), &entries); err != nil || len(entries) != 1 {
+		t.Errorf("bundle %s: %v %v", bundle, entries, err)
+	}
+	if _, err := os.Stat(f.metadataPath("con", "0.1.0")); err != nil {
+		t.Errorf("metadata file: %v", err)
+	}
+	var renamed map[string]string
+	if err := json.Unmarshal([]byte(f.read(filepath.Join(f.mirror, RenamedNamesFile))), &renamed); err != nil {
+		t.Fatal(err)
+	}
+	if renamed["3/c/con_"+BundleSuffix] != "con"+BundleSuffix {
+		t.Errorf("renamed names %v lack the bundle", renamed)
+	}
+	if !strings.Contains(f.log(), "con"+BundleSuffix) {
+		t.Errorf("rename not logged\n%s", f.log())
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"serde-1.0.0.metadata.json", "serde-1.0.0.metadata.json"},
+		{"con.versions.json", "con_.versions.json"},
+		{"NUL.versions.json", "NUL_.versions.json"},
+		{"com1", "com1_"},
+		{"con-0.1.0.metadata.json", "con-0.1.0.metadata.json"},
+		{"console.versions.json", "console.versions.json"},
+		{"a:b|c?.json", "a_b_c_.json"},
+		{"trailing.", "trailing_"},
+		{"tab\there", "tab_here"},
+	}
+	for _, test := range tests {
+		if got := SanitizeFileName(test.name); got != test.want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// envLines parses key=value lines
+func envLines(t *testing.T, content string) []map[string]string {
+	t.Helper()
+	var runs []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			t.Fatalf("line %q is not key=value", line)
+		}
+		if strings.HasPrefix(line, "processed=") {
+			runs = append(runs, make(map[string]string))
+		}
+		runs[len(runs)-1][line[:eq]] = line[eq+1:]
+	}
+	return runs
+}
+
+func TestEnvOut(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")), entry("serde", "1.0.1", ""))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	envOut := filepath.Join(f.dir, "env")
+
+	if code, _ := f.run("-env-out", envOut, "-run-id", "ci-1"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	runs := envLines(t, f.read(envOut))
+	want := map[string]string{"processed": "3", "linked": "2", "missing": "1", "errors": "0", "run_id": "ci-1"}
+	if len(runs) != 1 {
+		t.Fatalf("%d runs in %s, want 1", len(runs), envOut)
+	}
+	for key, value := range want {
+		if runs[0][key] != value {
+			t.Errorf("%s=%s, want %s", key, runs[0][key], value)
+		}
+	}
+	if _, err := strconv.ParseFloat(runs[0]["duration_seconds"], 64); err != nil {
+		t.Errorf("duration_seconds: %v", err)
+	}
+
+	// -github-output appends to the file $GITHUB_OUTPUT names
+	setenv(t, "GITHUB_OUTPUT", envOut)
+	if code, _ := f.run("-github-output", "-run-id", "ci-2"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	runs = envLines(t, f.read(envOut))
+	if len(runs) != 2 || runs[1]["run_id"] != "ci-2" || runs[1]["linked"] != "2" {
+		t.Errorf("after -github-output: %v", runs)
+	}
+}
+
+func TestParseCache(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	cache := filepath.Join(f.dir, "cache")
+	counts := func(wantHits, wantMisses, wantRebuilt int) {
+		t.Helper()
+		code, report := f.run("-parse-cache", cache)
+		if code != 0 || report == nil {
+			t.Fatalf("exit code %d\n%s", code, f.log())
+		}
+		if report.ParseCacheHits != wantHits || report.ParseCacheMisses != wantMisses || report.ParseCacheRebuilt != wantRebuilt || report.Success != 2 {
+			t.Errorf("hits %d, misses %d, rebuilt %d, organized %d; want %d, %d, %d and 2",
+				report.ParseCacheHits, report.ParseCacheMisses, report.ParseCacheRebuilt, report.Success, wantHits, wantMisses, wantRebuilt)
+		}
+	}
+
+	counts(0, 2, 0)
+	counts(2, 0, 0)
+
+	// A changed file is parsed again, and only it
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde 1.0.0"), `"yanked":true`))
+	counts(1, 1, 0)
+
+	// A truncated cache file is rebuilt instead of failing the run
+	// The cache entry of the old content was compacted away
+	cached := files(t, cache)
+	if len(cached) != 2 {
+		t.Fatalf("cache holds %d files, want 2", len(cached))
+	}
+	for path, content := range cached {
+		f.write(filepath.Join(cache, filepath.FromSlash(path)), content[:len(content)/2])
+	}
+	counts(0, 2, 2)
+	counts(2, 0, 0)
+}
+
+func TestParseCacheCorruptionRebuilds(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	cache := filepath.Join(f.dir, "cache")
+	if code, _ := f.run("-parse-cache", cache); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	cached := files(t, cache)
+	if len(cached) != 1 {
+		t.Fatalf("cache holds %d files, want 1", len(cached))
+	}
+	var path, good string
+	for rel, content := range cached {
+		path, good = filepath.Join(cache, filepath.FromSlash(rel)), content
+	}
+
+	flip := []byte(good)
+	flip[len(flip)-1] ^= 0xff
+	outdated := []byte(good)
+	outdated[4] = ParseCacheVersion - 1
+	tests := []struct{ name, content, reason string }{
+		{"empty", "", "truncated"},
+		{"garbage", "not a cache file at all", "not a parse cache file"},
+		{"flipped byte", string(flip), "checksum mismatch"},
+		{"outdated version", string(outdated), "format version"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f.write(path, test.content)
+			code, report := f.run("-parse-cache", cache)
+			if code != 0 || report == nil {
+				t.Fatalf("exit code %d\n%s", code, f.log())
+			}
+			if report.ParseCacheRebuilt != 1 || report.ParseCacheHits != 0 || report.Success != 1 {
+				t.Errorf("rebuilt %d, hits %d, organized %d; want 1, 0 and 1", report.ParseCacheRebuilt, report.ParseCacheHits, report.Success)
+			}
+			if log := f.log(); !strings.Contains(log, "WARNING") || !strings.Contains(log, test.reason) {
+				t.Errorf("log does not warn about %q:\n%s", test.reason, log)
+			}
+			// The rebuilt file is valid again
+			if _, report := f.run("-parse-cache", cache); report == nil || report.ParseCacheHits != 1 {
+				t.Errorf("rebuilt cache file was not hit by the next run\n%s", f.log())
+			}
+		})
+	}
+}
+
+func TestStripFields(t *testing.T) {
+	f := newFixture(t)
+	sum := f.crate("serde", "1.0.0", "serde 1.0.0")
+	f.indexFile("serde", entry("serde", "1.0.0", sum,
+		`"audit":"internal ticket 42"`,
+		`"internal":{"owner":"team-a","tier":1}`,
+		`"deps2":[{"name":"a","registry":"https://internal.example"},{"name":"b","registry":"https://internal.example"}]`))
+
+	if code, _ := f.run("-strip-fields", "audit,internal.owner,deps2.registry", "-record-raw-line", "hash"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	var metadata MetadataEntry
+	if err := json.Unmarshal([]byte(f.read(f.metadataPath("serde", "1.0.0"))), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metadata["audit"]; ok {
+		t.Errorf("audit was kept")
+	}
+	internal, _ := metadata["internal"].(map[string]interface{})
+	if _, ok := internal["owner"]; ok || internal["tier"] != float64(1) {
+		t.Errorf("internal = %v, want only tier", metadata["internal"])
+	}
+	deps, _ := metadata["deps2"].([]interface{})
+	for _, dep := range deps {
+		if _, ok := dep.(map[string]interface{})["registry"]; ok {
+			t.Errorf("dependency registry was kept: %v", dep)
+		}
+	}
+	if len(deps) != 2 || metadata.Name() != "serde" || metadata.Version() != "1.0.0" || metadata["cksum"] != sum {
+		t.Errorf("fields that were not stripped changed: %v", metadata)
+	}
+	local, _ := metadata["_local"].(map[string]interface{})
+	if stripped := fmt.Sprint(local["stripped_fields"]); stripped != "[audit internal.owner deps2.registry]" {
+		t.Errorf("stripped_fields = %s", stripped)
+	}
+
+	// The stripped document still matches its index line
+	if code, _ := f.run("-verify-raw-lines"); code != 0 || !strings.Contains(f.log(), "1 of 1 documents traced") {
+		t.Errorf("-verify-raw-lines: exit code %d\n%s", code, f.log())
+	}
+	if code, _ := f.run("-strip-fields", "vers"); code == 0 {
+		t.Errorf("stripping vers was accepted")
+	}
+}
+
+func TestHTMLReport(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0"), `"categories":["encoding","<script>alert(1)</script>"]`),
+		entry("serde", "1.0.1", ""), entry("serde", "1.0.2", ""))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0"), `"categories":["encoding"]`), entry("log", "0.4.1", ""))
+	report := filepath.Join(f.dir, "report-{run}.html")
+
+	if code, _ := f.run("-html-report", report, "-run-id", "html-1", "-categories"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	page := f.read(filepath.Join(f.dir, "report-html-1.html"))
+
+	// The page must be well-formed, with every element closed
+	decoder := xml.NewDecoder(strings.NewReader(page))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	var open []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("malformed HTML: %v\n%s", err, page)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			open = append(open, token.Name.Local)
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != token.Name.Local {
+				t.Fatalf("unexpected </%s> with %v open", token.Name.Local, open)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) != 0 {
+		t.Errorf("unclosed elements %v", open)
+	}
+
+	for _, want := range []string{
+		"Run html-1",
+		`<tr><th>Index files</th><td class="n">2</td></tr>`,
+		`<tr><th>Versions</th><td class="n">5</td></tr>`,
+		`<tr><th>Organized</th><td class="n">2</td></tr>`,
+		`<tr><th>Missing crate files</th><td class="n">3</td></tr>`,
+		`<tr><th>Coverage</th><td class="n">40.0%</td></tr>`,
+		`<tr><td>serde</td><td class="n">2</td></tr>`,
+		`<tr><td>log</td><td class="n">1</td></tr>`,
+		`<tr><td>encoding</td><td class="n">2</td></tr>`,
+		`&lt;script&gt;alert(1)&lt;/script&gt;`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s", want)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Errorf("category name was not escaped")
+	}
+	if strings.Index(page, "<td>serde</td>") > strings.Index(page, "<td>log</td>") {
+		t.Errorf("crates not ordered by missing versions")
+	}
+}
+
+func TestCheckpointResumeCountsWholeJob(t *testing.T) {
+	f := newFixture(t)
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("crate%d", i)
+		f.indexFile(name, entry(name, "1.0.0", f.crate(name, "1.0.0", name)), entry(name, "1.0.1", ""))
+	}
+	checkpoint := filepath.Join(f.dir, "checkpoint.json")
+	args := []string{"-checkpoint", checkpoint, "-threads", "1", "-run-id", "segment"}
+
+	// Slow index reads make the first segment time out part way
+	setenv(t, FaultsEnvVar, "read-delay=100ms")
+	code, first := f.run(append(args, "-timeout", "250ms")...)
+	os.Unsetenv(FaultsEnvVar)
+	if first == nil {
+		t.Fatalf("first segment: exit code %d\n%s", code, f.log())
+	}
+	if !first.Partial || first.Files == 0 || first.Files >= 8 {
+		t.Fatalf("first segment: partial %v after %d files, want a partial run", first.Partial, first.Files)
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatalf("no checkpoint after a timed out run: %v", err)
+	}
+
+	code, report := f.run(args...)
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.Partial || report.Segments != 2 {
+		t.Errorf("partial %v, segments %d; want a complete job in 2 segments", report.Partial, report.Segments)
+	}
+	if report.Files != 8 || report.Versions != 16 || report.Success != 8 || report.Missing != 8 {
+		t.Errorf("files %d, versions %d, organized %d, missing %d; want 8, 16, 8 and 8", report.Files, report.Versions, report.Success, report.Missing)
+	}
+	if report.Duration < 200*time.Millisecond {
+		t.Errorf("duration %v does not include the first segment", report.Duration)
+	}
+	if !strings.Contains(f.log(), "Resuming from checkpoint: "+strconv.Itoa(first.Files)+" of 8 index files already processed (segment 2") {
+		t.Errorf("resume not logged\n%s", f.log())
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint kept after the job completed: %v", err)
+	}
+}
+
+func TestArchiveReproducible(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	first := filepath.Join(f.dir, "first.tar.gz")
+	if code, _ := f.run("-archive-out", first, "-threads", "1"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+
+	// Neither file times nor the run's parallelism reach the archive
+	later := time.Now().Add(time.Hour)
+	for rel := range files(t, f.mirror) {
+		if err := os.Chtimes(filepath.Join(f.mirror, filepath.FromSlash(rel)), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := filepath.Join(f.dir, "second.tar.gz")
+	if code, _ := f.run("-archive-out", second, "-threads", "8"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if f.read(first) != f.read(second) {
+		t.Fatalf("archives of the same metadata differ")
+	}
+
+	// Nor does the formatting of the metadata files
+	path := f.metadataPath("serde", "1.0.0")
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(f.read(path)), &doc); err != nil {
+		t.Fatal(err)
+	}
+	indented, _ := json.MarshalIndent(doc, "", "\t")
+	f.write(path, string(indented)+"\n")
+	third := filepath.Join(f.dir, "third.tar.gz")
+	count, sum, err := WriteArchive(third, f.mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.read(third) != f.read(first) {
+		t.Errorf("reformatting a metadata file changed the archive")
+	}
+	if count != 3 || sum != sha256Hex(f.read(first)) {
+		t.Errorf("WriteArchive = %d files, sha256 %s; want 3 and %s", count, sum, sha256Hex(f.read(first)))
+	}
+
+	// The headers carry nothing of the machine or the time
+	gz, err := gzip.NewReader(strings.NewReader(f.read(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gz.Name != "" || !gz.ModTime.IsZero() || gz.OS != 255 {
+		t.Errorf("gzip header name %q, mtime %v, OS %d", gz.Name, gz.ModTime, gz.OS)
+	}
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Mode != 0644 || header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" || header.ModTime.Unix() != 0 {
+			t.Errorf("%s: mode %o, owner %d:%d (%q:%q), mtime %v", header.Name, header.Mode, header.Uid, header.Gid, header.Uname, header.Gname, header.ModTime)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if canonical, err := CanonicalJSON(data); err != nil || string(canonical) != string(data) {
+			t.Errorf("%s is not in canonical form: %v", header.Name, err)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 3 || !sort.StringsAreSorted(names) {
+		t.Errorf("archived %v, want 3 files sorted by path", names)
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	f := newFixture(t)
+	// Each crate has versions on both sides of its floor that string
+	// comparison would put on the wrong side
+	crates := map[string][]string{
+		"serde": {"0.9.0", "0.10.0", "1.0.0-rc.1", "1.0.0", "1.0.10"},
+		"rand":  {"0.7.3", "0.8.0-alpha", "0.8.0", "0.10.0"},
+		"log":   {"0.3.9", "0.4.0", "0.4.20"},
+		"old":   {"0.1.0", "0.2.0"},
+	}
+	for name, versions := range crates {
+		var lines []string
+		for _, version := range versions {
+			lines = append(lines, entry(name, version, f.crate(name, version, name+" "+version)))
+		}
+		f.indexFile(name, lines...)
+	}
+
+	code, report := f.run("-min-version", "serde=1.0.0,Rand=0.8.0", "-global-min-version", "0.4.0")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	want := map[string][]string{
+		"serde": {"1.0.0", "1.0.10"},
+		"rand":  {"0.8.0", "0.10.0"},
+		"log":   {"0.4.0", "0.4.20"},
+	}
+	for name, versions := range crates {
+		kept := map[string]bool{}
+		for _, version := range want[name] {
+			kept[version] = true
+		}
+		for _, version := range versions {
+			_, err := os.Stat(f.metadataPath(name, version))
+			if exists := err == nil; exists != kept[version] {
+				t.Errorf("%s %s: metadata written %v, want %v", name, version, exists, kept[version])
+			}
+		}
+	}
+	if report.Success != 6 || report.BelowMin != 8 || report.NoVersionAboveMin != 1 {
+		t.Errorf("organized %d, below minimum %d, crates with none above %d; want 6, 8 and 1",
+			report.Success, report.BelowMin, report.NoVersionAboveMin)
+	}
+	if !strings.Contains(f.log(), "Crate old has no versions at or above 0.4.0") {
+		t.Errorf("crate with no version above its floor was not reported\n%s", f.log())
+	}
+
+	for _, bad := range [][]string{{"-min-version", "serde"}, {"-min-version", "serde=1.0"}, {"-global-min-version", "latest"}} {
+		if code, _ := f.run(bad...); code == 0 {
+			t.Errorf("%v was accepted", bad)
+		}
+	}
+}
+
+func TestConcurrentDiscovery(t *testing.T) {
+	f := newFixture(t)
+	local := filepath.Join(f.dir, "local")
+	want := map[string]string{}
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("crate%02d", i)
+		f.indexFile(name, entry(name, "1.0.0", f.crate(name, "1.0.0", name)))
+		want[f.metadataPath(name, "1.0.0")] = ""
+	}
+	// The local index overrides one crate and adds another, so both walks
+	// of the discovery feed the run
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde 1.0.0")))
+	f.write(filepath.Join(local, "se", "rd", "serde"), entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0"), `"links":"local"`)+"\n")
+	f.write(filepath.Join(local, "3", "m", "mine"), entry("mine", "0.1.0", f.crate("mine", "0.1.0", "mine 0.1.0"))+"\n")
+	want[f.metadataPath("serde", "1.0.0")] = "local"
+	want[f.metadataPath("mine", "0.1.0")] = ""
+
+	logger, err := NewLogger(filepath.Join(f.dir, "organize.log"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	dest, err := NewDestination(f.mirror, LayoutBeside, f.mirror, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var phases []string
+	opts := &Options{
+		IndexDir:       f.index,
+		LocalIndexDir:  local,
+		MirrorDir:      f.mirror,
+		NumWorkers:     4,
+		FileMode:       0644,
+		DirMode:        0755,
+		Destinations:   []*Destination{dest},
+		VerifyChecksum: true,
+		Progress: func(snapshot ProgressSnapshot) {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(phases) == 0 || phases[len(phases)-1] != snapshot.Phase {
+				phases = append(phases, snapshot.Phase)
+			}
+		},
+	}
+	report, err := OrganizeMetadataContext(context.Background(), opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Success != 42 || report.Errors != 0 {
+		t.Errorf("organized %d with %d errors, want 42 and none\n%s", report.Success, report.Errors, f.log())
+	}
+	for path, links := range want {
+		var metadata MetadataEntry
+		if err := json.Unmarshal([]byte(f.read(path)), &metadata); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := metadata["links"].(string); got != links {
+			t.Errorf("%s: links = %q, want %q", path, got, links)
+		}
+	}
+	if got := strings.Join(phases, ","); !strings.HasPrefix(got, PhaseIndexBuild+","+PhaseDiscovery+","+PhaseProcessing) {
+		t.Errorf("phases = %s, want index_build, discovery, then processing", got)
+	}
+
+	// A failure of either walk ends the run with its error, without
+	// leaving the other walk waited on forever
+	for _, test := range []struct {
+		name   string
+		change func(opts *Options)
+		err    string
+	}{
+		{"missing mirror", func(opts *Options) { opts.MirrorDir = filepath.Join(f.dir, "nowhere") }, "failed to build crate file index"},
+		{"missing index", func(opts *Options) { opts.IndexDir = filepath.Join(f.dir, "nowhere") }, "failed to find metadata files"},
+		{"missing local index", func(opts *Options) { opts.LocalIndexDir = filepath.Join(f.dir, "nowhere") }, "failed to find local metadata files"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			failing := *opts
+			failing.Progress = nil
+			test.change(&failing)
+			done := make(chan error, 1)
+			go func() {
+				_, err := OrganizeMetadataContext(context.Background(), &failing, logger)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want %q", err, test.err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("run did not return")
+			}
+		})
+	}
+}
+
+func TestDumpEntry(t *testing.T) {
+	f := newFixture(t)
+	sum := f.crate("serde", "1.0.0", "serde 1.0.0")
+	f.indexFile("serde", entry("serde", "0.9.0", sha256Hex("serde 0.9.0")), entry("serde", "1.0.0", sum, `"links":"serde"`),
+		entry("serde", "1.1.0-rc.1", f.crate("serde", "1.1.0-rc.1", "serde 1.1.0-rc.1")))
+	f.indexFile("old-name", entry("old-name", "1.0.0", f.crate("new-name", "1.0.0", "new-name 1.0.0")))
+	renames := filepath.Join(f.dir, "renames.json")
+	f.write(renames, `{"old-name": "new-name"}`)
+	out := filepath.Join(f.dir, "out")
+	before := files(t, f.dir)
+
+	// The dump goes to stdout, so it runs in a child process
+	dump := func(args ...string) (int, EntryDump) {
+		t.Helper()
+		encoded, err := json.Marshal(f.args(append([]string{"-rename-map", renames, "-output-dir", out, "-layout", "flat"}, args...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), childEnv+"="+string(encoded))
+		stdout, err := cmd.Output()
+		var result EntryDump
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode(), result
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(stdout, &result); err != nil {
+			t.Fatalf("stdout is not an entry dump: %v\n%s", err, stdout)
+		}
+		return 0, result
+	}
+
+	code, got := dump("-dump-entry", "serde", "1.0.0")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if got.Crate != "serde" || got.Version != "1.0.0" || got.Source != SourceMain || got.Line != 2 ||
+		got.IndexFile != filepath.Join(f.index, "se", "rd", "serde") {
+		t.Errorf("index resolution = %s %s from %s line %d of %s", got.Crate, got.Version, got.Source, got.Line, got.IndexFile)
+	}
+	if got.Entry["cksum"] != sum || got.Entry["links"] != "serde" || got.Prerelease || got.Skipped != "" {
+		t.Errorf("entry = %v, prerelease %v, skipped %q", got.Entry, got.Prerelease, got.Skipped)
+	}
+	if got.ExpectedCrateFile != "serde-1.0.0.crate" || !got.Found || got.CrateFile != MirrorCratePath(f.mirror, "serde", "1.0.0") || got.MatchedAlias != "" {
+		t.Errorf("crate file = expected %s, found %v at %s (alias %q)", got.ExpectedCrateFile, got.Found, got.CrateFile, got.MatchedAlias)
+	}
+	if len(got.Destinations) != 1 || got.Destinations[0] != filepath.Join(out, "serde-1.0.0"+MetadataFileSuffix) {
+		t.Errorf("destinations = %v", got.Destinations)
+	}
+
+	// A crate file found under a rename alias
+	if code, got := dump("-dump-entry", "old-name", "1.0.0"); code != 0 || !got.Found || got.MatchedAlias != "new-name" ||
+		got.CrateFile != MirrorCratePath(f.mirror, "new-name", "1.0.0") || len(got.Destinations) != 1 {
+		t.Errorf("alias: exit code %d, found %v at %s (alias %q), destinations %v", code, got.Found, got.CrateFile, got.MatchedAlias, got.Destinations)
+	}
+	// A version the run would not organize has no destinations
+	if code, got := dump("-dump-entry", "serde", "0.9.0"); code != 0 || got.Found || got.CrateFile != "" || len(got.Destinations) != 0 {
+		t.Errorf("missing crate file: exit code %d, found %v at %q, destinations %v", code, got.Found, got.CrateFile, got.Destinations)
+	}
+	if code, got := dump("-prereleases", "skip", "-dump-entry", "serde", "1.1.0-rc.1"); code != 0 || !got.Prerelease || got.Skipped != "prerelease" || len(got.Destinations) != 0 {
+		t.Errorf("prerelease: exit code %d, prerelease %v, skipped %q, destinations %v", code, got.Prerelease, got.Skipped, got.Destinations)
+	}
+
+	for _, args := range [][]string{{"-dump-entry", "serde", "2.0.0"}, {"-dump-entry", "nope", "1.0.0"}, {"-dump-entry", "serde"}} {
+		if code, _ := dump(args...); code != 1 {
+			t.Errorf("%v: exit code %d, want 1", args, code)
+		}
+	}
+
+	// Nothing was written but the log
+	after := files(t, f.dir)
+	delete(after, "organize.log")
+	delete(before, "organize.log")
+	if len(after) != len(before) {
+		t.Errorf("dumping wrote files: %d before, %d after", len(before), len(after))
+	}
+}
+
+func TestTreeOut(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	f.indexFile("a", entry("a", "0.1.0", f.crate("a", "0.1.0", "a 0.1.0")))
+	tree := filepath.Join(f.dir, "tree.txt")
+
+	if code, _ := f.run("-dry-run", "-tree-out", tree); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	want := f.mirror + `
+├── 1
+│   └── a-0.1.0.metadata.json
+├── 3
+│   └── l
+│       └── log-0.4.0.metadata.json
+└── se
+    └── rd
+        ├── serde-1.0.0.metadata.json
+        └── serde-1.0.1.metadata.json
+
+5 directories, 4 files
+`
+	if got := f.read(tree); got != want {
+		t.Errorf("dry-run tree:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Writing, and finding the files unchanged, render the planned tree
+	if code, _ := f.run("-tree-out", tree); code != 0 || f.read(tree) != want {
+		t.Errorf("tree after writing (exit code %d):\n%s", code, f.read(tree))
+	}
+	if code, _ := f.run("-skip-unchanged", "-tree-out", tree); code != 0 || f.read(tree) != want {
+		t.Errorf("tree of unchanged files (exit code %d):\n%s", code, f.read(tree))
+	}
+
+	out := filepath.Join(f.dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := f.run("-dry-run", "-layout", "flat", "-output-dir", out, "-tree-out", tree); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	want = out + `
+├── a-0.1.0.metadata.json
+├── log-0.4.0.metadata.json
+├── serde-1.0.0.metadata.json
+└── serde-1.0.1.metadata.json
+
+0 directories, 4 files
+`
+	if got := f.read(tree); got != want {
+		t.Errorf("flat tree:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	f := newFixture(t)
+	config := filepath.Join(f.index, "config.json")
+	tests := []struct {
+		name, content string
+		problems      []string
+	}{
+		{"valid", `{"dl":"https://static.crates.io/crates","api":"https://crates.io"}`, nil},
+		{"dl markers", `{"dl":"https://example.com/{crate}/{version}/download","api":"https://example.com"}`, nil},
+		{"missing api", `{"dl":"https://static.crates.io/crates"}`, []string{`has no "api" field`}},
+		{"wrong types", `{"dl":42,"api":""}`, []string{`"dl" is not a non-empty string`, `"api" is not a non-empty string`}},
+		{"relative dl", `{"dl":"crates/download","api":"https://crates.io"}`, []string{`"dl" is not an absolute URL: "crates/download"`}},
+		{"truncated", `{"dl":"https://static.crates.io/cra`, []string{"is not a valid JSON object"}},
+		{"array", `["https://static.crates.io/crates"]`, []string{"is not a valid JSON object"}},
+		{"missing", "", []string{"does not exist"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(config)
+			if test.name != "missing" {
+				f.write(config, test.content)
+			}
+			path, problems := CheckIndexConfig(f.index)
+			if path != config {
+				t.Errorf("checked %s, want %s", path, config)
+			}
+			if len(problems) != len(test.problems) {
+				t.Fatalf("problems = %q, want %q", problems, test.problems)
+			}
+			for i, problem := range problems {
+				if !strings.HasPrefix(problem, test.problems[i]) {
+					t.Errorf("problem %d = %q, want %q", i, problem, test.problems[i])
+				}
+			}
+		})
+	}
+
+	// A sparse cache's config.json is in the directory above it
+	f.write(config, `{"dl":"https://static.crates.io/crates","api":"https://crates.io"}`)
+	if path, problems := CheckIndexConfig(filepath.Join(f.index, SparseCacheDir)); path != config || len(problems) != 0 {
+		t.Errorf("sparse cache: checked %s with problems %q", path, problems)
+	}
+
+	// Only -fail-on-bad-config stops the run
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	f.write(config, `{"dl":"https://static.crates.io/crates"}`)
+	if code, report := f.run("-check-config"); code != 0 || report == nil || report.Success != 1 {
+		t.Errorf("-check-config: exit code %d\n%s", code, f.log())
+	}
+	if !strings.Contains(f.log(), "WARNING") || !strings.Contains(f.log(), config+` has no "api" field`) {
+		t.Errorf("-check-config did not warn:\n%s", f.log())
+	}
+	os.Remove(f.metadataPath("serde", "1.0.0"))
+	if code, _ := f.run("-fail-on-bad-config"); code != 1 || !strings.Contains(f.log(), "ERROR") {
+		t.Errorf("-fail-on-bad-config: exit code %d, want 1\n%s", code, f.log())
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("-fail-on-bad-config processed the index: %v", err)
+	}
+}
+
+func TestOrganizeFromLockfile(t *testing.T) {
+	f := newFixture(t)
+	var all [][2]string
+	add := func(name string, versions ...string) {
+		var lines []string
+		for _, version := range versions {
+			lines = append(lines, entry(name, version, f.crate(name, version, name+" "+version)))
+			all = append(all, [2]string{name, version})
+		}
+		f.indexFile(name, lines...)
+	}
+	add("serde", "1.0.0", "1.0.1", "1.0.2")
+	add("log", "0.4.0", "0.4.1")
+	add("rand", "0.8.5")
+	add("unpinned", "1.0.0")
+	f.indexFile("libc", entry("libc", "0.2.0", sha256Hex("libc 0.2.0")))
+	lock := filepath.Join(f.dir, "Cargo.lock")
+	f.write(lock, `# This file is automatically @generated by Cargo.
+version = 3
+
+[[package]]
+name = "app"
+version = "0.1.0"
+dependencies = [
+ "log",
+ "serde",
+]
+
+[[package]]
+name = "libc"
+version = "0.2.0"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+
+[[package]]
+name = "log"
+version = "0.4.1"
+source = "sparse+https://index.crates.io/"
+
+[[package]]
+name = "missing-crate"
+version = "2.0.0"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+
+[[package]]
+name = "rand"
+version = "0.8.5"
+source = "git+https://github.com/rust-random/rand#abc123"
+
+[[package]]
+name = "serde"
+version = "1.0.1"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+checksum = "0000000000000000000000000000000000000000000000000000000000000000"
+
+[metadata]
+"checksum serde 1.0.0 (registry+https://github.com/rust-lang/crates.io-index)" = "ignored"
+`)
+
+	code, report := f.run("-organize-from-lockfile", lock)
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	// Only the registry packages are organized: not the workspace member,
+	// the git dependency, or anything the lockfile does not pin
+	pinned := map[string]bool{"serde 1.0.1": true, "log 0.4.1": true}
+	for _, version := range all {
+		_, err := os.Stat(f.metadataPath(version[0], version[1]))
+		if written := err == nil; written != pinned[version[0]+" "+version[1]] {
+			t.Errorf("%s %s: metadata written %v, want %v", version[0], version[1], written, !written)
+		}
+	}
+	if report.Success != 2 || report.LockfileNotInIndex != 1 || report.LockfileMissing != 1 {
+		t.Errorf("organized %d, not in index %d, missing %d; want 2, 1 and 1", report.Success, report.LockfileNotInIndex, report.LockfileMissing)
+	}
+	log := f.log()
+	for _, want := range []string{
+		"2 of 4 pinned versions organized",
+		"Lockfile version missing-crate-2.0.0 is not in the index",
+		"Lockfile version libc-0.2.0 has no crate file in the mirror",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q\n%s", want, log)
+		}
+	}
+
+	f.write(lock, "version = 3\n\n[[package]]\nname = \"app\"\nversion = \"0.1.0\"\n")
+	if code, _ := f.run("-organize-from-lockfile", lock); code == 0 {
+		t.Errorf("a lockfile without registry packages was accepted")
+	}
+}
+
+func TestPerFileTimeout(t *testing.T) {
+	f := newFixture(t)
+	for _, name := range []string{"serde", "log", "rand"} {
+		f.indexFile(name, entry(name, "1.0.0", f.crate(name, "1.0.0", name+" 1.0.0")))
+	}
+	logger, err := NewLogger(filepath.Join(f.dir, "organize.log"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	organize := func(delay string, timeout time.Duration) (*Report, time.Duration) {
+		t.Helper()
+		faults, err := ParseFaults("read-delay=" + delay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest, err := NewDestination(f.mirror, LayoutBeside, f.mirror, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &Options{
+			IndexDir:       f.index,
+			MirrorDir:      f.mirror,
+			NumWorkers:     1,
+			FileMode:       0644,
+			DirMode:        0755,
+			Destinations:   []*Destination{dest},
+			Faults:         faults,
+			PerFileTimeout: timeout,
+		}
+		start := time.Now()
+		report, err := OrganizeMetadataContext(context.Background(), opts, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report, time.Since(start)
+	}
+
+	// Every read hangs past the timeout; the one worker abandons each file
+	// in turn instead of waiting for it
+	goroutines := runtime.NumGoroutine()
+	report, elapsed := organize("2s", 50*time.Millisecond)
+	if report.TimedOut != 3 || report.Errors != 3 || report.Success != 0 {
+		t.Errorf("timed out %d, errors %d, organized %d; want 3, 3 and 0", report.TimedOut, report.Errors, report.Success)
+	}
+	if elapsed > time.Second {
+		t.Errorf("run took %v; the worker waited for the slow reads", elapsed)
+	}
+	if n := strings.Count(f.log(), "Abandoned index file"); n != 3 {
+		t.Errorf("logged %d abandoned files, want 3", n)
+	}
+
+	// The abandoned reads return once their deadline passes, and write nothing
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines after the run, %d before", n, goroutines)
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("abandoned file wrote its metadata: %v", err)
+	}
+
+	// Reads within the timeout are not affected
+	if report, _ := organize("10ms", 2*time.Second); report.TimedOut != 0 || report.Success != 3 {
+		t.Errorf("timed out %d, organized %d; want 0 and 3", report.TimedOut, report.Success)
+	}
+}
+
+func TestVerifyIndexManifest(t *testing.T) {
+	f := newFixture(t)
+	serde := []string{
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")),
+		entry("serde", "1.0.2", f.crate("serde", "1.0.2", "serde 1.0.2")),
+	}
+	f.indexFile("serde", serde...)
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	f.indexFile("a", entry("a", "0.1.0", f.crate("a", "0.1.0", "a 0.1.0")))
+	manifest := filepath.Join(f.dir, "index-manifest")
+	logHash := sha256Hex(f.read(filepath.Join(f.index, "3", "l", "log")))
+	f.write(manifest, fmt.Sprintf(`# generated by the mirror
+{"path":"se/rd/serde","lines":3}
+{"path":"3/l/log","lines":1,"sha256":%q}
+%s  1/a
+`, logHash, sha256Hex(f.read(filepath.Join(f.index, "1", "a")))))
+
+	entries, err := LoadIndexManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].Path != "1/a" || entries[2].Lines != nil || entries[1].SHA256 != logHash {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if problems := VerifyIndexManifest(f.index, entries); len(problems) != 0 {
+		t.Errorf("intact index: %q", problems)
+	}
+
+	// Truncate serde mid-sync, append to a, and lose log
+	f.indexFile("serde", serde[:2]...)
+	f.write(filepath.Join(f.index, "1", "a"), f.read(filepath.Join(f.index, "1", "a"))+entry("a", "0.2.0", "")+"\n")
+	os.Remove(filepath.Join(f.index, "3", "l", "log"))
+	want := []string{
+		filepath.Join(f.index, "se", "rd", "serde") + " has 2 entries, but the manifest expects 3; it may be truncated",
+		filepath.Join(f.index, "3", "l", "log") + " is missing",
+		filepath.Join(f.index, "1", "a") + " has SHA-256 ",
+	}
+	problems := VerifyIndexManifest(f.index, entries)
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %q", problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem, want[i]) {
+			t.Errorf("problem %d = %q, want %q", i, problem, want[i])
+		}
+	}
+
+	// The run warns and carries on
+	if code, report := f.run("-verify-index-manifest", manifest); code != 0 || report == nil || report.Success != 3 {
+		t.Errorf("exit code %d\n%s", code, f.log())
+	}
+	if log := f.log(); !strings.Contains(log, "WARNING - Index file "+want[0]) ||
+		!strings.Contains(log, "3 problems with the 3 index files listed in "+manifest) {
+		t.Errorf("log does not report the mismatches:\n%s", log)
+	}
+
+	f.write(manifest, `{"path":"se/rd/serde"}`+"\n")
+	if code, _ := f.run("-verify-index-manifest", manifest); code != 1 {
+		t.Errorf("malformed manifest: exit code %d, want 1", code)
+	}
+}
+
+func TestThenVerify(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+
+	code, report := f.run("-then-verify", "-record-raw-line", "hash")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if !report.Verified || report.VerifyFailures != 0 || report.Success != 2 {
+		t.Errorf("verified %v with %d failures, organized %d; want true, 0 and 2", report.Verified, report.VerifyFailures, report.Success)
+	}
+	if !strings.Contains(f.log(), "Verification passed: 2 passes") {
+		t.Errorf("log does not report the passes:\n%s", f.log())
+	}
+
+	// A crate file that does not match its checksum is still organized
+	// without -verify-checksum, but fails the verification that follows
+	f.crate("log", "0.4.0", "corrupted on disk")
+	os.Remove(f.metadataPath("log", "0.4.0"))
+	code, report = f.run("-then-verify")
+	if code != 4 || report == nil {
+		t.Fatalf("exit code %d, want 4\n%s", code, f.log())
+	}
+	if !report.Verified || report.VerifyFailures != 1 || report.Success != 2 {
+		t.Errorf("verified %v with %d failures, organized %d; want true, 1 and 2", report.Verified, report.VerifyFailures, report.Success)
+	}
+	if _, err := os.Stat(f.metadataPath("log", "0.4.0")); err != nil {
+		t.Errorf("metadata was not written before verifying: %v", err)
+	}
+	if !strings.Contains(f.log(), "Verification failed: 1 of 1 passes found problems") {
+		t.Errorf("log does not report the failure:\n%s", f.log())
+	}
+
+	if code, _ := f.run("-then-verify", "-dry-run"); code != 2 {
+		t.Errorf("-then-verify -dry-run: exit code %d, want 2", code)
+	}
+}
+
+func TestRepairPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits to repair")
+	}
+	f := newFixture(t)
+	modes := map[string]os.FileMode{"serde": 0600, "log": 0666, "rand": 0755, "syn": 0640}
+	for name := range modes {
+		f.indexFile(name, entry(name, "1.0.0", f.crate(name, "1.0.0", name+" 1.0.0")))
+	}
+	if code, _ := f.run(); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	before := files(t, f.mirror)
+	for name, mode := range modes {
+		if err := os.Chmod(f.metadataPath(name, "1.0.0"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Other files are not ours to repair
+	crate := MirrorCratePath(f.mirror, "serde", "1.0.0")
+	if err := os.Chmod(crate, 0600); err != nil {
+		t.Fatal(err)
+	}
+	check := func(want func(name string) os.FileMode) {
+		t.Helper()
+		for name := range modes {
+			info, err := os.Stat(f.metadataPath(name, "1.0.0"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != want(name) {
+				t.Errorf("%s: mode %04o, want %04o", name, info.Mode().Perm(), want(name))
+			}
+		}
+	}
+
+	if code, _ := f.run("-repair-permissions", "-file-mode", "0640", "-dry-run"); code != 0 || !strings.Contains(f.log(), "Would have changed the mode of 3 metadata files") {
+		t.Errorf("dry run: exit code %d\n%s", code, f.log())
+	}
+	check(func(name string) os.FileMode { return modes[name] })
+
+	if code, _ := f.run("-repair-permissions", "-file-mode", "0640"); code != 0 || !strings.Contains(f.log(), "Permission repair complete: changed the mode of 3 metadata files") {
+		t.Errorf("exit code %d\n%s", code, f.log())
+	}
+	check(func(string) os.FileMode { return 0640 })
+	if info, err := os.Stat(crate); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("crate file mode changed: %v", err)
+	}
+	after := files(t, f.mirror)
+	for path, content := range before {
+		if after[path] != content {
+			t.Errorf("%s content changed", path)
+		}
+	}
+
+	// Nothing is left to repair
+	if code, _ := f.run("-repair-permissions", "-file-mode", "0640"); code != 0 || !strings.Contains(f.log(), "Permission repair complete: changed the mode of 0 metadata files") {
+		t.Errorf("second repair: exit code %d\n%s", code, f.log())
+	}
+}
+
+func TestSummaryLine(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")), entry("serde", "1.0.1", sha256Hex("serde 1.0.1")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	keys := []string{"processed", "linked", "missing", "errors", "dur", "shards", "registry", "symlinks_replaced", "symlinks_written_through"}
+
+	// The line goes to stderr, so the run is a child process
+	summary := func(args ...string) map[string]string {
+		t.Helper()
+		encoded, err := json.Marshal(f.args(args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr strings.Builder
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), childEnv+"="+string(encoded))
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v\n%s", err, stderr.String())
+		}
+		if strings.Contains(stdout.String(), "organize: ") {
+			t.Errorf("summary line on stdout:\n%s", stdout.String())
+		}
+		var line string
+		for _, l := range strings.Split(stderr.String(), "\n") {
+			if strings.HasPrefix(l, "organize: ") {
+				if line != "" {
+					t.Fatalf("more than one summary line:\n%s", stderr.String())
+				}
+				line = l
+			}
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "organize: "))
+		if len(fields) != len(keys) {
+			t.Fatalf("summary line %q has %d fields, want %d", line, len(fields), len(keys))
+		}
+		values := make(map[string]string)
+		for i, field := range fields {
+			eq := strings.IndexByte(field, '=')
+			if eq < 0 || field[:eq] != keys[i] {
+				t.Fatalf("field %d of %q is %q, want %s=", i, line, field, keys[i])
+			}
+			values[keys[i]] = field[eq+1:]
+		}
+		if _, err := time.ParseDuration(values["dur"]); err != nil {
+			t.Errorf("dur: %v", err)
+		}
+		return values
+	}
+
+	got := summary()
+	want := map[string]string{"processed": "3", "linked": "2", "missing": "1", "errors": "0", "shards": "-", "registry": "-", "symlinks_replaced": "0", "symlinks_written_through": "0"}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s=%s, want %s", key, got[key], value)
+		}
+	}
+	// A restricted run has the same fields, in the same order
+	if got := summary("-shards", "s-z"); got["shards"] != "s-z" || got["processed"] != "2" || got["linked"] != "1" {
+		t.Errorf("sharded run: %v", got)
+	}
+}
+
+func TestPathGuardOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "se", "rd"), filepath.Join(root, "real"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "real"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	strict, err := NewPathGuard(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenient, err := NewPathGuard(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := filepath.Join(root, "se", "rd")
+	tests := []struct {
+		name, dir, crate, version string
+		want                      string // the path, or a substring of the error
+		allowed                   bool   // whether allowing symlinks makes it succeed
+	}{
+		{"plain", sub, "serde", "1.0.0", filepath.Join(sub, "serde-1.0.0"+MetadataFileSuffix), true},
+		{"directory still to be created", filepath.Join(root, "new", "dir"), "serde", "1.0.0", filepath.Join(root, "new", "dir", "serde-1.0.0"+MetadataFileSuffix), true},
+		{"dot-dot name", sub, "..", "1.0.0", `unsafe path component ".."`, false},
+		{"dot name", sub, ".", "1.0.0", `unsafe path component "."`, false},
+		{"empty name", sub, "", "1.0.0", `unsafe path component ""`, false},
+		{"embedded slash", sub, "se/../../outside", "1.0.0", "unsafe path component", false},
+		{"embedded backslash", sub, `se\..\x`, "1.0.0", "unsafe path component", false},
+		{"absolute name", sub, filepath.Join(outside, "serde"), "1.0.0", "unsafe path component", false},
+		{"NUL in name", sub, "serde\x00", "1.0.0", "unsafe path component", false},
+		{"dot-dot version", sub, "serde", "..", `unsafe path component ".."`, false},
+		{"escaping version", sub, "serde", "1.0.0/../../../x", "unsafe path component", false},
+		{"directory above the root", dir, "serde", "1.0.0", "is outside " + root, false},
+		{"dot-dot in the directory", filepath.Join(root, "se", "..", "..", "outside"), "serde", "1.0.0", "is outside " + root, false},
+		{"the root's sibling", outside, "serde", "1.0.0", "is outside " + root, false},
+		{"symlink out of the root", filepath.Join(root, "escape"), "serde", "1.0.0", "outside", true},
+		{"below a symlink out of the root", filepath.Join(root, "escape", "se", "rd"), "serde", "1.0.0", "outside", true},
+		{"symlink within the root", filepath.Join(root, "inside"), "serde", "1.0.0", filepath.Join(root, "inside", "serde-1.0.0"+MetadataFileSuffix), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := strict.OutputPath(test.dir, test.crate, test.version)
+			if strings.HasPrefix(test.want, root) {
+				if err != nil || got != test.want {
+					t.Errorf("OutputPath = %q, %v; want %q", got, err, test.want)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("OutputPath = %q, %v; want an error containing %q", got, err, test.want)
+			}
+
+			_, err = lenient.OutputPath(test.dir, test.crate, test.version)
+			if (err == nil) != test.allowed {
+				t.Errorf("with symlinks allowed: error %v, want success %v", err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestPathGuardCheckResolved(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "real"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "real"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "..", "outside"), filepath.Join(root, "real", "relative")); err != nil {
+		t.Fatal(err)
+	}
+	guard, err := NewPathGuard(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir    string
+		inside bool
+	}{
+		{root, true},
+		{filepath.Join(root, "real"), true},
+		{filepath.Join(root, "not", "created", "yet"), true},
+		{filepath.Join(root, "inside"), true},
+		{filepath.Join(root, "inside", "not", "created"), true},
+		{filepath.Join(root, "escape"), false},
+		{filepath.Join(root, "escape", "not", "created"), false},
+		{filepath.Join(root, "real", "relative"), false},
+		{filepath.Join(root, "inside", "relative"), false},
+		{outside, false},
+		{dir, false},
+	}
+	for _, test := range tests {
+		// The second check is answered from the cache and must agree
+		for pass := 0; pass < 2; pass++ {
+			err := guard.checkResolved(test.dir)
+			if (err == nil) != test.inside {
+				t.Errorf("checkResolved(%s), pass %d: %v, want inside %v", test.dir, pass+1, err, test.inside)
+			}
+		}
+	}
+}
+
+func TestSnapshotSkipsUnchangedCrates(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	snapshot := filepath.Join(f.dir, "snapshot.json")
+	hashes := func() map[string]string {
+		t.Helper()
+		var data snapshotFile
+		if err := json.Unmarshal([]byte(f.read(snapshot)), &data); err != nil {
+			t.Fatal(err)
+		}
+		return data.Crates
+	}
+	indexHash := func(name string) string {
+		return sha256Hex(f.read(filepath.Join(f.index, filepath.FromSlash(indexentry.IndexPath(name)))))
+	}
+
+	if code, report := f.run("-snapshot", snapshot); code != 0 || report.Success != 2 || report.SnapshotSkipped != 0 {
+		t.Fatalf("first run: exit code %d\n%s", code, f.log())
+	}
+	if got := hashes(); got["serde"] != indexHash("serde") || got["log"] != indexHash("log") {
+		t.Errorf("snapshot = %v", got)
+	}
+
+	// Between runs, log's metadata goes away but its index file stays the
+	// same, and serde gains a version
+	os.Remove(f.metadataPath("log", "0.4.0"))
+	f.indexFile("serde", entry("serde", "1.0.0", sha256Hex("serde 1.0.0")), entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")))
+
+	code, report := f.run("-snapshot", snapshot)
+	if code != 0 || report == nil {
+		t.Fatalf("second run: exit code %d\n%s", code, f.log())
+	}
+	// log's entries were never looked at, so its metadata was not written
+	if report.SnapshotSkipped != 1 || report.Versions != 2 || report.Success != 2 {
+		t.Errorf("skipped %d, versions %d, organized %d; want 1, 2 and 2", report.SnapshotSkipped, report.Versions, report.Success)
+	}
+	if _, err := os.Stat(f.metadataPath("log", "0.4.0")); !os.IsNotExist(err) {
+		t.Errorf("unchanged crate was processed: %v", err)
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.1")); err != nil {
+		t.Errorf("changed crate was not processed: %v", err)
+	}
+	if got := hashes(); got["serde"] != indexHash("serde") || got["log"] != indexHash("log") {
+		t.Errorf("snapshot after the change = %v, want serde's new hash and log's old one", got)
+	}
+}
+
+func TestValidateDeps(t *testing.T) {
+	f := newFixture(t)
+	withDeps := func(name, version string, reqs ...string) string {
+		var deps []string
+		for i, req := range reqs {
+			deps = append(deps, fmt.Sprintf(`{"name":"dep%d","req":%q,"features":[],"optional":false,"default_features":true,"target":null,"kind":"normal"}`, i, req))
+		}
+		return fmt.Sprintf(`{"name":%q,"vers":%q,"deps":[%s],"cksum":%q,"features":{},"yanked":false}`,
+			name, version, strings.Join(deps, ","), f.crate(name, version, name+" "+version))
+	}
+	f.indexFile("serde",
+		withDeps("serde", "1.0.0", "^1.2", ">=0.4, <0.6", "~0.2", "*", "^1.0"),
+		withDeps("serde", "1.0.1", "^1.2", ">>1"),
+		withDeps("serde", "1.0.2", "1..2"))
+	f.indexFile("log", withDeps("log", "0.4.0", "^^1", "=0.2.22"), withDeps("log", "0.4.1"))
+
+	code, report := f.run("-validate-deps", "-debug")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.InvalidDeps != 3 || report.Success != 5 {
+		t.Errorf("invalid %d, organized %d; want 3 and 5", report.InvalidDeps, report.Success)
+	}
+	log := f.log()
+	for _, want := range []string{
+		`Invalid dependency requirements in serde-1.0.1: dep1 ">>1"`,
+		`Invalid dependency requirements in serde-1.0.2: dep0 "1..2"`,
+		`Invalid dependency requirements in log-0.4.0: dep0 "^^1"`,
+		"serde: 3 organized, 2 with invalid dependency requirements (serde-1.0.1, serde-1.0.2)",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q\n%s", want, log)
+		}
+	}
+	for _, valid := range []string{"serde-1.0.0", "log-0.4.1", `"^1.2"`, `"=0.2.22"`} {
+		if strings.Contains(log, "Invalid dependency requirements in "+valid) || strings.Contains(log, "dep0 "+valid) {
+			t.Errorf("valid %s reported as invalid", valid)
+		}
+	}
+
+	// Without the flag nothing is checked
+	if _, report := f.run(); report == nil || report.InvalidDeps != 0 {
+		t.Errorf("requirements checked without -validate-deps")
+	}
+}
+
+func TestDateLayout(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0"), `"pubtime":"2017-04-20T16:21:04Z"`),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1"), `"created_at":"2019-03-02 10:00:00"`),
+		entry("serde", "1.0.2", f.crate("serde", "1.0.2", "serde 1.0.2"), `"published_at":"2020-11-30"`),
+		entry("serde", "1.0.3", f.crate("serde", "1.0.3", "serde 1.0.3"), `"timestamp":1640995200`))
+	f.indexFile("log",
+		entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")),
+		entry("log", "0.4.1", f.crate("log", "0.4.1", "log 0.4.1"), `"pubtime":"last tuesday"`),
+		entry("log", "0.4.2", f.crate("log", "0.4.2", "log 0.4.2")))
+	// Without a date field the crate file's mtime is used, unless it is
+	// implausible
+	setMtime := func(name, version string, mtime time.Time) {
+		if err := os.Chtimes(MirrorCratePath(f.mirror, name, version), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMtime("log", "0.4.0", time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC))
+	setMtime("log", "0.4.1", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	setMtime("log", "0.4.2", time.Now().Add(30*24*time.Hour))
+	out := filepath.Join(f.dir, "out")
+
+	if code, report := f.run("-date-layout", "-output-dir", out); code != 0 || report == nil || report.Success != 7 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	want := []string{
+		"2017/04/serde-1.0.0" + MetadataFileSuffix,
+		"2019/03/serde-1.0.1" + MetadataFileSuffix,
+		"2020/11/serde-1.0.2" + MetadataFileSuffix,
+		"2022/01/serde-1.0.3" + MetadataFileSuffix,
+		"2022/06/log-0.4.0" + MetadataFileSuffix,
+		"unknown/log-0.4.1" + MetadataFileSuffix,
+		"unknown/log-0.4.2" + MetadataFileSuffix,
+	}
+	var got []string
+	for path := range files(t, out) {
+		if strings.HasSuffix(path, MetadataFileSuffix) {
+			got = append(got, path)
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("metadata files:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestNewLoggerCreatesLogDir(t *testing.T) {
+	f := newFixture(t)
+	logPath := filepath.Join(f.dir, "logs", "nested", "organize.log")
+	logger, err := NewLogger(logPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hello")
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{filepath.Join(f.dir, "logs"), filepath.Dir(logPath)} {
+		info, err := os.Stat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() || info.Mode().Perm() != 0700 {
+			t.Errorf("%s: mode %v, want a directory with mode 0700", d, info.Mode())
+		}
+	}
+	if data, err := ioutil.ReadFile(logPath); err != nil || !strings.Contains(string(data), "hello") {
+		t.Errorf("log file %q, %v", data, err)
+	}
+
+	// The log directory cannot be created below a regular file
+	blocker := filepath.Join(f.dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLogger(filepath.Join(blocker, "logs", "organize.log"), 0755); err == nil || !strings.Contains(err.Error(), "failed to create log directory") {
+		t.Errorf("NewLogger below a file: %v", err)
+	}
+
+	// A run whose log directory cannot be created fails before doing anything
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	if code, report := f.run("-log-path", filepath.Join(blocker, "organize.log")); code != 1 || report != nil {
+		t.Errorf("exit code %d, report %v; want 1 and no report", code, report)
+	}
+	if _, err := os.Stat(f.metadataPath("serde", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("metadata written without a log: %v", err)
+	}
+}
+
+func TestResultsSocket(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", ""))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	socket := filepath.Join(f.dir, "results.sock")
+
+	// A consumer already listening on the socket receives every event
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []ResultEvent, 1)
+	go func() {
+		var events []ResultEvent
+		defer func() { received <- events }()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for {
+			var event ResultEvent
+			if decoder.Decode(&event) != nil {
+				return
+			}
+			events = append(events, event)
+		}
+	}()
+	code, report := f.run("-results-socket", socket)
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	// The run's connection may not have been accepted yet, and closing the
+	// listener would drop it with the events queued on it
+	var events []ResultEvent
+	select {
+	case events = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the consumer saw no end of the events\n%s", f.log())
+	}
+	listener.Close()
+	files := map[string]FileResult{}
+	var summary *ResultEvent
+	for _, event := range events {
+		switch event.Type {
+		case "file":
+			files[event.File.Crate] = *event.File
+		case "summary":
+			event := event
+			summary = &event
+		}
+	}
+	if got := files["serde"]; got.Success != 1 || got.Missing != 1 || strings.Join(got.MissingVersions, ",") != "serde-1.0.1" {
+		t.Errorf("serde file event %+v", got)
+	}
+	if got := files["log"]; got.Success != 1 || got.Missing != 0 {
+		t.Errorf("log file event %+v", got)
+	}
+	if len(files) != 2 {
+		t.Errorf("file events for %v, want serde and log", files)
+	}
+	if summary == nil || summary.Processed != 2 || summary.Report == nil || summary.Report.Success != 2 || summary.Report.Missing != 1 {
+		t.Errorf("summary event %+v", summary)
+	}
+
+	// A consumer that goes away mid-run does not fail the run. Slow index
+	// reads keep the run going well after the consumer has gone.
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("crate%02d", i)
+		f.indexFile(name, entry(name, "1.0.0", f.crate(name, "1.0.0", name)))
+	}
+	listener, err = net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}()
+	setenv(t, FaultsEnvVar, "read-delay=20ms")
+	code, report = f.run("-results-socket", socket, "-threads", "1")
+	if code != 0 || report == nil || report.Success != 7 || report.Errors != 0 {
+		t.Fatalf("exit code %d, report %+v\n%s", code, report, f.log())
+	}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("crate%02d", i)
+		if _, err := os.Stat(f.metadataPath(name, "1.0.0")); err != nil {
+			t.Error(err)
+		}
+	}
+	if !strings.Contains(f.log(), "Results socket consumer disconnected") {
+		t.Errorf("the consumer's disconnect was not noticed\n%s", f.log())
+	}
+}
+
+func TestEntryFilter(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", " 1.0.0 ", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")),
+		entry("serde", "1.0.2", f.crate("serde", "1.0.2", "serde 1.0.2")),
+		`{"name":"serde","deps":[]}`,
+		`{"name":"serde",}`)
+	f.indexFile("log",
+		entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")),
+		entry("log", "0.4.1", sha256Hex("log 0.4.1")))
+
+	logger, err := NewLogger(filepath.Join(f.dir, "organize.log"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	dest, err := NewDestination(f.mirror, LayoutBeside, f.mirror, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var seen []string
+	opts := &Options{
+		IndexDir:       f.index,
+		MirrorDir:      f.mirror,
+		NumWorkers:     2,
+		FileMode:       0644,
+		DirMode:        0755,
+		Destinations:   []*Destination{dest},
+		VerifyChecksum: true,
+		EntryFilter: func(entry MetadataEntry) bool {
+			name, _ := entry["name"].(string)
+			mu.Lock()
+			seen = append(seen, name+"-"+entry.Version())
+			mu.Unlock()
+			return name != "log" && entry.Version() != "1.0.1"
+		},
+	}
+	report, err := OrganizeMetadataContext(context.Background(), opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter sees every parsed entry with a version, already trimmed,
+	// and nothing else
+	sort.Strings(seen)
+	if got := strings.Join(seen, " "); got != "log-0.4.0 log-0.4.1 serde-1.0.0 serde-1.0.1 serde-1.0.2" {
+		t.Errorf("filter saw %s", got)
+	}
+
+	// Rejected entries are counted as filtered, not written, and not looked
+	// up in the mirror
+	if report.Filtered != 3 || report.Categories[OutcomeFiltered] != 3 || report.Success != 2 || report.Missing != 0 || report.Errors != 1 {
+		t.Errorf("filtered %d (%d), organized %d, missing %d, errors %d; want 3, 2, 0 and 1\n%s",
+			report.Filtered, report.Categories[OutcomeFiltered], report.Success, report.Missing, report.Errors, f.log())
+	}
+	if err := report.CheckAccounting(); err != nil {
+		t.Errorf("CheckAccounting: %v", err)
+	}
+	for _, id := range [][2]string{{"serde", "1.0.0"}, {"serde", "1.0.2"}} {
+		if _, err := os.Stat(f.metadataPath(id[0], id[1])); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, id := range [][2]string{{"serde", "1.0.1"}, {"log", "0.4.0"}, {"log", "0.4.1"}} {
+		if _, err := os.Stat(f.metadataPath(id[0], id[1])); !os.IsNotExist(err) {
+			t.Errorf("%s-%s written for a filtered entry: %v", id[0], id[1], err)
+		}
+	}
+	if !strings.Contains(f.log(), "3 entries were skipped by the entry filter") {
+		t.Errorf("log does not count the filtered entries\n%s", f.log())
+	}
+}
+
+func TestCompactIndexOut(t *testing.T) {
+	f := newFixture(t)
+	f.crate("serde", "1.0.3", "serde 1.0.3")
+	serde := []string{
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1"), `"yanked":true`),
+		entry("serde", "0.9.0", f.crate("serde", "0.9.0", "serde 0.9.0")),
+		entry("serde", "1.0.2", sha256Hex("serde 1.0.2")),
+		entry("serde", "1.0.3", sha256Hex("not what the mirror has")),
+		`{"name":"serde",}`,
+		entry("serde", "1.0.4", f.crate("serde", "1.0.4", "serde 1.0.4")),
+	}
+	f.indexFile("serde", serde...)
+	log := []string{entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0"))}
+	f.indexFile("log", log...)
+	f.indexFile("gone", entry("gone", "0.1.0", sha256Hex("gone 0.1.0")))
+	out := filepath.Join(f.dir, "compact")
+
+	code, report := f.run("-compact-index-out", out, "-min-version", "serde=1.0.0", "-verify-checksum")
+	if report == nil || report.Compacted != 3 {
+		t.Fatalf("exit code %d, report %+v\n%s", code, report, f.log())
+	}
+
+	// Only organized, unyanked entries are kept, one NDJSON file per crate
+	// at its index path, and crates with nothing kept get no file
+	want := map[string]string{
+		indexentry.IndexPath("serde"): serde[0] + "\n" + serde[6] + "\n",
+		indexentry.IndexPath("log"):   log[0] + "\n",
+	}
+	got := files(t, out)
+	if len(got) != len(want) {
+		t.Errorf("compacted files %v, want %d", got, len(want))
+	}
+	for path, content := range want {
+		if got[path] != content {
+			t.Errorf("%s:\n%s\nwant:\n%s", path, got[path], content)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(got[path], "\n"), "\n") {
+			var metadata MetadataEntry
+			if err := json.Unmarshal([]byte(line), &metadata); err != nil {
+				t.Errorf("%s: not NDJSON: %v", path, err)
+			}
+		}
+	}
+}
+
+func TestTrimmedEntryFields(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", " 1.0.0 ", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	f.indexFile("log", entry(" log\t", "0.4.0", " "+f.crate("log", "0.4.0", "log 0.4.0")+"\n"))
+
+	code, report := f.run("-debug", "-verify-checksum")
+	if code != 0 || report == nil || report.Success != 2 || report.Missing != 0 || report.ChecksumPassed != 2 {
+		t.Fatalf("exit code %d, report %+v\n%s", code, report, f.log())
+	}
+
+	// The trimmed values find the crate files and are what gets written
+	for _, id := range [][2]string{{"serde", "1.0.0"}, {"log", "0.4.0"}} {
+		var metadata MetadataEntry
+		if err := json.Unmarshal([]byte(f.read(f.metadataPath(id[0], id[1]))), &metadata); err != nil {
+			t.Fatal(err)
+		}
+		if metadata["name"] != id[0] || metadata["vers"] != id[1] || metadata["cksum"] != sha256Hex(id[0]+" "+id[1]) {
+			t.Errorf("%s-%s written as %v", id[0], id[1], metadata)
+		}
+	}
+
+	// Each trimmed field is logged at debug level
+	serdeIndex := filepath.Join(f.index, filepath.FromSlash(indexentry.IndexPath("serde")))
+	logIndex := filepath.Join(f.index, filepath.FromSlash(indexentry.IndexPath("log")))
+	for _, want := range []string{
+		fmt.Sprintf(`Trimmed whitespace from "vers" in %s`, serdeIndex),
+		fmt.Sprintf(`Trimmed whitespace from "name" in %s`, logIndex),
+		fmt.Sprintf(`Trimmed whitespace from "cksum" in %s`, logIndex),
+	} {
+		if !strings.Contains(f.log(), want) {
+			t.Errorf("log lacks %q\n%s", want, f.log())
+		}
+	}
+	if strings.Contains(f.log(), fmt.Sprintf(`Trimmed whitespace from "name" in %s`, serdeIndex)) {
+		t.Errorf("log reports trimming a field that had no whitespace\n%s", f.log())
+	}
+
+	// Without -debug trimming is silent
+	f.run()
+	if strings.Contains(f.log(), "Trimmed whitespace") {
+		t.Errorf("trimming logged without -debug\n%s", f.log())
+	}
+}
+
+func TestOutputsZero(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")),
+		entry("serde", "1.0.2", sha256Hex("serde 1.0.2")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+	out := filepath.Join(f.dir, "metadata out", "with spaces")
+	if err := os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(f.dir, "written list")
+
+	// outputs splits the list on NUL, requiring every path to be terminated
+	outputs := func() []string {
+		t.Helper()
+		data := f.read(list)
+		if data == "" {
+			return nil
+		}
+		if !strings.HasSuffix(data, "\x00") {
+			t.Fatalf("output list is not NUL-terminated: %q", data)
+		}
+		paths := strings.Split(strings.TrimSuffix(data, "\x00"), "\x00")
+		sort.Strings(paths)
+		return paths
+	}
+
+	if code, report := f.run("-output-dir", out, "-outputs-zero", list); code != 0 || report == nil || report.Success != 3 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	var written []string
+	for path := range files(t, out) {
+		written = append(written, filepath.Join(out, filepath.FromSlash(path)))
+	}
+	sort.Strings(written)
+	if got := outputs(); len(written) != 3 || strings.Join(got, "\n") != strings.Join(written, "\n") {
+		t.Errorf("output list:\n%s\nwant the files written:\n%s", strings.Join(got, "\n"), strings.Join(written, "\n"))
+	}
+	for _, path := range outputs() {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("listed path does not exist: %v", err)
+		}
+	}
+
+	// With -skip-unchanged unchanged files are not written again, so only
+	// the changed one is listed
+	f.indexFile("log", entry("log", "0.4.0", sha256Hex("log 0.4.0"), `"yanked":true`))
+	if code, _ := f.run("-output-dir", out, "-outputs-zero", list, "-skip-unchanged"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	want := filepath.Join(out, "3", "l", "log-0.4.0"+MetadataFileSuffix)
+	if got := outputs(); len(got) != 1 || got[0] != want {
+		t.Errorf("output list after changing log %q, want %q", got, want)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+
+	// checkProfile requires a non-empty gzipped profile at path
+	checkProfile := func(path string) {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Errorf("%s: not a gzipped profile: %v", path, err)
+			return
+		}
+		if raw, err := ioutil.ReadAll(reader); err != nil || len(raw) == 0 {
+			t.Errorf("%s: empty or corrupt profile (%d bytes): %v", path, len(raw), err)
+		}
+	}
+
+	cpu := filepath.Join(f.dir, "cpu.pprof")
+	mem := filepath.Join(f.dir, "mem.pprof")
+	if code, report := f.run("-cpuprofile", cpu, "-memprofile", mem); code != 0 || report == nil || report.Success != 1 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	checkProfile(cpu)
+	checkProfile(mem)
+	if !strings.Contains(f.log(), "Wrote heap profile to "+mem) {
+		t.Errorf("heap profile not logged\n%s", f.log())
+	}
+
+	// A run that gives up early still flushes both profiles
+	os.Remove(cpu)
+	os.Remove(mem)
+	if code, _ := f.run("-cpuprofile", cpu, "-memprofile", mem, "-index-dir", filepath.Join(f.dir, "no index")); code != 1 {
+		t.Fatalf("exit code %d, want 1\n%s", code, f.log())
+	}
+	checkProfile(cpu)
+	checkProfile(mem)
+}
+
+func TestCompressedArtifacts(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")))
+	f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+
+	// gunzip returns the decompressed lines of a gzip file
+	gunzip := func(path string) []string {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("%s is not gzipped: %v", path, err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	// checkManifest requires a manifest line for each metadata file, with
+	// its hash, and returns the lines sorted
+	checkManifest := func(lines []string) []string {
+		t.Helper()
+		want := map[string]string{
+			f.metadataPath("serde", "1.0.0"): sha256Hex(f.read(f.metadataPath("serde", "1.0.0"))),
+			f.metadataPath("log", "0.4.0"):   sha256Hex(f.read(f.metadataPath("log", "0.4.0"))),
+		}
+		if len(lines) != len(want) {
+			t.Errorf("manifest has %d lines, want %d", len(lines), len(want))
+		}
+		for _, line := range lines {
+			var entry ManifestEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("manifest line %q: %v", line, err)
+			}
+			if want[entry.Path] != entry.SHA256 {
+				t.Errorf("manifest entry %+v", entry)
+			}
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	// checkReport requires an NDJSON report with a header, a record per
+	// index file, and a complete footer
+	checkReport := func(lines []string) {
+		t.Helper()
+		var types []string
+		for _, line := range lines {
+			var record reportRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("report line %q: %v", line, err)
+			}
+			if record.Type == "" {
+				record.Type = "file"
+			}
+			if record.Type == "footer" && !record.Complete {
+				t.Errorf("footer not complete: %s", line)
+			}
+			types = append(types, record.Type)
+		}
+		if got := strings.Join(types, " "); got != "header file file footer" {
+			t.Errorf("report records %s", got)
+		}
+	}
+
+	// Names ending in .gz are compressed
+	manifest := filepath.Join(f.dir, "manifest.json.gz")
+	report := filepath.Join(f.dir, "report.ndjson.gz")
+	csvReport := filepath.Join(f.dir, "report.csv.gz")
+	if code, _ := f.run("-manifest-out", manifest, "-report-out", report, "-report-out", csvReport); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	bySuffix := checkManifest(gunzip(manifest))
+	checkReport(gunzip(report))
+	csvLines := gunzip(csvReport)
+	if !strings.HasPrefix(csvLines[0], "#header,") || len(csvLines) != 5 || !strings.Contains(csvLines[4], "complete=true") {
+		t.Errorf("CSV report:\n%s", strings.Join(csvLines, "\n"))
+	}
+
+	// The flags compress artifacts with any name, to the same content
+	manifest = filepath.Join(f.dir, "manifest.json")
+	report = filepath.Join(f.dir, "report.ndjson")
+	if code, _ := f.run("-manifest-out", manifest, "-compress-manifest", "-report-out", report, "-compress-report"); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if byFlag := checkManifest(gunzip(manifest)); strings.Join(byFlag, "\n") != strings.Join(bySuffix, "\n") {
+		t.Errorf("manifest compressed by flag:\n%s\nby suffix:\n%s", strings.Join(byFlag, "\n"), strings.Join(bySuffix, "\n"))
+	}
+	checkReport(gunzip(report))
+
+	// Without either, artifacts are plain text
+	if code, _ := f.run("-manifest-out", manifest, "-report-out", report); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	checkManifest(strings.Split(strings.TrimSuffix(f.read(manifest), "\n"), "\n"))
+	checkReport(strings.Split(strings.TrimSuffix(f.read(report), "\n"), "\n"))
+}
+
+func TestCategoriesOut(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("alpha",
+		entry("alpha", "1.0.0", f.crate("alpha", "1.0.0", "alpha 1.0.0"), `"categories":["cli","parsing"]`, `"keywords":["json"]`),
+		entry("alpha", "1.1.0", f.crate("alpha", "1.1.0", "alpha 1.1.0"), `"categories":[" CLI "]`))
+	f.indexFile("beta", entry("beta", "0.1.0", f.crate("beta", "0.1.0", "beta 0.1.0"), `"categories":["cli"]`, `"keywords":["json","serde"]`))
+	f.indexFile("gamma", entry("gamma", "0.1.0", f.crate("gamma", "0.1.0", "gamma 0.1.0"), `"categories":["parsing"]`, `"keywords":["JSON"]`))
+	// Crates without categories or keywords are not counted at all
+	f.indexFile("delta", entry("delta", "0.1.0", f.crate("delta", "0.1.0", "delta 0.1.0")))
+	f.indexFile("epsilon", entry("epsilon", "0.1.0", f.crate("epsilon", "0.1.0", "epsilon 0.1.0"), `"categories":[]`, `"keywords":[1,"  "]`))
+	// Only organized versions count
+	f.indexFile("zeta", entry("zeta", "0.1.0", sha256Hex("zeta 0.1.0"), `"categories":["web"]`))
+	out := filepath.Join(f.dir, "categories.json")
+
+	for _, test := range []struct {
+		top                  string
+		categories, keywords []TallyCount
+	}{
+		{"0", []TallyCount{{"cli", 2}, {"parsing", 2}}, []TallyCount{{"json", 3}, {"serde", 1}}},
+		// Ties are broken by name
+		{"1", []TallyCount{{"cli", 2}}, []TallyCount{{"json", 3}}},
+	} {
+		if code, _ := f.run("-categories-out", out, "-categories-top", test.top); code != 0 {
+			t.Fatalf("exit code %d\n%s", code, f.log())
+		}
+		var summary CategorySummary
+		if err := json.Unmarshal([]byte(f.read(out)), &summary); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Crates != 3 {
+			t.Errorf("top %s: %d crates with categories or keywords, want 3", test.top, summary.Crates)
+		}
+		if fmt.Sprint(summary.Categories) != fmt.Sprint(test.categories) || fmt.Sprint(summary.Keywords) != fmt.Sprint(test.keywords) {
+			t.Errorf("top %s: categories %v, keywords %v; want %v and %v", test.top, summary.Categories, summary.Keywords, test.categories, test.keywords)
+		}
+	}
+}
+
+func TestNameMismatches(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		// Mislabeled: the line in serde's index file names another crate
+		entry("serde_json", "1.0.1", f.crate("serde", "1.0.1", "serde 1.0.1")),
+		// Names differing only by case agree
+		entry("Serde", "1.0.2", f.crate("serde", "1.0.2", "serde 1.0.2")))
+
+	code, report := f.run("-check-names", "-debug")
+	if code != 0 || report == nil {
+		t.Fatalf("exit code %d\n%s", code, f.log())
+	}
+	if report.NameMismatches != 1 || report.Success != 3 {
+		t.Errorf("%d name mismatches, %d organized; want 1 and 3\n%s", report.NameMismatches, report.Success, f.log())
+	}
+	for _, want := range []string{
+		`Name mismatch for serde-1.0.1: entry name "serde_json", crate file serde-1.0.1.crate`,
+		"1 with a mismatched name (serde-1.0.1)",
+		"Found 1 versions whose entry name disagrees with their crate file",
+	} {
+		if !strings.Contains(f.log(), want) {
+			t.Errorf("log lacks %q\n%s", want, f.log())
+		}
+	}
+
+	// Names are only compared when asked
+	if _, report := f.run(); report == nil || report.NameMismatches != 0 {
+		t.Errorf("name mismatches counted without -check-names: %+v", report)
+	}
+}
+
+func TestListMissing(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde",
+		entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0")),
+		entry("serde", "1.0.1", sha256Hex("serde 1.0.1")),
+		entry("serde", "1.0.2", sha256Hex("serde 1.0.2"), `"yanked":true`))
+	f.indexFile("log", entry("log", "0.4.0", sha256Hex("log 0.4.0")))
+	list := filepath.Join(f.dir, "missing.tsv")
+
+	for _, test := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"urls", nil,
+			"log\t0.4.0\thttps://static.crates.io/crates/log/0.4.0/download\n" +
+				"serde\t1.0.1\thttps://static.crates.io/crates/serde/1.0.1/download\n"},
+		{"yanked", []string{"-list-missing-yanked"},
+			"log\t0.4.0\thttps://static.crates.io/crates/log/0.4.0/download\n" +
+				"serde\t1.0.1\thttps://static.crates.io/crates/serde/1.0.1/download\n" +
+				"serde\t1.0.2\thttps://static.crates.io/crates/serde/1.0.2/download\n"},
+		// Without config.json the download URLs are left empty
+		{"no config", nil, "log\t0.4.0\t\nserde\t1.0.1\t\n"},
+	} {
+		if test.name == "no config" {
+			if err := os.Remove(filepath.Join(f.index, "config.json")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if code, _ := f.run(append([]string{"-list-missing", "-list-missing-out", list}, test.args...)...); code != 0 {
+			t.Fatalf("%s: exit code %d\n%s", test.name, code, f.log())
+		}
+		if got := f.read(list); got != test.want {
+			t.Errorf("%s: list\n%q\nwant\n%q", test.name, got, test.want)
+		}
+	}
+	if !strings.Contains(f.log(), `No config.json with a "dl" URL in `+f.index+`; download URLs are left empty`) {
+		t.Errorf("missing config.json not reported\n%s", f.log())
+	}
+
+	// Listing writes no metadata
+	for path := range files(t, f.mirror) {
+		if !strings.HasSuffix(path, ".crate") {
+			t.Errorf("-list-missing wrote %s", path)
+		}
+	}
+}
+
+func TestLatestN(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		args       []string
+		kept       []string
+		skippedOld int
+	}{
+		// Versions are ranked by semver, not by line order or as strings,
+		// and prereleases take a place when they are organized
+		{"include prereleases", nil, []string{"serde-1.1.0", "serde-1.10.0", "serde-1.2.0-rc.1"}, 4},
+		{"skip prereleases", []string{"-prereleases", "skip"}, []string{"serde-1.0.1", "serde-1.1.0", "serde-1.10.0"}, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t)
+			var lines []string
+			for _, version := range []string{"0.9.0", "1.0.0", "1.10.0", "1.0.1", "1.2.0-rc.1", "1.1.0", "0.1.0"} {
+				lines = append(lines, entry("serde", version, f.crate("serde", version, "serde "+version)))
+			}
+			f.indexFile("serde", lines...)
+			// A crate with fewer than N versions keeps them all
+			f.indexFile("log", entry("log", "0.4.0", f.crate("log", "0.4.0", "log 0.4.0")))
+
+			code, report := f.run(append([]string{"-latest-n", "3"}, test.args...)...)
+			if code != 0 || report == nil {
+				t.Fatalf("exit code %d\n%s", code, f.log())
+			}
+			if report.SkippedOld != test.skippedOld || report.Categories[OutcomeSkippedOld] != test.skippedOld {
+				t.Errorf("skipped old %d (%d), want %d", report.SkippedOld, report.Categories[OutcomeSkippedOld], test.skippedOld)
+			}
+			if !strings.Contains(f.log(), fmt.Sprintf("Skipped %d versions older than their crate's newest 3", test.skippedOld)) {
+				t.Errorf("skipped versions not logged\n%s", f.log())
+			}
+			var kept []string
+			for path := range files(t, f.mirror) {
+				if strings.HasPrefix(filepath.Base(path), "serde-") && strings.HasSuffix(path, MetadataFileSuffix) {
+					kept = append(kept, strings.TrimSuffix(filepath.Base(path), MetadataFileSuffix))
+				}
+			}
+			sort.Strings(kept)
+			if strings.Join(kept, " ") != strings.Join(test.kept, " ") {
+				t.Errorf("organized %v, want %v", kept, test.kept)
+			}
+			if _, err := os.Stat(f.metadataPath("log", "0.4.0")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// cancelStore is an object store that cancels a context on every Put
+type cancelStore struct {
+	cancel  context.CancelFunc
+	objects int
+}
+
+func (s *cancelStore) Key(outputPath string) string {
+	return strings.TrimPrefix(filepath.ToSlash(outputPath), "/")
+}
+
+func (s *cancelStore) Put(key string, data []byte) error {
+	s.objects++
+	s.cancel()
+	return nil
+}
+
+func (s *cancelStore) Unchanged(key string, data []byte) (bool, error) {
+	return false, nil
+}
+
+func (s *cancelStore) String() string {
+	return "cancel://bucket"
+}
+
+func TestAbandonedFileWritesNothingAfterItsVersions(t *testing.T) {
+	f := newFixture(t)
+	f.indexFile("serde", entry("serde", "1.0.0", f.crate("serde", "1.0.0", "serde 1.0.0"), `"categories":["encoding"]`))
+	logger, err := NewLogger(filepath.Join(f.dir, "organize.log"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	crateIndex, err := BuildCrateFileIndex(f.mirror, nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := IndexFile{Path: filepath.Join(f.index, filepath.FromSlash(indexentry.IndexPath("serde"))), Root: f.index, Source: SourceMain}
+
+	// process processes the index file with every feature that writes
+	// after its versions, cancelling ctx when the store is written to
+	process := func(ctx context.Context, store *cancelStore) (*Snapshot, *CategoryTally, string) {
+		t.Helper()
+		dest, err := NewDestination(f.mirror, LayoutBeside, f.mirror, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		destinations := []*Destination{dest}
+		if store != nil {
+			storeDest, err := NewObjectDestination(store, LayoutBeside, f.mirror)
+			if err != nil {
+				t.Fatal(err)
+			}
+			destinations = append(destinations, storeDest)
+		}
+		latest, err := NewLatestLinks(f.mirror, []string{f.mirror}, LatestPointer, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := LoadSnapshot(filepath.Join(f.dir, "snapshot.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact := filepath.Join(f.dir, "compact")
+		opts := &Options{
+			IndexDir:        f.index,
+			MirrorDir:       f.mirror,
+			FileMode:        0644,
+			DirMode:         0755,
+			Destinations:    destinations,
+			Latest:          latest,
+			Bundles:         &BundleWriter{},
+			CompactIndexDir: compact,
+			Snapshot:        snapshot,
+			Categories:      NewCategoryTally("", 0),
+		}
+		ProcessMetadataFileContext(ctx, file, crateIndex, opts, logger)
+		return snapshot, opts.Categories, compact
+	}
+
+	// The file is abandoned while its only version is being written
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &cancelStore{cancel: cancel}
+	snapshot, categories, compact := process(ctx, store)
+	if store.objects != 1 {
+		t.Fatalf("%d objects written, want 1", store.objects)
+	}
+	var written []string
+	for path := range files(t, f.mirror) {
+		written = append(written, path)
+	}
+	sort.Strings(written)
+	if want := []string{"se/rd/serde-1.0.0.crate", "se/rd/serde-1.0.0" + MetadataFileSuffix}; strings.Join(written, " ") != strings.Join(want, " ") {
+		t.Errorf("mirror holds %v, want only %v", written, want)
+	}
+	if _, err := os.Stat(compact); !os.IsNotExist(err) {
+		t.Errorf("compacted index written for an abandoned file: %v", err)
+	}
+	if len(snapshot.current) != 0 {
+		t.Errorf("abandoned file recorded in the snapshot")
+	}
+	if summary := categories.Summary(0); summary.Crates != 0 {
+		t.Errorf("abandoned file tallied: %+v", summary)
+	}
+
+	// The same file processed to the end does all of it
+	snapshot, categories, compact = process(context.Background(), nil)
+	mirror := files(t, f.mirror)
+	if len(mirror) <= 2 {
+		t.Errorf("no latest pointers or bundle written: %v", mirror)
+	}
+	if _, err := os.Stat(compact); err != nil {
+		t.Error(err)
+	}
+	if len(snapshot.current) != 1 || categories.Summary(0).Crates != 1 {
+		t.Errorf("snapshot has %d crates, tally %+v; want 1 each", len(snapshot.current), categories.Summary(0))
+	}
+}
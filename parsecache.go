@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseCacheVersion is the format version of parse cache files; files of
+// another version are rebuilt
+const ParseCacheVersion = 2
+
+// parseCacheMagic starts every parse cache file. It is followed by the
+// format version byte and the SHA-256 of the gob payload after them, so a
+// file truncated or corrupted by a killed run is detected before decoding.
+var parseCacheMagic = []byte("OMPC")
+
+// parseCacheHeaderSize is the size of the magic, version, and checksum
+const parseCacheHeaderSize = 4 + 1 + sha256.Size
+
+// ParseCache stores the parsed entries of index files, gob-encoded and keyed
+// by the SHA-256 of the file's content, so that a later run reading the same
+// content skips JSON parsing. Entries are cached as parsed, before any of the
+// per-run processing, so the cache does not depend on the run's options.
+type ParseCache struct {
+	dir string
+
+	// used holds the content hashes looked up this run, which are the live
+	// entries if the run read every index file
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+// parseCacheFile is the on-disk form of one cached index file
+type parseCacheFile struct {
+	Version int
+	Lines   []parsedLine
+}
+
+// gobNull stands in for JSON null, since gob cannot encode nil interface values
+type gobNull struct{}
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(gobNull{})
+}
+
+// OpenParseCache uses dir as a parse cache, creating it if needed
+func OpenParseCache(dir string) (*ParseCache, error) {
+	if err := fsMkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create parse cache %s: %v", dir, err)
+	}
+	return &ParseCache{dir: dir, used: make(map[string]bool)}, nil
+}
+
+// replaceNulls returns value with every nil replaced by gobNull{}, or the
+// reverse if restore is set. Restoring also turns the nil slices and maps
+// gob decodes empty ones into back into empty ones, as JSON parsing has them.
+func replaceNulls(value interface{}, restore bool) interface{} {
+	switch v := value.(type) {
+	case nil:
+		if restore {
+			return nil
+		}
+		return gobNull{}
+	case gobNull:
+		if restore {
+			return nil
+		}
+		return v
+	case map[string]interface{}:
+		if v == nil && restore {
+			return map[string]interface{}{}
+		}
+		for key, item := range v {
+			v[key] = replaceNulls(item, restore)
+		}
+		return v
+	case MetadataEntry:
+		if v == nil && restore {
+			return MetadataEntry{}
+		}
+		for key, item := range v {
+			v[key] = replaceNulls(item, restore)
+		}
+		return v
+	case []interface{}:
+		if v == nil && restore {
+			return []interface{}{}
+		}
+		for i, item := range v {
+			v[i] = replaceNulls(item, restore)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// path returns the cache file for a content hash
+func (c *ParseCache) path(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash+".gob")
+}
+
+// Parse returns the parsed lines of content, from the cache if it holds
+// them and otherwise by parsing and then storing them. It reports whether
+// the cache was hit. A nil cache always parses.
+func (c *ParseCache) Parse(content []byte, logger *Logger) (lines []parsedLine, cached bool, rebuilt bool) {
+	if c == nil {
+		return parseIndexLines(content), false, false
+	}
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	path := c.path(hash)
+	c.mu.Lock()
+	c.used[hash] = true
+	c.mu.Unlock()
+
+	if data, err := ioutil.ReadFile(path); err == nil {
+		lines, err := decodeParseCache(data)
+		if err == nil {
+			return lines, true, false
+		}
+		logger.Warning("Rebuilding parse cache file %s: %v", path, err)
+		rebuilt = true
+	}
+
+	parsed := parseIndexLines(content)
+	if err := c.store(path, parsed); err != nil {
+		logger.Warning("Failed to store parsed entries in the parse cache: %v", err)
+	}
+	return parsed, false, rebuilt
+}
+
+// decodeParseCache verifies the header and checksum of a parse cache file
+// and decodes its lines
+func decodeParseCache(data []byte) (lines []parsedLine, err error) {
+	if len(data) < parseCacheHeaderSize || !bytes.Equal(data[:4], parseCacheMagic) {
+		return nil, fmt.Errorf("not a parse cache file, or truncated")
+	}
+	if data[4] != ParseCacheVersion {
+		return nil, fmt.Errorf("format version %d, expected %d", data[4], ParseCacheVersion)
+	}
+	payload := data[parseCacheHeaderSize:]
+	if sum := sha256.Sum256(payload); !bytes.Equal(sum[:], data[5:parseCacheHeaderSize]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	// The checksum rules out corruption, but a decoder panic must still not
+	// take the run down
+	defer func() {
+		if r := recover(); r != nil {
+			lines, err = nil, fmt.Errorf("decode panic: %v", r)
+		}
+	}()
+	var cached parseCacheFile
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&cached); err != nil {
+		return nil, err
+	}
+	for i, line := range cached.Lines {
+		if line.Err == "" {
+			cached.Lines[i].Entry = replaceNulls(line.Entry, true).(MetadataEntry)
+		}
+	}
+	return cached.Lines, nil
+}
+
+// store writes parsed lines to path. The entries are restored afterwards,
+// since encoding replaces their nulls in place.
+func (c *ParseCache) store(path string, parsed []parsedLine) error {
+	for _, line := range parsed {
+		replaceNulls(line.Entry, false)
+	}
+	defer func() {
+		for _, line := range parsed {
+			replaceNulls(line.Entry, true)
+		}
+	}()
+
+	if err := fsMkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(parseCacheFile{Version: ParseCacheVersion, Lines: parsed}); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(payload.Bytes())
+
+	temp, err := fsTempFile(filepath.Dir(path), ".parse-*.tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(temp)
+	writer.Write(parseCacheMagic)
+	writer.WriteByte(ParseCacheVersion)
+	writer.Write(sum[:])
+	writer.Write(payload.Bytes())
+	err = writer.Flush()
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fsRename(temp.Name(), path)
+	}
+	if err != nil {
+		fsRemove(temp.Name())
+	}
+	return err
+}
+
+// DefaultCompactBudget is how long the parse cache compaction at the end
+// of a run may take; the next run continues where it stopped
+const DefaultCompactBudget = 30 * time.Second
+
+// compactCursorFile records the shard directory an unfinished compaction
+// stopped at
+const compactCursorFile = ".compact-cursor"
+
+// staleTempAge is how old a parse cache temp file must be before a
+// compaction treats it as left behind by a killed run
+const staleTempAge = time.Hour
+
+// CompactReport summarizes a parse cache compaction
+type CompactReport struct {
+	Scanned   int           `json:"scanned"`
+	Dead      int           `json:"dead"`
+	Stale     int           `json:"stale"`
+	Temps     int           `json:"temps"`
+	Reclaimed int64         `json:"reclaimed_bytes"`
+	Errors    int           `json:"errors"`
+	Complete  bool          `json:"complete"`
+	Duration  time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the compaction
+func (r *CompactReport) SummaryLine() string {
+	return fmt.Sprintf("compact-cache: scanned=%d dead=%d stale=%d temps=%d reclaimed=%d complete=%v errors=%d dur=%s",
+		r.Scanned, r.Dead, r.Stale, r.Temps, r.Reclaimed, r.Complete, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// Used returns the content hashes looked up so far
+func (c *ParseCache) Used() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	used := make(map[string]bool, len(c.used))
+	for hash := range c.used {
+		used[hash] = true
+	}
+	return used
+}
+
+// ParseCacheLive returns the content hashes of the index files, the parse
+// cache entries a run over them would look up
+func ParseCacheLive(files []IndexFile) (map[string]bool, error) {
+	live := make(map[string]bool, len(files))
+	for _, file := range files {
+		content, err := readIndexContent(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file.Path, err)
+		}
+		sum := sha256.Sum256(content)
+		live[hex.EncodeToString(sum[:])] = true
+	}
+	return live, nil
+}
+
+// parseCacheCurrent reports whether a cache file starts with the header of
+// the current format version
+func parseCacheCurrent(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header[:4], parseCacheMagic) && header[4] == ParseCacheVersion
+}
+
+// Compact removes the cache files that are not in live, those of another
+// format version, and temp files left by killed runs, then the shard
+// directories left empty. Each removal is of one whole file, so a cache
+// interrupted mid-compaction is still valid: every file left in it is a
+// complete entry. With a budget, it stops at the first shard directory
+// after the budget is spent and records it, and the next compaction starts
+// there, so every shard is visited in turn.
+func (c *ParseCache) Compact(live map[string]bool, budget time.Duration, dryRun bool, logger *Logger) (*CompactReport, error) {
+	startTime := time.Now()
+	report := &CompactReport{Complete: true}
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parse cache %s: %v", c.dir, err)
+	}
+	var shards []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			shards = append(shards, entry.Name())
+		}
+	}
+
+	// Continue from where the last compaction stopped
+	cursorPath := filepath.Join(c.dir, compactCursorFile)
+	if cursor, err := ioutil.ReadFile(cursorPath); err == nil {
+		start := sort.SearchStrings(shards, strings.TrimSpace(string(cursor)))
+		shards = append(shards[start:], shards[:start]...)
+	}
+
+	remove := func(path string, size int64) {
+		if dryRun {
+			logger.Debug("DRY RUN: Would remove %s", path)
+		} else if err := fsRemove(path); err != nil {
+			logger.Error("Failed to remove %s: %v", path, err)
+			report.Errors++
+			return
+		}
+		report.Reclaimed += size
+	}
+
+	for i, shard := range shards {
+		if budget > 0 && i > 0 && time.Since(startTime) > budget {
+			report.Complete = false
+			if !dryRun {
+				temp := cursorPath + ".tmp"
+				if err := fsWriteFile(temp, []byte(shard+"\n"), 0644); err != nil || fsRename(temp, cursorPath) != nil {
+					logger.Warning("Failed to record where the parse cache compaction stopped")
+				}
+			}
+			break
+		}
+
+		dir := filepath.Join(c.dir, shard)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logger.Error("Failed to list %s: %v", dir, err)
+			report.Errors++
+			continue
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			switch name := file.Name(); {
+			case strings.HasPrefix(name, ".parse-") && strings.HasSuffix(name, ".tmp"):
+				if time.Since(file.ModTime()) > staleTempAge {
+					report.Temps++
+					remove(path, file.Size())
+				}
+			case strings.HasSuffix(name, ".gob"):
+				report.Scanned++
+				if !live[strings.TrimSuffix(name, ".gob")] {
+					report.Dead++
+					remove(path, file.Size())
+				} else if !parseCacheCurrent(path) {
+					report.Stale++
+					remove(path, file.Size())
+				}
+			}
+		}
+		if !dryRun {
+			// Only succeeds if the shard directory is now empty
+			fsRemove(dir)
+		}
+	}
+	if report.Complete && !dryRun {
+		if err := fsRemove(cursorPath); err != nil && !os.IsNotExist(err) {
+			logger.Warning("Failed to remove %s: %v", cursorPath, err)
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+	return report, nil
+}
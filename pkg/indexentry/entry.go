@@ -0,0 +1,103 @@
+// Package indexentry parses the lines of a crates.io-style registry index.
+// Each line of an index file is one JSON object describing a crate version;
+// ParseLine decodes it into an Entry without interpreting the schema, so v1
+// and v2 entries, features2, links and yanked all pass through unchanged.
+// The package has no dependencies outside the standard library.
+package indexentry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Entry is one parsed index entry, keyed by the JSON field names
+type Entry map[string]interface{}
+
+// MaxNameLength is the longest crate name the registry accepts
+const MaxNameLength = 64
+
+// ValidateName checks a name against the registry's rules: 1 to 64
+// ASCII characters, starting with a letter, containing only letters,
+// digits, '-' and '_'. Uppercase letters are accepted because historical
+// entries use them; names are compared case-insensitively.
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty crate name")
+	}
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("crate name %q is longer than %d characters", name, MaxNameLength)
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i == 0:
+			return fmt.Errorf("crate name %q must start with a letter", name)
+		case c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return fmt.Errorf("crate name %q contains invalid character %q", name, c)
+		}
+	}
+	return nil
+}
+
+// IndexPath returns the slash-separated path of a crate's file within the
+// registry index: 1/{name}, 2/{name}, 3/{first char}/{name}, or
+// {chars 1-2}/{chars 3-4}/{name}, all lowercased
+func IndexPath(name string) string {
+	name = strings.ToLower(name)
+	switch len(name) {
+	case 0:
+		return ""
+	case 1:
+		return "1/" + name
+	case 2:
+		return "2/" + name
+	case 3:
+		return "3/" + name[:1] + "/" + name
+	default:
+		return name[:2] + "/" + name[2:4] + "/" + name
+	}
+}
+
+// ErrNotEntry is returned by ParseLine for lines that are not JSON objects,
+// such as blank lines, which index files may contain and readers skip
+var ErrNotEntry = errors.New("not an index entry")
+
+// ParseLine parses one line of an index file into its entry
+func ParseLine(line []byte) (Entry, error) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("{")) || !bytes.HasSuffix(line, []byte("}")) {
+		return nil, ErrNotEntry
+	}
+	var entry Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Name returns the entry's crate name, or "" if it has none
+func (e Entry) Name() string {
+	name, _ := e["name"].(string)
+	return name
+}
+
+// Version returns the entry's version, or "" if it has none
+func (e Entry) Version() string {
+	version, _ := e["vers"].(string)
+	return version
+}
+
+// ExpectedCrateFilename returns the name of the entry's crate file in the
+// mirror, {name}-{version}.crate
+func (e Entry) ExpectedCrateFilename() string {
+	return fmt.Sprintf("%s-%s.crate", e.Name(), e.Version())
+}
+
+// IndexPath returns the path of the entry's crate file within the index
+func (e Entry) IndexPath() string {
+	return IndexPath(e.Name())
+}
@@ -0,0 +1,163 @@
+package indexentry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Lines as they appear in the crates.io index
+const (
+	lineV1     = `{"name":"serde","vers":"1.0.0","deps":[],"cksum":"2d1d5c53d4c0a8d7c4d1b5d5d1e7a1f7e4b1b5c6d7e8f9a0b1c2d3e4f5a6b7c8","features":{"default":["std"],"std":[]},"yanked":false}`
+	lineV2     = `{"name":"rand","vers":"0.8.5","deps":[{"name":"libc","req":"^0.2.22","features":[],"optional":true,"default_features":false,"target":"cfg(unix)","kind":"normal"}],"cksum":"34af8d1a0e25924bc5b7c43c4c9baa5e72d7b0cb4f9ab0e9c9e1d7b0e8b4e3c1","features":{"default":["std"]},"features2":{"serde1":["dep:serde"]},"yanked":false,"v":2}`
+	lineLinks  = `{"name":"openssl-sys","vers":"0.9.80","deps":[],"cksum":"23bbbf7854cd45b83958ebe919f0e8e516793727652e27fda10a8384cfc790b7","features":{},"yanked":false,"links":"openssl"}`
+	lineYanked = `{"name":"log","vers":"0.4.0-rc.1","deps":[],"cksum":"b0a7d7d3b1c4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0","features":{},"yanked":true}`
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		crate    string
+		version  string
+		filename string
+		path     string
+		check    func(t *testing.T, e Entry)
+	}{
+		{"v1", lineV1, "serde", "1.0.0", "serde-1.0.0.crate", "se/rd/serde", func(t *testing.T, e Entry) {
+			if _, ok := e["v"]; ok {
+				t.Errorf("v1 entry gained a v field")
+			}
+			features := e["features"].(map[string]interface{})
+			if !reflect.DeepEqual(features["default"], []interface{}{"std"}) {
+				t.Errorf("features = %v", features)
+			}
+		}},
+		{"v2 with features2", lineV2, "rand", "0.8.5", "rand-0.8.5.crate", "ra/nd/rand", func(t *testing.T, e Entry) {
+			if e["v"] != float64(2) {
+				t.Errorf("v = %v, want 2", e["v"])
+			}
+			features2, ok := e["features2"].(map[string]interface{})
+			if !ok || !reflect.DeepEqual(features2["serde1"], []interface{}{"dep:serde"}) {
+				t.Errorf("features2 = %v", e["features2"])
+			}
+			deps := e["deps"].([]interface{})
+			if dep := deps[0].(map[string]interface{}); dep["target"] != "cfg(unix)" || dep["optional"] != true {
+				t.Errorf("dependency = %v", dep)
+			}
+		}},
+		{"links", lineLinks, "openssl-sys", "0.9.80", "openssl-sys-0.9.80.crate", "op/en/openssl-sys", func(t *testing.T, e Entry) {
+			if e["links"] != "openssl" {
+				t.Errorf("links = %v", e["links"])
+			}
+		}},
+		{"yanked prerelease", lineYanked, "log", "0.4.0-rc.1", "log-0.4.0-rc.1.crate", "3/l/log", func(t *testing.T, e Entry) {
+			if e["yanked"] != true {
+				t.Errorf("yanked = %v", e["yanked"])
+			}
+		}},
+		{"surrounding whitespace", "  " + lineV1 + "\r\n", "serde", "1.0.0", "serde-1.0.0.crate", "se/rd/serde", nil},
+		{"one-letter name", `{"name":"a","vers":"0.1.0"}`, "a", "0.1.0", "a-0.1.0.crate", "1/a", nil},
+		{"uppercase name", `{"name":"Inflector","vers":"0.11.4"}`, "Inflector", "0.11.4", "Inflector-0.11.4.crate", "in/fl/inflector", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry, err := ParseLine([]byte(test.line))
+			if err != nil {
+				t.Fatalf("ParseLine: %v", err)
+			}
+			if got := entry.Name(); got != test.crate {
+				t.Errorf("Name() = %q, want %q", got, test.crate)
+			}
+			if got := entry.Version(); got != test.version {
+				t.Errorf("Version() = %q, want %q", got, test.version)
+			}
+			if got := entry.ExpectedCrateFilename(); got != test.filename {
+				t.Errorf("ExpectedCrateFilename() = %q, want %q", got, test.filename)
+			}
+			if got := entry.IndexPath(); got != test.path {
+				t.Errorf("IndexPath() = %q, want %q", got, test.path)
+			}
+			if test.check != nil {
+				test.check(t, entry)
+			}
+		})
+	}
+}
+
+func TestParseLineRejects(t *testing.T) {
+	for _, line := range []string{"", "   ", "\n", "[1,2]", `"serde"`, "# comment"} {
+		if _, err := ParseLine([]byte(line)); err != ErrNotEntry {
+			t.Errorf("ParseLine(%q) error = %v, want ErrNotEntry", line, err)
+		}
+	}
+	for _, line := range []string{`{"name":"serde",}`, `{"name":"serde","vers":1.0.0}`, `{not json}`} {
+		if _, err := ParseLine([]byte(line)); err == nil || err == ErrNotEntry {
+			t.Errorf("ParseLine(%q) error = %v, want a JSON error", line, err)
+		}
+	}
+}
+
+func TestEntryMissingFields(t *testing.T) {
+	entry, err := ParseLine([]byte(`{"name":42,"deps":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name() != "" || entry.Version() != "" {
+		t.Errorf("Name() = %q, Version() = %q, want both empty", entry.Name(), entry.Version())
+	}
+	if entry.IndexPath() != "" {
+		t.Errorf("IndexPath() = %q, want empty", entry.IndexPath())
+	}
+}
+
+func TestIndexPath(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"", ""},
+		{"a", "1/a"},
+		{"Z", "1/z"},
+		{"cc", "2/cc"},
+		{"Xy", "2/xy"},
+		{"log", "3/l/log"},
+		{"Syn", "3/s/syn"},
+		{"serd", "se/rd/serd"},
+		{"serde", "se/rd/serde"},
+		{"Serde_JSON", "se/rd/serde_json"},
+		{"a-b-c", "a-/b-/a-b-c"},
+		{"tokio-util", "to/ki/tokio-util"},
+		{strings.Repeat("x", MaxNameLength), "xx/xx/" + strings.Repeat("x", MaxNameLength)},
+	}
+	for _, test := range tests {
+		if got := IndexPath(test.name); got != test.want {
+			t.Errorf("IndexPath(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	valid := []string{"a", "Z", "serde", "serde_json", "tokio-util", "Inflector", "a1", "x--y__z", strings.Repeat("a", MaxNameLength)}
+	for _, name := range valid {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("ValidateName(%q): %v", name, err)
+		}
+	}
+	invalid := []string{
+		"",
+		strings.Repeat("a", MaxNameLength+1),
+		"1abc",
+		"_serde",
+		"-serde",
+		"serde json",
+		"serde.json",
+		"serde/json",
+		"..",
+		"a\\b",
+		"café",
+		"serde\x00",
+	}
+	for _, name := range invalid {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("ValidateName(%q) succeeded, want an error", name)
+		}
+	}
+}
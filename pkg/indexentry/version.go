@@ -0,0 +1,254 @@
+package indexentry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semantic version as used by crates.io
+type Version struct {
+	Major uint64
+	Minor uint64
+	Patch uint64
+	Pre   []string
+	Build string
+}
+
+// parseVersionNumber parses a numeric version component, rejecting leading zeros
+func parseVersionNumber(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty version component")
+	}
+	if len(s) > 1 && s[0] == '0' {
+		return 0, fmt.Errorf("leading zero in %q", s)
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid version component %q", s)
+		}
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// splitPreBuild splits "1.2.3-pre+build" into the numeric part and its
+// prerelease identifiers and build metadata
+func splitPreBuild(s string) (string, []string, string, error) {
+	var build string
+	if i := strings.Index(s, "+"); i >= 0 {
+		build = s[i+1:]
+		s = s[:i]
+		if build == "" {
+			return "", nil, "", fmt.Errorf("empty build metadata")
+		}
+	}
+
+	var pre []string
+	if i := strings.Index(s, "-"); i >= 0 {
+		for _, ident := range strings.Split(s[i+1:], ".") {
+			if ident == "" {
+				return "", nil, "", fmt.Errorf("empty prerelease identifier")
+			}
+			for _, c := range ident {
+				if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+					return "", nil, "", fmt.Errorf("invalid prerelease identifier %q", ident)
+				}
+			}
+			pre = append(pre, ident)
+		}
+		s = s[:i]
+	}
+
+	return s, pre, build, nil
+}
+
+// ParseVersion parses a full "major.minor.patch[-pre][+build]" version
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	core, pre, build, err := splitPreBuild(s)
+	if err != nil {
+		return v, err
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("version %q must have three components", s)
+	}
+	numbers := make([]uint64, 3)
+	for i, part := range parts {
+		if numbers[i], err = parseVersionNumber(part); err != nil {
+			return v, fmt.Errorf("version %q: %v", s, err)
+		}
+	}
+
+	return Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2], Pre: pre, Build: build}, nil
+}
+
+// IsPrerelease reports whether the version has prerelease identifiers
+func (v Version) IsPrerelease() bool {
+	return len(v.Pre) > 0
+}
+
+// String formats the version back into its canonical form
+func (v Version) String() string {
+	str := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Pre) > 0 {
+		str += "-" + strings.Join(v.Pre, ".")
+	}
+	if v.Build != "" {
+		str += "+" + v.Build
+	}
+	return str
+}
+
+// Compare returns -1, 0, or 1 following semver precedence. Build metadata is ignored.
+func (v Version) Compare(o Version) int {
+	for _, pair := range [][2]uint64{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A version without prerelease identifiers has higher precedence
+	switch {
+	case len(v.Pre) == 0 && len(o.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		a, b := v.Pre[i], o.Pre[i]
+		if a == b {
+			continue
+		}
+		aNum, aErr := strconv.ParseUint(a, 10, 64)
+		bNum, bErr := strconv.ParseUint(b, 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		case aErr == nil:
+			// Numeric identifiers have lower precedence than alphanumeric ones
+			return -1
+		case bErr == nil:
+			return 1
+		case a < b:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch {
+	case len(v.Pre) < len(o.Pre):
+		return -1
+	case len(v.Pre) > len(o.Pre):
+		return 1
+	}
+	return 0
+}
+
+// ValidateVersionReq checks a dependency requirement such as "^1.2" or
+// ">=0.4, <0.6" against Cargo's semver requirement syntax
+func ValidateVersionReq(req string) error {
+	req = strings.TrimSpace(req)
+	if req == "" {
+		return fmt.Errorf("empty requirement")
+	}
+	if req == "*" {
+		return nil
+	}
+
+	for _, comparator := range strings.Split(req, ",") {
+		if err := validateComparator(strings.TrimSpace(comparator)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateComparator checks a single comparator: an optional operator
+// followed by a possibly partial or wildcard version
+func validateComparator(comparator string) error {
+	if comparator == "" {
+		return fmt.Errorf("empty comparator")
+	}
+
+	op := ""
+	for _, candidate := range []string{">=", "<=", "=", ">", "<", "~", "^"} {
+		if strings.HasPrefix(comparator, candidate) {
+			op = candidate
+			break
+		}
+	}
+	version := strings.TrimSpace(comparator[len(op):])
+	if version == "" {
+		return fmt.Errorf("comparator %q has no version", comparator)
+	}
+
+	core, pre, _, err := splitPreBuild(version)
+	if err != nil {
+		return fmt.Errorf("comparator %q: %v", comparator, err)
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return fmt.Errorf("comparator %q has too many version components", comparator)
+	}
+	wildcard := false
+	for _, part := range parts {
+		if part == "*" || part == "x" || part == "X" {
+			wildcard = true
+			continue
+		}
+		if wildcard {
+			return fmt.Errorf("comparator %q has a number after a wildcard", comparator)
+		}
+		if _, err := parseVersionNumber(part); err != nil {
+			return fmt.Errorf("comparator %q: %v", comparator, err)
+		}
+	}
+	if len(pre) > 0 && (len(parts) != 3 || wildcard) {
+		return fmt.Errorf("comparator %q has a prerelease without a full version", comparator)
+	}
+
+	return nil
+}
+
+// lessVersion orders versions by semver, valid ones first, falling back to
+// the version string for versions that do not parse or have equal precedence
+func lessVersion(a, b string) bool {
+	pa, errA := ParseVersion(a)
+	pb, errB := ParseVersion(b)
+	if errA == nil && errB == nil {
+		if c := pa.Compare(pb); c != 0 {
+			return c < 0
+		}
+	} else if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	return a < b
+}
+
+// SortVersions sorts version strings from lowest to highest by semver
+func SortVersions(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return lessVersion(versions[i], versions[j])
+	})
+}
+
+// SortEntries sorts entries from lowest to highest version by semver
+func SortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return lessVersion(entries[i].Version(), entries[j].Version())
+	})
+}
@@ -0,0 +1,119 @@
+package indexentry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Version
+		pre  bool
+	}{
+		{"0.0.0", Version{}, false},
+		{"1.2.3", Version{Major: 1, Minor: 2, Patch: 3}, false},
+		{"1.0.0-alpha.1", Version{Major: 1, Pre: []string{"alpha", "1"}}, true},
+		{"2.0.0-beta.1+build.5", Version{Major: 2, Pre: []string{"beta", "1"}, Build: "build.5"}, true},
+		{"0.1.0+20240101", Version{Minor: 1, Build: "20240101"}, false},
+		{"1.0.0-x-y-z", Version{Major: 1, Pre: []string{"x-y-z"}}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseVersion(test.in)
+		if err != nil {
+			t.Errorf("ParseVersion(%q): %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+		if got.IsPrerelease() != test.pre {
+			t.Errorf("ParseVersion(%q).IsPrerelease() = %v", test.in, got.IsPrerelease())
+		}
+		if got.String() != test.in {
+			t.Errorf("ParseVersion(%q).String() = %q", test.in, got.String())
+		}
+	}
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	for _, in := range []string{"", "1", "1.2", "1.2.3.4", "01.2.3", "1.x.3", "1.2.3-", "1.2.3-a..b", "1.2.3-a_b", "1.2.3+", " 1.2.3", "1.2.-3"} {
+		if v, err := ParseVersion(in); err == nil {
+			t.Errorf("ParseVersion(%q) = %+v, want an error", in, v)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// Each version is lower than the next, per the semver precedence rules
+	ordered := []string{
+		"0.9.9", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := ParseVersion(ordered[i])
+			b, _ := ParseVersion(ordered[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.Compare(b); got != want {
+				t.Errorf("%s.Compare(%s) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	a, _ := ParseVersion("1.0.0+one")
+	b, _ := ParseVersion("1.0.0+two")
+	if a.Compare(b) != 0 {
+		t.Errorf("build metadata affected precedence")
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []string{"1.10.0", "not-a-version", "1.2.0", "1.0.0-rc.1", "0.1.0", "1.0.0", "garbage"}
+	SortVersions(versions)
+	want := []string{"0.1.0", "1.0.0-rc.1", "1.0.0", "1.2.0", "1.10.0", "garbage", "not-a-version"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("SortVersions = %v, want %v", versions, want)
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	var entries []Entry
+	for _, line := range []string{lineV1, `{"name":"serde","vers":"1.0.100"}`, `{"name":"serde","vers":"0.9.0"}`, `{"name":"serde","vers":"1.0.0+meta"}`} {
+		entry, err := ParseLine([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	SortEntries(entries)
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Version())
+	}
+	// Equal precedence falls back to the version string
+	want := []string{"0.9.0", "1.0.0", "1.0.0+meta", "1.0.100"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SortEntries = %v, want %v", got, want)
+	}
+}
+
+func TestValidateVersionReq(t *testing.T) {
+	valid := []string{"*", "^1.2", ">=0.4, <0.6", "~1", "=1.2.3", "1.2.*", "1.x", "^1.0.0-beta.1", " 0.2.22 ", "<=2", ">1.0.0"}
+	for _, req := range valid {
+		if err := ValidateVersionReq(req); err != nil {
+			t.Errorf("ValidateVersionReq(%q): %v", req, err)
+		}
+	}
+	invalid := []string{"", " ", "^", ">=1.0,", "1.2.3.4", "1.*.3", "^1.0-beta", "1.*-beta", "^01.2", "1.2.3-", "^1.a"}
+	for _, req := range invalid {
+		if err := ValidateVersionReq(req); err == nil {
+			t.Errorf("ValidateVersionReq(%q) succeeded, want an error", req)
+		}
+	}
+}
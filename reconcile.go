@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// Reconcile classes of an existing metadata file, compared with the
+// document this tool would generate for it
+const (
+	ReconcileIdentical = "identical"
+	ReconcileFormatted = "formatted"
+	ReconcileDifferent = "different"
+	ReconcileForeign   = "foreign"
+)
+
+// ReconcileReport summarizes a reconcile pass over existing metadata files
+type ReconcileReport struct {
+	Checked   int `json:"checked"`
+	Identical int `json:"identical"`
+	Formatted int `json:"formatted"`
+	Different int `json:"different"`
+	Foreign   int `json:"foreign"`
+	Rewritten int `json:"rewritten"`
+	Errors    int `json:"errors"`
+
+	// ExtraFields counts the files holding each top-level field the index
+	// entry lacks, kept or not
+	ExtraFields map[string]int `json:"extra_fields,omitempty"`
+
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *ReconcileReport) SummaryLine() string {
+	return fmt.Sprintf("reconcile: checked=%d identical=%d formatted=%d different=%d foreign=%d rewritten=%d errors=%d dur=%s",
+		r.Checked, r.Identical, r.Formatted, r.Different, r.Foreign, r.Rewritten, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// indexEntries returns the lines of a crate's index file by version,
+// looking in each index directory in turn
+func indexEntries(indexDirs []string, name string) map[string]string {
+	for _, dir := range indexDirs {
+		if dir == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(indexentry.IndexPath(name))))
+		if err != nil {
+			continue
+		}
+		lines := make(map[string]string)
+		for _, line := range strings.Split(string(content), "\n") {
+			if entry, err := indexentry.ParseLine([]byte(line)); err == nil {
+				lines[entry.Version()] = line
+			}
+		}
+		return lines
+	}
+	return nil
+}
+
+// ReconcileMetadata classifies every metadata file in the destinations
+// against the document generated from its index entry, with the fields
+// in keep (and the local info block) carried over from the file:
+// identical bytes, equal once canonicalized (see CanonicalJSON), different
+// content, or foreign, when the file is not an entry of an indexed version.
+// With rewrite, formatted and different files are replaced by the
+// generated document.
+func ReconcileMetadata(opts *Options, keep []string, rewrite bool, logger *Logger) (*ReconcileReport, error) {
+	logger.Info("Reconciling existing metadata files with the index...")
+	startTime := time.Now()
+	report := &ReconcileReport{ExtraFields: make(map[string]int)}
+	kept := map[string]bool{LocalInfoKey: true}
+	for _, field := range keep {
+		kept[field] = true
+	}
+
+	// Files of one crate are usually walked together, so only the last
+	// crate's index entries are kept
+	var cachedName string
+	var cachedLines map[string]string
+
+	check := func(dest *Destination, path string) {
+		report.Checked++
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.Error("Failed to read %s: %v", path, err)
+			report.Errors++
+			return
+		}
+		// Numbers are decoded as written, so kept fields are carried over exactly
+		var doc MetadataEntry
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil || doc.Name() == "" || doc.Version() == "" {
+			logger.Info("%s: foreign, not a metadata document with a name and version", path)
+			report.Foreign++
+			return
+		}
+		if doc.Name() != cachedName {
+			cachedName, cachedLines = doc.Name(), indexEntries([]string{opts.IndexDir, opts.LocalIndexDir}, doc.Name())
+		}
+		line, ok := cachedLines[doc.Version()]
+		if !ok {
+			logger.Info("%s: foreign, %s-%s is not in the index", path, doc.Name(), doc.Version())
+			report.Foreign++
+			return
+		}
+		generated, err := indexentry.ParseLine([]byte(line))
+		if err != nil {
+			logger.Error("Failed to parse the index entry of %s: %v", path, err)
+			report.Errors++
+			return
+		}
+		for field, value := range doc {
+			if _, ok := generated[field]; ok {
+				continue
+			}
+			if field != LocalInfoKey {
+				report.ExtraFields[field]++
+			}
+			if kept[field] {
+				generated[field] = value
+			}
+		}
+
+		want, err := json.MarshalIndent(generated, "", "  ")
+		if err != nil {
+			logger.Error("Failed to encode the generated document for %s: %v", path, err)
+			report.Errors++
+			return
+		}
+		class := ReconcileDifferent
+		if bytes.Equal(content, want) {
+			class = ReconcileIdentical
+		} else {
+			got, err1 := CanonicalJSON(content)
+			wanted, err2 := CanonicalJSON(want)
+			if err1 == nil && err2 == nil && bytes.Equal(got, wanted) {
+				class = ReconcileFormatted
+			}
+		}
+		switch class {
+		case ReconcileIdentical:
+			report.Identical++
+			logger.Debug("%s: identical", path)
+			return
+		case ReconcileFormatted:
+			report.Formatted++
+		default:
+			report.Different++
+		}
+		logger.Info("%s: %s", path, class)
+
+		if !rewrite {
+			return
+		}
+		if opts.DryRun {
+			logger.Info("DRY RUN: Would rewrite %s", path)
+			return
+		}
+		if _, err := dest.Write(path, want, opts); err != nil {
+			logger.Error("Failed to rewrite %s: %v", path, err)
+			report.Errors++
+			return
+		}
+		report.Rewritten++
+	}
+
+	for _, dest := range opts.Destinations {
+		err := filepath.Walk(dest.Root, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if isTrashDir(info) {
+				return filepath.SkipDir
+			}
+			if dest.InMirror && opts.Ignore.Match(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), MetadataFileSuffix) {
+				check(dest, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("error walking %s: %v", dest.Root, err)
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+	adoptable := 100.0
+	if report.Checked > 0 {
+		adoptable = 100 * float64(report.Identical) / float64(report.Checked)
+	}
+	logger.Info("Reconcile complete: %d metadata files, %d identical (%.1f%% adoptable as-is), %d formatted differently, %d different, %d foreign in %v",
+		report.Checked, report.Identical, adoptable, report.Formatted, report.Different, report.Foreign, report.Duration)
+	fields := make([]string, 0, len(report.ExtraFields))
+	for field := range report.ExtraFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		logger.Info("Extra field %q in %d files (kept: %v)", field, report.ExtraFields[field], kept[field])
+	}
+	return report, nil
+}
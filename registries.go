@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Registry is one registry of a -registries file: its index, its crate
+// store, and the options that apply only to it
+type Registry struct {
+	Name         string   `json:"name"`
+	IndexDir     string   `json:"index_dir"`
+	SourceFormat string   `json:"source_format,omitempty"`
+	MirrorDir    string   `json:"mirror_dir"`
+	OutputDirs   []string `json:"output_dirs,omitempty"`
+	LogPath      string   `json:"log_path,omitempty"`
+
+	// Args are more flags for this registry's run, e.g. its own -report-out
+	Args []string `json:"args,omitempty"`
+}
+
+// registriesFile is the on-disk form of a -registries file
+type registriesFile struct {
+	Registries []Registry `json:"registries"`
+}
+
+// LoadRegistries reads a -registries file and returns the registries
+// selected by a comma-separated list of names, or all of them. Registries
+// must not share a mirror or output directory, so that crates of the same
+// name in different registries can never overwrite each other's files.
+func LoadRegistries(path, selection string) ([]Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registries: %v", err)
+	}
+	var config registriesFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse registries %s: %v", path, err)
+	}
+
+	byName := make(map[string]bool)
+	var roots []string
+	var owners []string
+	for _, registry := range config.Registries {
+		if registry.Name == "" || registry.IndexDir == "" || registry.MirrorDir == "" {
+			return nil, fmt.Errorf("%s: every registry needs a name, index_dir, and mirror_dir", path)
+		}
+		if byName[registry.Name] {
+			return nil, fmt.Errorf("%s: registry %q is defined twice", path, registry.Name)
+		}
+		byName[registry.Name] = true
+
+		for _, root := range append([]string{registry.MirrorDir}, registry.OutputDirs...) {
+			for i, other := range roots {
+				if owners[i] != registry.Name && OverlappingRoots(root, other) {
+					return nil, fmt.Errorf("%s: registries %q and %q share the directory %s", path, owners[i], registry.Name, root)
+				}
+			}
+			roots = append(roots, root)
+			owners = append(owners, registry.Name)
+		}
+	}
+	if len(config.Registries) == 0 {
+		return nil, fmt.Errorf("%s defines no registries", path)
+	}
+	if selection == "" {
+		return config.Registries, nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(selection, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !byName[name] {
+			return nil, fmt.Errorf("no registry named %q in %s", name, path)
+		}
+		wanted[name] = true
+	}
+	var selected []Registry
+	for _, registry := range config.Registries {
+		if wanted[registry.Name] {
+			selected = append(selected, registry)
+		}
+	}
+	return selected, nil
+}
+
+// registryArgs returns the command line for one registry's run: the shared
+// flags, minus those selecting registries, followed by the registry's own.
+// Its log goes to its log_path, or to the shared log path with the
+// registry's name added before the extension.
+func registryArgs(args []string, registry Registry, logPath string) []string {
+	var shared []string
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			shared = append(shared, args[i])
+			continue
+		}
+		name := strings.TrimLeft(args[i], "-")
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name = name[:eq]
+		} else if name == "registries" || name == "registry" {
+			i++ // skip the value
+		}
+		if name == "registries" || name == "registry" {
+			continue
+		}
+		shared = append(shared, args[i])
+	}
+
+	if registry.LogPath == "" {
+		ext := filepath.Ext(logPath)
+		registry.LogPath = strings.TrimSuffix(logPath, ext) + "-" + registry.Name + ext
+	}
+	own := []string{"-index-dir", registry.IndexDir, "-mirror-dir", registry.MirrorDir, "-log-path", registry.LogPath}
+	if registry.SourceFormat != "" {
+		own = append(own, "-source-format", registry.SourceFormat)
+	}
+	for _, dir := range registry.OutputDirs {
+		own = append(own, "-output-dir", dir)
+	}
+	return append(append(shared, own...), registry.Args...)
+}
+
+// RunRegistries runs the organizer once for each registry, each with its
+// own index, crate file index, lock, log, and reports, and returns the
+// highest exit status of the runs
+func RunRegistries(args []string, registries []Registry, logPath string) int {
+	status := 0
+	for _, registry := range registries {
+		fmt.Fprintf(os.Stderr, "registry %s: index %s, mirror %s\n", registry.Name, registry.IndexDir, registry.MirrorDir)
+		if code := run(registryArgs(args, registry, logPath), registry.Name); code > status {
+			status = code
+		}
+	}
+	return status
+}
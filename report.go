@@ -0,0 +1,1070 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportJSONSchema returns a JSON Schema (draft 2020-12) of the Report as
+// written by -summary-json, generated from its fields so the two cannot drift
+func ReportJSONSchema() map[string]interface{} {
+	schema := jsonSchemaOf(reflect.TypeOf(Report{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "organize_metadata run summary"
+	return schema
+}
+
+// jsonSchemaOf describes a Go type as encoding/json would encode it. Fields
+// without omitempty are required; durations are integer nanoseconds.
+func jsonSchemaOf(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return jsonSchemaOf(t.Elem())
+	}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(time.Duration(0)):
+		return map[string]interface{}{"type": "integer"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchemaOf(field.Type)
+			omitEmpty := false
+			for _, option := range tag[1:] {
+				omitEmpty = omitEmpty || option == "omitempty"
+			}
+			if !omitEmpty {
+				required = append(required, name)
+			}
+		}
+		sort.Strings(required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+// SummaryLine formats the report as the stable single-line summary written to
+// stderr at the end of a run, for example:
+//
+//	organize: processed=1234 linked=1200 missing=34 errors=0 dur=1m2.5s shards=- registry=- symlinks_replaced=0 symlinks_written_through=0
+//
+// Every field is always present, in this order, as key=value with no spaces
+// in the value. processed is the number of versions seen, linked the number
+// of metadata files written (or that would be written in dry-run mode), dur
+// a Go duration string, and shards and registry are "-" when the run was not
+// restricted to shards or a registry. Fields are only ever appended, never
+// renamed, removed, or reordered.
+func (r *Report) SummaryLine() string {
+	return fmt.Sprintf("organize: processed=%d linked=%d missing=%d errors=%d dur=%s shards=%s registry=%s symlinks_replaced=%d symlinks_written_through=%d",
+		r.Versions, r.Success, r.Missing, r.Errors, r.Duration.Round(time.Millisecond),
+		summaryValue(r.Shards), summaryValue(r.Registry), r.SymlinksReplaced, r.SymlinksWrittenThrough)
+}
+
+// summaryValue formats a string field of the summary line: "-" if empty,
+// and without whitespace so the line splits on spaces
+func summaryValue(value string) string {
+	value = strings.Join(strings.Fields(value), "")
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// WriteEnvFile appends the summary counts to path as key=value lines, the
+// format of $GITHUB_OUTPUT, so CI steps can branch on them
+func (r *Report) WriteEnvFile(path string) error {
+	file, err := fsOpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	_, err = fmt.Fprintf(file, "processed=%d\nlinked=%d\nmissing=%d\nerrors=%d\nduration_seconds=%.3f\nrun_id=%s\n",
+		r.Versions, r.Success, r.Missing, r.Errors, r.Duration.Seconds(), r.RunID)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// MissingCount is the number of missing versions of one crate
+type MissingCount struct {
+	Crate    string
+	Versions int
+}
+
+// topMissing returns the n crates with the most missing versions, then by name
+func topMissing(missing map[string]int, n int) []MissingCount {
+	top := make([]MissingCount, 0, len(missing))
+	for crate, versions := range missing {
+		top = append(top, MissingCount{Crate: crate, Versions: versions})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Versions != top[j].Versions {
+			return top[i].Versions > top[j].Versions
+		}
+		return top[i].Crate < top[j].Crate
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// htmlReportTemplate renders the -html-report summary as a self-contained page
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Metadata organization report {{.Report.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+td.n { text-align: right; }
+th { background: #f0f0f0; }
+</style>
+</head>
+<body>
+<h1>Metadata organization report</h1>
+<p>Run {{.Report.RunID}}, finished {{.Finished}}{{if .Report.Shards}}, shards {{.Report.Shards}}{{end}}{{if .Report.Partial}} (partial: {{.Report.FilesPending}} index files not processed){{end}}.</p>
+<h2>Summary</h2>
+<table>
+<tr><th>Index files</th><td class="n">{{.Report.Files}}</td></tr>
+<tr><th>Versions</th><td class="n">{{.Report.Versions}}</td></tr>
+<tr><th>Organized</th><td class="n">{{.Report.Success}}</td></tr>
+<tr><th>Missing crate files</th><td class="n">{{.Report.Missing}}</td></tr>
+<tr><th>Errors</th><td class="n">{{.Report.Errors}}</td></tr>
+<tr><th>Coverage</th><td class="n">{{printf "%.1f" .Coverage}}%</td></tr>
+<tr><th>Duration</th><td class="n">{{.Duration}}</td></tr>
+</table>
+{{if .TopMissing}}<h2>Crates with the most missing versions</h2>
+<table>
+<tr><th>Crate</th><th>Missing versions</th></tr>
+{{range .TopMissing}}<tr><td>{{.Crate}}</td><td class="n">{{.Versions}}</td></tr>
+{{end}}</table>
+{{end}}{{with .Categories}}<h2>Categories</h2>
+<p>{{.Crates}} crates list categories or keywords.</p>
+<table>
+<tr><th>Category</th><th>Crates</th></tr>
+{{range .Categories}}<tr><td>{{.Name}}</td><td class="n">{{.Crates}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>Keyword</th><th>Crates</th></tr>
+{{range .Keywords}}<tr><td>{{.Name}}</td><td class="n">{{.Crates}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// WriteHTMLReport renders the report, the crates with the most missing
+// versions, and the category breakdown (if any) as an HTML page at path
+func WriteHTMLReport(path string, report *Report, missing map[string]int, categories *CategorySummary) error {
+	coverage := 100.0
+	if report.Versions > 0 {
+		coverage = 100 * float64(report.Success) / float64(report.Versions)
+	}
+	data := struct {
+		Report     *Report
+		Finished   string
+		Duration   time.Duration
+		Coverage   float64
+		TopMissing []MissingCount
+		Categories *CategorySummary
+	}{
+		Report:     report,
+		Finished:   time.Now().Format(time.RFC3339),
+		Duration:   report.Duration.Round(time.Millisecond),
+		Coverage:   coverage,
+		TopMissing: topMissing(missing, htmlReportTopMissing),
+		Categories: categories,
+	}
+
+	var buf bytes.Buffer
+	if err := htmlReportTemplate.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render HTML report: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := fsWriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write HTML report: %v", err)
+	}
+	if err := fsRename(tmp, path); err != nil {
+		fsRemove(tmp)
+		return fmt.Errorf("failed to write HTML report: %v", err)
+	}
+	return nil
+}
+
+// htmlReportTopMissing is how many crates the HTML report lists as missing the most versions
+const htmlReportTopMissing = 25
+
+// ReportWriter writes per-file results as they arrive, so a report does not
+// grow in memory with the size of the run. A report is only complete once its
+// footer has been written; one without a footer was interrupted.
+type ReportWriter interface {
+	WriteResult(result FileResult) error
+
+	// Finish writes the footer and closes the report. A nil report marks
+	// the run as failed.
+	Finish(report *Report) error
+}
+
+// reportFlushInterval is how many results are buffered between flushes
+const reportFlushInterval = 1000
+
+// GzipSuffix marks artifacts that are written gzip-compressed
+const GzipSuffix = ".gz"
+
+// artifactFile is a report or manifest file, gzip-compressed as it is
+// written if requested, so large artifacts are never held in memory
+type artifactFile struct {
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// createArtifact creates an artifact at path, compressed if compress is set
+// or the path ends in .gz
+func createArtifact(path string, compress bool) (*artifactFile, error) {
+	file, err := fsCreate(path)
+	if err != nil {
+		return nil, err
+	}
+	artifact := &artifactFile{file: file}
+	if compress || strings.HasSuffix(strings.ToLower(path), GzipSuffix) {
+		artifact.gz = gzip.NewWriter(file)
+	}
+	return artifact, nil
+}
+
+func (a *artifactFile) Write(p []byte) (int, error) {
+	if a.gz != nil {
+		return a.gz.Write(p)
+	}
+	return a.file.Write(p)
+}
+
+// Close finishes the gzip stream, if any, and closes the file
+func (a *artifactFile) Close() error {
+	var err error
+	if a.gz != nil {
+		err = a.gz.Close()
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openArtifact opens an artifact for reading, decompressing it if its path
+// ends in .gz
+func openArtifact(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(strings.ToLower(path), GzipSuffix) {
+		return file, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, file}, nil
+}
+
+// OpenReportWriter creates a streaming report at path, as CSV if the path
+// ends in .csv (or .csv.gz) and as NDJSON otherwise, gzip-compressed if
+// compress is set or the path ends in .gz
+func OpenReportWriter(path string, compress bool, runID string, labels Labels) (ReportWriter, error) {
+	file, err := createArtifact(path, compress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create report %s: %v", path, err)
+	}
+
+	started := time.Now()
+	var writer ReportWriter
+	if strings.HasSuffix(strings.TrimSuffix(strings.ToLower(path), GzipSuffix), ".csv") {
+		writer, err = newCSVReportWriter(file, started, runID)
+	} else {
+		writer, err = newNDJSONReportWriter(file, started, runID, labels)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write report header to %s: %v", path, err)
+	}
+	return writer, nil
+}
+
+// ReportSchemaVersion is the version of the NDJSON report format; reports
+// can only be merged with reports of the same version
+const ReportSchemaVersion = 1
+
+// reportRecord is a header or footer record of an NDJSON report
+type reportRecord struct {
+	Type     string    `json:"type"`
+	Schema   int       `json:"schema"`
+	Started  time.Time `json:"started"`
+	RunID    string    `json:"run_id,omitempty"`
+	Labels   Labels    `json:"labels,omitempty"`
+	Complete bool      `json:"complete"`
+	Note     string    `json:"note,omitempty"`
+	Report   *Report   `json:"report,omitempty"`
+}
+
+// ndjsonReportWriter writes one JSON object per line: a header record, a
+// record per index file, and a footer record
+type ndjsonReportWriter struct {
+	file    io.WriteCloser
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	started time.Time
+	count   int
+}
+
+func newNDJSONReportWriter(file io.WriteCloser, started time.Time, runID string, labels Labels) (*ndjsonReportWriter, error) {
+	w := &ndjsonReportWriter{file: file, writer: bufio.NewWriter(file), started: started}
+	w.encoder = json.NewEncoder(w.writer)
+	header := reportRecord{Type: "header", Schema: ReportSchemaVersion, Started: started, RunID: runID, Labels: labels, Note: "incomplete unless a footer record with complete=true follows"}
+	if err := w.encoder.Encode(header); err != nil {
+		return nil, err
+	}
+	return w, w.writer.Flush()
+}
+
+// WriteResult implements ReportWriter
+func (w *ndjsonReportWriter) WriteResult(result FileResult) error {
+	if err := w.encoder.Encode(result); err != nil {
+		return err
+	}
+	w.count++
+	if w.count%reportFlushInterval == 0 {
+		return w.writer.Flush()
+	}
+	return nil
+}
+
+// Finish implements ReportWriter
+func (w *ndjsonReportWriter) Finish(report *Report) error {
+	footer := reportRecord{Type: "footer", Schema: ReportSchemaVersion, Started: w.started}
+	if report != nil {
+		summary := *report
+		summary.Duration = time.Since(w.started)
+		footer.Report = &summary
+	}
+	switch {
+	case report == nil:
+		footer.Note = "run failed"
+	case report.Partial:
+		footer.Note = "run stopped before every index file was processed"
+	default:
+		footer.Complete = true
+	}
+
+	err := w.encoder.Encode(footer)
+	if flushErr := w.writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// csvReportColumns are the columns of a CSV report
+var csvReportColumns = []string{"path", "crate", "source", "total", "success", "missing", "errors"}
+
+// csvReportWriter writes a CSV report. The first and last lines are
+// "#"-prefixed header and footer records around the column header and rows.
+type csvReportWriter struct {
+	file    io.WriteCloser
+	writer  *csv.Writer
+	started time.Time
+	count   int
+}
+
+func newCSVReportWriter(file io.WriteCloser, started time.Time, runID string) (*csvReportWriter, error) {
+	w := &csvReportWriter{file: file, writer: csv.NewWriter(file), started: started}
+	w.writer.Write([]string{"#header", "started=" + started.Format(time.RFC3339), "run=" + runID, "incomplete unless a #footer complete=true line follows"})
+	w.writer.Write(csvReportColumns)
+	w.writer.Flush()
+	return w, w.writer.Error()
+}
+
+// WriteResult implements ReportWriter
+func (w *csvReportWriter) WriteResult(result FileResult) error {
+	if err := w.writer.Write([]string{
+		result.Path,
+		result.Crate,
+		result.Source,
+		strconv.Itoa(result.Total),
+		strconv.Itoa(result.Success),
+		strconv.Itoa(result.Missing),
+		strconv.Itoa(result.Errors),
+	}); err != nil {
+		return err
+	}
+	w.count++
+	if w.count%reportFlushInterval == 0 {
+		w.writer.Flush()
+		return w.writer.Error()
+	}
+	return nil
+}
+
+// Finish implements ReportWriter
+func (w *csvReportWriter) Finish(report *Report) error {
+	footer := []string{"#footer", "complete=false"}
+	switch {
+	case report == nil:
+		footer = append(footer, "run failed")
+	case report.Partial:
+		footer = append(footer, "run stopped before every index file was processed")
+	default:
+		footer[1] = "complete=true"
+	}
+	if report != nil {
+		footer = append(footer,
+			fmt.Sprintf("files=%d", report.Files),
+			fmt.Sprintf("versions=%d", report.Versions),
+			fmt.Sprintf("success=%d", report.Success),
+			fmt.Sprintf("missing=%d", report.Missing),
+			fmt.Sprintf("errors=%d", report.Errors))
+	}
+
+	w.writer.Write(footer)
+	w.writer.Flush()
+	err := w.writer.Error()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// MergedReport combines the NDJSON reports of several runs, such as the
+// shards of a mirror processed on different hosts
+type MergedReport struct {
+	Schema   int      `json:"schema"`
+	Sources  []string `json:"sources"`
+	Shards   []string `json:"shards,omitempty"`
+	RunIDs   []string `json:"run_ids,omitempty"`
+	Complete bool     `json:"complete"`
+	Report   Report   `json:"report"`
+	Missing  []string `json:"missing"`
+
+	// WallDuration is the longest run, as the runs are assumed to be
+	// concurrent; TotalDuration is the sum of all runs
+	WallDuration  time.Duration `json:"wall_duration_ns"`
+	TotalDuration time.Duration `json:"total_duration_ns"`
+
+	// VersionsPerSecond is the combined throughput over the wall duration
+	VersionsPerSecond float64 `json:"versions_per_second"`
+
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// reportLine is any line of an NDJSON report: a header or footer record, or
+// a per-file result
+type reportLine struct {
+	Type   string  `json:"type"`
+	Schema int     `json:"schema"`
+	Report *Report `json:"report"`
+	FileResult
+}
+
+// ReportFiles expands report paths, replacing each directory with the
+// NDJSON files, gzipped or not, directly inside it. Other files in the
+// directory, such as a -summary-json, are not reports and are left out.
+func ReportFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Name(), GzipSuffix)
+			if !entry.IsDir() && strings.HasSuffix(name, ".ndjson") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// MergeReports sums the counts of the NDJSON reports written by -report-out,
+// merges their missing version lists, and checks that their schema versions
+// match. Incomplete reports are merged but make the result incomplete.
+func MergeReports(paths []string, logger *Logger) (*MergedReport, error) {
+	merged := &MergedReport{Schema: ReportSchemaVersion, Complete: true}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no reports to merge")
+	}
+
+	for _, path := range paths {
+		file, err := openArtifact(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open report: %v", err)
+		}
+
+		var footer *Report
+		schema := 0
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var line reportLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s is not an NDJSON report: %v", path, err)
+			}
+			switch line.Type {
+			case "header":
+				schema = line.Schema
+			case "footer":
+				footer = line.Report
+			default:
+				merged.Missing = append(merged.Missing, line.MissingVersions...)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read report %s: %v", path, err)
+		}
+
+		if schema != ReportSchemaVersion {
+			return nil, fmt.Errorf("report %s has schema version %d, expected %d", path, schema, ReportSchemaVersion)
+		}
+		merged.Sources = append(merged.Sources, path)
+
+		if footer == nil || footer.Partial {
+			merged.Complete = false
+			warning := fmt.Sprintf("report %s is incomplete", path)
+			merged.Warnings = append(merged.Warnings, warning)
+			logger.Warning("%s", warning)
+			if footer == nil {
+				continue
+			}
+		}
+
+		merged.Report.Merge(footer)
+		merged.Report.FilesPending += footer.FilesPending
+		merged.TotalDuration += footer.Duration
+		if footer.Duration > merged.WallDuration {
+			merged.WallDuration = footer.Duration
+		}
+		if footer.Shards != "" {
+			merged.Shards = append(merged.Shards, footer.Shards)
+		}
+		if footer.RunID != "" {
+			merged.RunIDs = append(merged.RunIDs, footer.RunID)
+		}
+	}
+
+	sort.Strings(merged.Missing)
+	merged.Report.Duration = merged.WallDuration
+	merged.Report.Partial = !merged.Complete
+	if merged.WallDuration > 0 {
+		merged.VersionsPerSecond = float64(merged.Report.Versions) / merged.WallDuration.Seconds()
+	}
+
+	// Sharded runs should cover every crate exactly once
+	if len(merged.Shards) > 0 {
+		for _, warning := range shardCoverageWarnings(merged.Shards) {
+			merged.Warnings = append(merged.Warnings, warning)
+			logger.Warning("%s", warning)
+		}
+	}
+	return merged, nil
+}
+
+// shardCoverageWarnings checks that the shard expressions of merged reports
+// cover each letter a crate name can start with, and that no character is
+// covered twice
+func shardCoverageWarnings(exprs []string) []string {
+	counts := make(map[byte]int)
+	for _, expr := range exprs {
+		shards, err := ParseShards(expr)
+		if err != nil {
+			return []string{fmt.Sprintf("invalid shard expression %q: %v", expr, err)}
+		}
+		for c := byte('0'); c <= 'z'; c++ {
+			if shards.containsChar(c) {
+				counts[c]++
+			}
+		}
+	}
+
+	var gaps, overlaps []string
+	for _, chars := range []string{"abcdefghijklmnopqrstuvwxyz", "0123456789"} {
+		for i := 0; i < len(chars); i++ {
+			switch {
+			case counts[chars[i]] == 0 && chars[i] >= 'a':
+				gaps = append(gaps, chars[i:i+1])
+			case counts[chars[i]] > 1:
+				overlaps = append(overlaps, chars[i:i+1])
+			}
+		}
+	}
+
+	var warnings []string
+	if len(gaps) > 0 {
+		warnings = append(warnings, "no shard covers crates starting with "+strings.Join(gaps, ","))
+	}
+	if len(overlaps) > 0 {
+		warnings = append(warnings, "more than one shard covers crates starting with "+strings.Join(overlaps, ","))
+	}
+	return warnings
+}
+
+// ManifestEntry is one line of a manifest. SHA256 is the hash of the file's
+// bytes and ContentHash that of its canonical form (see ContentHash).
+type ManifestEntry struct {
+	Path        string `json:"path"`
+	SHA256      string `json:"sha256"`
+	ContentHash string `json:"content_hash"`
+	Size        int    `json:"size"`
+	Changed     bool   `json:"changed"`
+}
+
+// Manifest streams an NDJSON line with the path, SHA-256, and size of every
+// metadata file a run writes or finds unchanged. Entries are written as they
+// arrive, optionally through gzip, so the manifest of a full mirror is never
+// held in memory.
+type Manifest struct {
+	mu      sync.Mutex
+	file    *artifactFile
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	count   int
+	err     error
+}
+
+// OpenManifest creates the manifest at path, compressed if compress is set
+// or the path ends in .gz
+func OpenManifest(path string, compress bool) (*Manifest, error) {
+	file, err := createArtifact(path, compress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %v", err)
+	}
+	m := &Manifest{file: file, writer: bufio.NewWriter(file)}
+	m.encoder = json.NewEncoder(m.writer)
+	return m, nil
+}
+
+// Add records a metadata file and its content. Write errors are reported by Close.
+func (m *Manifest) Add(path string, data []byte, changed bool) {
+	if m == nil {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	contentHash, _ := ContentHash(data)
+	entry := ManifestEntry{Path: path, SHA256: hex.EncodeToString(sum[:]), ContentHash: contentHash, Size: len(data), Changed: changed}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = m.encoder.Encode(entry)
+	m.count++
+	if m.err == nil && m.count%reportFlushInterval == 0 {
+		m.err = m.writer.Flush()
+	}
+}
+
+// Close flushes the manifest and closes its file
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.writer.Flush(); err != nil && m.err == nil {
+		m.err = err
+	}
+	if err := m.file.Close(); err != nil && m.err == nil {
+		m.err = err
+	}
+	return m.err
+}
+
+// OutputList writes the path of every written metadata file, each
+// terminated by a NUL byte, so the list can be piped into xargs -0
+type OutputList struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+	file   *os.File
+	count  int
+	err    error
+}
+
+// OpenOutputList creates the output list at path, or writes it to stdout if path is "-"
+func OpenOutputList(path string) (*OutputList, error) {
+	if path == "-" {
+		return &OutputList{writer: bufio.NewWriter(os.Stdout)}, nil
+	}
+
+	file, err := fsCreate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output list: %v", err)
+	}
+	return &OutputList{writer: bufio.NewWriter(file), file: file}, nil
+}
+
+// Add appends a path to the list. Write errors are reported by Close.
+func (o *OutputList) Add(path string) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return
+	}
+	if _, err := o.writer.WriteString(path); err != nil {
+		o.err = err
+		return
+	}
+	o.err = o.writer.WriteByte(0)
+	o.count++
+}
+
+// Close flushes the list and closes its file
+func (o *OutputList) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.writer.Flush(); err != nil && o.err == nil {
+		o.err = err
+	}
+	if o.file != nil {
+		if err := o.file.Close(); err != nil && o.err == nil {
+			o.err = err
+		}
+	}
+	return o.err
+}
+
+// OutputTree collects the metadata files a run wrote, found unchanged, or
+// would write in a dry run, and renders them per destination as a sorted
+// tree like the tree command, so the layout can be reviewed or diffed
+type OutputTree struct {
+	mu    sync.Mutex
+	path  string
+	roots map[string]map[string]bool
+}
+
+// NewOutputTree creates a tree that is written to path, or stdout if path is "-"
+func NewOutputTree(path string) *OutputTree {
+	return &OutputTree{path: path, roots: make(map[string]map[string]bool)}
+}
+
+// Add records a metadata file produced under dest
+func (t *OutputTree) Add(dest *Destination, outputPath string) {
+	if t == nil {
+		return
+	}
+
+	rel := strings.TrimPrefix(outputPath, string(filepath.Separator))
+	if dest.Store == nil {
+		if r, err := filepath.Rel(dest.Root, outputPath); err == nil {
+			rel = r
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	files := t.roots[dest.Root]
+	if files == nil {
+		files = make(map[string]bool)
+		t.roots[dest.Root] = files
+	}
+	files[filepath.ToSlash(rel)] = true
+}
+
+// treeNode is a directory or file in a rendered OutputTree
+type treeNode struct {
+	children map[string]*treeNode
+}
+
+// Render writes the tree of every destination, roots in sorted order,
+// followed by a count of directories and files like the tree command
+func (t *OutputTree) Render(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	roots := make([]string, 0, len(t.roots))
+	for root := range t.roots {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+
+	bw := bufio.NewWriter(w)
+	dirs, files := 0, 0
+	for _, root := range roots {
+		top := &treeNode{children: make(map[string]*treeNode)}
+		for rel := range t.roots[root] {
+			node := top
+			for _, part := range strings.Split(rel, "/") {
+				child := node.children[part]
+				if child == nil {
+					child = &treeNode{children: make(map[string]*treeNode)}
+					node.children[part] = child
+				}
+				node = child
+			}
+		}
+		fmt.Fprintln(bw, root)
+		d, f := renderTreeNode(bw, top, "")
+		dirs += d
+		files += f
+	}
+	fmt.Fprintf(bw, "\n%d directories, %d files\n", dirs, files)
+	return bw.Flush()
+}
+
+// renderTreeNode writes the children of node below prefix and returns the
+// number of directories and files under it
+func renderTreeNode(w io.Writer, node *treeNode, prefix string) (int, int) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dirs, files := 0, 0
+	for i, name := range names {
+		branch, indent := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, indent = "└── ", "    "
+		}
+		fmt.Fprintf(w, "%s%s%s\n", prefix, branch, name)
+
+		child := node.children[name]
+		if len(child.children) == 0 {
+			files++
+			continue
+		}
+		dirs++
+		d, f := renderTreeNode(w, child, prefix+indent)
+		dirs += d
+		files += f
+	}
+	return dirs, files
+}
+
+// Close writes the tree to its path
+func (t *OutputTree) Close() error {
+	if t.path == "-" {
+		return t.Render(os.Stdout)
+	}
+
+	file, err := fsCreate(t.path)
+	if err != nil {
+		return fmt.Errorf("failed to create tree: %v", err)
+	}
+	if err := t.Render(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write tree: %v", err)
+	}
+	return file.Close()
+}
+
+// ResultEvent is one JSON line streamed to results socket consumers
+type ResultEvent struct {
+	Type      string      `json:"type"` // "file", "progress", or "summary"
+	Time      time.Time   `json:"time"`
+	File      *FileResult `json:"file,omitempty"`
+	Processed int         `json:"processed,omitempty"`
+	Total     int         `json:"total,omitempty"`
+	Report    *Report     `json:"report,omitempty"`
+
+	// Bytes and TotalBytes measure progress by the size of the index files
+	Bytes      int64 `json:"bytes,omitempty"`
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+}
+
+// ResultStream streams result events as JSON lines over a Unix domain
+// socket. If a consumer is already listening on the path it connects to it;
+// otherwise it listens on the path and broadcasts to every client that
+// connects. Events are queued and written by a background goroutine, so a
+// slow or disconnected consumer never blocks or fails the run; events that
+// do not fit in the queue are dropped and counted.
+type ResultStream struct {
+	path     string
+	listener net.Listener
+	events   chan ResultEvent
+	done     chan struct{}
+	logger   *Logger
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	dropped int
+}
+
+// OpenResultStream connects to or creates the Unix socket at path
+func OpenResultStream(path string, logger *Logger) (*ResultStream, error) {
+	stream := &ResultStream{
+		path:   path,
+		events: make(chan ResultEvent, 4096),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		stream.conns = append(stream.conns, conn)
+		logger.Info("Streaming results to existing socket %s", path)
+	} else {
+		// Nobody is listening, so any file at the path is a stale socket
+		fsRemove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on results socket %s: %v", path, err)
+		}
+		stream.listener = listener
+		go stream.accept()
+		logger.Info("Streaming results to clients of socket %s", path)
+	}
+
+	go stream.write()
+	return stream, nil
+}
+
+// accept adds connecting clients until the listener is closed
+func (s *ResultStream) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+	}
+}
+
+// write sends queued events to all connections, dropping any that fail
+func (s *ResultStream) write() {
+	defer close(s.done)
+	for event := range s.events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+
+		s.mu.Lock()
+		live := s.conns[:0]
+		for _, conn := range s.conns {
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write(line); err != nil {
+				s.logger.Warning("Results socket consumer disconnected: %v", err)
+				conn.Close()
+				continue
+			}
+			live = append(live, conn)
+		}
+		s.conns = live
+		s.mu.Unlock()
+	}
+}
+
+// Send queues an event without blocking
+func (s *ResultStream) Send(event ResultEvent) {
+	if s == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case s.events <- event:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+}
+
+// Close flushes queued events and closes the socket
+func (s *ResultStream) Close() {
+	if s == nil {
+		return
+	}
+	close(s.events)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+		fsRemove(s.path)
+	}
+	if s.dropped > 0 {
+		s.logger.Warning("Dropped %d result events because the results socket consumer was too slow", s.dropped)
+	}
+}
+
+// writeSummaryJSON writes the report as indented JSON to path
+func writeSummaryJSON(path string, report *Report, logger *Logger) {
+	if data, err := json.MarshalIndent(report, "", "  "); err != nil {
+		logger.Error("Failed to encode summary: %v", err)
+	} else if err := fsWriteFile(path, append(data, '\n'), 0644); err != nil {
+		logger.Error("Failed to write summary: %v", err)
+	} else {
+		logger.Info("Wrote summary to %s", path)
+	}
+}
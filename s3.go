@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ObjectStore is a destination backend that stores documents as objects
+// under keys rather than as files. It must be safe for concurrent use.
+type ObjectStore interface {
+	// Key returns the object key for a path the layout produced
+	Key(outputPath string) string
+	// Put stores data under key, replacing any existing object
+	Put(key string, data []byte) error
+	// Unchanged reports whether the object at key already holds data
+	Unchanged(key string, data []byte) (bool, error)
+	// String returns the store's URL, for logs and per-destination counts
+	String() string
+}
+
+// S3Store puts objects into an S3-compatible bucket with requests signed by
+// AWS Signature Version 4. Credentials and the region come from the standard
+// AWS_* environment variables.
+type S3Store struct {
+	bucket    string
+	prefix    string
+	endpoint  *url.URL
+	pathStyle bool
+	region    string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+// NewS3Store creates a store for bucket, with keys under prefix. The
+// endpoint defaults to $AWS_ENDPOINT_URL_S3, then $AWS_ENDPOINT_URL, then AWS
+// itself; buckets on a custom endpoint (MinIO, Ceph, R2) are addressed
+// path-style. connections is how many connections are kept open per host.
+func NewS3Store(bucket, prefix, endpoint string, connections int) (*S3Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket given")
+	}
+	store := &S3Store{
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("S3 credentials not set: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	if store.region == "" {
+		store.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+
+	for _, candidate := range []string{endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")} {
+		if candidate != "" {
+			endpoint = candidate
+			store.pathStyle = true
+			break
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://" + bucket + ".s3." + store.region + ".amazonaws.com"
+	}
+	parsed, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	store.endpoint = parsed
+
+	if connections < 1 {
+		connections = 1
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = connections
+	store.client = &http.Client{Transport: transport, Timeout: 5 * time.Minute}
+	return store, nil
+}
+
+// String implements ObjectStore
+func (s *S3Store) String() string {
+	if s.prefix == "" {
+		return "s3://" + s.bucket
+	}
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// Key implements ObjectStore. Layout paths are rooted at the separator, so
+// the key is the prefix and the path's slash-separated components.
+func (s *S3Store) Key(outputPath string) string {
+	key := strings.TrimPrefix(filepath.ToSlash(outputPath), "/")
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// Put implements ObjectStore. Metadata documents are far below the 5 GiB
+// limit of a single PUT, so no multipart upload is needed; the body is
+// streamed from memory with its length and checksum.
+func (s *S3Store) Put(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return s3Error(http.MethodPut, key, resp)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Unchanged implements ObjectStore by comparing the object's ETag, the MD5
+// of its content for single-part uploads, with the MD5 of data
+func (s *S3Store) Unchanged(key string, data []byte) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 300:
+		return false, s3Error(http.MethodHead, key, resp)
+	}
+	sum := md5.Sum(data)
+	return strings.Trim(resp.Header.Get("ETag"), `"`) == hex.EncodeToString(sum[:]), nil
+}
+
+// do sends a signed request for key
+func (s *S3Store) do(method, key string, body []byte) (*http.Response, error) {
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	}
+	escaped := s3EscapePath(s.endpoint.Path + path)
+
+	req, err := http.NewRequest(method, s.endpoint.Scheme+"://"+s.endpoint.Host+escaped, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// Send the path exactly as it was signed
+	req.URL.Opaque = escaped
+	req.ContentLength = int64(len(body))
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	s.sign(req, escaped, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 headers to req
+func (s *S3Store) sign(req *http.Request, canonicalURI string, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	payload := hex.EncodeToString(payloadHash[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	if req.Header.Get("Content-Type") != "" {
+		names = append(names, "content-type")
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, canonicalURI, "", headers.String(), signedHeaders, payload}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath percent-encodes every byte of a path except the unreserved
+// characters and slashes, as SigV4 requires for S3
+func s3EscapePath(path string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Error describes a failed S3 request, with the start of the response body
+func s3Error(method, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Tracer records spans for the phases of a run and a sample of index files
+// and exports them to an OpenTelemetry collector as OTLP/HTTP JSON. A nil
+// Tracer and the nil spans it returns record nothing, so instrumentation
+// costs only a nil check when tracing is off.
+type Tracer struct {
+	url    string
+	sample float64
+	slow   time.Duration
+	client *http.Client
+	logger *Logger
+	spans  chan *Span
+	done   chan struct{}
+
+	dropped int64
+}
+
+// Span is one timed operation in a trace
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []otlpKeyValue
+
+	// sampled is false for file spans that are only exported if slow
+	sampled bool
+}
+
+// Span export batching
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 4096
+)
+
+// NewTracer creates a tracer exporting to the collector at endpoint (for
+// example http://localhost:4318). A fraction sample of file spans is kept,
+// plus every file span that takes at least slow.
+func NewTracer(endpoint string, sample float64, slow time.Duration, logger *Logger) *Tracer {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	t := &Tracer{
+		url:    url,
+		sample: sample,
+		slow:   slow,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		spans:  make(chan *Span, traceQueueSize),
+		done:   make(chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// Start starts a span for a phase of the run. A nil parent starts a new trace.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{tracer: t, name: name, start: time.Now(), sampled: true}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// StartFile starts a span for one index file, subject to sampling
+func (t *Tracer) StartFile(name string, parent *Span) *Span {
+	span := t.Start(name, parent)
+	if span != nil {
+		span.sampled = mathrand.Float64() < t.sample
+	}
+	return span
+}
+
+// SetString sets a string attribute on the span
+func (s *Span) SetString(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}})
+}
+
+// SetInt sets an integer attribute on the span
+func (s *Span) SetInt(key string, value int) {
+	if s == nil {
+		return
+	}
+	text := strconv.Itoa(value)
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &text}})
+}
+
+// End ends the span and queues it for export. Unsampled file spans are
+// dropped unless they were slow, and spans are dropped rather than blocking
+// the run if the export queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	if !s.sampled && s.end.Sub(s.start) < s.tracer.slow {
+		return
+	}
+	s.SetInt("duration_ms", int(s.end.Sub(s.start)/time.Millisecond))
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		atomic.AddInt64(&s.tracer.dropped, 1)
+	}
+}
+
+// Close exports the remaining spans and stops the exporter
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+
+	close(t.spans)
+	<-t.done
+	if dropped := atomic.LoadInt64(&t.dropped); dropped > 0 {
+		t.logger.Warning("Dropped %d trace spans because the export queue was full", dropped)
+	}
+}
+
+// export sends queued spans to the collector in batches
+func (t *Tracer) export() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				t.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				t.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// OTLP/HTTP JSON request types, as far as they are used here
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// send posts one batch of spans to the collector
+func (t *Tracer) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var scope otlpScopeSpans
+	scope.Scope.Name = "organize_metadata"
+	for _, span := range batch {
+		converted := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        span.attrs,
+		}
+		if span.parentID != [8]byte{} {
+			converted.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		scope.Spans = append(scope.Spans, converted)
+	}
+
+	serviceName := "organize_metadata"
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}}}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+
+	body, err := json.Marshal(otlpTraceRequest{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		t.logger.Error("Failed to encode trace spans: %v", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.logger.Warning("Failed to export %d trace spans: %v", len(batch), err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.logger.Warning("Failed to export %d trace spans: collector returned %s", len(batch), resp.Status)
+	}
+}
+
+// StartCPUProfile starts writing a CPU profile to path and returns a
+// function that stops profiling and closes the file
+func StartCPUProfile(path string) (func(), error) {
+	file, err := fsCreate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CPU profile: %v", err)
+	}
+	if err := pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to start CPU profile: %v", err)
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		file.Close()
+	}, nil
+}
+
+// WriteHeapProfile writes a heap profile to path after a garbage collection,
+// so it reflects live memory
+func WriteHeapProfile(path string) error {
+	file, err := fsCreate(path)
+	if err != nil {
+		return fmt.Errorf("failed to create heap profile: %v", err)
+	}
+	defer file.Close()
+
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		return fmt.Errorf("failed to write heap profile: %v", err)
+	}
+	return nil
+}
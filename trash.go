@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TrashDirName is the directory inside a mirror or publish root where
+// deleted files are staged, in a directory per run, until -empty-trash
+// removes them
+const TrashDirName = ".trash"
+
+// DefaultTrashRetention is how long -empty-trash keeps staged files
+const DefaultTrashRetention = 7 * 24 * time.Hour
+
+// isTrashDir reports whether a walk has reached a trash directory, which
+// holds staged deletions rather than mirror content
+func isTrashDir(info fs.FileInfo) bool {
+	return info.IsDir() && info.Name() == TrashDirName
+}
+
+// Trash stages deletions under Root by moving files to
+// Root/.trash/<run ID>/, keeping their paths relative to Root, so they can
+// be restored until the trash is emptied
+type Trash struct {
+	Root    string
+	RunID   string
+	DirMode os.FileMode
+}
+
+// Remove moves path, which must be under Root, into the trash
+func (t *Trash) Remove(path string) error {
+	rel, err := filepath.Rel(t.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not under %s", path, t.Root)
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+	target := filepath.Join(t.Root, TrashDirName, t.RunID, rel)
+	if err := fsMkdirAll(filepath.Dir(target), t.DirMode); err != nil {
+		return err
+	}
+	return fsRename(path, target)
+}
+
+// TrashUsage returns the number of files staged in root's trash and their size
+func TrashUsage(root string) (int, int64, error) {
+	return treeUsage(filepath.Join(root, TrashDirName))
+}
+
+// treeUsage returns the number of files under dir and their size, or
+// zero if dir does not exist
+func treeUsage(dir string) (int, int64, error) {
+	files := 0
+	var bytes int64
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes, err
+}
+
+// trashStaged returns when the last file was staged in a run's trash
+// directory. Moved files keep their own mtimes, so this is the newest
+// mtime of the directories they were moved into.
+func trashStaged(runDir string) (time.Time, error) {
+	var staged time.Time
+	err := filepath.Walk(runDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.ModTime().After(staged) {
+			staged = info.ModTime()
+		}
+		return nil
+	})
+	return staged, err
+}
+
+// TrashReport summarizes an -empty-trash pass
+type TrashReport struct {
+	Runs     int           `json:"runs"`
+	Emptied  int           `json:"emptied"`
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Errors   int           `json:"errors"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *TrashReport) SummaryLine() string {
+	return fmt.Sprintf("empty-trash: runs=%d emptied=%d files=%d bytes=%d errors=%d dur=%s",
+		r.Runs, r.Emptied, r.Files, r.Bytes, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// EmptyTrash permanently removes the runs staged in root's trash more
+// than retention ago
+func EmptyTrash(root string, retention time.Duration, dryRun bool, logger *Logger) (*TrashReport, error) {
+	startTime := time.Now()
+	report := &TrashReport{}
+	trashDir := filepath.Join(root, TrashDirName)
+	runs, err := ioutil.ReadDir(trashDir)
+	if os.IsNotExist(err) {
+		logger.Info("%s has no trash", root)
+		return report, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash: %v", err)
+	}
+
+	for _, run := range runs {
+		if !run.IsDir() {
+			continue
+		}
+		report.Runs++
+		runDir := filepath.Join(trashDir, run.Name())
+		staged, err := trashStaged(runDir)
+		if err != nil {
+			logger.Error("Failed to read %s: %v", runDir, err)
+			report.Errors++
+			continue
+		}
+		if age := time.Since(staged); age < retention {
+			logger.Debug("Keeping %s, staged %v ago", runDir, age.Round(time.Second))
+			continue
+		}
+		files, bytes, err := treeUsage(runDir)
+		if err != nil {
+			logger.Error("Failed to read %s: %v", runDir, err)
+			report.Errors++
+			continue
+		}
+		if dryRun {
+			logger.Info("DRY RUN: Would empty %s (%d files, %d bytes, staged %s)", runDir, files, bytes, staged.Format(time.RFC3339))
+		} else if err := fsRemoveAll(runDir); err != nil {
+			logger.Error("Failed to empty %s: %v", runDir, err)
+			report.Errors++
+			continue
+		} else {
+			logger.Info("Emptied %s (%d files, %d bytes, staged %s)", runDir, files, bytes, staged.Format(time.RFC3339))
+		}
+		report.Emptied++
+		report.Files += files
+		report.Bytes += bytes
+	}
+
+	report.Duration = time.Since(startTime)
+	return report, nil
+}
+
+// RestoreFromTrash moves the most recently staged copy of path back into
+// place from the trash of the nearest enclosing root that has one, and
+// returns where it was staged. An existing file at path is not replaced.
+func RestoreFromTrash(path string, dirMode os.FileMode) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(abs); err == nil {
+		return "", fmt.Errorf("%s exists; move it aside first", path)
+	}
+
+	for root := filepath.Dir(abs); ; root = filepath.Dir(root) {
+		runs, _ := ioutil.ReadDir(filepath.Join(root, TrashDirName))
+		rel, _ := filepath.Rel(root, abs)
+		var newest string
+		var newestStaged time.Time
+		for _, run := range runs {
+			candidate := filepath.Join(root, TrashDirName, run.Name(), rel)
+			if _, err := os.Lstat(candidate); err != nil {
+				continue
+			}
+			if dir, err := os.Stat(filepath.Dir(candidate)); err == nil && (newest == "" || dir.ModTime().After(newestStaged)) {
+				newest, newestStaged = candidate, dir.ModTime()
+			}
+		}
+		if newest != "" {
+			if err := fsMkdirAll(filepath.Dir(abs), dirMode); err != nil {
+				return "", err
+			}
+			return newest, fsRename(newest, abs)
+		}
+		if parent := filepath.Dir(root); parent == root {
+			return "", fmt.Errorf("no trash above %s holds it", path)
+		}
+	}
+}
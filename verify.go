@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTlantis/organize-crates/pkg/indexentry"
+)
+
+// VerifyReport summarizes a checksum verification pass
+type VerifyReport struct {
+	Checked    int           `json:"checked"`
+	OK         int           `json:"ok"`
+	Mismatched int           `json:"mismatched"`
+	NoChecksum int           `json:"no_checksum"`
+	Missing    int           `json:"missing"`
+	Errors     int           `json:"errors"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *VerifyReport) SummaryLine() string {
+	return fmt.Sprintf("verify: checked=%d ok=%d mismatched=%d no_cksum=%d missing=%d errors=%d dur=%s",
+		r.Checked, r.OK, r.Mismatched, r.NoChecksum, r.Missing, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// verifyJob is one crate file to check against its index checksum
+type verifyJob struct {
+	id    string
+	path  string
+	cksum string
+}
+
+// readIndexEntries reads the JSON entries of an index file, skipping blank
+// and malformed lines, and trims whitespace from their key fields
+func readIndexEntries(path string) ([]MetadataEntry, error) {
+	content, err := readIndexContent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []MetadataEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		entry, err := indexentry.ParseLine([]byte(line))
+		if err != nil {
+			continue
+		}
+		trimEntryFields(entry)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// VerifyChecksums checks every crate file in the mirror that has an index
+// entry against the entry's cksum field, hashing with its own pool of
+// workers so verification can be sized independently of organization
+func VerifyChecksums(opts *Options, workers int, logger *Logger) (*VerifyReport, error) {
+	logger.Info("Verifying crate file checksums with %d workers...", workers)
+	startTime := time.Now()
+
+	crateIndex, err := BuildCrateFileIndex(opts.MirrorDir, opts.Ignore, nil, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build crate file index: %v", err)
+	}
+	metadataFiles, err := FindMetadataFiles(opts.IndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find metadata files: %v", err)
+	}
+	if opts.LocalIndexDir != "" {
+		localFiles, err := FindMetadataFiles(opts.LocalIndexDir, opts.Shards, nil, opts.IndexWalk, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find local metadata files: %v", err)
+		}
+		metadataFiles = append(metadataFiles, localFiles...)
+	}
+
+	report := &VerifyReport{}
+	var mu sync.Mutex
+	jobs := make(chan verifyJob, workers*4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				actual, err := hashFile(job.path)
+				mu.Lock()
+				report.Checked++
+				switch {
+				case err != nil:
+					report.Errors++
+					logger.Error("Failed to hash %s: %v", job.path, err)
+				case !strings.EqualFold(actual, job.cksum):
+					report.Mismatched++
+					logger.Error("Checksum mismatch for %s: index has %s, file has %s", job.id, job.cksum, actual)
+				default:
+					report.OK++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Read index files and queue a job per version with a crate file
+	for _, file := range metadataFiles {
+		entries, err := readIndexEntries(file.Path)
+		if err != nil {
+			logger.Error("Failed to read metadata file %s: %v", file.Path, err)
+			mu.Lock()
+			report.Errors++
+			mu.Unlock()
+			continue
+		}
+
+		for _, entry := range entries {
+			name := filepath.Base(file.Path)
+			if opts.CrateIDMode {
+				name, _ = entry["name"].(string)
+			}
+			version, _ := entry["vers"].(string)
+			if name == "" || version == "" {
+				continue
+			}
+			id := name + "-" + version
+
+			path, ok := crateIndex[id+".crate"]
+			if !ok {
+				for _, alias := range opts.RenameMap.Aliases(name) {
+					if path, ok = crateIndex[alias+"-"+version+".crate"]; ok {
+						break
+					}
+				}
+			}
+
+			cksum, _ := entry["cksum"].(string)
+			mu.Lock()
+			if !ok {
+				report.Missing++
+			} else if cksum == "" {
+				report.NoChecksum++
+			}
+			mu.Unlock()
+			if ok && cksum != "" {
+				jobs <- verifyJob{id: id, path: path, cksum: cksum}
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Verification complete: %d of %d crate files match their checksum, %d mismatched, %d without a checksum in %v",
+		report.OK, report.Checked, report.Mismatched, report.NoChecksum, report.Duration)
+	return report, nil
+}
+
+// VerifyAfterRun runs, with the run's own options, every verification pass
+// that applies to what the run wrote: crate checksums always, raw lines if
+// they were recorded, bundles if they were written, and directory
+// manifests if they were kept. It returns each pass's summary line and the
+// number of passes that failed, by the same criteria as their modes.
+func VerifyAfterRun(opts *Options, workers int, logger *Logger) ([]string, int) {
+	var lines []string
+	failed := 0
+	fail := func(name string, err error) {
+		logger.Error("Failed to verify %s: %v", name, err)
+		failed++
+	}
+
+	if verifyReport, err := VerifyChecksums(opts, workers, logger); err != nil {
+		fail("checksums", err)
+	} else {
+		lines = append(lines, verifyReport.SummaryLine())
+		if verifyReport.Mismatched > 0 || verifyReport.Errors > 0 {
+			failed++
+		}
+	}
+	if opts.RawLine != "" {
+		if rawReport, err := VerifyRawLines(opts, logger); err != nil {
+			fail("raw lines", err)
+		} else {
+			lines = append(lines, rawReport.SummaryLine())
+			if rawReport.Untraceable > 0 || rawReport.Errors > 0 {
+				failed++
+			}
+		}
+	}
+	if opts.Bundles != nil {
+		if bundleReport, err := VerifyBundles(opts, logger); err != nil {
+			fail("bundles", err)
+		} else {
+			lines = append(lines, bundleReport.SummaryLine())
+			if bundleReport.Mismatched > 0 || bundleReport.Missing > 0 || bundleReport.Errors > 0 {
+				failed++
+			}
+		}
+	}
+	if opts.DirManifests {
+		roots := make([]string, len(opts.Destinations))
+		for i, dest := range opts.Destinations {
+			roots[i] = dest.Root
+		}
+		if manifestReport, err := VerifyDirManifests(roots, false, logger); err != nil {
+			fail("directory manifests", err)
+		} else {
+			lines = append(lines, manifestReport.SummaryLine())
+			if manifestReport.Errors > 0 || manifestReport.Stale > 0 {
+				failed++
+			}
+		}
+	}
+	return lines, failed
+}
+
+// RawLineReport summarizes a raw line verification pass
+type RawLineReport struct {
+	Checked     int           `json:"checked"`
+	Traced      int           `json:"traced"`
+	Untraceable int           `json:"untraceable"`
+	Unrecorded  int           `json:"unrecorded"`
+	Errors      int           `json:"errors"`
+	Duration    time.Duration `json:"duration_ns"`
+}
+
+// SummaryLine returns a single machine-parseable line summarizing the pass
+func (r *RawLineReport) SummaryLine() string {
+	return fmt.Sprintf("verify-raw: checked=%d traced=%d untraceable=%d unrecorded=%d errors=%d dur=%s",
+		r.Checked, r.Traced, r.Untraceable, r.Unrecorded, r.Errors, r.Duration.Round(time.Millisecond))
+}
+
+// canonicalEntry returns the compact, key-sorted encoding of an entry as it
+// would be written, without its local info block
+func canonicalEntry(entry MetadataEntry) ([]byte, error) {
+	stripped := make(MetadataEntry, len(entry))
+	for key, value := range entry {
+		if key != LocalInfoKey {
+			stripped[key] = value
+		}
+	}
+	trimEntryFields(stripped)
+	return json.Marshal(stripped)
+}
+
+// canonicalLine parses an index line and returns its canonical encoding,
+// after applying the transformations recorded in doc, the document written
+// from it
+func canonicalLine(line string, doc MetadataEntry) ([]byte, error) {
+	entry, err := indexentry.ParseLine([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	replayTransforms(doc, entry)
+	return canonicalEntry(entry)
+}
+
+// findIndexLine returns the line of the crate's index file whose SHA-256 is
+// sum, looking in each index directory in turn
+func findIndexLine(indexDirs []string, name, sum string) (string, bool) {
+	for _, dir := range indexDirs {
+		if dir == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(indexentry.IndexPath(name))))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			lineSum := sha256.Sum256([]byte(line))
+			if hex.EncodeToString(lineSum[:]) == sum {
+				return line, true
+			}
+		}
+	}
+	return "", false
+}
+
+// VerifyRawLines checks that every metadata document in the destinations can
+// be traced to an index line: the line recorded in its local info block (or,
+// if only the hash was recorded, the line with that hash in the crate's index
+// file) must hash to the recorded SHA-256 and canonicalize to the document.
+func VerifyRawLines(opts *Options, logger *Logger) (*RawLineReport, error) {
+	logger.Info("Verifying that metadata documents trace back to index lines...")
+	startTime := time.Now()
+	report := &RawLineReport{}
+
+	check := func(path string) {
+		report.Checked++
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.Error("Failed to read %s: %v", path, err)
+			report.Errors++
+			return
+		}
+		var doc MetadataEntry
+		if err := json.Unmarshal(content, &doc); err != nil {
+			logger.Error("Failed to parse %s: %v", path, err)
+			report.Errors++
+			return
+		}
+
+		info, _ := doc[LocalInfoKey].(map[string]interface{})
+		sum, _ := info["raw_sha256"].(string)
+		if sum == "" {
+			report.Unrecorded++
+			return
+		}
+
+		line, ok := info["raw_line"].(string)
+		if ok {
+			lineSum := sha256.Sum256([]byte(line))
+			ok = hex.EncodeToString(lineSum[:]) == sum
+		} else {
+			name, _ := doc["name"].(string)
+			line, ok = findIndexLine([]string{opts.IndexDir, opts.LocalIndexDir}, name, sum)
+		}
+
+		if ok {
+			want, err1 := canonicalLine(line, doc)
+			got, err2 := canonicalEntry(doc)
+			ok = err1 == nil && err2 == nil && bytes.Equal(want, got)
+		}
+		if !ok {
+			logger.Error("%s cannot be traced to an index line with sha256 %s", path, sum)
+			report.Untraceable++
+			return
+		}
+		report.Traced++
+	}
+
+	for _, dest := range opts.Destinations {
+		err := filepath.Walk(dest.Root, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if isTrashDir(info) {
+				return filepath.SkipDir
+			}
+			if dest.InMirror && opts.Ignore.Match(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), MetadataFileSuffix) {
+				check(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("error walking %s: %v", dest.Root, err)
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+	logger.Info("Raw line verification complete: %d of %d documents traced, %d untraceable, %d without a recorded line in %v",
+		report.Traced, report.Checked, report.Untraceable, report.Unrecorded, report.Duration)
+	return report, nil
+}